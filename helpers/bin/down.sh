@@ -5,6 +5,10 @@ if [ -z $1 ]; then
     exit 1
 fi
 
+# keep the evidence of a failed cluster before it is destroyed.
+if [[ -n "$GATHER" ]]; then
+    azure-cluster gather $GATHER_FLAGS "$1" || echo "gathering from $1 failed"
+fi
 
 az group delete --name "$1" --no-wait --yes
 
@@ -5,20 +5,10 @@ if [[ $# -eq 0 ]]; then
     exit 1
 fi
 
+# run from an acs-engine checkout: make builds the bin/acs-engine which
+# azure-cluster up runs to generate the ARM template.
 make
 
-RESOURCE_GROUP="$1"
-IMAGE="$2"
-CUSTOM_RG="$3"
+export AZURE_SUBSCRIPTION_ID="${AZURE_SUBSCRIPTION_ID:-$SUBSCRIPTION_ID}"
 
-if [[ -z "$IMAGE" ]]; then
-    IMAGE=$(az image list -g images -o json --query "[?starts_with(name, 'centos7-3.10-') && tags.valid=='true'].name | sort(@) | [-1]" | tr -d '"')
-fi
-
-if [[ -z "$CUSTOM_RG" ]]; then
-    CUSTOM_RG=images
-fi
-
-RESOURCE_GROUP="$RESOURCE_GROUP" IMAGE="$IMAGE" CUSTOM_RG="$CUSTOM_RG" envsubst <_input/openshift-template.json >_input/openshift.json
-
-time bin/acs-engine deploy -f --resource-group $1 --location eastus --subscription-id $SUBSCRIPTION_ID _input/openshift.json
+exec azure-cluster up -image "$2" -image-resource-group "${3:-images}" "$1"
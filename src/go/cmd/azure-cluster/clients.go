@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+)
+
+// deploymentsClient submits and lists ARM template deployments.
+// CreateOrUpdate returns once the deployment has succeeded or failed, or its
+// timeout has passed.
+type deploymentsClient interface {
+	CreateOrUpdate(ctx context.Context, resourceGroup, name string, deployment resources.Deployment) error
+	ListByResourceGroup(ctx context.Context, resourceGroup string) ([]resources.DeploymentExtended, error)
+}
+
+// deploymentOperationsClient lists the operations of a deployment.
+type deploymentOperationsClient interface {
+	List(ctx context.Context, resourceGroup, deployment string) ([]resources.DeploymentOperation, error)
+}
+
+// machinesClient returns the instance views of virtual machines and of scale
+// set instances.
+type machinesClient interface {
+	InstanceView(ctx context.Context, resourceGroup, name string) (*compute.VirtualMachineInstanceView, error)
+	ScaleSetInstanceView(ctx context.Context, resourceGroup, scaleSet, instanceID string) (*compute.VirtualMachineScaleSetVMInstanceView, error)
+}
+
+type azureDeploymentsClient struct {
+	client resources.DeploymentsClient
+}
+
+var _ deploymentsClient = &azureDeploymentsClient{}
+
+func newDeploymentsClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer, timeout time.Duration) *azureDeploymentsClient {
+	c := &azureDeploymentsClient{client: resources.NewDeploymentsClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = azureclient.HTTPClient
+	c.client.PollingDuration = timeout
+	return c
+}
+
+func (c *azureDeploymentsClient) CreateOrUpdate(ctx context.Context, resourceGroup, name string, deployment resources.Deployment) error {
+	future, err := c.client.CreateOrUpdate(ctx, resourceGroup, name, deployment)
+	if err != nil {
+		return err
+	}
+
+	if err = future.WaitForCompletion(ctx, c.client.Client); err != nil {
+		return err
+	}
+
+	_, err = future.Result(c.client)
+	return err
+}
+
+func (c *azureDeploymentsClient) ListByResourceGroup(ctx context.Context, resourceGroup string) ([]resources.DeploymentExtended, error) {
+	results, err := c.client.ListByResourceGroup(ctx, resourceGroup, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var deployments []resources.DeploymentExtended
+	for ; results.NotDone(); results.Next() {
+		deployments = append(deployments, results.Values()...)
+	}
+
+	return deployments, nil
+}
+
+type azureDeploymentOperationsClient struct {
+	client resources.DeploymentOperationsClient
+}
+
+var _ deploymentOperationsClient = &azureDeploymentOperationsClient{}
+
+func newDeploymentOperationsClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) *azureDeploymentOperationsClient {
+	c := &azureDeploymentOperationsClient{client: resources.NewDeploymentOperationsClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = azureclient.HTTPClient
+	return c
+}
+
+func (c *azureDeploymentOperationsClient) List(ctx context.Context, resourceGroup, deployment string) ([]resources.DeploymentOperation, error) {
+	results, err := c.client.List(ctx, resourceGroup, deployment, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var operations []resources.DeploymentOperation
+	for ; results.NotDone(); results.Next() {
+		operations = append(operations, results.Values()...)
+	}
+
+	return operations, nil
+}
+
+type azureMachinesClient struct {
+	vms      compute.VirtualMachinesClient
+	scaleSet compute.VirtualMachineScaleSetVMsClient
+}
+
+var _ machinesClient = &azureMachinesClient{}
+
+func newMachinesClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) *azureMachinesClient {
+	c := &azureMachinesClient{
+		vms:      compute.NewVirtualMachinesClientWithBaseURI(azureutil.BaseURI(env), subscriptionID),
+		scaleSet: compute.NewVirtualMachineScaleSetVMsClientWithBaseURI(azureutil.BaseURI(env), subscriptionID),
+	}
+	c.vms.Authorizer = authorizer
+	c.vms.Sender = azureclient.HTTPClient
+	c.scaleSet.Authorizer = authorizer
+	c.scaleSet.Sender = azureclient.HTTPClient
+	return c
+}
+
+func (c *azureMachinesClient) InstanceView(ctx context.Context, resourceGroup, name string) (*compute.VirtualMachineInstanceView, error) {
+	view, err := c.vms.InstanceView(ctx, resourceGroup, name)
+	if err != nil {
+		return nil, err
+	}
+	return &view, nil
+}
+
+func (c *azureMachinesClient) ScaleSetInstanceView(ctx context.Context, resourceGroup, scaleSet, instanceID string) (*compute.VirtualMachineScaleSetVMInstanceView, error) {
+	view, err := c.scaleSet.GetInstanceView(ctx, resourceGroup, scaleSet, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return &view, nil
+}
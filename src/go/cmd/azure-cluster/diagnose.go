@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// deploymentType is the resource type of the nested deployments of a
+// template.
+const deploymentType = "Microsoft.Resources/deployments"
+
+// diagnosis is the report of the deployments in a resource group and their
+// failed operations.
+type diagnosis struct {
+	ResourceGroup string              `json:"resourceGroup"`
+	Generated     time.Time           `json:"generated"`
+	Deployments   []deploymentSummary `json:"deployments"`
+	Failures      []operationFailure  `json:"failures"`
+}
+
+// deploymentSummary describes a deployment.  Parent is the deployment which
+// nested it, if any.
+type deploymentSummary struct {
+	ResourceGroup     string     `json:"resourceGroup"`
+	Name              string     `json:"name"`
+	Parent            string     `json:"parent,omitempty"`
+	ProvisioningState string     `json:"provisioningState"`
+	Timestamp         *time.Time `json:"timestamp,omitempty"`
+}
+
+// operationFailure is a failed deployment operation.  Path holds the names of
+// the deployments enclosing Deployment, outermost first.  Message summarises
+// StatusMessage, which is kept as returned by Resource Manager.
+type operationFailure struct {
+	ResourceGroup  string          `json:"resourceGroup"`
+	Deployment     string          `json:"deployment"`
+	Path           []string        `json:"path,omitempty"`
+	OperationID    string          `json:"operationId"`
+	Timestamp      *time.Time      `json:"timestamp,omitempty"`
+	StatusCode     string          `json:"statusCode,omitempty"`
+	Message        string          `json:"message"`
+	StatusMessage  interface{}     `json:"statusMessage,omitempty"`
+	TargetResource *targetResource `json:"targetResource,omitempty"`
+}
+
+// targetResource is the resource a deployment operation acted on.
+type targetResource struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// diagnoser finds the failed operations of the deployments in a resource
+// group.
+type diagnoser struct {
+	deployments deploymentsClient
+	operations  deploymentOperationsClient
+
+	now func() time.Time
+}
+
+// deploymentRef identifies a deployment.
+type deploymentRef struct {
+	resourceGroup string
+	name          string
+}
+
+func (r deploymentRef) key() string {
+	return strings.ToLower(r.resourceGroup + "/" + r.name)
+}
+
+// diagnose reports every deployment in resourceGroup, including those nested
+// in them, and their failed operations.  Deployments are walked from the
+// outermost, oldest first.  A failed operation which runs a nested deployment
+// is only reported if none of the operations of the nested deployment are,
+// since they are the cause of its failure.
+func (d *diagnoser) diagnose(ctx context.Context, resourceGroup string) (*diagnosis, error) {
+	deployments, err := d.deployments.ListByResourceGroup(ctx, resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	// operations caches the operations of each deployment walked.
+	operations := map[string][]resources.DeploymentOperation{}
+	listOperations := func(r deploymentRef) ([]resources.DeploymentOperation, error) {
+		if ops, found := operations[r.key()]; found {
+			return ops, nil
+		}
+		ops, err := d.operations.List(ctx, r.resourceGroup, r.name)
+		if err != nil {
+			return nil, fmt.Errorf("deployment %s/%s: %v", r.resourceGroup, r.name, err)
+		}
+		sort.SliceStable(ops, func(i, j int) bool { return timestamp(ops[i]).Before(timestamp(ops[j])) })
+		operations[r.key()] = ops
+		return ops, nil
+	}
+
+	// deployments nested in others are walked from their parents.
+	states := map[string]*resources.DeploymentPropertiesExtended{}
+	nested := map[string]struct{}{}
+	for _, dep := range deployments {
+		r := deploymentRef{resourceGroup: resourceGroup, name: to.String(dep.Name)}
+		states[r.key()] = dep.Properties
+
+		ops, err := listOperations(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range ops {
+			if child, ok := nestedDeployment(op, resourceGroup); ok {
+				nested[child.key()] = struct{}{}
+			}
+		}
+	}
+
+	var roots []resources.DeploymentExtended
+	for _, dep := range deployments {
+		r := deploymentRef{resourceGroup: resourceGroup, name: to.String(dep.Name)}
+		if _, found := nested[r.key()]; !found {
+			roots = append(roots, dep)
+		}
+	}
+	sort.SliceStable(roots, func(i, j int) bool {
+		ti, tj := deploymentTimestamp(roots[i].Properties), deploymentTimestamp(roots[j].Properties)
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return to.String(roots[i].Name) < to.String(roots[j].Name)
+	})
+
+	diag := &diagnosis{
+		ResourceGroup: resourceGroup,
+		Generated:     d.now().UTC(),
+		Deployments:   []deploymentSummary{},
+		Failures:      []operationFailure{},
+	}
+	visited := map[string]struct{}{}
+
+	// walk reports the deployment r and its failed operations, returning the
+	// number of failures reported.
+	var walk func(r deploymentRef, path []string) (int, error)
+	walk = func(r deploymentRef, path []string) (int, error) {
+		if _, found := visited[r.key()]; found {
+			return 0, nil
+		}
+		visited[r.key()] = struct{}{}
+
+		s := deploymentSummary{ResourceGroup: r.resourceGroup, Name: r.name}
+		if len(path) > 0 {
+			s.Parent = path[len(path)-1]
+		}
+		if props := states[r.key()]; props != nil {
+			s.ProvisioningState = to.String(props.ProvisioningState)
+			if props.Timestamp != nil {
+				t := props.Timestamp.Time.UTC()
+				s.Timestamp = &t
+			}
+		}
+		diag.Deployments = append(diag.Deployments, s)
+
+		ops, err := listOperations(r)
+		if err != nil {
+			return 0, err
+		}
+
+		var n int
+		for _, op := range ops {
+			if op.Properties == nil {
+				continue
+			}
+
+			var failed int
+			if child, ok := nestedDeployment(op, r.resourceGroup); ok {
+				// nested deployments in other resource groups are not
+				// listed, so their state is that of their operation.
+				if _, found := states[child.key()]; !found {
+					states[child.key()] = &resources.DeploymentPropertiesExtended{ProvisioningState: op.Properties.ProvisioningState, Timestamp: op.Properties.Timestamp}
+				}
+				if failed, err = walk(child, append(path[:len(path):len(path)], r.name)); err != nil {
+					return 0, err
+				}
+				n += failed
+			}
+
+			if !strings.EqualFold(to.String(op.Properties.ProvisioningState), "Failed") || failed > 0 {
+				continue
+			}
+			diag.Failures = append(diag.Failures, newOperationFailure(r, path, op))
+			n++
+		}
+
+		return n, nil
+	}
+
+	for _, dep := range roots {
+		if _, err := walk(deploymentRef{resourceGroup: resourceGroup, name: to.String(dep.Name)}, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return diag, nil
+}
+
+// nestedDeployment returns the deployment run by op, if it runs one.  Nested
+// deployments are in resourceGroup unless their ID says otherwise.
+func nestedDeployment(op resources.DeploymentOperation, resourceGroup string) (deploymentRef, bool) {
+	if op.Properties == nil || op.Properties.TargetResource == nil {
+		return deploymentRef{}, false
+	}
+	target := op.Properties.TargetResource
+	if !strings.EqualFold(to.String(target.ResourceType), deploymentType) {
+		return deploymentRef{}, false
+	}
+
+	r := deploymentRef{resourceGroup: resourceGroup, name: to.String(target.ResourceName)}
+	if id, err := azure.ParseResourceID(to.String(target.ID)); err == nil {
+		r.resourceGroup = id.ResourceGroup
+	}
+	return r, true
+}
+
+func newOperationFailure(r deploymentRef, path []string, op resources.DeploymentOperation) operationFailure {
+	f := operationFailure{
+		ResourceGroup: r.resourceGroup,
+		Deployment:    r.name,
+		Path:          path,
+		OperationID:   to.String(op.OperationID),
+		StatusCode:    to.String(op.Properties.StatusCode),
+		Message:       statusMessage(op.Properties.StatusMessage),
+		StatusMessage: op.Properties.StatusMessage,
+	}
+	if op.Properties.Timestamp != nil {
+		t := op.Properties.Timestamp.Time.UTC()
+		f.Timestamp = &t
+	}
+	if target := op.Properties.TargetResource; target != nil {
+		f.TargetResource = &targetResource{ID: to.String(target.ID), Type: to.String(target.ResourceType), Name: to.String(target.ResourceName)}
+	}
+	return f
+}
+
+func timestamp(op resources.DeploymentOperation) time.Time {
+	if op.Properties == nil {
+		return time.Time{}
+	}
+	return dateTime(op.Properties.Timestamp)
+}
+
+func deploymentTimestamp(props *resources.DeploymentPropertiesExtended) time.Time {
+	if props == nil {
+		return time.Time{}
+	}
+	return dateTime(props.Timestamp)
+}
+
+func dateTime(t *date.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.Time
+}
+
+// statusMessage summarises the status message of a deployment operation.
+// Messages are usually an object holding an error, whose details may hold
+// further errors; their codes and messages are joined.  Messages of any other
+// form are returned as JSON.
+func statusMessage(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case map[string]interface{}:
+		if e, ok := v["error"].(map[string]interface{}); ok {
+			return errorMessage(e)
+		}
+	}
+
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// errorMessage formats an ARM error object and its details as "code: message;
+// code: message...".
+func errorMessage(e map[string]interface{}) string {
+	var s []string
+	code, _ := e["code"].(string)
+	message, _ := e["message"].(string)
+	switch {
+	case code != "" && message != "":
+		s = append(s, code+": "+message)
+	case code != "" || message != "":
+		s = append(s, code+message)
+	}
+
+	details, _ := e["details"].([]interface{})
+	for _, d := range details {
+		if d, ok := d.(map[string]interface{}); ok {
+			if m := errorMessage(d); m != "" {
+				s = append(s, m)
+			}
+		}
+	}
+
+	return strings.Join(s, "; ")
+}
+
+// printDiagnosis writes a human-readable summary of diag to w: the state of
+// each deployment, followed by each failed operation.
+func printDiagnosis(w io.Writer, diag *diagnosis) {
+	for _, s := range diag.Deployments {
+		name := s.Name
+		if s.ResourceGroup != diag.ResourceGroup {
+			name = s.ResourceGroup + "/" + s.Name
+		}
+		if s.Parent != "" {
+			fmt.Fprintf(w, "deployment %s (nested in %s): %s\n", name, s.Parent, s.ProvisioningState)
+		} else {
+			fmt.Fprintf(w, "deployment %s: %s\n", name, s.ProvisioningState)
+		}
+	}
+
+	if len(diag.Failures) == 0 {
+		fmt.Fprintln(w, "no failed operations")
+		return
+	}
+
+	for _, f := range diag.Failures {
+		target := "unknown resource"
+		if f.TargetResource != nil {
+			target = f.TargetResource.Type + " " + f.TargetResource.Name
+		}
+		if f.StatusCode != "" {
+			target += " (" + f.StatusCode + ")"
+		}
+		fmt.Fprintf(w, "failed: deployment %s: %s: %s\n", strings.Join(append(f.Path[:len(f.Path):len(f.Path)], f.Deployment), "/"), target, f.Message)
+	}
+}
+
+// writeDiagnosis writes diag to w as indented JSON.
+func writeDiagnosis(w io.Writer, diag *diagnosis) error {
+	b, err := json.MarshalIndent(diag, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// deployment returns a deployment with the given state, started at minute.
+func deployment(name, state string, minute int) resources.DeploymentExtended {
+	return resources.DeploymentExtended{
+		Name: to.StringPtr(name),
+		Properties: &resources.DeploymentPropertiesExtended{
+			ProvisioningState: to.StringPtr(state),
+			Timestamp:         &date.Time{Time: testNow.Add(time.Duration(minute) * time.Minute)},
+		},
+	}
+}
+
+// operation returns a deployment operation on the resource with the given ID,
+// of the form "resourceGroup/type/name", at minute.
+func operation(id, state string, minute int, message interface{}) resources.DeploymentOperation {
+	parts := strings.SplitN(id, "/", 2)
+	i := strings.LastIndex(parts[1], "/")
+	return resources.DeploymentOperation{
+		OperationID: to.StringPtr(id),
+		Properties: &resources.DeploymentOperationProperties{
+			ProvisioningState: to.StringPtr(state),
+			Timestamp:         &date.Time{Time: testNow.Add(time.Duration(minute) * time.Minute)},
+			StatusMessage:     message,
+			TargetResource: &resources.TargetResource{
+				ID:           to.StringPtr("/subscriptions/sub/resourceGroups/" + parts[0] + "/providers/" + parts[1]),
+				ResourceType: to.StringPtr(parts[1][:i]),
+				ResourceName: to.StringPtr(parts[1][i+1:]),
+			},
+		},
+	}
+}
+
+func armError(code, message string, details ...interface{}) map[string]interface{} {
+	e := map[string]interface{}{"code": code, "message": message}
+	if len(details) > 0 {
+		e["details"] = details
+	}
+	return e
+}
+
+func TestDiagnose(t *testing.T) {
+	quota := map[string]interface{}{"error": armError("QuotaExceeded", "not enough cores")}
+	d := &diagnoser{
+		deployments: &fakeDeploymentsClient{existing: map[string][]resources.DeploymentExtended{
+			"test": {
+				deployment("azure-cluster-2", "Failed", 10),
+				deployment("nested", "Failed", 11),
+				deployment("azure-cluster-1", "Succeeded", 0),
+			},
+		}},
+		operations: &fakeDeploymentOperationsClient{operations: map[string][]resources.DeploymentOperation{
+			"test/azure-cluster-1": {
+				operation("test/Microsoft.Network/virtualNetworks/vnet", "Succeeded", 1, nil),
+			},
+			"test/azure-cluster-2": {
+				operation("test/Microsoft.Resources/deployments/other", "Failed", 13, "Conflict"),
+				operation("test/Microsoft.Resources/deployments/nested", "Failed", 11, map[string]interface{}{"error": armError("DeploymentFailed", "nested failed")}),
+				operation("test/Microsoft.Network/virtualNetworks/vnet", "Succeeded", 10, nil),
+			},
+			"test/nested": {
+				operation("test/Microsoft.Compute/virtualMachines/master-0", "Failed", 12, quota),
+			},
+			"test/other": {
+				operation("test/Microsoft.Storage/storageAccounts/sa", "Succeeded", 13, nil),
+			},
+		}},
+		now: func() time.Time { return testNow },
+	}
+
+	diag, err := d.diagnose(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deployments []string
+	for _, s := range diag.Deployments {
+		deployments = append(deployments, s.Name+"<"+s.Parent+">:"+s.ProvisioningState)
+	}
+	if want := []string{"azure-cluster-1<>:Succeeded", "azure-cluster-2<>:Failed", "nested<azure-cluster-2>:Failed", "other<azure-cluster-2>:Failed"}; !reflect.DeepEqual(deployments, want) {
+		t.Errorf("got deployments %v, want %v", deployments, want)
+	}
+
+	// the nested deployment's failure is explained by its operations, so only
+	// they are reported; the other nested deployment has no failed operations,
+	// so its own is.
+	var failures []string
+	for _, f := range diag.Failures {
+		failures = append(failures, strings.Join(append(f.Path, f.Deployment), "/")+" "+f.TargetResource.Name+": "+f.Message)
+	}
+	if want := []string{
+		"azure-cluster-2/nested master-0: QuotaExceeded: not enough cores",
+		"azure-cluster-2 other: Conflict",
+	}; !reflect.DeepEqual(failures, want) {
+		t.Errorf("got failures %v, want %v", failures, want)
+	}
+	if f := diag.Failures[0]; f.TargetResource.Type != "Microsoft.Compute/virtualMachines" || !reflect.DeepEqual(f.StatusMessage, quota) {
+		t.Errorf("got failure %#v", f)
+	}
+
+	var out bytes.Buffer
+	printDiagnosis(&out, diag)
+	if !strings.Contains(out.String(), "failed: deployment azure-cluster-2/nested: Microsoft.Compute/virtualMachines master-0: QuotaExceeded: not enough cores\n") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err = writeDiagnosis(&out, diag); err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		ResourceGroup string
+		Generated     time.Time
+		Failures      []struct {
+			Deployment    string
+			Path          []string
+			StatusMessage interface{}
+		}
+	}
+	if err = json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.ResourceGroup != "test" || !report.Generated.Equal(testNow) || len(report.Failures) != 2 ||
+		report.Failures[0].Deployment != "nested" || !reflect.DeepEqual(report.Failures[0].Path, []string{"azure-cluster-2"}) ||
+		!reflect.DeepEqual(report.Failures[0].StatusMessage, quota) {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+}
+
+func TestDiagnoseOtherResourceGroup(t *testing.T) {
+	d := &diagnoser{
+		deployments: &fakeDeploymentsClient{existing: map[string][]resources.DeploymentExtended{
+			"test": {deployment("azure-cluster", "Failed", 0)},
+		}},
+		operations: &fakeDeploymentOperationsClient{operations: map[string][]resources.DeploymentOperation{
+			"test/azure-cluster": {
+				operation("images/Microsoft.Resources/deployments/nested", "Failed", 1, nil),
+			},
+			"images/nested": {
+				operation("images/Microsoft.Compute/images/image", "Failed", 2, "image not found"),
+			},
+		}},
+		now: func() time.Time { return testNow },
+	}
+
+	diag, err := d.diagnose(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diag.Deployments) != 2 || diag.Deployments[1].ResourceGroup != "images" || diag.Deployments[1].ProvisioningState != "Failed" {
+		t.Errorf("got deployments %#v", diag.Deployments)
+	}
+	if len(diag.Failures) != 1 || diag.Failures[0].ResourceGroup != "images" || diag.Failures[0].Message != "image not found" {
+		t.Errorf("got failures %#v", diag.Failures)
+	}
+}
+
+func TestStatusMessage(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		message interface{}
+		want    string
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name:    "string",
+			message: "Conflict",
+			want:    "Conflict",
+		},
+		{
+			name: "error with details",
+			message: map[string]interface{}{"error": armError("DeploymentFailed", "At least one resource deployment operation failed.",
+				armError("BadRequest", "invalid image"),
+				map[string]interface{}{"code": "Conflict"},
+			)},
+			want: "DeploymentFailed: At least one resource deployment operation failed.; BadRequest: invalid image; Conflict",
+		},
+		{
+			name:    "other",
+			message: map[string]interface{}{"status": "Failed"},
+			want:    `{"status":"Failed"}`,
+		},
+	} {
+		if got := statusMessage(tt.message); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// execResult is the outcome of running a command on a node.  ExitStatus is -1
+// if the command could not be run or its status is unknown, in which case
+// Error says why.
+type execResult struct {
+	Node       string `json:"node"`
+	Role       string `json:"role,omitempty"`
+	Address    string `json:"address"`
+	ExitStatus int    `json:"exitStatus"`
+	Error      string `json:"error,omitempty"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+}
+
+// nodeDialer connects to cluster nodes.
+type nodeDialer interface {
+	Dial(ctx context.Context, n *node) (*ssh.Client, error)
+}
+
+var _ nodeDialer = &sshDialer{}
+
+// executor runs commands on many nodes at once.  If out is set, the output of
+// each node is written to it as it arrives, each line prefixed with the name
+// of the node, followed by its exit status.
+type executor struct {
+	dialer   nodeDialer
+	parallel int
+	out      io.Writer
+
+	mu sync.Mutex
+}
+
+// exec runs command on each of nodes, at most e.parallel at once, and returns
+// the results in the order of nodes.
+func (e *executor) exec(ctx context.Context, nodes []node, command []string) []execResult {
+	results := make([]execResult, len(nodes))
+
+	sem := make(chan struct{}, e.parallel)
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = e.run(ctx, &nodes[i], command)
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// run runs command on n.
+func (e *executor) run(ctx context.Context, n *node, command []string) execResult {
+	r := execResult{Node: n.Name, Role: n.Role, Address: n.PrivateIP, ExitStatus: -1}
+
+	var stdout, stderr bytes.Buffer
+	outw, errw := io.Writer(&stdout), io.Writer(&stderr)
+	var prefixed []*prefixWriter
+	if e.out != nil {
+		o, er := e.prefixWriter(n.Name), e.prefixWriter(n.Name)
+		prefixed = append(prefixed, o, er)
+		outw, errw = io.MultiWriter(outw, o), io.MultiWriter(errw, er)
+	}
+
+	err := ctx.Err()
+	if err == nil {
+		var client *ssh.Client
+		if client, err = e.dialer.Dial(ctx, n); err == nil {
+			err = runSession(client, command, nil, outw, errw)
+			client.Close()
+		}
+	}
+
+	for _, w := range prefixed {
+		w.Flush()
+	}
+
+	switch err := err.(type) {
+	case nil:
+		r.ExitStatus = 0
+	case *ssh.ExitError:
+		r.ExitStatus = err.ExitStatus()
+	default:
+		r.Error = err.Error()
+	}
+	r.Stdout, r.Stderr = stdout.String(), stderr.String()
+
+	if e.out != nil {
+		e.mu.Lock()
+		if r.Error != "" {
+			fmt.Fprintf(e.out, "%s: error: %s\n", n.Name, r.Error)
+		} else {
+			fmt.Fprintf(e.out, "%s: exit status %d\n", n.Name, r.ExitStatus)
+		}
+		e.mu.Unlock()
+	}
+
+	return r
+}
+
+func (e *executor) prefixWriter(prefix string) *prefixWriter {
+	return &prefixWriter{mu: &e.mu, w: e.out, prefix: prefix + ": "}
+}
+
+// prefixWriter writes whole lines to w, each prefixed with prefix, holding mu
+// so that the lines of concurrent writers are not interleaved.  A final
+// incomplete line is written by Flush.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+
+	i := bytes.LastIndexByte(p.buf, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+
+	p.write(p.buf[:i+1])
+	p.buf = append(p.buf[:0], p.buf[i+1:]...)
+
+	return len(b), nil
+}
+
+// Flush writes any incomplete line, terminating it.
+func (p *prefixWriter) Flush() {
+	if len(p.buf) > 0 {
+		p.write(append(p.buf, '\n'))
+		p.buf = p.buf[:0]
+	}
+}
+
+func (p *prefixWriter) write(lines []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(lines) > 0 {
+		i := bytes.IndexByte(lines, '\n')
+		io.WriteString(p.w, p.prefix)
+		p.w.Write(lines[:i+1])
+		lines = lines[i+1:]
+	}
+}
+
+// writeResults writes results to w as indented JSON.
+func writeResults(w io.Writer, results []execResult) error {
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azure-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile, pub := testKey(t, dir, "id_ecdsa")
+
+	master := newTestSSHServer(t, "master", pub)
+	defer master.Close()
+	compute := newTestSSHServer(t, "compute", pub)
+	defer compute.Close()
+	master.forward[net.JoinHostPort("10.0.2.4", master.port())] = compute.addr()
+
+	d, err := newSSHDialer("127.0.0.1", &sshOptions{User: "cloud-user", KeyFile: keyFile, InsecureIgnoreHostKey: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.port = master.port()
+
+	nodes := []node{
+		{Name: "ocp-compute-12345678-0", Role: "compute", PrivateIP: "10.0.2.4"},
+		{Name: "ocp-infra-12345678-0", Role: "infra", PrivateIP: "10.0.1.4"},
+		{Name: "ocp-master-12345678-0", Role: "master", PrivateIP: "10.0.0.4", PublicIP: "127.0.0.1"},
+	}
+
+	var out bytes.Buffer
+	e := &executor{dialer: d, parallel: 2, out: &out}
+	results := e.exec(context.Background(), nodes, []string{"fail"})
+
+	if len(results) != 3 {
+		t.Fatalf("got %d results", len(results))
+	}
+	want := []execResult{
+		{Node: "ocp-compute-12345678-0", Role: "compute", Address: "10.0.2.4", ExitStatus: 3, Stdout: "compute: fail\n", Stderr: "failed"},
+		{Node: "ocp-infra-12345678-0", Role: "infra", Address: "10.0.1.4", ExitStatus: -1, Error: results[1].Error},
+		{Node: "ocp-master-12345678-0", Role: "master", Address: "10.0.0.4", ExitStatus: 3, Stdout: "master: fail\n", Stderr: "failed"},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got results %#v, want %#v", results, want)
+	}
+	if !strings.Contains(results[1].Error, "via 127.0.0.1") {
+		t.Errorf("got error %q", results[1].Error)
+	}
+
+	// lines of different nodes interleave, but each node's are in order.
+	lines := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		i := strings.Index(line, ": ")
+		lines[line[:i]] = append(lines[line[:i]], line[i+2:])
+	}
+	if got, want := lines["ocp-master-12345678-0"], []string{"master: fail", "failed", "exit status 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got master output %q, want %q", got, want)
+	}
+	if got := lines["ocp-infra-12345678-0"]; len(got) != 1 || !strings.HasPrefix(got[0], "error: ") {
+		t.Errorf("got infra output %q", got)
+	}
+
+	out.Reset()
+	if err = writeResults(&out, results); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []execResult
+	if err = json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, results) {
+		t.Errorf("got JSON %s", out.String())
+	}
+}
+
+func TestExecCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	e := &executor{dialer: &sshDialer{}, parallel: 1}
+	results := e.exec(ctx, []node{{Name: "ocp-master-12345678-0"}}, []string{"uptime"})
+	if len(results) != 1 || results[0].ExitStatus != -1 || results[0].Error != context.Canceled.Error() {
+		t.Errorf("got results %#v", results)
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &prefixWriter{mu: &sync.Mutex{}, w: &out, prefix: "node: "}
+
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\nthree\n\nfou"))
+	if want := "node: one\nnode: two\nnode: three\nnode: \n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	w.Flush()
+	w.Flush()
+	if want := "node: one\nnode: two\nnode: three\nnode: \nnode: fou\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// fakeDeploymentsClient records the deployments submitted to it, keyed by
+// resource group and then by name.  If err is set, deployments fail with it.
+// ListByResourceGroup returns the deployments in existing, keyed by resource
+// group.
+type fakeDeploymentsClient struct {
+	mu          sync.Mutex
+	deployments map[string]map[string]resources.Deployment
+	existing    map[string][]resources.DeploymentExtended
+	err         error
+}
+
+var _ deploymentsClient = &fakeDeploymentsClient{}
+
+func (c *fakeDeploymentsClient) CreateOrUpdate(ctx context.Context, resourceGroup, name string, deployment resources.Deployment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.deployments == nil {
+		c.deployments = map[string]map[string]resources.Deployment{}
+	}
+	if c.deployments[resourceGroup] == nil {
+		c.deployments[resourceGroup] = map[string]resources.Deployment{}
+	}
+	c.deployments[resourceGroup][name] = deployment
+
+	return c.err
+}
+
+func (c *fakeDeploymentsClient) ListByResourceGroup(ctx context.Context, resourceGroup string) ([]resources.DeploymentExtended, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.existing[resourceGroup], nil
+}
+
+// fakeDeploymentOperationsClient is an in-memory deploymentOperationsClient,
+// keyed by "resourcegroup/deployment".
+type fakeDeploymentOperationsClient struct {
+	operations map[string][]resources.DeploymentOperation
+}
+
+var _ deploymentOperationsClient = &fakeDeploymentOperationsClient{}
+
+func (c *fakeDeploymentOperationsClient) List(ctx context.Context, resourceGroup, deployment string) ([]resources.DeploymentOperation, error) {
+	ops, found := c.operations[resourceGroup+"/"+deployment]
+	if !found {
+		return nil, fmt.Errorf("deployment %s not found", deployment)
+	}
+	return append([]resources.DeploymentOperation(nil), ops...), nil
+}
+
+// fakeMachinesClient returns instance views whose boot diagnostics serial
+// logs are at the URIs in serialLogs, keyed by machine name, or by
+// "scaleset_instance" for scale set instances.
+type fakeMachinesClient struct {
+	serialLogs map[string]string
+}
+
+var _ machinesClient = &fakeMachinesClient{}
+
+func (c *fakeMachinesClient) bootDiagnostics(name string) *compute.BootDiagnosticsInstanceView {
+	uri, found := c.serialLogs[name]
+	if !found {
+		return nil
+	}
+	return &compute.BootDiagnosticsInstanceView{SerialConsoleLogBlobURI: to.StringPtr(uri)}
+}
+
+func (c *fakeMachinesClient) InstanceView(ctx context.Context, resourceGroup, name string) (*compute.VirtualMachineInstanceView, error) {
+	return &compute.VirtualMachineInstanceView{BootDiagnostics: c.bootDiagnostics(name)}, nil
+}
+
+func (c *fakeMachinesClient) ScaleSetInstanceView(ctx context.Context, resourceGroup, scaleSet, instanceID string) (*compute.VirtualMachineScaleSetVMInstanceView, error) {
+	return &compute.VirtualMachineScaleSetVMInstanceView{BootDiagnostics: c.bootDiagnostics(scaleSet + "_" + instanceID)}, nil
+}
+
+// fakeGenerator records the cluster definition it is given, and returns
+// template and parameters, or err if set.
+type fakeGenerator struct {
+	definition []byte
+	template   map[string]interface{}
+	parameters map[string]interface{}
+	err        error
+}
+
+var _ generator = &fakeGenerator{}
+
+func (g *fakeGenerator) Generate(ctx context.Context, definition []byte) (map[string]interface{}, map[string]interface{}, error) {
+	g.definition = definition
+	if g.err != nil {
+		return nil, nil, g.err
+	}
+	return g.template, g.parameters, nil
+}
+
+// image returns an image in eastus with the given name and tags, passed as
+// key/value pairs.
+func image(name string, tags ...string) compute.Image {
+	image := compute.Image{
+		Name:     to.StringPtr(name),
+		ID:       to.StringPtr("/subscriptions/sub/resourceGroups/images/providers/Microsoft.Compute/images/" + name),
+		Location: to.StringPtr("eastus"),
+		Tags:     map[string]*string{},
+	}
+	for i := 0; i < len(tags); i += 2 {
+		image.Tags[tags[i]] = to.StringPtr(tags[i+1])
+	}
+	return image
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// journalCommand dumps a node's journal.
+	journalCommand = "sudo journalctl --no-pager"
+
+	// originCommand writes a tar of a node's OpenShift configuration.
+	originCommand = "sudo tar -C /etc -cf - origin"
+
+	// ocCommand dumps the objects of a kind, run on a master.
+	ocCommand = "sudo oc --config=/etc/origin/master/admin.kubeconfig get %s --all-namespaces -o yaml"
+)
+
+// ocResources are the kinds of object dumped with oc get.  Secrets and config
+// maps are left out, as they hold credentials.
+var ocResources = []string{
+	"nodes",
+	"namespaces",
+	"events",
+	"pods",
+	"services",
+	"endpoints",
+	"routes",
+	"deploymentconfigs",
+	"deployments",
+	"daemonsets",
+	"replicationcontrollers",
+	"builds",
+	"persistentvolumes",
+	"persistentvolumeclaims",
+}
+
+// gatherer collects the logs and configuration of the nodes of a cluster into
+// a tarball, so that the evidence of a failure outlives the cluster.  Failures
+// to collect something are reported to out and listed in the tarball's
+// errors.txt, rather than stopping the collection.
+type gatherer struct {
+	dialer   nodeDialer
+	machines machinesClient
+	storage  azureclient.StorageClient
+	parallel int
+	now      func() time.Time
+	out      io.Writer
+}
+
+// archive is a tarball to which files are added concurrently.  Its files are
+// all under the directory prefix.
+type archive struct {
+	mu      sync.Mutex
+	tw      *tar.Writer
+	prefix  string
+	modTime time.Time
+	out     io.Writer
+	errs    []string
+	err     error
+}
+
+// add adds a file to the archive.  The first error writing it is kept, and
+// later files are dropped.
+func (a *archive) add(name string, data []byte) {
+	a.addReader(name, int64(len(data)), bytes.NewReader(data))
+}
+
+// addReader adds a file of size bytes, read from r, to the archive.
+func (a *archive) addReader(name string, size int64, r io.Reader) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.err != nil {
+		return
+	}
+
+	hdr := &tar.Header{
+		Name:    path.Join(a.prefix, name),
+		Mode:    0644,
+		Size:    size,
+		ModTime: a.modTime,
+	}
+	if a.err = a.tw.WriteHeader(hdr); a.err != nil {
+		return
+	}
+	_, a.err = io.CopyN(a.tw, r, size)
+}
+
+// fail records that something could not be collected.
+func (a *archive) fail(format string, args ...interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintf(a.out, "warning: %s\n", msg)
+	a.errs = append(a.errs, msg)
+}
+
+// gather writes a gzipped tarball of everything collected from the nodes of c,
+// the cluster in resourceGroup, to w.  Its files are under the directory name:
+// the journal, redacted /etc/origin and boot diagnostics serial log of each
+// node under nodes/NODE, and oc get dumps from the first master under oc.
+func (g *gatherer) gather(ctx context.Context, resourceGroup string, c *cluster, name string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	a := &archive{tw: tar.NewWriter(gz), prefix: name, modTime: g.now(), out: g.out}
+
+	sem := make(chan struct{}, g.parallel)
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			f()
+		}()
+	}
+
+	for i := range c.Nodes {
+		n := &c.Nodes[i]
+		run(func() { g.gatherNode(ctx, resourceGroup, n, a) })
+	}
+
+	if master, err := c.find("master"); err == nil {
+		run(func() { g.gatherOC(ctx, master, a) })
+	} else {
+		a.fail("oc: %v", err)
+	}
+
+	wg.Wait()
+
+	if len(a.errs) > 0 {
+		a.add("errors.txt", []byte(strings.Join(a.errs, "\n")+"\n"))
+	}
+
+	if err := a.err; err != nil {
+		return err
+	}
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// gatherNode adds the serial log, journal and redacted OpenShift configuration
+// of n to a.
+func (g *gatherer) gatherNode(ctx context.Context, resourceGroup string, n *node, a *archive) {
+	dir := path.Join("nodes", n.Name)
+
+	if log, err := g.serialLog(ctx, resourceGroup, n); err != nil {
+		a.fail("%s: serial log: %v", n.Name, err)
+	} else if log != nil {
+		a.add(path.Join(dir, "serial.log"), log)
+	}
+
+	if err := ctx.Err(); err != nil {
+		a.fail("%s: %v", n.Name, err)
+		return
+	}
+
+	client, err := g.dialer.Dial(ctx, n)
+	if err != nil {
+		a.fail("%s: %v", n.Name, err)
+		return
+	}
+	defer client.Close()
+
+	if err := addJournal(client, path.Join(dir, "journal.log"), a); err != nil {
+		a.fail("%s: journal: %v", n.Name, err)
+	}
+
+	if err := addOrigin(client, path.Join(dir, "etc"), a); err != nil {
+		a.fail("%s: /etc/origin: %v", n.Name, err)
+	}
+}
+
+// addJournal adds the journal of the node connected to client to a as name.
+// The journal can be large, and the size of a file must be known before it is
+// added, so it is spooled to a temporary file rather than held in memory.
+func addJournal(client *ssh.Client, name string, a *archive) error {
+	f, err := ioutil.TempFile("", "azure-cluster-journal")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = stream(client, journalCommand, func(r io.Reader) error {
+		_, err := io.Copy(f, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	a.addReader(name, size, f)
+	return nil
+}
+
+// addOrigin adds the redacted /etc/origin of the node connected to client to a
+// under dir, reading the files from the tar as it is produced.  Only one file
+// at a time is held in memory, as a whole file is needed to redact it.
+func addOrigin(client *ssh.Client, dir string, a *archive) error {
+	return stream(client, originCommand, func(r io.Reader) error {
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				continue
+			}
+
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			// names are anchored so that none escapes the node's directory.
+			a.add(path.Join(dir, path.Clean("/"+hdr.Name)), redact(hdr.Name, b))
+		}
+	})
+}
+
+// gatherOC adds oc get dumps of ocResources, run on master, to a.
+func (g *gatherer) gatherOC(ctx context.Context, master *node, a *archive) {
+	client, err := g.dialer.Dial(ctx, master)
+	if err != nil {
+		a.fail("oc: %v", err)
+		return
+	}
+	defer client.Close()
+
+	for _, resource := range ocResources {
+		if err := ctx.Err(); err != nil {
+			a.fail("oc: %v", err)
+			return
+		}
+
+		b, err := output(client, fmt.Sprintf(ocCommand, resource))
+		if err != nil {
+			a.fail("oc get %s: %v", resource, err)
+			continue
+		}
+		a.add(path.Join("oc", resource+".yaml"), b)
+	}
+}
+
+// serialLog returns the boot diagnostics serial console log of n, or nil if
+// boot diagnostics are not enabled on it.  The log's storage account is taken
+// to be in the cluster's resource group, where the templates create it.
+func (g *gatherer) serialLog(ctx context.Context, resourceGroup string, n *node) ([]byte, error) {
+	var uri *string
+	if scaleSet, instanceID, ok := scaleSetInstance(n.ID); ok {
+		view, err := g.machines.ScaleSetInstanceView(ctx, resourceGroup, scaleSet, instanceID)
+		if err != nil {
+			return nil, err
+		}
+		if view.BootDiagnostics != nil {
+			uri = view.BootDiagnostics.SerialConsoleLogBlobURI
+		}
+	} else {
+		view, err := g.machines.InstanceView(ctx, resourceGroup, path.Base(n.ID))
+		if err != nil {
+			return nil, err
+		}
+		if view.BootDiagnostics != nil {
+			uri = view.BootDiagnostics.SerialConsoleLogBlobURI
+		}
+	}
+	if uri == nil || *uri == "" {
+		return nil, nil
+	}
+
+	account, container, blob, err := azureutil.ParseBlobURI(*uri)
+	if err != nil {
+		return nil, err
+	}
+
+	bc, err := g.storage.GetBlobsClient(ctx, resourceGroup, account)
+	if err != nil {
+		return nil, err
+	}
+
+	return bc.Get(ctx, container, blob)
+}
+
+// output runs command on client and returns its output.  The error of a
+// command which fails includes its standard error.
+func output(client *ssh.Client, command string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := stream(client, command, func(r io.Reader) error {
+		_, err := io.Copy(&buf, r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// stream runs command on client, passing its output to f as it is produced.
+// The error of a command which fails includes its standard error.
+func stream(client *ssh.Client, command string, f func(io.Reader) error) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	// closing the session, rather than waiting for the command, also stops a
+	// command left blocked writing output after f fails.
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	if err = session.Start(command); err != nil {
+		return err
+	}
+	if err = f(stdout); err != nil {
+		return err
+	}
+	// f need not read to the end, as of a tar's trailing padding.
+	if _, err = io.Copy(ioutil.Discard, stdout); err != nil {
+		return err
+	}
+
+	if err = session.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %v: %s", command, err, msg)
+		}
+		return fmt.Errorf("%s: %v", command, err)
+	}
+
+	return nil
+}
+
+var (
+	// secretFileRx matches the names of files which are wholly secret.
+	secretFileRx = regexp.MustCompile(`(\.key|htpasswd|session-secrets\.yaml|encryption-config\.yaml)$`)
+
+	// privateKeyRx matches PEM-encoded private keys.
+	privateKeyRx = regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`)
+
+	// secretValueRx matches YAML and INI settings whose names end in a word
+	// marking them as secret, such as clientSecret, bindPassword, token and
+	// client-key-data.
+	secretValueRx = regexp.MustCompile(`(?im)^(\s*(?:-\s*)?"?[\w-]*(?:password|secret|token|key-data|keydata)"?\s*[:=][ \t]*)\S.*$`)
+
+	// secretJSONRx matches JSON string members named likewise, wherever they
+	// are on a line.
+	secretJSONRx = regexp.MustCompile(`(?i)("[\w-]*(?:password|secret|token|key-data|keydata)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+	// secretParentRx matches YAML settings named likewise, or in the plural,
+	// whose values are nested beneath them, such as clientSecret with a value
+	// or file.
+	secretParentRx = regexp.MustCompile(`(?i)^\s*(?:-\s*)?"?[\w-]*(?:password|secret|token|key-data|keydata)s?"?\s*:\s*$`)
+
+	// nestedValueRx matches the value of a YAML setting or list item.
+	nestedValueRx = regexp.MustCompile(`^(\s*(?:-[ \t]*)?(?:[^\s:]+:[ \t]+)?)\S.*?(\r?\n)?$`)
+)
+
+// redacted replaces secrets.
+const redacted = "REDACTED"
+
+// redact returns the contents of the configuration file name with its secrets
+// replaced: private keys, password files and session secrets entirely, and
+// otherwise private keys and the values of settings named as secrets, whether
+// given inline or nested beneath them.
+func redact(name string, data []byte) []byte {
+	if secretFileRx.MatchString(name) {
+		return []byte(redacted + "\n")
+	}
+
+	data = privateKeyRx.ReplaceAll(data, []byte(redacted))
+	data = secretJSONRx.ReplaceAll(data, []byte(`${1}"`+redacted+`"`))
+	data = secretValueRx.ReplaceAll(data, []byte("${1}"+redacted))
+	return redactNested(data)
+}
+
+// redactNested replaces the values of the lines nested beneath YAML settings
+// matching secretParentRx, leaving the names of nested settings in place.
+func redactNested(data []byte) []byte {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+
+	// parent is the indentation of the secret setting whose nested lines are
+	// being redacted, or -1.  A list may be nested at the indentation of a
+	// setting which is not itself a list item.
+	parent, item := -1, false
+	for i, line := range lines {
+		trimmed := bytes.TrimSpace(line)
+		if len(trimmed) == 0 {
+			continue
+		}
+		indent := len(line) - len(bytes.TrimLeft(line, " "))
+		isItem := trimmed[0] == '-'
+
+		if parent >= 0 {
+			if indent > parent || indent == parent && isItem && !item {
+				if !bytes.HasSuffix(trimmed, []byte(":")) {
+					lines[i] = nestedValueRx.ReplaceAll(line, []byte("${1}"+redacted+"${2}"))
+				}
+				continue
+			}
+			parent = -1
+		}
+
+		if secretParentRx.Match(line) {
+			parent, item = indent, isItem
+		}
+	}
+
+	return bytes.Join(lines, nil)
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// runUp deploys a cluster to the resource group given in args.
+func runUp(args []string) error {
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	template := fs.String("template", "_input/openshift-template.json", "cluster definition template")
+	image := fs.String("image", "", "image name (default: the latest valid image of -image-family)")
+	imageFamily := fs.String("image-family", "centos7-3.10", "family of the image used by default")
+	imageResourceGroup := fs.String("image-resource-group", "images", "resource group of the image")
+	location := fs.String("location", "eastus", "location of the cluster")
+	acsEngine := fs.String("acs-engine", "bin/acs-engine", "path to the acs-engine binary which generates the ARM template")
+	outputDir := fs.String("output-dir", "", "directory for the generated ARM template and credentials (default: _output/RESOURCEGROUP)")
+	timeout := fs.Duration("timeout", time.Hour, "time allowed for the deployment")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: azure-cluster up [flags] RESOURCEGROUP")
+	}
+	if *outputDir == "" {
+		*outputDir = filepath.Join("_output", fs.Arg(0))
+	}
+
+	tmpl, err := ioutil.ReadFile(*template)
+	if err != nil {
+		return err
+	}
+
+	env, err := azureutil.Environment()
+	if err != nil {
+		return err
+	}
+
+	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	subscriptionID := os.Getenv("AZURE_SUBSCRIPTION_ID")
+	d := &deployer{
+		images:      azureclient.NewImagesClient(env, subscriptionID, authorizer),
+		groups:      azureclient.NewGroupsClient(env, subscriptionID, authorizer),
+		deployments: newDeploymentsClient(env, subscriptionID, authorizer, *timeout),
+		generator:   &acsEngineGenerator{Command: *acsEngine, OutputDir: *outputDir, Stdout: os.Stdout, Stderr: os.Stderr},
+		now:         time.Now,
+		out:         os.Stdout,
+	}
+
+	p := &clusterParameters{
+		ResourceGroup:      fs.Arg(0),
+		Location:           *location,
+		Image:              *image,
+		ImageResourceGroup: *imageResourceGroup,
+	}
+
+	ctx := azureutil.SignalContext()
+	name, err := d.up(ctx, tmpl, p, *imageFamily)
+	if err != nil && name != "" && ctx.Err() == nil {
+		// explain the failure from the operations of the deployment.
+		dg := &diagnoser{
+			deployments: d.deployments,
+			operations:  newDeploymentOperationsClient(env, subscriptionID, authorizer),
+			now:         time.Now,
+		}
+		if diag, derr := dg.diagnose(ctx, p.ResourceGroup); derr == nil {
+			printDiagnosis(os.Stdout, diag)
+		} else {
+			fmt.Fprintf(os.Stderr, "diagnosing %s: %v\n", name, derr)
+		}
+	}
+	return err
+}
+
+// runDiagnose reports the failed operations of the deployments in the
+// resource group given in args, optionally writing a JSON report.
+func runDiagnose(args []string) error {
+	fs := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	output := fs.String("o", "", "file to which to write the JSON report")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: azure-cluster diagnose [-o FILE] RESOURCEGROUP")
+	}
+
+	env, err := azureutil.Environment()
+	if err != nil {
+		return err
+	}
+
+	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	subscriptionID := os.Getenv("AZURE_SUBSCRIPTION_ID")
+	d := &diagnoser{
+		deployments: newDeploymentsClient(env, subscriptionID, authorizer, 0),
+		operations:  newDeploymentOperationsClient(env, subscriptionID, authorizer),
+		now:         time.Now,
+	}
+
+	diag, err := d.diagnose(azureutil.SignalContext(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	printDiagnosis(os.Stdout, diag)
+
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		if err = writeDiagnosis(f, diag); err != nil {
+			f.Close()
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sshFlags defines the flags configuring SSH connections on fs.
+func sshFlags(fs *flag.FlagSet) *sshOptions {
+	o := &sshOptions{}
+	fs.StringVar(&o.User, "user", "cloud-user", "user to log in as")
+	fs.StringVar(&o.KeyFile, "i", "", "private key file")
+	fs.BoolVar(&o.Agent, "agent", true, "use the keys of the SSH agent at SSH_AUTH_SOCK")
+	fs.StringVar(&o.KnownHosts, "known-hosts", "", "known hosts file against which host keys are checked (default: ~/.ssh/known_hosts)")
+	fs.BoolVar(&o.InsecureIgnoreHostKey, "insecure-ignore-host-key", false, "do not check host keys")
+	fs.DurationVar(&o.Timeout, "timeout", 30*time.Second, "time allowed to connect")
+	return o
+}
+
+// resolveCluster returns the nodes of the cluster in resourceGroup.
+func resolveCluster(ctx context.Context, resourceGroup string) (*cluster, error) {
+	env, err := azureutil.Environment()
+	if err != nil {
+		return nil, err
+	}
+
+	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+
+	return newNodeResolver(env, os.Getenv("AZURE_SUBSCRIPTION_ID"), authorizer).resolve(ctx, resourceGroup)
+}
+
+// runSSH connects to a node of the cluster in the resource group given in args
+// and runs a command or an interactive shell there.
+func runSSH(args []string) error {
+	fs := flag.NewFlagSet("ssh", flag.ExitOnError)
+	o := sshFlags(fs)
+	printAddress := fs.Bool("print", false, "print the address of the node rather than connecting to it")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return errors.New("usage: azure-cluster ssh [flags] RESOURCEGROUP [NODE [COMMAND...]]")
+	}
+
+	ctx := azureutil.SignalContext()
+	c, err := resolveCluster(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// without a node, connect to the masters' public address, as ssh_master
+	// did.
+	var n *node
+	if fs.NArg() > 1 {
+		if n, err = c.find(fs.Arg(1)); err != nil {
+			return err
+		}
+	}
+
+	if *printAddress {
+		switch {
+		case n == nil:
+			fmt.Println(c.Master)
+		case n.PublicIP != "":
+			fmt.Println(n.PublicIP)
+		default:
+			fmt.Println(n.PrivateIP)
+		}
+		return nil
+	}
+
+	d, err := newSSHDialer(c.Master, o)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	client, err := d.Dial(ctx, n)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var command []string
+	if fs.NArg() > 2 {
+		command = fs.Args()[2:]
+	}
+	return runSession(client, command, os.Stdin, os.Stdout, os.Stderr)
+}
+
+// runExec runs a command on every node of the cluster in the resource group
+// given in args.
+func runExec(args []string) error {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	o := sshFlags(fs)
+	parallel := fs.Int("parallel", 10, "number of nodes on which the command runs at once")
+	role := fs.String("role", "", "only run the command on nodes with this role (master, infra or compute)")
+	jsonOutput := fs.Bool("json", false, "print the results as JSON once the command has finished on every node")
+	fs.Parse(args)
+
+	command := fs.Args()
+	if len(command) > 0 {
+		command = command[1:]
+	}
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	}
+	if len(command) == 0 {
+		return errors.New("usage: azure-cluster exec [flags] RESOURCEGROUP -- COMMAND...")
+	}
+	if *parallel < 1 {
+		return errors.New("-parallel must be at least 1")
+	}
+
+	ctx := azureutil.SignalContext()
+	c, err := resolveCluster(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var nodes []node
+	for _, n := range c.Nodes {
+		if *role == "" || n.Role == *role {
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) == 0 {
+		return fmt.Errorf("no nodes in resource group %s", fs.Arg(0))
+	}
+
+	d, err := newSSHDialer(c.Master, o)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	e := &executor{dialer: d, parallel: *parallel}
+	if !*jsonOutput {
+		e.out = os.Stdout
+	}
+	results := e.exec(ctx, nodes, command)
+
+	if *jsonOutput {
+		if err = writeResults(os.Stdout, results); err != nil {
+			return err
+		}
+	}
+
+	var failed int
+	for _, r := range results {
+		if r.ExitStatus != 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("command failed on %d of %d nodes", failed, len(results))
+	}
+
+	return nil
+}
+
+// runGather collects the logs and configuration of the cluster in the
+// resource group given in args into a tarball, optionally uploading it.
+func runGather(args []string) error {
+	fs := flag.NewFlagSet("gather", flag.ExitOnError)
+	o := sshFlags(fs)
+	outputDir := fs.String("output-dir", "_output", "directory to which to write the tarball")
+	parallel := fs.Int("parallel", 10, "number of nodes from which to gather at once")
+	uploadAccount := fs.String("upload-account", "", "storage account to which to upload the tarball (default: none)")
+	uploadResourceGroup := fs.String("upload-resource-group", "images", "resource group of the upload storage account")
+	uploadContainer := fs.String("upload-container", "gather", "blob container to which to upload the tarball")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: azure-cluster gather [flags] RESOURCEGROUP")
+	}
+	if *parallel < 1 {
+		return errors.New("-parallel must be at least 1")
+	}
+
+	env, err := azureutil.Environment()
+	if err != nil {
+		return err
+	}
+
+	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	subscriptionID := os.Getenv("AZURE_SUBSCRIPTION_ID")
+	ctx := azureutil.SignalContext()
+	c, err := newNodeResolver(env, subscriptionID, authorizer).resolve(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	d, err := newSSHDialer(c.Master, o)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	g := &gatherer{
+		dialer:   d,
+		machines: newMachinesClient(env, subscriptionID, authorizer),
+		storage:  azureclient.NewStorageClient(env, subscriptionID, authorizer),
+		parallel: *parallel,
+		now:      time.Now,
+		out:      os.Stderr,
+	}
+
+	if err = os.MkdirAll(*outputDir, 0700); err != nil {
+		return err
+	}
+
+	name := fs.Arg(0) + "-" + g.now().UTC().Format("20060102150405")
+	path := filepath.Join(*outputDir, name+".tar.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = g.gather(ctx, fs.Arg(0), c, name, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s\n", path)
+
+	if *uploadAccount == "" {
+		return nil
+	}
+
+	bc, err := g.storage.GetBlobsClient(ctx, *uploadResourceGroup, *uploadAccount)
+	if err != nil {
+		return err
+	}
+
+	if f, err = os.Open(path); err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = bc.Put(ctx, *uploadContainer, filepath.Base(path), f); err != nil {
+		return fmt.Errorf("uploading %s: %v", path, err)
+	}
+	fmt.Printf("uploaded %s to %s/%s\n", filepath.Base(path), *uploadAccount, *uploadContainer)
+
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `usage: %s command [flags]
+
+Commands:
+  up [-template FILE] [-image IMAGE] [-image-family FAMILY] [-image-resource-group RG] [-location LOCATION] [-acs-engine PATH] [-output-dir DIR] [-timeout DURATION] RESOURCEGROUP
+	render the cluster definition template, generate its ARM template with
+	acs-engine, and deploy it to RESOURCEGROUP, which is created if
+	necessary and tagged "now" so that the cluster is eventually purged;
+	the template may refer to ${RESOURCE_GROUP}, ${LOCATION}, ${IMAGE} and
+	${IMAGE_RESOURCE_GROUP}, with or without braces; if the deployment
+	fails, its failed operations are reported as by diagnose
+  diagnose [-o FILE] RESOURCEGROUP
+	report the state of the deployments in RESOURCEGROUP, including nested
+	deployments, and the status messages and target resources of their
+	failed operations; -o writes the report as JSON to FILE, e.g. to attach
+	to CI results
+  ssh [-user USER] [-i KEY] [-agent=false] [-known-hosts FILE] [-insecure-ignore-host-key] [-timeout DURATION] [-print] RESOURCEGROUP [NODE [COMMAND...]]
+	run COMMAND, or an interactive shell, on NODE of the cluster in
+	RESOURCEGROUP, named by its virtual machine name or private IP, or
+	"master" for the first master; nodes without a public IP are reached
+	through the masters' public address, which is connected to if NODE is
+	omitted; -print prints the node's address instead
+  exec [-user USER] [-i KEY] [-agent=false] [-known-hosts FILE] [-insecure-ignore-host-key] [-timeout DURATION] [-parallel N] [-role ROLE] [-json] RESOURCEGROUP -- COMMAND...
+	run COMMAND on every virtual machine and scale set instance of the
+	cluster in RESOURCEGROUP, or those with ROLE, N at once, printing each
+	line of output prefixed with the node's name followed by its exit
+	status; -json prints the output and exit status of each node as JSON
+	instead
+  gather [-user USER] [-i KEY] [-agent=false] [-known-hosts FILE] [-insecure-ignore-host-key] [-timeout DURATION] [-output-dir DIR] [-parallel N] [-upload-account ACCOUNT] [-upload-resource-group RG] [-upload-container CONTAINER] RESOURCEGROUP
+	collect the journal, /etc/origin with its secrets redacted and boot
+	diagnostics serial log of every node of the cluster in RESOURCEGROUP,
+	and oc get dumps from its first master, into DIR/RESOURCEGROUP-TIME.tar.gz;
+	if ACCOUNT is given, the tarball is also uploaded to CONTAINER there
+
+Host keys are checked against the -known-hosts file, by default
+~/.ssh/known_hosts; -insecure-ignore-host-key skips the check, e.g. for
+short-lived clusters whose keys cannot be known in advance.
+
+The subscription and credentials are taken from the usual AZURE_* environment
+variables.
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	var err error
+	switch flag.Arg(0) {
+	case "up":
+		err = runUp(flag.Args()[1:])
+	case "diagnose":
+		err = runDiagnose(flag.Args()[1:])
+	case "ssh":
+		err = runSSH(flag.Args()[1:])
+	case "exec":
+		err = runExec(flag.Args()[1:])
+	case "gather":
+		err = runGather(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		// remote commands exit with their own status, as under ssh(1).
+		os.Exit(exitErr.ExitStatus())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-04-01/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+)
+
+// masterPrefix is the prefix of the names of the masters of a cluster and of
+// the public IP address through which they are reached.
+const masterPrefix = "ocp-master"
+
+// roles are the roles of cluster nodes, recognised from their names.
+var roles = []string{"master", "infra", "compute"}
+
+// node is a virtual machine of a cluster.  ID is the resource ID of the
+// machine.  PublicIP is empty if the node is only reachable from within the
+// cluster's network.
+type node struct {
+	ID        string
+	Name      string
+	Role      string
+	PrivateIP string
+	PublicIP  string
+}
+
+// cluster is the nodes of a cluster, sorted by name, and the public address
+// of its masters, through which the other nodes are reached.
+type cluster struct {
+	Nodes  []node
+	Master string
+}
+
+// find returns the node whose name or private IP is name.  As in node names,
+// "master" is the first master.
+func (c *cluster) find(name string) (*node, error) {
+	for i, n := range c.Nodes {
+		if strings.EqualFold(n.Name, name) || n.PrivateIP == name || name == "master" && n.Role == "master" {
+			return &c.Nodes[i], nil
+		}
+	}
+
+	names := make([]string, 0, len(c.Nodes))
+	for _, n := range c.Nodes {
+		names = append(names, n.Name)
+	}
+	return nil, fmt.Errorf("no node %s: nodes are %s", name, strings.Join(names, ", "))
+}
+
+// nodeResolver finds the nodes of clusters from their network interfaces.
+type nodeResolver struct {
+	scaleSets  azureclient.ScaleSetsClient
+	interfaces azureclient.InterfacesClient
+	addresses  azureclient.PublicIPAddressesClient
+}
+
+func newNodeResolver(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) *nodeResolver {
+	return &nodeResolver{
+		scaleSets:  azureclient.NewScaleSetsClient(env, subscriptionID, authorizer),
+		interfaces: azureclient.NewInterfacesClient(env, subscriptionID, authorizer),
+		addresses:  azureclient.NewPublicIPAddressesClient(env, subscriptionID, authorizer),
+	}
+}
+
+// resolve returns the nodes of the cluster in resourceGroup.  Each virtual
+// machine or scale set instance with a network interface is a node, named after
+// the machine, with the addresses of the primary IP configuration of its
+// primary interface.  The masters' address is that of a master which has a public
+// IP or, failing that, of the public IP named after the masters, as masters
+// usually sit behind a load balancer.
+func (r *nodeResolver) resolve(ctx context.Context, resourceGroup string) (*cluster, error) {
+	addresses, err := r.addresses.ListByResourceGroup(ctx, resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[string]network.PublicIPAddress{}
+	for _, a := range addresses {
+		byID[strings.ToLower(to.String(a.ID))] = a
+	}
+
+	interfaces, err := r.interfaces.ListByResourceGroup(ctx, resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	scaleSets, err := r.scaleSets.ListByResourceGroup(ctx, resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+	for _, ss := range scaleSets {
+		nics, err := r.interfaces.ListByScaleSet(ctx, resourceGroup, to.String(ss.Name))
+		if err != nil {
+			return nil, err
+		}
+		interfaces = append(interfaces, nics...)
+	}
+
+	// a machine with several interfaces is one node, reached through its
+	// primary interface, or its first if none is marked primary.
+	var machines []string
+	primary := map[string]network.Interface{}
+	for _, nic := range interfaces {
+		if nic.InterfacePropertiesFormat == nil || nic.VirtualMachine == nil {
+			continue
+		}
+
+		id := strings.ToLower(to.String(nic.VirtualMachine.ID))
+		if p, found := primary[id]; !found {
+			machines = append(machines, id)
+			primary[id] = nic
+		} else if !to.Bool(p.Primary) && to.Bool(nic.Primary) {
+			primary[id] = nic
+		}
+	}
+
+	c := &cluster{}
+	for _, id := range machines {
+		nic := primary[id]
+		n := node{ID: to.String(nic.VirtualMachine.ID), Name: machineName(to.String(nic.VirtualMachine.ID))}
+		n.Role = nodeRole(n.Name)
+
+		if config := primaryIPConfiguration(nic); config != nil {
+			n.PrivateIP = to.String(config.PrivateIPAddress)
+			if config.PublicIPAddress != nil {
+				if a, found := byID[strings.ToLower(to.String(config.PublicIPAddress.ID))]; found && a.PublicIPAddressPropertiesFormat != nil {
+					n.PublicIP = to.String(a.IPAddress)
+				}
+			}
+		}
+
+		c.Nodes = append(c.Nodes, n)
+	}
+	sort.Slice(c.Nodes, func(i, j int) bool { return c.Nodes[i].Name < c.Nodes[j].Name })
+
+	for _, n := range c.Nodes {
+		if n.Role == "master" && n.PublicIP != "" {
+			c.Master = n.PublicIP
+			break
+		}
+	}
+	if c.Master == "" {
+		sort.Slice(addresses, func(i, j int) bool { return to.String(addresses[i].Name) < to.String(addresses[j].Name) })
+		for _, a := range addresses {
+			if strings.HasPrefix(to.String(a.Name), masterPrefix) && a.PublicIPAddressPropertiesFormat != nil && a.IPAddress != nil {
+				c.Master = *a.IPAddress
+				break
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// primaryIPConfiguration returns the primary IP configuration of nic, or its
+// first if none is marked primary.
+func primaryIPConfiguration(nic network.Interface) *network.InterfaceIPConfigurationPropertiesFormat {
+	if nic.IPConfigurations == nil || len(*nic.IPConfigurations) == 0 {
+		return nil
+	}
+
+	configs := *nic.IPConfigurations
+	for _, config := range configs {
+		if config.InterfaceIPConfigurationPropertiesFormat != nil && to.Bool(config.Primary) {
+			return config.InterfaceIPConfigurationPropertiesFormat
+		}
+	}
+	return configs[0].InterfaceIPConfigurationPropertiesFormat
+}
+
+// machineName returns the name of the virtual machine with the given ID.  Scale
+// set instances are named "scaleset_instance", as in the portal.
+func machineName(id string) string {
+	if scaleSet, instanceID, ok := scaleSetInstance(id); ok {
+		return scaleSet + "_" + instanceID
+	}
+	return path.Base(id)
+}
+
+// scaleSetInstance returns the scale set and instance ID of the virtual
+// machine with the given ID, if it is a scale set instance.
+func scaleSetInstance(id string) (string, string, bool) {
+	parts := strings.Split(id, "/")
+	for i := 0; i+3 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "virtualMachineScaleSets") && strings.EqualFold(parts[i+2], "virtualMachines") {
+			return parts[i+1], parts[i+3], true
+		}
+	}
+	return "", "", false
+}
+
+// nodeRole returns the role of the node called name, or "" if it has none of
+// the known roles.
+func nodeRole(name string) string {
+	parts := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool { return r == '-' || r == '_' })
+	for _, part := range parts {
+		for _, role := range roles {
+			if part == role {
+				return role
+			}
+		}
+	}
+	return ""
+}
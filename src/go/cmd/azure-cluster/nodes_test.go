@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-04-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient/fake"
+)
+
+const testNetworkPrefix = "/subscriptions/sub/resourceGroups/test/providers/Microsoft.Network/"
+
+// nic returns a network interface of the virtual machine vm, with the given
+// private IP and, if publicIP is not empty, the public IP of that name.  The
+// machines of scale sets are named "scaleset/virtualMachines/instance".
+func nic(vm, privateIP, publicIP string) network.Interface {
+	config := network.InterfaceIPConfiguration{
+		InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+			PrivateIPAddress: to.StringPtr(privateIP),
+			Primary:          to.BoolPtr(true),
+		},
+	}
+	if publicIP != "" {
+		config.PublicIPAddress = &network.PublicIPAddress{ID: to.StringPtr(testNetworkPrefix + "publicIPAddresses/" + publicIP)}
+	}
+
+	return network.Interface{
+		Name: to.StringPtr(vm + "-nic"),
+		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
+			VirtualMachine:   &network.SubResource{ID: to.StringPtr(machineID(vm))},
+			IPConfigurations: &[]network.InterfaceIPConfiguration{{}, config},
+		},
+	}
+}
+
+// withPrimary returns nic, marked as its machine's primary interface or not.
+func withPrimary(nic network.Interface, primary bool) network.Interface {
+	nic.Primary = to.BoolPtr(primary)
+	return nic
+}
+
+func machineID(vm string) string {
+	if strings.Contains(vm, "/") {
+		return "/subscriptions/sub/resourceGroups/test/providers/Microsoft.Compute/virtualMachineScaleSets/" + vm
+	}
+	return "/subscriptions/sub/resourceGroups/test/providers/Microsoft.Compute/virtualMachines/" + vm
+}
+
+func publicIP(name, address string) network.PublicIPAddress {
+	return network.PublicIPAddress{
+		ID:                              to.StringPtr(testNetworkPrefix + "publicIPAddresses/" + name),
+		Name:                            to.StringPtr(name),
+		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{IPAddress: to.StringPtr(address)},
+	}
+}
+
+func TestResolve(t *testing.T) {
+	for _, tt := range []struct {
+		name               string
+		interfaces         []network.Interface
+		scaleSetInterfaces []network.Interface
+		addresses          []network.PublicIPAddress
+		want               *cluster
+	}{
+		{
+			name: "masters behind a load balancer",
+			interfaces: []network.Interface{
+				nic("ocp-compute-12345678-0", "10.0.2.4", ""),
+				nic("ocp-master-12345678-0", "10.0.0.4", ""),
+				nic("ocp-infra-12345678-0", "10.0.1.4", "ocp-router-ip"),
+				{Name: to.StringPtr("detached"), InterfacePropertiesFormat: &network.InterfacePropertiesFormat{}},
+			},
+			scaleSetInterfaces: []network.Interface{
+				nic("ocp-compute-vmss/virtualMachines/3", "10.0.2.7", ""),
+			},
+			addresses: []network.PublicIPAddress{
+				publicIP("ocp-router-ip", "52.0.0.2"),
+				publicIP("ocp-master-ip", "52.0.0.1"),
+			},
+			want: &cluster{
+				Nodes: []node{
+					{ID: machineID("ocp-compute-12345678-0"), Name: "ocp-compute-12345678-0", Role: "compute", PrivateIP: "10.0.2.4"},
+					{ID: machineID("ocp-compute-vmss/virtualMachines/3"), Name: "ocp-compute-vmss_3", Role: "compute", PrivateIP: "10.0.2.7"},
+					{ID: machineID("ocp-infra-12345678-0"), Name: "ocp-infra-12345678-0", Role: "infra", PrivateIP: "10.0.1.4", PublicIP: "52.0.0.2"},
+					{ID: machineID("ocp-master-12345678-0"), Name: "ocp-master-12345678-0", Role: "master", PrivateIP: "10.0.0.4"},
+				},
+				Master: "52.0.0.1",
+			},
+		},
+		{
+			name: "machine with several interfaces",
+			interfaces: []network.Interface{
+				withPrimary(nic("ocp-master-12345678-0", "10.1.0.4", ""), false),
+				withPrimary(nic("ocp-master-12345678-0", "10.0.0.4", "master-0"), true),
+				nic("ocp-compute-12345678-0", "10.0.2.4", ""),
+				nic("ocp-compute-12345678-0", "10.1.2.4", ""),
+			},
+			addresses: []network.PublicIPAddress{
+				publicIP("master-0", "52.0.0.3"),
+			},
+			want: &cluster{
+				Nodes: []node{
+					{ID: machineID("ocp-compute-12345678-0"), Name: "ocp-compute-12345678-0", Role: "compute", PrivateIP: "10.0.2.4"},
+					{ID: machineID("ocp-master-12345678-0"), Name: "ocp-master-12345678-0", Role: "master", PrivateIP: "10.0.0.4", PublicIP: "52.0.0.3"},
+				},
+				Master: "52.0.0.3",
+			},
+		},
+		{
+			name: "master with a public IP",
+			interfaces: []network.Interface{
+				nic("ocp-master-12345678-0", "10.0.0.4", "master-0"),
+				nic("bastion", "10.0.3.4", ""),
+			},
+			addresses: []network.PublicIPAddress{
+				publicIP("ocp-master-ip", "52.0.0.1"),
+				publicIP("master-0", "52.0.0.3"),
+			},
+			want: &cluster{
+				Nodes: []node{
+					{ID: machineID("bastion"), Name: "bastion", PrivateIP: "10.0.3.4"},
+					{ID: machineID("ocp-master-12345678-0"), Name: "ocp-master-12345678-0", Role: "master", PrivateIP: "10.0.0.4", PublicIP: "52.0.0.3"},
+				},
+				Master: "52.0.0.3",
+			},
+		},
+	} {
+		r := &nodeResolver{
+			scaleSets: &fake.ScaleSetsClient{ScaleSets: map[string][]compute.VirtualMachineScaleSet{
+				"test": {{Name: to.StringPtr("ocp-compute-vmss")}},
+			}},
+			interfaces: &fake.InterfacesClient{
+				Interfaces:         map[string][]network.Interface{"test": tt.interfaces},
+				ScaleSetInterfaces: map[string][]network.Interface{"test/ocp-compute-vmss": tt.scaleSetInterfaces},
+			},
+			addresses: &fake.PublicIPAddressesClient{Addresses: map[string][]network.PublicIPAddress{"test": tt.addresses}},
+		}
+
+		c, err := r.resolve(context.Background(), "test")
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, c, tt.want)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	c := &cluster{
+		Nodes: []node{
+			{Name: "ocp-compute-12345678-0", Role: "compute", PrivateIP: "10.0.2.4"},
+			{Name: "ocp-master-12345678-0", Role: "master", PrivateIP: "10.0.0.4"},
+			{Name: "ocp-master-12345678-1", Role: "master", PrivateIP: "10.0.0.5"},
+		},
+	}
+
+	for name, want := range map[string]string{
+		"OCP-Compute-12345678-0": "ocp-compute-12345678-0",
+		"10.0.0.5":               "ocp-master-12345678-1",
+		"master":                 "ocp-master-12345678-0",
+	} {
+		n, err := c.find(name)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if n.Name != want {
+			t.Errorf("%s: got %s, want %s", name, n.Name, want)
+		}
+	}
+
+	if _, err := c.find("infra"); err == nil || err.Error() != "no node infra: nodes are ocp-compute-12345678-0, ocp-master-12345678-0, ocp-master-12345678-1" {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshOptions configure connections to cluster nodes.  The key in KeyFile and
+// the keys held by the SSH agent, if Agent is set, are offered.  Host keys are
+// checked against KnownHosts, by default ~/.ssh/known_hosts, unless
+// InsecureIgnoreHostKey is set.
+type sshOptions struct {
+	User                  string
+	KeyFile               string
+	Agent                 bool
+	KnownHosts            string
+	InsecureIgnoreHostKey bool
+	Timeout               time.Duration
+}
+
+// sshDialer connects to the nodes of a cluster, jumping through the masters'
+// public address to reach nodes without a public IP.  The connection to the
+// masters is shared by every jump.
+type sshDialer struct {
+	config *ssh.ClientConfig
+	master string
+	port   string
+
+	mu      sync.Mutex
+	jump    *ssh.Client
+	closers []io.Closer
+}
+
+// newSSHDialer returns a dialer for the cluster whose masters are reached at
+// master.  It must be closed.
+func newSSHDialer(master string, o *sshOptions) (*sshDialer, error) {
+	d := &sshDialer{master: master, port: "22"}
+
+	var auth []ssh.AuthMethod
+	if o.KeyFile != "" {
+		b, err := ioutil.ReadFile(o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", o.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); o.Agent && sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("ssh agent: %v", err)
+		}
+		d.closers = append(d.closers, conn)
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	if len(auth) == 0 {
+		d.Close()
+		return nil, errors.New("no SSH key given and no SSH agent available")
+	}
+
+	hostKeyCallback, err := o.hostKeyCallback()
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	d.config = &ssh.ClientConfig{
+		User:            o.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         o.Timeout,
+	}
+
+	return d, nil
+}
+
+// hostKeyCallback returns the callback checking host keys against o.KnownHosts,
+// or ~/.ssh/known_hosts.  Hosts which are not listed there are rejected.
+func (o *sshOptions) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if o.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	file := o.KnownHosts
+	if file == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return nil, errors.New("HOME is not set: use -known-hosts or -insecure-ignore-host-key")
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	check, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("%v (use -insecure-ignore-host-key to skip host key checking)", err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		if kerr, ok := err.(*knownhosts.KeyError); ok && len(kerr.Want) == 0 {
+			return fmt.Errorf("host key of %s is not in %s (use -insecure-ignore-host-key to skip host key checking)", hostname, file)
+		}
+		return err
+	}, nil
+}
+
+// Dial connects to n, or to the masters' public address if n is nil.
+func (d *sshDialer) Dial(ctx context.Context, n *node) (*ssh.Client, error) {
+	if n == nil {
+		if d.master == "" {
+			return nil, errors.New("cluster has no public master address")
+		}
+		return d.dial(ctx, d.master)
+	}
+	if n.PublicIP != "" {
+		return d.dial(ctx, n.PublicIP)
+	}
+
+	jump, err := d.jumpClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(n.PrivateIP, d.port)
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s via %s: %v", n.Name, d.master, err)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, d.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s via %s: %v", n.Name, d.master, err)
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// jumpClient returns the shared connection to the masters.
+func (d *sshDialer) jumpClient(ctx context.Context) (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.jump != nil {
+		return d.jump, nil
+	}
+	if d.master == "" {
+		return nil, errors.New("cluster has no public master address to jump through")
+	}
+
+	jump, err := d.dial(ctx, d.master)
+	if err != nil {
+		return nil, err
+	}
+	d.jump = jump
+	d.closers = append(d.closers, jump)
+
+	return jump, nil
+}
+
+func (d *sshDialer) dial(ctx context.Context, host string) (*ssh.Client, error) {
+	addr := net.JoinHostPort(host, d.port)
+
+	dialer := net.Dialer{Timeout: d.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, d.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %v", addr, err)
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// Close closes the connection to the masters and to the SSH agent.
+func (d *sshDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var err error
+	for _, c := range d.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	d.closers, d.jump = nil, nil
+
+	return err
+}
+
+// runSession runs command on client, joining its arguments with spaces as
+// ssh(1) does.  Without a command, it runs an interactive shell, on a
+// terminal if stdin is one.  A command which fails returns an *ssh.ExitError.
+func runSession(client *ssh.Client, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin, session.Stdout, session.Stderr = stdin, stdout, stderr
+
+	if len(command) > 0 {
+		return session.Run(strings.Join(command, " "))
+	}
+
+	if f, ok := stdin.(*os.File); ok && isTerminal(f) {
+		rows, cols := terminalSize(f)
+
+		restore, err := makeRaw(f)
+		if err != nil {
+			return err
+		}
+		defer restore()
+
+		term := os.Getenv("TERM")
+		if term == "" {
+			term = "xterm"
+		}
+		if err = session.RequestPty(term, rows, cols, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+			return err
+		}
+	}
+
+	if err = session.Shell(); err != nil {
+		return err
+	}
+
+	return session.Wait()
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// stty runs stty(1) on the terminal f.
+func stty(f *os.File, args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = f
+	b, err := cmd.Output()
+	return strings.TrimSpace(string(b)), err
+}
+
+// terminalSize returns the size of the terminal f, defaulting to 24x80.
+func terminalSize(f *os.File) (int, int) {
+	size, err := stty(f, "size")
+	if err == nil {
+		if fields := strings.Fields(size); len(fields) == 2 {
+			rows, rerr := strconv.Atoi(fields[0])
+			cols, cerr := strconv.Atoi(fields[1])
+			if rerr == nil && cerr == nil {
+				return rows, cols
+			}
+		}
+	}
+	return 24, 80
+}
+
+// makeRaw puts the terminal f into raw mode, so that keystrokes are passed to
+// the remote terminal, and returns a function which restores its state.
+func makeRaw(f *os.File) (func(), error) {
+	state, err := stty(f, "-g")
+	if err != nil {
+		return nil, fmt.Errorf("stty: %v", err)
+	}
+
+	if _, err = stty(f, "raw", "-echo"); err != nil {
+		return nil, fmt.Errorf("stty: %v", err)
+	}
+
+	return func() { stty(f, state) }, nil
+}
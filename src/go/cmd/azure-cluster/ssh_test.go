@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an SSH server which accepts the user cloud-user with a
+// single key.  Commands are not run: those in responses output their values,
+// and others are echoed, prefixed with the server's name; the command "fail"
+// also writes "failed" to stderr and exits 3.  Forwarded connections to the
+// addresses in forward are made to their values instead.
+type testSSHServer struct {
+	name      string
+	hostKey   ssh.PublicKey
+	listener  net.Listener
+	forward   map[string]string
+	responses map[string][]byte
+}
+
+func newTestSSHServer(t *testing.T, name string, authorized ssh.PublicKey) *testSSHServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() != "cloud-user" || !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, errors.New("unauthorized")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSSHServer{name: name, hostKey: hostKey.PublicKey(), listener: l, forward: map[string]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+
+	return s
+}
+
+func (s *testSSHServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testSSHServer) port() string {
+	_, port, _ := net.SplitHostPort(s.addr())
+	return port
+}
+
+// writeKnownHosts writes a known hosts file at path listing the host key of
+// each server at the given address.
+func writeKnownHosts(t *testing.T, path string, hosts map[string]*testSSHServer) {
+	var b bytes.Buffer
+	for addr, s := range hosts {
+		fmt.Fprintln(&b, knownhosts.Line([]string{addr}, s.hostKey))
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *testSSHServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			go s.session(newChannel)
+		case "direct-tcpip":
+			go s.directTCPIP(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+func (s *testSSHServer) session(newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		var exec struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		if out, found := s.responses[exec.Command]; found {
+			channel.Write(out)
+		} else {
+			fmt.Fprintf(channel, "%s: %s\n", s.name, exec.Command)
+		}
+		var status struct{ Status uint32 }
+		if exec.Command == "fail" {
+			fmt.Fprintf(channel.Stderr(), "failed")
+			status.Status = 3
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(&status))
+		return
+	}
+}
+
+func (s *testSSHServer) directTCPIP(newChannel ssh.NewChannel) {
+	var dest struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &dest); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	addr, found := s.forward[net.JoinHostPort(dest.Host, fmt.Sprint(dest.Port))]
+	if !found {
+		newChannel.Reject(ssh.ConnectionFailed, "no route to host")
+		return
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	go io.Copy(channel, conn)
+	io.Copy(conn, channel)
+}
+
+// testKey writes a new private key to a file in dir, returning the file's name
+// and the public key.
+func testKey(t *testing.T, dir, name string) (string, ssh.PublicKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, pub
+}
+
+func TestSSHDialer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azure-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile, pub := testKey(t, dir, "id_ecdsa")
+
+	master := newTestSSHServer(t, "master", pub)
+	defer master.Close()
+	compute := newTestSSHServer(t, "compute", pub)
+	defer compute.Close()
+	master.forward[net.JoinHostPort("10.0.2.4", master.port())] = compute.addr()
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	writeKnownHosts(t, knownHosts, map[string]*testSSHServer{
+		master.addr(): master,
+		net.JoinHostPort("10.0.2.4", master.port()): compute,
+	})
+
+	d, err := newSSHDialer("127.0.0.1", &sshOptions{User: "cloud-user", KeyFile: keyFile, KnownHosts: knownHosts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.port = master.port()
+
+	for _, tt := range []struct {
+		name       string
+		node       *node
+		command    []string
+		wantOutput string
+		wantStatus int
+	}{
+		{
+			name:       "master address",
+			command:    []string{"uptime"},
+			wantOutput: "master: uptime\n",
+		},
+		{
+			name:       "public IP",
+			node:       &node{Name: "ocp-master-12345678-0", PrivateIP: "10.0.0.4", PublicIP: "127.0.0.1"},
+			command:    []string{"sudo", "oc", "get", "nodes"},
+			wantOutput: "master: sudo oc get nodes\n",
+		},
+		{
+			name:       "jump to private IP",
+			node:       &node{Name: "ocp-compute-12345678-0", PrivateIP: "10.0.2.4"},
+			command:    []string{"hostname"},
+			wantOutput: "compute: hostname\n",
+		},
+		{
+			name:       "command fails",
+			node:       &node{Name: "ocp-compute-12345678-0", PrivateIP: "10.0.2.4"},
+			command:    []string{"fail"},
+			wantOutput: "compute: fail\n",
+			wantStatus: 3,
+		},
+	} {
+		client, err := d.Dial(context.Background(), tt.node)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+
+		var out, stderr bytes.Buffer
+		err = runSession(client, tt.command, nil, &out, &stderr)
+		client.Close()
+
+		var status int
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			status = exitErr.ExitStatus()
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if status != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.name, status, tt.wantStatus)
+		}
+		if out.String() != tt.wantOutput {
+			t.Errorf("%s: got output %q, want %q", tt.name, out.String(), tt.wantOutput)
+		}
+	}
+
+	if _, err = d.Dial(context.Background(), &node{Name: "ocp-infra-12345678-0", PrivateIP: "10.0.1.4"}); err == nil {
+		t.Error("expected error dialing unreachable node")
+	}
+}
+
+func TestSSHDialerAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azure-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, pub := testKey(t, dir, "id_ecdsa")
+	otherKeyFile, _ := testKey(t, dir, "id_other")
+
+	s := newTestSSHServer(t, "master", pub)
+	defer s.Close()
+
+	d, err := newSSHDialer("127.0.0.1", &sshOptions{User: "cloud-user", KeyFile: otherKeyFile, InsecureIgnoreHostKey: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.port = s.port()
+
+	if _, err = d.Dial(context.Background(), nil); err == nil {
+		t.Error("expected error authenticating with the wrong key")
+	}
+
+	if _, err = newSSHDialer("127.0.0.1", &sshOptions{User: "cloud-user"}); err == nil || err.Error() != "no SSH key given and no SSH agent available" {
+		t.Errorf("got error %v", err)
+	}
+
+	if _, err = newSSHDialer("127.0.0.1", &sshOptions{User: "cloud-user", KeyFile: filepath.Join(dir, "missing")}); err == nil {
+		t.Error("expected error reading missing key")
+	}
+}
+
+func TestSSHDialerHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azure-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile, pub := testKey(t, dir, "id_ecdsa")
+
+	s := newTestSSHServer(t, "master", pub)
+	defer s.Close()
+	other := newTestSSHServer(t, "other", pub)
+	defer other.Close()
+
+	if err = os.Mkdir(filepath.Join(dir, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeKnownHosts(t, filepath.Join(dir, ".ssh", "known_hosts"), map[string]*testSSHServer{s.addr(): s})
+	writeKnownHosts(t, filepath.Join(dir, "changed"), map[string]*testSSHServer{s.addr(): other})
+	writeKnownHosts(t, filepath.Join(dir, "empty"), nil)
+
+	home := os.Getenv("HOME")
+	defer os.Setenv("HOME", home)
+	os.Setenv("HOME", dir)
+
+	for _, tt := range []struct {
+		name    string
+		o       sshOptions
+		wantErr string
+	}{
+		{name: "default known hosts"},
+		{name: "unknown host", o: sshOptions{KnownHosts: filepath.Join(dir, "empty")}, wantErr: "is not in"},
+		{name: "changed key", o: sshOptions{KnownHosts: filepath.Join(dir, "changed")}, wantErr: "key mismatch"},
+		{name: "changed key ignored", o: sshOptions{KnownHosts: filepath.Join(dir, "changed"), InsecureIgnoreHostKey: true}},
+	} {
+		tt.o.User, tt.o.KeyFile = "cloud-user", keyFile
+		d, err := newSSHDialer("127.0.0.1", &tt.o)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		d.port = s.port()
+
+		client, err := d.Dial(context.Background(), nil)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if client != nil {
+			client.Close()
+		}
+		d.Close()
+	}
+
+	if _, err = newSSHDialer("127.0.0.1", &sshOptions{User: "cloud-user", KeyFile: keyFile, KnownHosts: filepath.Join(dir, "missing")}); err == nil || !strings.Contains(err.Error(), "-insecure-ignore-host-key") {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/vmimage"
+)
+
+// nowTag is the tag holding the Unix time at which a resource group was
+// created, from which azure-purge's group rules time it out.
+const nowTag = "now"
+
+// clusterParameters are the values substituted into a cluster definition
+// template.
+type clusterParameters struct {
+	ResourceGroup      string
+	Location           string
+	Image              string
+	ImageResourceGroup string
+}
+
+// variables returns the template variables of p.  CUSTOM_RG is an older name
+// of IMAGE_RESOURCE_GROUP, still used by existing templates.
+func (p *clusterParameters) variables() map[string]string {
+	return map[string]string{
+		"RESOURCE_GROUP":       p.ResourceGroup,
+		"LOCATION":             p.Location,
+		"IMAGE":                p.Image,
+		"IMAGE_RESOURCE_GROUP": p.ImageResourceGroup,
+		"CUSTOM_RG":            p.ImageResourceGroup,
+	}
+}
+
+var variableRx = regexp.MustCompile(`\$(?:\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))`)
+
+// renderTemplate substitutes the parameters p for the ${NAME} and $NAME
+// references in the JSON cluster definition template tmpl, as envsubst does.  Values are escaped as JSON
+// string contents, since references appear within strings.  It is an error
+// for the template to refer to an unknown variable, or not to be valid JSON
+// once rendered.
+func renderTemplate(tmpl []byte, p *clusterParameters) ([]byte, error) {
+	vars := p.variables()
+
+	unknown := map[string]struct{}{}
+	b := variableRx.ReplaceAllFunc(tmpl, func(ref []byte) []byte {
+		m := variableRx.FindSubmatch(ref)
+		name := string(m[1]) + string(m[2])
+		v, found := vars[name]
+		if !found {
+			unknown[name] = struct{}{}
+			return ref
+		}
+
+		s, _ := json.Marshal(v)
+		return s[1 : len(s)-1]
+	})
+
+	if len(unknown) > 0 {
+		names := make([]string, 0, len(unknown))
+		for name := range unknown {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("template refers to unknown variables %s", strings.Join(names, ", "))
+	}
+
+	if !json.Valid(b) {
+		return nil, errors.New("rendered template is not valid JSON")
+	}
+
+	return b, nil
+}
+
+// generator turns a cluster definition into an ARM template and the values
+// of its parameters.
+type generator interface {
+	Generate(ctx context.Context, definition []byte) (template, parameters map[string]interface{}, err error)
+}
+
+// acsEngineGenerator generates ARM templates by running "Command generate".
+// The cluster definition and everything acs-engine generates, including the
+// cluster's credentials, are written to OutputDir.
+type acsEngineGenerator struct {
+	Command   string
+	OutputDir string
+	Stdout    io.Writer
+	Stderr    io.Writer
+}
+
+var _ generator = &acsEngineGenerator{}
+
+func (g *acsEngineGenerator) Generate(ctx context.Context, definition []byte) (map[string]interface{}, map[string]interface{}, error) {
+	if err := os.MkdirAll(g.OutputDir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	path := filepath.Join(g.OutputDir, "clusterdefinition.json")
+	if err := ioutil.WriteFile(path, definition, 0600); err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, g.Command, "generate", "--output-directory", g.OutputDir, path)
+	cmd.Stdout, cmd.Stderr = g.Stdout, g.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, nil, fmt.Errorf("%s generate: %v", g.Command, err)
+	}
+
+	var template map[string]interface{}
+	if err := readJSON(filepath.Join(g.OutputDir, "azuredeploy.json"), &template); err != nil {
+		return nil, nil, err
+	}
+
+	// the parameters file holds a complete deployment parameters document,
+	// of which only the parameters themselves are submitted.
+	var parameters struct {
+		Parameters map[string]interface{} `json:"parameters"`
+	}
+	if err := readJSON(filepath.Join(g.OutputDir, "azuredeploy.parameters.json"), &parameters); err != nil {
+		return nil, nil, err
+	}
+
+	return template, parameters.Parameters, nil
+}
+
+// readJSON decodes the JSON file at path into v.
+func readJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+// deployer brings up clusters from cluster definition templates.
+type deployer struct {
+	images      azureclient.ImagesClient
+	groups      azureclient.GroupsClient
+	deployments deploymentsClient
+	generator   generator
+
+	now func() time.Time
+	out io.Writer
+}
+
+// resolveImage returns the name of the most recently built image of family
+// in resourceGroup which is tagged "valid: true".
+func (d *deployer) resolveImage(ctx context.Context, resourceGroup, family string) (string, error) {
+	images, err := d.images.ListByResourceGroup(ctx, resourceGroup)
+	if err != nil {
+		return "", err
+	}
+
+	f := vmimage.Filter{Family: family, Tags: map[string]string{"valid": "true"}}
+	latest := vmimage.Latest(images, f, 1)
+	if len(latest) == 0 {
+		return "", fmt.Errorf("no valid %s image in resource group %s", family, resourceGroup)
+	}
+
+	return latest[0].Name, nil
+}
+
+// tagGroup creates the resource group of p, or updates its tags if it exists,
+// stamping it with the current time in the now tag so that the cluster is
+// eventually purged.  Other tags of an existing group are kept.
+func (d *deployer) tagGroup(ctx context.Context, p *clusterParameters) error {
+	group, err := d.groups.Get(ctx, p.ResourceGroup)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		group = &resources.Group{Location: to.StringPtr(p.Location)}
+	}
+	if group.Tags == nil {
+		group.Tags = map[string]*string{}
+	}
+	group.Tags[nowTag] = to.StringPtr(strconv.FormatInt(d.now().Unix(), 10))
+
+	return d.groups.CreateOrUpdate(ctx, p.ResourceGroup, resources.Group{Location: group.Location, Tags: group.Tags})
+}
+
+// up renders the cluster definition template tmpl with p, generates the ARM
+// template of the cluster and deploys it to the resource group of p, which is
+// created and tagged first so that even a failed deployment is purged.  If
+// p.Image is empty, the latest valid image of family is used.  The name of the
+// deployment is returned, whether or not it succeeded.
+func (d *deployer) up(ctx context.Context, tmpl []byte, p *clusterParameters, family string) (string, error) {
+	if p.Image == "" {
+		image, err := d.resolveImage(ctx, p.ImageResourceGroup, family)
+		if err != nil {
+			return "", err
+		}
+		p.Image = image
+	}
+	fmt.Fprintf(d.out, "using image %s/%s\n", p.ImageResourceGroup, p.Image)
+
+	definition, err := renderTemplate(tmpl, p)
+	if err != nil {
+		return "", err
+	}
+
+	template, parameters, err := d.generator.Generate(ctx, definition)
+	if err != nil {
+		return "", err
+	}
+
+	if err = d.tagGroup(ctx, p); err != nil {
+		return "", fmt.Errorf("resource group %s: %v", p.ResourceGroup, err)
+	}
+
+	start := d.now()
+	name := "azure-cluster-" + start.UTC().Format("20060102150405")
+	fmt.Fprintf(d.out, "deploying %s to resource group %s\n", name, p.ResourceGroup)
+
+	err = d.deployments.CreateOrUpdate(ctx, p.ResourceGroup, name, resources.Deployment{
+		Properties: &resources.DeploymentProperties{
+			Template:   template,
+			Parameters: parameters,
+			Mode:       resources.Incremental,
+		},
+	})
+	if err != nil {
+		return name, fmt.Errorf("deployment %s failed: %v", name, err)
+	}
+
+	fmt.Fprintf(d.out, "deployed %s in %s\n", name, d.now().Sub(start).Round(time.Second))
+	return name, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient/fake"
+)
+
+var testNow = time.Date(2018, 6, 14, 12, 0, 0, 0, time.UTC)
+
+const testTemplate = `{"properties": {"imageResourceGroup": "${CUSTOM_RG}", "imageName": "${IMAGE}", "dnsPrefix": "${RESOURCE_GROUP}"}}`
+
+func testDeployer(images []compute.Image) (*deployer, *fake.GroupsClient, *fakeDeploymentsClient, *fakeGenerator) {
+	gc := &fake.GroupsClient{}
+	dc := &fakeDeploymentsClient{}
+	g := &fakeGenerator{
+		template:   map[string]interface{}{"resources": []interface{}{}},
+		parameters: map[string]interface{}{"masterCount": map[string]interface{}{"value": 1}},
+	}
+
+	return &deployer{
+		images:      &fake.ImagesClient{Images: map[string][]compute.Image{"images": images}},
+		groups:      gc,
+		deployments: dc,
+		generator:   g,
+		now:         func() time.Time { return testNow },
+		out:         &bytes.Buffer{},
+	}, gc, dc, g
+}
+
+func TestRenderTemplate(t *testing.T) {
+	p := &clusterParameters{ResourceGroup: "test", Location: "eastus", Image: `odd"name`, ImageResourceGroup: "images"}
+
+	for _, tt := range []struct {
+		name    string
+		tmpl    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "variables",
+			tmpl: `{"a": "${RESOURCE_GROUP}-${LOCATION}", "b": "${IMAGE_RESOURCE_GROUP}/${CUSTOM_RG}"}`,
+			want: `{"a": "test-eastus", "b": "images/images"}`,
+		},
+		{
+			name: "unbraced variables",
+			tmpl: `{"a": "$RESOURCE_GROUP-$LOCATION", "b": "$IMAGE_RESOURCE_GROUP/$CUSTOM_RG", "c": "${RESOURCE_GROUP}x $LOCATION"}`,
+			want: `{"a": "test-eastus", "b": "images/images", "c": "testx eastus"}`,
+		},
+		{
+			name: "values are escaped",
+			tmpl: `{"image": "${IMAGE}"}`,
+			want: `{"image": "odd\"name"}`,
+		},
+		{
+			name:    "unknown variables",
+			tmpl:    `{"a": "${SSH_KEY}", "b": "$CLIENT_ID", "c": "${SSH_KEY}"}`,
+			wantErr: "template refers to unknown variables CLIENT_ID, SSH_KEY",
+		},
+		{
+			name:    "invalid JSON",
+			tmpl:    `{"a": ${RESOURCE_GROUP}}`,
+			wantErr: "rendered template is not valid JSON",
+		},
+	} {
+		got, err := renderTemplate([]byte(tt.tmpl), p)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUp(t *testing.T) {
+	images := []compute.Image{
+		image("centos7-3.10-201806140000", "valid", "true"),
+		image("centos7-3.10-201806141000"),
+		image("centos7-3.10-201806130000", "valid", "true"),
+		image("rhel7-3.10-201806150000", "valid", "true"),
+	}
+	// as with up.sh, the latest image is used wherever it is.
+	images[0].Location = to.StringPtr("westus")
+	d, gc, dc, g := testDeployer(images)
+
+	p := &clusterParameters{ResourceGroup: "test", Location: "eastus", ImageResourceGroup: "images"}
+	name, err := d.up(context.Background(), []byte(testTemplate), p, "centos7-3.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `{"properties": {"imageResourceGroup": "images", "imageName": "centos7-3.10-201806140000", "dnsPrefix": "test"}}`; string(g.definition) != want {
+		t.Errorf("got definition %s, want %s", g.definition, want)
+	}
+
+	wantGroup := resources.Group{
+		Name:     to.StringPtr("test"),
+		Location: to.StringPtr("eastus"),
+		Tags:     map[string]*string{"now": to.StringPtr(strconv.FormatInt(testNow.Unix(), 10))},
+	}
+	if got, _ := gc.Get(context.Background(), "test"); got == nil || !reflect.DeepEqual(*got, wantGroup) {
+		t.Errorf("got group %#v, want %#v", got, wantGroup)
+	}
+
+	if name != "azure-cluster-20180614120000" {
+		t.Errorf("got deployment name %q", name)
+	}
+	deployment, found := dc.deployments["test"][name]
+	if !found {
+		t.Fatalf("deployment %s not submitted", name)
+	}
+	if props := deployment.Properties; !reflect.DeepEqual(props.Template, g.template) || !reflect.DeepEqual(props.Parameters, g.parameters) || props.Mode != resources.Incremental {
+		t.Errorf("got deployment properties %#v", props)
+	}
+}
+
+func TestUpExistingGroup(t *testing.T) {
+	d, gc, _, _ := testDeployer(nil)
+	gc.Groups = []resources.Group{
+		{Name: to.StringPtr("test"), Location: to.StringPtr("westus"), Tags: map[string]*string{"now": to.StringPtr("1"), "persist": to.StringPtr("true")}},
+	}
+
+	p := &clusterParameters{ResourceGroup: "test", Location: "eastus", Image: "custom", ImageResourceGroup: "images"}
+	if _, err := d.up(context.Background(), []byte(testTemplate), p, "centos7-3.10"); err != nil {
+		t.Fatal(err)
+	}
+
+	wantGroup := resources.Group{
+		Name:     to.StringPtr("test"),
+		Location: to.StringPtr("westus"),
+		Tags:     map[string]*string{"now": to.StringPtr(strconv.FormatInt(testNow.Unix(), 10)), "persist": to.StringPtr("true")},
+	}
+	if got, _ := gc.Get(context.Background(), "test"); got == nil || !reflect.DeepEqual(*got, wantGroup) {
+		t.Errorf("got group %#v, want %#v", got, wantGroup)
+	}
+}
+
+func TestUpFailures(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		images    []compute.Image
+		genErr    error
+		deployErr error
+		wantErr   string
+		wantGroup bool
+	}{
+		{
+			name:    "no valid image",
+			images:  []compute.Image{image("centos7-3.10-201806140000")},
+			wantErr: "no valid centos7-3.10 image in resource group images",
+		},
+		{
+			name:    "generation fails",
+			images:  []compute.Image{image("centos7-3.10-201806140000", "valid", "true")},
+			genErr:  errors.New("bad cluster definition"),
+			wantErr: "bad cluster definition",
+		},
+		{
+			name:      "deployment fails",
+			images:    []compute.Image{image("centos7-3.10-201806140000", "valid", "true")},
+			deployErr: errors.New("quota exceeded"),
+			wantErr:   "deployment azure-cluster-20180614120000 failed: quota exceeded",
+			wantGroup: true,
+		},
+	} {
+		d, gc, dc, g := testDeployer(tt.images)
+		g.err = tt.genErr
+		dc.err = tt.deployErr
+
+		p := &clusterParameters{ResourceGroup: "test", Location: "eastus", ImageResourceGroup: "images"}
+		_, err := d.up(context.Background(), []byte(testTemplate), p, "centos7-3.10")
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if got, _ := gc.Get(context.Background(), "test"); (got != nil) != tt.wantGroup {
+			t.Errorf("%s: got group %v, want %v", tt.name, got != nil, tt.wantGroup)
+		}
+	}
+}
+
+func TestACSEngineGenerator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azure-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a stand-in for acs-engine which checks its arguments and writes a
+	// template and parameters.
+	script := filepath.Join(dir, "acs-engine")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+[ "$1 $2" = "generate --output-directory" ] && [ -f "$4" ] || exit 1
+echo '{"resources": []}' >"$3/azuredeploy.json"
+echo '{"contentVersion": "1.0.0.0", "parameters": {"masterCount": {"value": 1}}}' >"$3/azuredeploy.parameters.json"
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	g := &acsEngineGenerator{Command: script, OutputDir: filepath.Join(dir, "_output", "test"), Stdout: &out, Stderr: &out}
+	template, parameters, err := g.Generate(context.Background(), []byte(`{}`))
+	if err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+
+	if want := map[string]interface{}{"resources": []interface{}{}}; !reflect.DeepEqual(template, want) {
+		t.Errorf("got template %#v, want %#v", template, want)
+	}
+	if want := map[string]interface{}{"masterCount": map[string]interface{}{"value": float64(1)}}; !reflect.DeepEqual(parameters, want) {
+		t.Errorf("got parameters %#v, want %#v", parameters, want)
+	}
+
+	g.Command = filepath.Join(dir, "missing")
+	if _, _, err = g.Generate(context.Background(), []byte(`{}`)); err == nil || !strings.Contains(err.Error(), "missing generate") {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// fakeValidator is a validator which records the images it was asked to
+// validate, and fails with err.
+type fakeValidator struct {
+	validated []string
+	err       error
+}
+
+var _ validator = &fakeValidator{}
+
+func (v *fakeValidator) Validate(ctx context.Context, resourceGroup string, image compute.Image) error {
+	v.validated = append(v.validated, resourceGroup+"/"+*image.Name)
+	return v.err
+}
+
+// blobURI returns the URI of a blob in the public cloud.
+func blobURI(storageAccount, container, name string) string {
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", storageAccount, container, name)
+}
+
+// vhdImage returns a provisioned image in eastus whose OS and data disks are
+// the blobs with the given URIs, with the given tags, passed as key/value
+// pairs.
+func vhdImage(name, osDisk string, dataDisks []string, tags ...string) compute.Image {
+	var disks []compute.ImageDataDisk
+	for i, uri := range dataDisks {
+		disks = append(disks, compute.ImageDataDisk{Lun: to.Int32Ptr(int32(i)), BlobURI: to.StringPtr(uri)})
+	}
+
+	image := compute.Image{
+		ID:       to.StringPtr("/subscriptions/sub/resourceGroups/images/providers/Microsoft.Compute/images/" + name),
+		Name:     to.StringPtr(name),
+		Location: to.StringPtr("eastus"),
+		Tags:     map[string]*string{},
+		ImageProperties: &compute.ImageProperties{
+			StorageProfile: &compute.ImageStorageProfile{
+				OsDisk:    &compute.ImageOSDisk{OsType: compute.Linux, OsState: compute.Generalized, BlobURI: to.StringPtr(osDisk)},
+				DataDisks: &disks,
+			},
+			ProvisioningState: to.StringPtr("Succeeded"),
+		},
+	}
+	for i := 0; i < len(tags); i += 2 {
+		image.Tags[tags[i]] = to.StringPtr(tags[i+1])
+	}
+	return image
+}
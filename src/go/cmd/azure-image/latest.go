@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/vmimage"
+)
+
+// tagList is a flag.Value accumulating KEY=VALUE tags.
+type tagList map[string]string
+
+func (l tagList) String() string {
+	var tags []string
+	for k, v := range l {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ",")
+}
+
+func (l tagList) Set(s string) error {
+	p := strings.SplitN(s, "=", 2)
+	if len(p) != 2 || p[0] == "" {
+		return fmt.Errorf("invalid tag %q: must be of the form KEY=VALUE", s)
+	}
+	l[p[0]] = p[1]
+	return nil
+}
+
+// latestImages returns the n most recently built images matching f in
+// resourceGroup, or in the whole subscription if resourceGroup is empty,
+// newest first.  It is an error for no image to match.
+func latestImages(ctx context.Context, ic azureclient.ImagesClient, resourceGroup string, f vmimage.Filter, n int) ([]vmimage.Image, error) {
+	var images []compute.Image
+	var err error
+	if resourceGroup == "" {
+		images, err = ic.List(ctx)
+	} else {
+		images, err = ic.ListByResourceGroup(ctx, resourceGroup)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	latest := vmimage.Latest(images, f, n)
+	if len(latest) == 0 {
+		return nil, errors.New("no images match")
+	}
+
+	return latest, nil
+}
+
+// printImages writes images to w as an indented JSON array.
+func printImages(w io.Writer, images []vmimage.Image) error {
+	b, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient/fake"
+	"github.com/openshift/azure-misc/src/go/pkg/vmimage"
+)
+
+func TestLatestImages(t *testing.T) {
+	ic := &fake.ImagesClient{Images: map[string][]compute.Image{
+		"images": {
+			vhdImage("centos7-3.10-201806120000", "", nil, "valid", "true"),
+			vhdImage("centos7-3.10-201806130000", "", nil, "valid", "true"),
+			vhdImage("centos7-3.10-201806140000", "", nil),
+			vhdImage("centos7-3.9-201806150000", "", nil, "valid", "true"),
+		},
+		"other": {
+			vhdImage("centos7-3.10-201806160000", "", nil, "valid", "true"),
+		},
+	}}
+
+	for _, tt := range []struct {
+		name          string
+		resourceGroup string
+		filter        vmimage.Filter
+		n             int
+		want          []string
+		wantErr       bool
+	}{
+		{
+			name:          "latest valid image",
+			resourceGroup: "images",
+			filter:        vmimage.Filter{Family: "centos7-3.10", Tags: map[string]string{"valid": "true"}},
+			n:             1,
+			want:          []string{"centos7-3.10-201806130000"},
+		},
+		{
+			name:          "latest images",
+			resourceGroup: "images",
+			filter:        vmimage.Filter{Family: "centos7-3.10"},
+			n:             2,
+			want:          []string{"centos7-3.10-201806140000", "centos7-3.10-201806130000"},
+		},
+		{
+			name:   "whole subscription",
+			filter: vmimage.Filter{Family: "centos7-3.10", Tags: map[string]string{"valid": "true"}},
+			want:   []string{"centos7-3.10-201806160000", "centos7-3.10-201806130000", "centos7-3.10-201806120000"},
+		},
+		{
+			name:          "no match",
+			resourceGroup: "images",
+			filter:        vmimage.Filter{Location: "westus"},
+			wantErr:       true,
+		},
+	} {
+		images, err := latestImages(context.Background(), ic, tt.resourceGroup, tt.filter, tt.n)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+
+		var got []string
+		for _, image := range images {
+			got = append(got, image.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrintImages(t *testing.T) {
+	ic := &fake.ImagesClient{Images: map[string][]compute.Image{
+		"images": {vhdImage(testImage, "", nil, "valid", "true")},
+	}}
+	images, err := latestImages(context.Background(), ic, "images", vmimage.Filter{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := printImages(&out, images); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{{
+		"name":          testImage,
+		"id":            "/subscriptions/sub/resourceGroups/images/providers/Microsoft.Compute/images/" + testImage,
+		"resourceGroup": "images",
+		"location":      "eastus",
+		"family":        "centos7-3.10",
+		"built":         "2018-06-14T00:00:00Z",
+		"tags":          map[string]interface{}{"valid": "true"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTagList(t *testing.T) {
+	l := tagList{}
+	for _, v := range []string{"valid=true", "kind=centos", "empty="} {
+		if err := l.Set(v); err != nil {
+			t.Errorf("%s: unexpected error %v", v, err)
+		}
+	}
+	if got, want := l.String(), "empty=,kind=centos,valid=true"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, v := range []string{"valid", "=true"} {
+		if err := l.Set(v); err == nil {
+			t.Errorf("%s: unexpected success", v)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+	"github.com/openshift/azure-misc/src/go/pkg/vmimage"
+)
+
+// runPromote validates, tags and replicates an image.
+func runPromote(args []string) error {
+	var targets targetList
+
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	resourceGroup := fs.String("resource-group", "images", "resource group of the image")
+	storageResourceGroup := fs.String("storage-resource-group", "", "resource group of the storage accounts holding the image's VHDs (default: that of the image)")
+	validate := fs.String("validate", "", "shell command which validates the image, exiting zero if it is valid")
+	fs.Var(&targets, "to", "replicate the image to RESOURCEGROUP/ACCOUNT, copying its VHDs to the storage account (repeatable)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: azure-image promote [flags] IMAGE")
+	}
+	if *storageResourceGroup == "" {
+		*storageResourceGroup = *resourceGroup
+	}
+
+	env, err := azureutil.Environment()
+	if err != nil {
+		return err
+	}
+
+	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	subscriptionID := os.Getenv("AZURE_SUBSCRIPTION_ID")
+	p := &promoter{
+		images:  azureclient.NewImagesClient(env, subscriptionID, authorizer),
+		storage: azureclient.NewStorageClient(env, subscriptionID, authorizer),
+		now:     time.Now,
+		out:     os.Stdout,
+	}
+	if *validate != "" {
+		p.validate = &commandValidator{Command: *validate, Stdout: os.Stdout, Stderr: os.Stderr}
+	}
+
+	return p.promote(azureutil.SignalContext(), *resourceGroup, fs.Arg(0), *storageResourceGroup, targets)
+}
+
+// runLatestImage prints the latest images matching the given filters as JSON.
+func runLatestImage(args []string) error {
+	tags := tagList{}
+
+	fs := flag.NewFlagSet("latest-image", flag.ExitOnError)
+	resourceGroup := fs.String("resource-group", "images", "resource group of the images (empty: the whole subscription)")
+	family := fs.String("family", "", "image family, e.g. centos7-3.10")
+	version := fs.String("version", "", "image version, if the name pattern has a version group")
+	namePattern := fs.String("name-pattern", vmimage.DefaultPattern, "image name pattern, with named groups family, timestamp and version")
+	timestampLayout := fs.String("timestamp-layout", vmimage.TimestampLayout, "layout of the timestamp in image names, as in Go's time.Parse")
+	location := fs.String("location", "", "image location")
+	valid := fs.Bool("valid", true, `only select images tagged "valid: true"`)
+	n := fs.Int("n", 1, "number of images to print (0: all)")
+	fs.Var(tags, "tag", "only select images with tag KEY=VALUE (repeatable)")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: azure-image latest-image [flags]")
+	}
+	if *valid {
+		tags["valid"] = "true"
+	}
+
+	scheme, err := vmimage.NewScheme(*namePattern, *timestampLayout)
+	if err != nil {
+		return err
+	}
+
+	env, err := azureutil.Environment()
+	if err != nil {
+		return err
+	}
+
+	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	ic := azureclient.NewImagesClient(env, os.Getenv("AZURE_SUBSCRIPTION_ID"), authorizer)
+	f := vmimage.Filter{Scheme: scheme, Family: *family, Version: *version, Location: *location, Tags: tags}
+
+	images, err := latestImages(azureutil.SignalContext(), ic, *resourceGroup, f, *n)
+	if err != nil {
+		return err
+	}
+
+	return printImages(os.Stdout, images)
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `usage: %s command [flags]
+
+Commands:
+  promote [-resource-group RG] [-storage-resource-group RG] [-validate CMD] [-to RG/ACCOUNT]... IMAGE
+	run the validation command, if any, against IMAGE, tag it "valid: true",
+	and recreate it from copies of its VHDs in each target resource group
+  latest-image [-resource-group RG] [-family FAMILY] [-version VERSION] [-location LOCATION] [-valid=false] [-tag KEY=VALUE]... [-n N]
+      [-name-pattern REGEXP] [-timestamp-layout LAYOUT]
+	print the N most recently built images matching the filters as a JSON
+	array, newest first.  Image names are matched against the regular
+	expression -name-pattern: its named group timestamp gives an image's
+	build time, parsed in UTC using -timestamp-layout (as in Go's
+	time.Parse), and its optional groups family and version give the family
+	and version selected by -family and -version.  By default images are
+	named FAMILY-YYYYMMDDHHMM, with no version
+
+The subscription and credentials are taken from the usual AZURE_* environment
+variables.
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	var err error
+	switch flag.Arg(0) {
+	case "promote":
+		err = runPromote(flag.Args()[1:])
+	case "latest-image":
+		err = runLatestImage(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+)
+
+// sasLifetime is how long the blobs of an image being replicated may be read
+// by the destination storage account.
+const sasLifetime = 24 * time.Hour
+
+// validator checks that an image is fit to be promoted.
+type validator interface {
+	Validate(ctx context.Context, resourceGroup string, image compute.Image) error
+}
+
+// commandValidator validates an image by running Command with the shell.  The
+// image is valid if the command exits zero.  The image's name, resource group,
+// ID and location are passed in the IMAGE_NAME, IMAGE_RESOURCE_GROUP, IMAGE_ID
+// and IMAGE_LOCATION environment variables.
+type commandValidator struct {
+	Command string
+	Stdout  io.Writer
+	Stderr  io.Writer
+}
+
+var _ validator = &commandValidator{}
+
+func (v *commandValidator) Validate(ctx context.Context, resourceGroup string, image compute.Image) error {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", v.Command)
+	cmd.Env = append(os.Environ(),
+		"IMAGE_NAME="+to.String(image.Name),
+		"IMAGE_RESOURCE_GROUP="+resourceGroup,
+		"IMAGE_ID="+to.String(image.ID),
+		"IMAGE_LOCATION="+to.String(image.Location),
+	)
+	cmd.Stdout, cmd.Stderr = v.Stdout, v.Stderr
+
+	return cmd.Run()
+}
+
+// target is a resource group to which an image is replicated, and the storage
+// account in it to which the image's VHDs are copied.  The replica is created
+// in the location of the storage account.
+type target struct {
+	resourceGroup  string
+	storageAccount string
+}
+
+func (t target) String() string {
+	return t.resourceGroup + "/" + t.storageAccount
+}
+
+// targetList is a flag.Value collecting RESOURCEGROUP/ACCOUNT targets.
+type targetList []target
+
+func (l *targetList) String() string {
+	s := make([]string, 0, len(*l))
+	for _, t := range *l {
+		s = append(s, t.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *targetList) Set(v string) error {
+	parts := strings.Split(v, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid target %q: expected RESOURCEGROUP/ACCOUNT", v)
+	}
+	*l = append(*l, target{resourceGroup: parts[0], storageAccount: parts[1]})
+	return nil
+}
+
+// promoter validates images, tags them valid and replicates them.  If validate
+// is nil, images are promoted without validation.
+type promoter struct {
+	images   azureclient.ImagesClient
+	storage  azureclient.StorageClient
+	validate validator
+
+	now func() time.Time
+	out io.Writer
+}
+
+// promote validates the named image in resourceGroup and tags it "valid:
+// true", then copies its VHDs to each of targets and recreates it there.  The
+// VHDs of the image are in storage accounts in storageResourceGroup.  The
+// image is tagged before it is replicated, so a failed replication can simply
+// be retried.
+func (p *promoter) promote(ctx context.Context, resourceGroup, name, storageResourceGroup string, targets []target) error {
+	image, err := p.images.Get(ctx, resourceGroup, name)
+	if err != nil {
+		return err
+	}
+	if image.ImageProperties == nil || to.String(image.ProvisioningState) != "Succeeded" {
+		return fmt.Errorf("image %s has not been provisioned", name)
+	}
+
+	if p.validate != nil {
+		fmt.Fprintf(p.out, "validating image %s\n", name)
+		if err = p.validate.Validate(ctx, resourceGroup, image); err != nil {
+			return fmt.Errorf("image %s failed validation: %v", name, err)
+		}
+	}
+
+	if v := image.Tags["valid"]; v == nil || *v != "true" {
+		if image.Tags == nil {
+			image.Tags = map[string]*string{}
+		}
+		image.Tags["valid"] = to.StringPtr("true")
+		if err = p.images.CreateOrUpdate(ctx, resourceGroup, name, image); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(p.out, "tagged image %s valid\n", name)
+
+	for _, t := range targets {
+		if err = p.replicate(ctx, image, storageResourceGroup, t); err != nil {
+			return fmt.Errorf("replicating image %s to %s: %v", name, t, err)
+		}
+		fmt.Fprintf(p.out, "replicated image %s to %s\n", name, t)
+	}
+
+	return nil
+}
+
+// replicate copies the VHDs of image to the storage account of t, keeping
+// their container and blob names, and creates an image of the same name and
+// tags from the copies in the resource group of t.
+func (p *promoter) replicate(ctx context.Context, image compute.Image, storageResourceGroup string, t target) error {
+	if image.StorageProfile == nil || image.StorageProfile.OsDisk == nil || image.StorageProfile.OsDisk.BlobURI == nil {
+		return fmt.Errorf("image is not built from VHDs")
+	}
+
+	location, err := p.storage.GetLocation(ctx, t.resourceGroup, t.storageAccount)
+	if err != nil {
+		return err
+	}
+
+	dst, err := p.storage.GetBlobsClient(ctx, t.resourceGroup, t.storageAccount)
+	if err != nil {
+		return err
+	}
+
+	sources := map[string]azureclient.BlobsClient{}
+	copyVHD := func(uri string) (string, error) {
+		account, container, name, err := azureutil.ParseBlobURI(uri)
+		if err != nil {
+			return "", err
+		}
+
+		src := sources[account]
+		if src == nil {
+			if src, err = p.storage.GetBlobsClient(ctx, storageResourceGroup, account); err != nil {
+				return "", err
+			}
+			sources[account] = src
+		}
+
+		sas, err := src.GetSASURI(container, name, p.now().Add(sasLifetime))
+		if err != nil {
+			return "", err
+		}
+		if err = dst.Copy(ctx, container, name, sas); err != nil {
+			return "", err
+		}
+
+		return dst.GetURI(container, name), nil
+	}
+
+	osDisk := *image.StorageProfile.OsDisk
+	uri, err := copyVHD(*osDisk.BlobURI)
+	if err != nil {
+		return err
+	}
+	osDisk.BlobURI = &uri
+
+	var dataDisks []compute.ImageDataDisk
+	if image.StorageProfile.DataDisks != nil {
+		for _, d := range *image.StorageProfile.DataDisks {
+			if d.BlobURI == nil {
+				return fmt.Errorf("data disk %d is not a VHD", to.Int32(d.Lun))
+			}
+			uri, err := copyVHD(*d.BlobURI)
+			if err != nil {
+				return err
+			}
+			d.BlobURI = &uri
+			dataDisks = append(dataDisks, d)
+		}
+	}
+
+	return p.images.CreateOrUpdate(ctx, t.resourceGroup, *image.Name, compute.Image{
+		Location: &location,
+		Tags:     image.Tags,
+		ImageProperties: &compute.ImageProperties{
+			StorageProfile: &compute.ImageStorageProfile{OsDisk: &osDisk, DataDisks: &dataDisks},
+		},
+	})
+}
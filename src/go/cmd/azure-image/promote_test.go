@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient/fake"
+)
+
+var testNow = time.Date(2018, 6, 14, 12, 0, 0, 0, time.UTC)
+
+const testImage = "centos7-3.10-201806140000"
+
+// testPromoter returns a promoter with the given image in the images resource
+// group, whose VHDs are in the openshiftimages storage account, and empty
+// storage accounts eastus2images and westusimages in the resource groups
+// images-eastus2 and images-westus.
+func testPromoter(image compute.Image, v validator) (*promoter, *fake.ImagesClient, *fake.StorageClient) {
+	ic := &fake.ImagesClient{Images: map[string][]compute.Image{"images": {image}}}
+
+	sc := &fake.StorageClient{}
+	src := sc.AddAccount("images", "openshiftimages", "eastus")
+	src.Blobs["images/"+testImage+".vhd"] = []byte("os")
+	src.Blobs["images/"+testImage+"-data.vhd"] = []byte("data")
+	sc.AddAccount("images-eastus2", "eastus2images", "eastus2")
+	sc.AddAccount("images-westus", "westusimages", "westus")
+
+	return &promoter{
+		images:   ic,
+		storage:  sc,
+		validate: v,
+		now:      func() time.Time { return testNow },
+		out:      &bytes.Buffer{},
+	}, ic, sc
+}
+
+func TestPromote(t *testing.T) {
+	osDisk := blobURI("openshiftimages", "images", testImage+".vhd")
+	dataDisk := blobURI("openshiftimages", "images", testImage+"-data.vhd")
+
+	v := &fakeValidator{}
+	p, ic, sc := testPromoter(vhdImage(testImage, osDisk, []string{dataDisk}, "kind", "centos"), v)
+
+	targets := []target{{resourceGroup: "images-eastus2", storageAccount: "eastus2images"}, {resourceGroup: "images-westus", storageAccount: "westusimages"}}
+	if err := p.promote(context.Background(), "images", testImage, "images", targets); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"images/" + testImage}; !reflect.DeepEqual(v.validated, want) {
+		t.Errorf("got validated %v, want %v", v.validated, want)
+	}
+
+	wantTags := map[string]*string{"kind": to.StringPtr("centos"), "valid": to.StringPtr("true")}
+	source, err := ic.Get(context.Background(), "images", testImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := source.Tags; !reflect.DeepEqual(got, wantTags) {
+		t.Errorf("got source tags %v, want %v", got, wantTags)
+	}
+
+	for _, tt := range []struct {
+		resourceGroup  string
+		storageAccount string
+		location       string
+	}{
+		{resourceGroup: "images-eastus2", storageAccount: "eastus2images", location: "eastus2"},
+		{resourceGroup: "images-westus", storageAccount: "westusimages", location: "westus"},
+	} {
+		image, err := ic.Get(context.Background(), tt.resourceGroup, testImage)
+		if err != nil {
+			t.Errorf("%s: image not replicated", tt.resourceGroup)
+			continue
+		}
+		if to.String(image.Location) != tt.location {
+			t.Errorf("%s: got location %s, want %s", tt.resourceGroup, to.String(image.Location), tt.location)
+		}
+		if !reflect.DeepEqual(image.Tags, wantTags) {
+			t.Errorf("%s: got tags %v, want %v", tt.resourceGroup, image.Tags, wantTags)
+		}
+
+		sp := image.StorageProfile
+		if got, want := to.String(sp.OsDisk.BlobURI), blobURI(tt.storageAccount, "images", testImage+".vhd"); got != want {
+			t.Errorf("%s: got OS disk %s, want %s", tt.resourceGroup, got, want)
+		}
+		if sp.OsDisk.OsType != compute.Linux || sp.OsDisk.OsState != compute.Generalized {
+			t.Errorf("%s: OS disk properties not copied: %#v", tt.resourceGroup, sp.OsDisk)
+		}
+		if len(*sp.DataDisks) != 1 || to.String((*sp.DataDisks)[0].BlobURI) != blobURI(tt.storageAccount, "images", testImage+"-data.vhd") {
+			t.Errorf("%s: got data disks %#v", tt.resourceGroup, *sp.DataDisks)
+		}
+
+		if got, want := sc.Accounts[tt.storageAccount].Names("images"), []string{testImage + "-data.vhd", testImage + ".vhd"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got blobs %v, want %v", tt.storageAccount, got, want)
+		}
+	}
+
+	want := `validating image ` + testImage + `
+tagged image ` + testImage + ` valid
+replicated image ` + testImage + ` to images-eastus2/eastus2images
+replicated image ` + testImage + ` to images-westus/westusimages
+`
+	if got := p.out.(*bytes.Buffer).String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestPromoteFailures(t *testing.T) {
+	osDisk := blobURI("openshiftimages", "images", testImage+".vhd")
+
+	managed := vhdImage(testImage, osDisk, nil)
+	managed.StorageProfile.OsDisk.BlobURI = nil
+	managed.StorageProfile.OsDisk.ManagedDisk = &compute.SubResource{ID: to.StringPtr("/subscriptions/sub/resourceGroups/images/providers/Microsoft.Compute/disks/source")}
+
+	provisioning := vhdImage(testImage, osDisk, nil)
+	provisioning.ProvisioningState = to.StringPtr("Creating")
+
+	for _, tt := range []struct {
+		name       string
+		image      compute.Image
+		validator  validator
+		targets    []target
+		wantErr    string
+		wantTagged bool
+	}{
+		{
+			name:      "invalid images are not tagged",
+			image:     vhdImage(testImage, osDisk, nil),
+			validator: &fakeValidator{err: errors.New("exit status 1")},
+			wantErr:   "image " + testImage + " failed validation: exit status 1",
+		},
+		{
+			name:    "images are not promoted until provisioned",
+			image:   provisioning,
+			wantErr: "image " + testImage + " has not been provisioned",
+		},
+		{
+			name:       "images not built from VHDs cannot be replicated",
+			image:      managed,
+			targets:    []target{{resourceGroup: "images-westus", storageAccount: "westusimages"}},
+			wantErr:    "replicating image " + testImage + " to images-westus/westusimages: image is not built from VHDs",
+			wantTagged: true,
+		},
+		{
+			name:       "unknown target storage account",
+			image:      vhdImage(testImage, osDisk, nil),
+			targets:    []target{{resourceGroup: "images-westus", storageAccount: "eastus2images"}},
+			wantErr:    "storage account images-westus/eastus2images not found",
+			wantTagged: true,
+		},
+		{
+			name:       "missing VHD",
+			image:      vhdImage(testImage, blobURI("openshiftimages", "images", "missing.vhd"), nil),
+			targets:    []target{{resourceGroup: "images-westus", storageAccount: "westusimages"}},
+			wantErr:    "blob " + blobURI("openshiftimages", "images", "missing.vhd") + " not found",
+			wantTagged: true,
+		},
+	} {
+		p, ic, _ := testPromoter(tt.image, tt.validator)
+
+		err := p.promote(context.Background(), "images", testImage, "images", tt.targets)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+		}
+
+		image, _ := ic.Get(context.Background(), "images", testImage)
+		v := image.Tags["valid"]
+		if tagged := v != nil && *v == "true"; tagged != tt.wantTagged {
+			t.Errorf("%s: got tagged %v, want %v", tt.name, tagged, tt.wantTagged)
+		}
+		if len(ic.Images) != 1 {
+			t.Errorf("%s: image replicated to %v", tt.name, ic.Images)
+		}
+	}
+}
+
+func TestPromoteValidImage(t *testing.T) {
+	p, ic, _ := testPromoter(vhdImage(testImage, blobURI("openshiftimages", "images", testImage+".vhd"), nil, "valid", "true"), nil)
+
+	if err := p.promote(context.Background(), "images", testImage, "images", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ic.Updates != 0 {
+		t.Errorf("valid image was updated %d times", ic.Updates)
+	}
+}
+
+func TestCommandValidator(t *testing.T) {
+	image := vhdImage(testImage, blobURI("openshiftimages", "images", testImage+".vhd"), nil)
+
+	for _, tt := range []struct {
+		command string
+		wantErr bool
+	}{
+		{command: `test "$IMAGE_NAME" = ` + testImage + ` && test "$IMAGE_RESOURCE_GROUP" = images && test "$IMAGE_LOCATION" = eastus && test "$IMAGE_ID" = ` + *image.ID},
+		{command: "exit 1", wantErr: true},
+	} {
+		var out bytes.Buffer
+		v := &commandValidator{Command: tt.command, Stdout: &out, Stderr: &out}
+		err := v.Validate(context.Background(), "images", image)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, output %q", tt.command, err, out.String())
+		}
+	}
+}
+
+func TestTargetList(t *testing.T) {
+	var l targetList
+	for _, v := range []string{"images-westus/westusimages", "rg/account"} {
+		if err := l.Set(v); err != nil {
+			t.Errorf("%s: unexpected error %v", v, err)
+		}
+	}
+	if got, want := l.String(), "images-westus/westusimages,rg/account"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, v := range []string{"westusimages", "rg/", "/account", "a/b/c"} {
+		if err := l.Set(v); err == nil {
+			t.Errorf("%s: unexpected success", v)
+		}
+	}
+}
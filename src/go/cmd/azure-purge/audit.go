@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+
+	azstorage "github.com/Azure/azure-sdk-for-go/storage"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	defaultAuditTable = "azurepurgeaudit"
+
+	// auditPartitionLayout is the layout of the partition keys of the audit
+	// table: records are partitioned by UTC day, so that queries by time only
+	// scan the days concerned.
+	auditPartitionLayout = "2006-01-02"
+
+	resultStarted      = "started"
+	resultDeleted      = "deleted"
+	resultQuarantined  = "quarantined"
+	resultRestored     = "restored"
+	resultMarked       = "marked"
+	resultUnmarked     = "unmarked"
+	resultFailed       = "failed"
+	resultNotAttempted = "not attempted"
+	resultKept         = "kept"
+	resultMissing      = "missing"
+)
+
+// auditRecord is an entry in the audit log: an action taken by a purge run,
+// and its outcome.  An action which is carried out has two records: one with
+// the result "started", written first, and one with its outcome.  Tags holds
+// the tags of the resource when it was selected.
+type auditRecord struct {
+	Time         time.Time         `json:"time"`
+	RunID        string            `json:"runId"`
+	Operator     string            `json:"operator"`
+	Subscription string            `json:"subscription"`
+	ResourceID   string            `json:"resourceId"`
+	Kind         string            `json:"kind"`
+	Name         string            `json:"name"`
+	Rule         string            `json:"rule"`
+	Action       string            `json:"action"`
+	Reason       string            `json:"reason"`
+	Result       string            `json:"result"`
+	Error        string            `json:"error,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+// auditQuery selects the audit records written at or after From and before To,
+// about resources named Name.  Empty fields select every record.
+type auditQuery struct {
+	From time.Time
+	To   time.Time
+	Name string
+}
+
+// auditLog writes the audit records of a single run, identified by runID, on
+// behalf of operator.  A nil *auditLog records nothing.
+type auditLog struct {
+	client   auditClient
+	runID    string
+	operator string
+}
+
+// newAuditLog returns an auditLog for a new run.
+func newAuditLog(client auditClient, operator string) (*auditLog, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{client: client, runID: id.String(), operator: operator}, nil
+}
+
+// getOperator returns the identity recorded in the audit log: the service
+// principal AZURE_CLIENT_ID if set, and otherwise the local user.
+func getOperator() string {
+	if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+		return id
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// resourceProviders holds the resource provider and type of each kind of
+// resource deleted by name.
+var resourceProviders = map[string]string{
+	kindImage:    "Microsoft.Compute/images",
+	kindDisk:     "Microsoft.Compute/disks",
+	kindSnapshot: "Microsoft.Compute/snapshots",
+	kindNIC:      "Microsoft.Network/networkInterfaces",
+	kindPublicIP: "Microsoft.Network/publicIPAddresses",
+}
+
+// resourceID returns the ID of the resource of a in the given subscription.
+// Blobs have no resource ID, so one is made up from that of their container.
+func (a *action) resourceID(subscription string) string {
+	group := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", subscription, a.ResourceGroup)
+
+	switch a.Kind {
+	case kindGroup:
+		return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", subscription, a.Name)
+	case kindBlob:
+		return fmt.Sprintf("%s/providers/Microsoft.Storage/storageAccounts/%s/blobServices/default/containers/%s/blobs/%s", group, a.StorageAccount, a.Container, a.Name)
+	case kindResource:
+		return a.ID
+	}
+
+	return fmt.Sprintf("%s/providers/%s/%s", group, resourceProviders[a.Kind], a.Name)
+}
+
+// recordTags records the tags of the resource of a for the audit log.
+func (p *purger) recordTags(a *action, tags map[string]*string) {
+	if len(tags) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.tags == nil {
+		p.tags = map[string]map[string]string{}
+	}
+	m := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if v != nil {
+			m[k] = *v
+		}
+	}
+	p.tags[a.key()] = m
+}
+
+// newRecord returns an audit record of a, with the given result.
+func (p *purger) newRecord(a *action, result string) auditRecord {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return auditRecord{
+		Time:         time.Now().UTC().Truncate(time.Second),
+		RunID:        p.auditLog.runID,
+		Operator:     p.auditLog.operator,
+		Subscription: p.subscription,
+		ResourceID:   a.resourceID(p.subscription),
+		Kind:         a.Kind,
+		Name:         a.Name,
+		Rule:         a.Rule,
+		Action:       a.Action,
+		Reason:       a.Reason,
+		Result:       result,
+		Tags:         p.tags[a.key()],
+	}
+}
+
+// auditStart records that a is about to be carried out.  Nothing is carried
+// out which could not be recorded, so an error is returned if the record
+// cannot be written.
+func (p *purger) auditStart(ctx context.Context, a *action) error {
+	if p.auditLog == nil {
+		return nil
+	}
+
+	if err := p.auditLog.client.Insert(ctx, []auditRecord{p.newRecord(a, resultStarted)}); err != nil {
+		return fmt.Errorf("writing audit log: %v", err)
+	}
+
+	return nil
+}
+
+// auditResult records the outcome of an action as soon as it is known, so
+// that the audit log is complete up to the point at which a run is killed.  The
+// first error writing a record is kept, to be returned by audit.
+func (p *purger) auditResult(ctx context.Context, r result) {
+	if p.auditLog == nil {
+		return
+	}
+
+	rec := p.newRecord(&r.action, "")
+	switch {
+	case r.attempts == 0:
+		rec.Result = resultNotAttempted
+		rec.Error = r.err.Error()
+	case r.err != nil:
+		rec.Result = resultFailed
+		rec.Error = r.err.Error()
+	case r.Action == actionQuarantine:
+		rec.Result = resultQuarantined
+	case r.Action == actionRestore:
+		rec.Result = resultRestored
+	case r.Action == actionMark:
+		rec.Result = resultMarked
+	case r.Action == actionUnmark:
+		rec.Result = resultUnmarked
+	default:
+		rec.Result = resultDeleted
+	}
+
+	if err := p.auditLog.client.Insert(ctx, []auditRecord{rec}); err != nil {
+		p.mu.Lock()
+		if p.auditErr == nil {
+			p.auditErr = fmt.Errorf("writing audit log: %v", err)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// audit appends a record of each of actions which was not executed to the
+// audit log: those kept or missing, and those never reached because ctx was
+// done.  Actions which were executed were recorded as they were carried out,
+// and any error doing so is returned.  Nothing is recorded on a dry run.
+func (p *purger) audit(ctx context.Context, actions []action) error {
+	if p.auditLog == nil || p.dryRun || len(actions) == 0 {
+		return nil
+	}
+
+	recorded := map[string]struct{}{}
+	for _, r := range p.sortedResults() {
+		recorded[r.key()] = struct{}{}
+	}
+
+	records := make([]auditRecord, 0, len(actions))
+	for i := range actions {
+		a := &actions[i]
+		if _, found := recorded[a.key()]; found {
+			continue
+		}
+
+		rec := p.newRecord(a, "")
+		switch a.Action {
+		case actionDelete, actionQuarantine, actionRestore, actionMark, actionUnmark:
+			rec.Result = resultNotAttempted
+		case actionKeep:
+			rec.Result = resultKept
+		case actionMissing:
+			rec.Result = resultMissing
+		}
+
+		records = append(records, rec)
+	}
+
+	var err error
+	if len(records) > 0 {
+		if err = p.auditLog.client.Insert(ctx, records); err != nil {
+			err = fmt.Errorf("writing audit log: %v", err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.auditErr != nil {
+		return p.auditErr
+	}
+	return err
+}
+
+// filter returns the OData filter of the table query selecting q.
+func (q auditQuery) filter() string {
+	var clauses []string
+	if !q.From.IsZero() {
+		from := q.From.UTC()
+		clauses = append(clauses,
+			fmt.Sprintf("PartitionKey ge '%s'", from.Format(auditPartitionLayout)),
+			fmt.Sprintf("Time ge datetime'%s'", from.Format(time.RFC3339)))
+	}
+	if !q.To.IsZero() {
+		to := q.To.UTC()
+		clauses = append(clauses,
+			fmt.Sprintf("PartitionKey le '%s'", to.Format(auditPartitionLayout)),
+			fmt.Sprintf("Time lt datetime'%s'", to.Format(time.RFC3339)))
+	}
+	if q.Name != "" {
+		clauses = append(clauses, fmt.Sprintf("Name eq '%s'", strings.Replace(q.Name, "'", "''", -1)))
+	}
+
+	return strings.Join(clauses, " and ")
+}
+
+// auditEntity converts rec to an entity of table t.  Entities are keyed by the
+// day and time of the record, followed by a random suffix, so that they sort
+// chronologically and are never overwritten.
+func auditEntity(t *azstorage.Table, rec auditRecord) (*azstorage.Entity, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	e := t.GetEntityReference(rec.Time.UTC().Format(auditPartitionLayout), rec.Time.UTC().Format("20060102T150405Z")+"-"+id.String())
+	e.Properties = map[string]interface{}{
+		"Time":         rec.Time.UTC(),
+		"RunID":        rec.RunID,
+		"Operator":     rec.Operator,
+		"Subscription": rec.Subscription,
+		"ResourceID":   rec.ResourceID,
+		"Kind":         rec.Kind,
+		"Name":         rec.Name,
+		"Rule":         rec.Rule,
+		"Action":       rec.Action,
+		"Reason":       rec.Reason,
+		"Result":       rec.Result,
+	}
+	if rec.Error != "" {
+		e.Properties["Error"] = rec.Error
+	}
+	if len(rec.Tags) > 0 {
+		b, err := json.Marshal(rec.Tags)
+		if err != nil {
+			return nil, err
+		}
+		e.Properties["Tags"] = string(b)
+	}
+
+	return e, nil
+}
+
+// auditRecordFromEntity converts an entity written by auditEntity back to a
+// record.
+func auditRecordFromEntity(e *azstorage.Entity) (auditRecord, error) {
+	str := func(key string) string {
+		s, _ := e.Properties[key].(string)
+		return s
+	}
+
+	rec := auditRecord{
+		RunID:        str("RunID"),
+		Operator:     str("Operator"),
+		Subscription: str("Subscription"),
+		ResourceID:   str("ResourceID"),
+		Kind:         str("Kind"),
+		Name:         str("Name"),
+		Rule:         str("Rule"),
+		Action:       str("Action"),
+		Reason:       str("Reason"),
+		Result:       str("Result"),
+		Error:        str("Error"),
+	}
+	// Time is a string unless the entity was read with metadata
+	switch t := e.Properties["Time"].(type) {
+	case time.Time:
+		rec.Time = t
+	case string:
+		var err error
+		if rec.Time, err = time.Parse(time.RFC3339Nano, t); err != nil {
+			return auditRecord{}, fmt.Errorf("entity %s/%s: invalid time: %v", e.PartitionKey, e.RowKey, err)
+		}
+	}
+
+	if tags := str("Tags"); tags != "" {
+		if err := json.Unmarshal([]byte(tags), &rec.Tags); err != nil {
+			return auditRecord{}, fmt.Errorf("entity %s/%s: invalid tags: %v", e.PartitionKey, e.RowKey, err)
+		}
+	}
+
+	return rec, nil
+}
+
+// printAuditRecords writes records to w as a JSON array.
+func printAuditRecords(w io.Writer, records []auditRecord) error {
+	if records == nil {
+		records = []auditRecord{}
+	}
+
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// sortAuditRecords sorts records by time, and records of the same time by
+// run and resource ID.
+func sortAuditRecords(records []auditRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		switch {
+		case !records[i].Time.Equal(records[j].Time):
+			return records[i].Time.Before(records[j].Time)
+		case records[i].RunID != records[j].RunID:
+			return records[i].RunID < records[j].RunID
+		default:
+			return records[i].ResourceID < records[j].ResourceID
+		}
+	})
+}
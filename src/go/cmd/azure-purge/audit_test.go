@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	azstorage "github.com/Azure/azure-sdk-for-go/storage"
+)
+
+func TestAudit(t *testing.T) {
+	images := []compute.Image{image("centos7-3.10-"+ts(7*time.Hour), "valid", "false", "owner", "ci")}
+	groups := []resources.Group{group("new", "now", unix(time.Hour)), group("old", "now", unix(73*time.Hour))}
+
+	for _, dryRun := range []bool{false, true} {
+		p, _, _, gc := testPurger(images, nil, groups)
+		p.subscription = "sub"
+		p.dryRun = dryRun
+		gc.Failures = map[string][]error{"old": {errors.New("boom")}}
+
+		ac := &fakeAuditClient{}
+		p.auditLog = &auditLog{client: ac, runID: "run", operator: "operator"}
+
+		pol := &policy{Images: defaultPolicy().Images, Groups: defaultPolicy().Groups}
+		err := p.run(context.Background(), pol)
+		if dryRun {
+			if err != nil {
+				t.Fatalf("dry run: unexpected error %v", err)
+			}
+			if len(ac.records) != 0 {
+				t.Errorf("dry run: got %d audit records, want none", len(ac.records))
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+
+		// records of executed actions are written as they are carried out,
+		// and the rest afterwards, so only the order of the records of each
+		// resource is known.
+		records, _ := ac.Query(context.Background(), auditQuery{})
+		sort.SliceStable(records, func(i, j int) bool { return records[i].ResourceID < records[j].ResourceID })
+		for i := range records {
+			if records[i].Time.IsZero() {
+				t.Errorf("%s: no time", records[i].Name)
+			}
+			records[i].Time = time.Time{}
+		}
+
+		want := []auditRecord{
+			{RunID: "run", Operator: "operator", Subscription: "sub", ResourceID: "/subscriptions/sub/resourceGroups/images/providers/Microsoft.Compute/images/centos7-3.10-" + ts(7*time.Hour), Kind: kindImage, Name: "centos7-3.10-" + ts(7*time.Hour), Rule: "default", Action: actionDelete, Reason: "not valid after build timeout", Result: resultStarted, Tags: map[string]string{"valid": "false", "owner": "ci"}},
+			{RunID: "run", Operator: "operator", Subscription: "sub", ResourceID: "/subscriptions/sub/resourceGroups/images/providers/Microsoft.Compute/images/centos7-3.10-" + ts(7*time.Hour), Kind: kindImage, Name: "centos7-3.10-" + ts(7*time.Hour), Rule: "default", Action: actionDelete, Reason: "not valid after build timeout", Result: resultDeleted, Tags: map[string]string{"valid": "false", "owner": "ci"}},
+			{RunID: "run", Operator: "operator", Subscription: "sub", ResourceID: "/subscriptions/sub/resourceGroups/new", Kind: kindGroup, Name: "new", Rule: "default", Action: actionKeep, Reason: "timeout not expired", Result: resultKept, Tags: map[string]string{"now": unix(time.Hour)}},
+			{RunID: "run", Operator: "operator", Subscription: "sub", ResourceID: "/subscriptions/sub/resourceGroups/old", Kind: kindGroup, Name: "old", Rule: "default", Action: actionDelete, Reason: "timeout expired", Result: resultStarted, Tags: map[string]string{"now": unix(73 * time.Hour)}},
+			{RunID: "run", Operator: "operator", Subscription: "sub", ResourceID: "/subscriptions/sub/resourceGroups/old", Kind: kindGroup, Name: "old", Rule: "default", Action: actionDelete, Reason: "timeout expired", Result: resultFailed, Error: "boom", Tags: map[string]string{"now": unix(73 * time.Hour)}},
+		}
+		if !reflect.DeepEqual(records, want) {
+			t.Errorf("got records %#v, want %#v", records, want)
+		}
+
+		records, _ = ac.Query(context.Background(), auditQuery{Name: "old", From: time.Now().Add(-time.Hour)})
+		if len(records) != 2 || records[0].Name != "old" || records[1].Name != "old" {
+			t.Errorf("query: got records %#v", records)
+		}
+	}
+}
+
+func TestAuditFailure(t *testing.T) {
+	p, ic, _, _ := testPurger([]compute.Image{image("foo")}, nil, nil)
+	p.auditLog = &auditLog{client: &fakeAuditClient{err: errors.New("table not found")}}
+
+	pol := &policy{Images: defaultPolicy().Images}
+	pol.Images[0].DeleteUnmatched = true
+	err := p.run(context.Background(), pol)
+	if err == nil || !strings.Contains(err.Error(), "writing audit log: table not found") {
+		t.Errorf("got error %v", err)
+	}
+
+	// nothing is deleted which could not be recorded as started
+	if got := ic.Names("images"); !reflect.DeepEqual(got, []string{"foo"}) {
+		t.Errorf("got images %v, want foo", got)
+	}
+}
+
+func TestAuditStartedBeforeDeletion(t *testing.T) {
+	p, _, _, gc := testPurger(nil, nil, []resources.Group{group("old", "now", unix(73*time.Hour))})
+	ac := &fakeAuditClient{}
+	p.auditLog = &auditLog{client: ac, runID: "run"}
+
+	var started []string
+	gc.OnDelete = func(name string) {
+		records, _ := ac.Query(context.Background(), auditQuery{Name: name})
+		for _, rec := range records {
+			started = append(started, rec.Result)
+		}
+	}
+
+	if err := p.run(context.Background(), &policy{Groups: defaultPolicy().Groups}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(started, []string{resultStarted}) {
+		t.Errorf("got records %v before deletion, want started", started)
+	}
+}
+
+func TestAuditResourceID(t *testing.T) {
+	for _, tt := range []struct {
+		a    action
+		want string
+	}{
+		{a: action{Kind: kindImage, ResourceGroup: "images", Name: "foo"}, want: "/subscriptions/sub/resourceGroups/images/providers/Microsoft.Compute/images/foo"},
+		{a: action{Kind: kindPublicIP, ResourceGroup: "rg", Name: "ip"}, want: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/publicIPAddresses/ip"},
+		{a: action{Kind: kindBlob, ResourceGroup: "images", StorageAccount: "openshiftimages", Container: "images", Name: "foo.vhd"}, want: "/subscriptions/sub/resourceGroups/images/providers/Microsoft.Storage/storageAccounts/openshiftimages/blobServices/default/containers/images/blobs/foo.vhd"},
+		{a: action{Kind: kindGroup, Name: "old"}, want: "/subscriptions/sub/resourceGroups/old"},
+		{a: action{Kind: kindResource, ID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Web/sites/app"}, want: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Web/sites/app"},
+	} {
+		if got := tt.a.resourceID("sub"); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.a.Kind, got, tt.want)
+		}
+	}
+}
+
+func TestAuditQueryFilter(t *testing.T) {
+	for _, tt := range []struct {
+		q    auditQuery
+		want string
+	}{
+		{},
+		{
+			q:    auditQuery{Name: "bob's-cluster"},
+			want: "Name eq 'bob''s-cluster'",
+		},
+		{
+			q:    auditQuery{From: testNow.Add(-36 * time.Hour), To: testNow},
+			want: "PartitionKey ge '2018-06-13' and Time ge datetime'2018-06-13T00:00:00Z' and PartitionKey le '2018-06-14' and Time lt datetime'2018-06-14T12:00:00Z'",
+		},
+	} {
+		if got := tt.q.filter(); got != tt.want {
+			t.Errorf("got filter %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestAuditEntity(t *testing.T) {
+	rec := auditRecord{
+		Time:         testNow,
+		RunID:        "run",
+		Operator:     "operator",
+		Subscription: "sub",
+		ResourceID:   "/subscriptions/sub/resourceGroups/old",
+		Kind:         kindGroup,
+		Name:         "old",
+		Rule:         "default",
+		Action:       actionDelete,
+		Reason:       "timeout expired",
+		Result:       resultFailed,
+		Error:        "boom",
+		Tags:         map[string]string{"now": unix(73 * time.Hour)},
+	}
+
+	var table azstorage.Table
+	e, err := auditEntity(&table, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.PartitionKey != "2018-06-14" || !strings.HasPrefix(e.RowKey, "20180614T120000Z-") {
+		t.Errorf("got keys %q, %q", e.PartitionKey, e.RowKey)
+	}
+
+	// as returned by a query without metadata
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var props map[string]interface{}
+	if err = json.Unmarshal(b, &props); err != nil {
+		t.Fatal(err)
+	}
+	for k := range props {
+		if strings.HasSuffix(k, azstorage.OdataTypeSuffix) {
+			delete(props, k)
+		}
+	}
+	if b, err = json.Marshal(props); err != nil {
+		t.Fatal(err)
+	}
+
+	var got azstorage.Entity
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := auditRecordFromEntity(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, rec) {
+		t.Errorf("got record %#v, want %#v", r, rec)
+	}
+}
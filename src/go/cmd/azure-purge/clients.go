@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2015-01-01/locks"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2016-06-01/subscriptions"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	azstorage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+)
+
+// subscriptionsClient lists the IDs of the enabled subscriptions visible in a
+// tenant.
+type subscriptionsClient interface {
+	List(ctx context.Context, tenantID string) ([]string, error)
+}
+
+// locksClient lists the management locks which apply to a resource group.
+type locksClient interface {
+	ListAtResourceGroupLevel(ctx context.Context, resourceGroup string) ([]locks.ManagementLockObject, error)
+}
+
+// vmsClient lists the virtual machines in a subscription.
+type vmsClient interface {
+	List(ctx context.Context) ([]compute.VirtualMachine, error)
+}
+
+// disksClient lists and deletes the managed disks in a subscription.  Delete
+// returns once the disk has been removed.
+type disksClient interface {
+	List(ctx context.Context) ([]compute.Disk, error)
+	Delete(ctx context.Context, resourceGroup, name string) error
+}
+
+// snapshotsClient lists and deletes the snapshots in a subscription.  Delete
+// returns once the snapshot has been removed.
+type snapshotsClient interface {
+	List(ctx context.Context) ([]compute.Snapshot, error)
+	Delete(ctx context.Context, resourceGroup, name string) error
+}
+
+// resourcesClient lists the resources of every type in a subscription, and
+// tags and deletes them by ID using the given API version of their resource
+// type.  UpdateTagsByID replaces the tags of a resource.  DeleteByID returns
+// once the resource has been removed.
+type resourcesClient interface {
+	List(ctx context.Context) ([]resources.GenericResource, error)
+	UpdateTagsByID(ctx context.Context, id, apiVersion string, tags map[string]*string) error
+	DeleteByID(ctx context.Context, id, apiVersion string) error
+}
+
+// providersClient returns a resource provider, including the API versions of
+// its resource types.
+type providersClient interface {
+	Get(ctx context.Context, namespace string) (resources.Provider, error)
+}
+
+// leaseClient acquires, renews and releases a lease on a single blob.
+// AcquireLease creates the blob if it does not exist, and fails with a 409
+// Conflict if the lease is held by another client.
+type leaseClient interface {
+	AcquireLease(ctx context.Context, d time.Duration, leaseID string) error
+	RenewLease(ctx context.Context, leaseID string) error
+	ReleaseLease(ctx context.Context, leaseID string) error
+}
+
+// auditClient appends records to the audit log and searches it.  Records are
+// never updated or removed.  Query returns records in chronological order.
+type auditClient interface {
+	Insert(ctx context.Context, records []auditRecord) error
+	Query(ctx context.Context, q auditQuery) ([]auditRecord, error)
+}
+
+type azureSubscriptionsClient struct {
+	env azure.Environment
+}
+
+var _ subscriptionsClient = &azureSubscriptionsClient{}
+
+func (c *azureSubscriptionsClient) List(ctx context.Context, tenantID string) ([]string, error) {
+	authorizer, err := getAuthorizer(c.env, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	client := subscriptions.NewClientWithBaseURI(azureutil.BaseURI(c.env))
+	client.Authorizer = authorizer
+	client.Sender = azureclient.HTTPClient
+
+	results, err := client.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for ; results.NotDone(); results.Next() {
+		for _, sub := range results.Values() {
+			if sub.State == subscriptions.Enabled {
+				ids = append(ids, *sub.SubscriptionID)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+type azureLocksClient struct {
+	client locks.ManagementLocksClient
+}
+
+var _ locksClient = &azureLocksClient{}
+
+func newLocksClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) *azureLocksClient {
+	c := &azureLocksClient{client: locks.NewManagementLocksClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = azureclient.HTTPClient
+	return c
+}
+
+func (c *azureLocksClient) ListAtResourceGroupLevel(ctx context.Context, resourceGroup string) ([]locks.ManagementLockObject, error) {
+	results, err := c.client.ListAtResourceGroupLevel(ctx, resourceGroup, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var l []locks.ManagementLockObject
+	for ; results.NotDone(); results.Next() {
+		l = append(l, results.Values()...)
+	}
+
+	return l, nil
+}
+
+type azureVMsClient struct {
+	client compute.VirtualMachinesClient
+}
+
+var _ vmsClient = &azureVMsClient{}
+
+func newVMsClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) *azureVMsClient {
+	c := &azureVMsClient{client: compute.NewVirtualMachinesClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = azureclient.HTTPClient
+	return c
+}
+
+func (c *azureVMsClient) List(ctx context.Context) ([]compute.VirtualMachine, error) {
+	results, err := c.client.ListAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var vms []compute.VirtualMachine
+	for ; results.NotDone(); results.Next() {
+		vms = append(vms, results.Values()...)
+	}
+
+	return vms, nil
+}
+
+type azureDisksClient struct {
+	client compute.DisksClient
+}
+
+var _ disksClient = &azureDisksClient{}
+
+func newDisksClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) *azureDisksClient {
+	c := &azureDisksClient{client: compute.NewDisksClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = azureclient.HTTPClient
+	azureclient.SkipRegistration(&c.client.Client)
+	return c
+}
+
+func (c *azureDisksClient) List(ctx context.Context) ([]compute.Disk, error) {
+	results, err := c.client.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var disks []compute.Disk
+	for ; results.NotDone(); results.Next() {
+		disks = append(disks, results.Values()...)
+	}
+
+	return disks, nil
+}
+
+func (c *azureDisksClient) Delete(ctx context.Context, resourceGroup, name string) error {
+	future, err := c.client.Delete(ctx, resourceGroup, name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, c.client.Client)
+}
+
+type azureSnapshotsClient struct {
+	client compute.SnapshotsClient
+}
+
+var _ snapshotsClient = &azureSnapshotsClient{}
+
+func newSnapshotsClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) *azureSnapshotsClient {
+	c := &azureSnapshotsClient{client: compute.NewSnapshotsClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = azureclient.HTTPClient
+	azureclient.SkipRegistration(&c.client.Client)
+	return c
+}
+
+func (c *azureSnapshotsClient) List(ctx context.Context) ([]compute.Snapshot, error) {
+	results, err := c.client.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []compute.Snapshot
+	for ; results.NotDone(); results.Next() {
+		snapshots = append(snapshots, results.Values()...)
+	}
+
+	return snapshots, nil
+}
+
+func (c *azureSnapshotsClient) Delete(ctx context.Context, resourceGroup, name string) error {
+	future, err := c.client.Delete(ctx, resourceGroup, name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, c.client.Client)
+}
+
+type azureResourcesClient struct {
+	client resources.Client
+}
+
+var _ resourcesClient = &azureResourcesClient{}
+
+func newResourcesClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) *azureResourcesClient {
+	c := &azureResourcesClient{client: resources.NewClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = azureclient.HTTPClient
+	azureclient.SkipRegistration(&c.client.Client)
+	return c
+}
+
+func (c *azureResourcesClient) List(ctx context.Context) ([]resources.GenericResource, error) {
+	results, err := c.client.List(ctx, "", "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var l []resources.GenericResource
+	for ; results.NotDone(); results.Next() {
+		l = append(l, results.Values()...)
+	}
+
+	return l, nil
+}
+
+// UpdateTagsByID replaces the tags of the resource with the given ID.  As with
+// DeleteByID, the request's API version is replaced before it is sent.
+func (c *azureResourcesClient) UpdateTagsByID(ctx context.Context, id, apiVersion string, tags map[string]*string) error {
+	req, err := c.client.UpdateByIDPreparer(ctx, id, resources.GenericResource{Tags: tags})
+	if err != nil {
+		return autorest.NewErrorWithError(err, "resources.Client", "UpdateByID", nil, "Failure preparing request")
+	}
+
+	q := req.URL.Query()
+	q.Set("api-version", apiVersion)
+	req.URL.RawQuery = q.Encode()
+
+	future, err := c.client.UpdateByIDSender(req)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, c.client.Client)
+}
+
+// DeleteByID deletes the resource with the given ID.  The SDK always uses the
+// API version of the resources package, which most resource types do not
+// support, so the request's API version is replaced before it is sent.
+func (c *azureResourcesClient) DeleteByID(ctx context.Context, id, apiVersion string) error {
+	req, err := c.client.DeleteByIDPreparer(ctx, id)
+	if err != nil {
+		return autorest.NewErrorWithError(err, "resources.Client", "DeleteByID", nil, "Failure preparing request")
+	}
+
+	q := req.URL.Query()
+	q.Set("api-version", apiVersion)
+	req.URL.RawQuery = q.Encode()
+
+	future, err := c.client.DeleteByIDSender(req)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, c.client.Client)
+}
+
+type azureProvidersClient struct {
+	client resources.ProvidersClient
+}
+
+var _ providersClient = &azureProvidersClient{}
+
+func newProvidersClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) *azureProvidersClient {
+	c := &azureProvidersClient{client: resources.NewProvidersClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = azureclient.HTTPClient
+	return c
+}
+
+func (c *azureProvidersClient) Get(ctx context.Context, namespace string) (resources.Provider, error) {
+	return c.client.Get(ctx, namespace, "")
+}
+
+// newLeaseClient returns a leaseClient for the named blob in the given storage
+// account.
+func newLeaseClient(ctx context.Context, env azure.Environment, subscriptionID string, authorizer autorest.Authorizer, resourceGroup, storageAccount, container, name string) (leaseClient, error) {
+	client, err := azureclient.NewAccountClient(ctx, env, subscriptionID, authorizer, resourceGroup, storageAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := client.GetBlobService()
+	return &azureLeaseClient{blob: bs.GetContainerReference(container).GetBlobReference(name)}, nil
+}
+
+type azureLeaseClient struct {
+	blob *azstorage.Blob
+}
+
+var _ leaseClient = &azureLeaseClient{}
+
+func (c *azureLeaseClient) AcquireLease(ctx context.Context, d time.Duration, leaseID string) error {
+	_, err := c.blob.AcquireLease(int(d/time.Second), leaseID, nil)
+	if statusCode(err) != http.StatusNotFound {
+		return err
+	}
+
+	// the container or blob does not exist yet
+	if _, err = c.blob.Container.CreateIfNotExists(nil); err != nil {
+		return err
+	}
+	if err = c.blob.CreateBlockBlob(nil); err != nil {
+		return err
+	}
+
+	_, err = c.blob.AcquireLease(int(d/time.Second), leaseID, nil)
+	return err
+}
+
+func (c *azureLeaseClient) RenewLease(ctx context.Context, leaseID string) error {
+	return c.blob.RenewLease(leaseID, nil)
+}
+
+func (c *azureLeaseClient) ReleaseLease(ctx context.Context, leaseID string) error {
+	return c.blob.ReleaseLease(leaseID, nil)
+}
+
+// newAuditClient returns an auditClient for the named table in the given
+// storage account, creating the table if it does not exist.
+func newAuditClient(ctx context.Context, env azure.Environment, subscriptionID string, authorizer autorest.Authorizer, resourceGroup, storageAccount, table string) (auditClient, error) {
+	client, err := azureclient.NewAccountClient(ctx, env, subscriptionID, authorizer, resourceGroup, storageAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := client.GetTableService()
+	t := ts.GetTableReference(table)
+	if err = t.Create(30, azstorage.EmptyPayload, nil); err != nil && statusCode(err) != http.StatusConflict {
+		return nil, err
+	}
+
+	return &azureAuditClient{table: t}, nil
+}
+
+type azureAuditClient struct {
+	table *azstorage.Table
+}
+
+var _ auditClient = &azureAuditClient{}
+
+func (c *azureAuditClient) Insert(ctx context.Context, records []auditRecord) error {
+	for _, rec := range records {
+		e, err := auditEntity(c.table, rec)
+		if err != nil {
+			return err
+		}
+		if err = e.Insert(azstorage.EmptyPayload, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *azureAuditClient) Query(ctx context.Context, q auditQuery) ([]auditRecord, error) {
+	// without metadata, times are returned as strings: the SDK cannot decode
+	// times with fractional seconds.
+	result, err := c.table.QueryEntities(30, azstorage.NoMetadata, &azstorage.QueryOptions{Filter: q.filter()})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []auditRecord
+	for {
+		for _, e := range result.Entities {
+			rec, err := auditRecordFromEntity(e)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, rec)
+		}
+
+		if result.NextLink == nil {
+			break
+		}
+		if result, err = result.NextResults(nil); err != nil {
+			return nil, err
+		}
+	}
+	sortAuditRecords(records)
+
+	return records, nil
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/ghodss/yaml"
+	"github.com/openshift/azure-misc/src/go/pkg/vmimage"
+)
+
+const (
+	defaultResourceGroup  = "images"
+	defaultStorageAccount = "openshiftimages"
+	defaultContainer      = "images"
+	defaultKeepImages     = 5
+	defaultBuildTimeout   = 6 * time.Hour
+	defaultGroupTimeout   = 3 * 24 * time.Hour
+	defaultGroupTag       = "now"
+	defaultPersistTag     = "persist"
+	defaultExpiresTag     = "expires"
+	defaultOrphanTimeout  = 24 * time.Hour
+	defaultOrphanedTag    = "orphaned-at"
+	defaultCreatedAtTag   = "created-at"
+	defaultTTLTag         = "ttl"
+	defaultExpiresAtTag   = "expires-at"
+
+	defaultQuarantinePeriod    = 3 * 24 * time.Hour
+	defaultQuarantineTag       = "purge-pending"
+	defaultQuarantinedTag      = "purge-quarantined"
+	defaultQuarantineContainer = "quarantine"
+
+	defaultImagePattern    = vmimage.DefaultPattern
+	defaultBlobPattern     = `-(?P<timestamp>[0-9]{12})\.vhd$`
+	defaultTimestampLayout = vmimage.TimestampLayout
+)
+
+// duration is a time.Duration which is (un)marshalled as a string, e.g. "6h".
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	var err error
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// policy is the set of retention rules applied by a purge run, loaded from a
+// YAML or JSON file such as:
+//
+//	images:
+//	- name: openshift
+//	  resourceGroup: images
+//	  keepImages: 5
+//	  keepYoungerThan: 72h
+//	  keepWeekly: 4
+//	  buildTimeout: 6h
+//	  namePattern: ^(?P<family>.*)-(?P<version>[0-9.]+)-(?P<timestamp>[0-9]{12})$
+//	  timestampLayout: "200601021504"
+//	  currentVersions: 2
+//	  oldVersions:
+//	    keepImages: 1
+//	blobs:
+//	- resourceGroup: images
+//	  storageAccount: openshiftimages
+//	  container: images
+//	  deleteUnmatched: true
+//	groups:
+//	- tag: now
+//	  timeout: 72h
+//	  persistTag: persist
+//	  expiresTag: expires
+//	orphans:
+//	- kinds: [disk, snapshot, nic, publicip]
+//	  timeout: 24h
+//	  orphanedTag: orphaned-at
+//	ttls:
+//	- createdAtTag: created-at
+//	  ttlTag: ttl
+//	  expiresAtTag: expires-at
+//	quarantine:
+//	  period: 72h
+//	  tag: purge-pending
+//	  quarantinedTag: purge-quarantined
+//	  container: quarantine
+type policy struct {
+	Subscriptions []subscriptionTarget `json:"subscriptions,omitempty"`
+
+	Images  []imageRule  `json:"images,omitempty"`
+	Blobs   []blobRule   `json:"blobs,omitempty"`
+	Groups  []groupRule  `json:"groups,omitempty"`
+	Orphans []orphanRule `json:"orphans,omitempty"`
+	TTLs    []ttlRule    `json:"ttls,omitempty"`
+
+	Quarantine *quarantineConfig `json:"quarantine,omitempty"`
+}
+
+// subscriptionTarget selects the subscription ID, or every enabled subscription
+// in the tenant if ID is empty.
+type subscriptionTarget struct {
+	ID       string `json:"id,omitempty"`
+	TenantID string `json:"tenantId,omitempty"`
+}
+
+// imageRule removes the images in ResourceGroup which are invalid after
+// BuildTimeout or not kept by the retention of their family and version.
+type imageRule struct {
+	Name            string    `json:"name,omitempty"`
+	ResourceGroup   string    `json:"resourceGroup,omitempty"`
+	KeepImages      *int      `json:"keepImages,omitempty"`
+	KeepYoungerThan duration  `json:"keepYoungerThan,omitempty"`
+	KeepWeekly      int       `json:"keepWeekly,omitempty"`
+	BuildTimeout    *duration `json:"buildTimeout,omitempty"`
+	NamePattern     string    `json:"namePattern,omitempty"`
+	TimestampLayout string    `json:"timestampLayout,omitempty"`
+	DeleteUnmatched bool      `json:"deleteUnmatched,omitempty"`
+
+	// OldVersions, if set, replaces the retention of all but the
+	// CurrentVersions newest versions of each family.
+	CurrentVersions *int       `json:"currentVersions,omitempty"`
+	OldVersions     *retention `json:"oldVersions,omitempty"`
+}
+
+// retention keeps the KeepImages newest images, those younger than
+// KeepYoungerThan, and the newest image of each of the last KeepWeekly weeks.
+type retention struct {
+	KeepImages      *int     `json:"keepImages,omitempty"`
+	KeepYoungerThan duration `json:"keepYoungerThan,omitempty"`
+	KeepWeekly      int      `json:"keepWeekly,omitempty"`
+}
+
+// retention returns the retention of the current versions of the rule's
+// images.
+func (r imageRule) retention() retention {
+	return retention{KeepImages: r.KeepImages, KeepYoungerThan: r.KeepYoungerThan, KeepWeekly: r.KeepWeekly}
+}
+
+// validate checks a retention of the rule named rule, whose fields are
+// prefixed by path in error messages.
+func (r *retention) validate(rule, path string) error {
+	if *r.KeepImages < 0 {
+		return fmt.Errorf("rule %q: %skeepImages must not be negative", rule, path)
+	}
+	if r.KeepYoungerThan.Duration < 0 {
+		return fmt.Errorf("rule %q: %skeepYoungerThan must not be negative", rule, path)
+	}
+	if r.KeepWeekly < 0 {
+		return fmt.Errorf("rule %q: %skeepWeekly must not be negative", rule, path)
+	}
+	return nil
+}
+
+// blobRule removes the blobs in StorageAccount/Container which are older than
+// BuildTimeout and not referenced by any image in ImageResourceGroup.
+type blobRule struct {
+	Name               string    `json:"name,omitempty"`
+	ResourceGroup      string    `json:"resourceGroup,omitempty"`
+	StorageAccount     string    `json:"storageAccount,omitempty"`
+	Container          string    `json:"container,omitempty"`
+	ImageResourceGroup string    `json:"imageResourceGroup,omitempty"`
+	BuildTimeout       *duration `json:"buildTimeout,omitempty"`
+	NamePattern        string    `json:"namePattern,omitempty"`
+	TimestampLayout    string    `json:"timestampLayout,omitempty"`
+	DeleteUnmatched    bool      `json:"deleteUnmatched,omitempty"`
+}
+
+// scheme returns the naming scheme of the rule's images.
+func (r imageRule) scheme() (*vmimage.Scheme, error) {
+	return vmimage.NewScheme(r.NamePattern, r.TimestampLayout)
+}
+
+// scheme returns the naming scheme of the rule's blobs.
+func (r blobRule) scheme() (*vmimage.Scheme, error) {
+	return vmimage.NewScheme(r.NamePattern, r.TimestampLayout)
+}
+
+// groupRule removes the resource groups whose Tag time, in Unix seconds, is
+// older than Timeout, unless they are persisted, unexpired or locked.
+type groupRule struct {
+	Name       string    `json:"name,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	Timeout    *duration `json:"timeout,omitempty"`
+	PersistTag string    `json:"persistTag,omitempty"`
+	ExpiresTag string    `json:"expiresTag,omitempty"`
+}
+
+// orphanRule removes the disks, snapshots, network interfaces and public IP
+// addresses of Kinds which have been tagged with OrphanedTag for longer than
+// Timeout.
+type orphanRule struct {
+	Name        string    `json:"name,omitempty"`
+	Kinds       []string  `json:"kinds,omitempty"`
+	Timeout     *duration `json:"timeout,omitempty"`
+	OrphanedTag string    `json:"orphanedTag,omitempty"`
+}
+
+// ttlRule removes the resources and resource groups whose ExpiresAtTag time has
+// passed, or whose TTLTag duration has elapsed since their CreatedAtTag time.
+type ttlRule struct {
+	Name         string `json:"name,omitempty"`
+	CreatedAtTag string `json:"createdAtTag,omitempty"`
+	TTLTag       string `json:"ttlTag,omitempty"`
+	ExpiresAtTag string `json:"expiresAtTag,omitempty"`
+}
+
+// quarantineConfig tags resources selected for deletion with Tag and
+// QuarantinedTag, or moves blobs to Container, and deletes them once Period has
+// passed.
+type quarantineConfig struct {
+	Period         *duration `json:"period,omitempty"`
+	Tag            string    `json:"tag,omitempty"`
+	QuarantinedTag string    `json:"quarantinedTag,omitempty"`
+	Container      string    `json:"container,omitempty"`
+}
+
+// defaultPolicy returns the policy used when no policy file is given.
+func defaultPolicy() *policy {
+	p := &policy{
+		Images: []imageRule{{Name: "default"}},
+		Blobs:  []blobRule{{Name: "default"}},
+		Groups: []groupRule{{Name: "default"}},
+	}
+	p.setDefaults()
+	return p
+}
+
+// loadPolicy reads, defaults and validates the policy at path, or returns the
+// default policy if path is empty.
+func loadPolicy(path string) (*policy, error) {
+	if path == "" {
+		return defaultPolicy(), nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := parsePolicy(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return p, nil
+}
+
+// parsePolicy parses, defaults and validates a YAML or JSON policy, rejecting
+// unknown fields.
+func parsePolicy(b []byte) (*policy, error) {
+	b, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+
+	var p policy
+	if err = d.Decode(&p); err != nil {
+		return nil, err
+	}
+
+	p.setDefaults()
+
+	if err = p.validate(); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func (p *policy) setDefaults() {
+	for i := range p.Images {
+		r := &p.Images[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("images[%d]", i)
+		}
+		if r.ResourceGroup == "" {
+			r.ResourceGroup = defaultResourceGroup
+		}
+		if r.KeepImages == nil {
+			r.KeepImages = to.IntPtr(defaultKeepImages)
+		}
+		if r.BuildTimeout == nil {
+			r.BuildTimeout = &duration{defaultBuildTimeout}
+		}
+		if r.NamePattern == "" {
+			r.NamePattern = defaultImagePattern
+		}
+		if r.TimestampLayout == "" {
+			r.TimestampLayout = defaultTimestampLayout
+		}
+		if r.OldVersions != nil {
+			if r.CurrentVersions == nil {
+				r.CurrentVersions = to.IntPtr(1)
+			}
+			if r.OldVersions.KeepImages == nil {
+				r.OldVersions.KeepImages = to.IntPtr(1)
+			}
+		}
+	}
+
+	for i := range p.Blobs {
+		r := &p.Blobs[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("blobs[%d]", i)
+		}
+		if r.ResourceGroup == "" {
+			r.ResourceGroup = defaultResourceGroup
+		}
+		if r.StorageAccount == "" {
+			r.StorageAccount = defaultStorageAccount
+		}
+		if r.Container == "" {
+			r.Container = defaultContainer
+		}
+		if r.ImageResourceGroup == "" {
+			r.ImageResourceGroup = r.ResourceGroup
+		}
+		if r.BuildTimeout == nil {
+			r.BuildTimeout = &duration{defaultBuildTimeout}
+		}
+		if r.NamePattern == "" {
+			r.NamePattern = defaultBlobPattern
+		}
+		if r.TimestampLayout == "" {
+			r.TimestampLayout = defaultTimestampLayout
+		}
+	}
+
+	for i := range p.Groups {
+		r := &p.Groups[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("groups[%d]", i)
+		}
+		if r.Tag == "" {
+			r.Tag = defaultGroupTag
+		}
+		if r.Timeout == nil {
+			r.Timeout = &duration{defaultGroupTimeout}
+		}
+		if r.PersistTag == "" {
+			r.PersistTag = defaultPersistTag
+		}
+		if r.ExpiresTag == "" {
+			r.ExpiresTag = defaultExpiresTag
+		}
+	}
+
+	for i := range p.Orphans {
+		r := &p.Orphans[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("orphans[%d]", i)
+		}
+		if len(r.Kinds) == 0 {
+			r.Kinds = []string{kindDisk, kindSnapshot, kindNIC, kindPublicIP}
+		}
+		if r.Timeout == nil {
+			r.Timeout = &duration{defaultOrphanTimeout}
+		}
+		if r.OrphanedTag == "" {
+			r.OrphanedTag = defaultOrphanedTag
+		}
+	}
+
+	if q := p.Quarantine; q != nil {
+		if q.Period == nil {
+			q.Period = &duration{defaultQuarantinePeriod}
+		}
+		if q.Tag == "" {
+			q.Tag = defaultQuarantineTag
+		}
+		if q.QuarantinedTag == "" {
+			q.QuarantinedTag = defaultQuarantinedTag
+		}
+		if q.Container == "" {
+			q.Container = defaultQuarantineContainer
+		}
+	}
+
+	for i := range p.TTLs {
+		r := &p.TTLs[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("ttls[%d]", i)
+		}
+		if r.CreatedAtTag == "" {
+			r.CreatedAtTag = defaultCreatedAtTag
+		}
+		if r.TTLTag == "" {
+			r.TTLTag = defaultTTLTag
+		}
+		if r.ExpiresAtTag == "" {
+			r.ExpiresAtTag = defaultExpiresAtTag
+		}
+	}
+}
+
+func (p *policy) validate() error {
+	if len(p.Images)+len(p.Blobs)+len(p.Groups)+len(p.Orphans)+len(p.TTLs) == 0 {
+		return fmt.Errorf("policy contains no rules")
+	}
+
+	ids := map[string]struct{}{}
+	for _, s := range p.Subscriptions {
+		if s.ID == "" {
+			continue
+		}
+		if _, found := ids[strings.ToLower(s.ID)]; found {
+			return fmt.Errorf("duplicate subscription %q", s.ID)
+		}
+		ids[strings.ToLower(s.ID)] = struct{}{}
+	}
+
+	names := map[string]struct{}{}
+	checkName := func(kind, name string) error {
+		if _, found := names[kind+"/"+name]; found {
+			return fmt.Errorf("duplicate %s rule name %q", kind, name)
+		}
+		names[kind+"/"+name] = struct{}{}
+		return nil
+	}
+
+	for _, r := range p.Images {
+		if err := checkName("images", r.Name); err != nil {
+			return err
+		}
+		ret := r.retention()
+		if err := ret.validate(r.Name, ""); err != nil {
+			return err
+		}
+		if r.BuildTimeout.Duration < 0 {
+			return fmt.Errorf("rule %q: buildTimeout must not be negative", r.Name)
+		}
+		if _, err := r.scheme(); err != nil {
+			return fmt.Errorf("rule %q: namePattern: %v", r.Name, err)
+		}
+		if r.CurrentVersions != nil && *r.CurrentVersions < 0 {
+			return fmt.Errorf("rule %q: currentVersions must not be negative", r.Name)
+		}
+		if r.OldVersions != nil {
+			if err := r.OldVersions.validate(r.Name, "oldVersions."); err != nil {
+				return err
+			}
+		} else if r.CurrentVersions != nil {
+			return fmt.Errorf("rule %q: currentVersions requires oldVersions", r.Name)
+		}
+	}
+
+	for _, r := range p.Blobs {
+		if err := checkName("blobs", r.Name); err != nil {
+			return err
+		}
+		if r.BuildTimeout.Duration < 0 {
+			return fmt.Errorf("rule %q: buildTimeout must not be negative", r.Name)
+		}
+		if _, err := r.scheme(); err != nil {
+			return fmt.Errorf("rule %q: namePattern: %v", r.Name, err)
+		}
+	}
+
+	for _, r := range p.Groups {
+		if err := checkName("groups", r.Name); err != nil {
+			return err
+		}
+		if r.Timeout.Duration < 0 {
+			return fmt.Errorf("rule %q: timeout must not be negative", r.Name)
+		}
+	}
+
+	for _, r := range p.Orphans {
+		if err := checkName("orphans", r.Name); err != nil {
+			return err
+		}
+		for _, kind := range r.Kinds {
+			switch kind {
+			case kindDisk, kindSnapshot, kindNIC, kindPublicIP:
+			default:
+				return fmt.Errorf("rule %q: unknown kind %q", r.Name, kind)
+			}
+		}
+		if r.Timeout.Duration < 0 {
+			return fmt.Errorf("rule %q: timeout must not be negative", r.Name)
+		}
+	}
+
+	for _, r := range p.TTLs {
+		if err := checkName("ttls", r.Name); err != nil {
+			return err
+		}
+		if r.CreatedAtTag == r.TTLTag || r.CreatedAtTag == r.ExpiresAtTag || r.TTLTag == r.ExpiresAtTag {
+			return fmt.Errorf("rule %q: createdAtTag, ttlTag and expiresAtTag must differ", r.Name)
+		}
+	}
+
+	if q := p.Quarantine; q != nil {
+		if q.Period.Duration < 0 {
+			return fmt.Errorf("quarantine: period must not be negative")
+		}
+		if strings.EqualFold(q.Tag, q.QuarantinedTag) {
+			return fmt.Errorf("quarantine: tag and quarantinedTag must differ")
+		}
+		for _, r := range p.Blobs {
+			if strings.EqualFold(r.Container, q.Container) {
+				return fmt.Errorf("quarantine: container %q is purged by rule %q", q.Container, r.Name)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		policy  string
+		want    *policy
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			policy: `
+images:
+- {}
+blobs:
+- {}
+groups:
+- {}
+`,
+			want: &policy{
+				Images: []imageRule{{Name: "images[0]", ResourceGroup: "images", KeepImages: to.IntPtr(5), BuildTimeout: &duration{6 * time.Hour}, NamePattern: defaultImagePattern, TimestampLayout: "200601021504"}},
+				Blobs:  []blobRule{{Name: "blobs[0]", ResourceGroup: "images", StorageAccount: "openshiftimages", Container: "images", ImageResourceGroup: "images", BuildTimeout: &duration{6 * time.Hour}, NamePattern: defaultBlobPattern, TimestampLayout: "200601021504"}},
+				Groups: []groupRule{{Name: "groups[0]", Tag: "now", Timeout: &duration{72 * time.Hour}, PersistTag: "persist", ExpiresTag: "expires"}},
+			},
+		},
+		{
+			name:   "json",
+			policy: `{"images": [{"name": "team", "resourceGroup": "team-images", "keepImages": 2, "buildTimeout": "1h30m"}]}`,
+			want: &policy{
+				Images: []imageRule{{Name: "team", ResourceGroup: "team-images", KeepImages: to.IntPtr(2), BuildTimeout: &duration{90 * time.Minute}, NamePattern: defaultImagePattern, TimestampLayout: "200601021504"}},
+			},
+		},
+		{
+			name: "blob image resource group defaults to storage account resource group",
+			policy: `
+blobs:
+- resourceGroup: vhds
+`,
+			want: &policy{
+				Blobs: []blobRule{{Name: "blobs[0]", ResourceGroup: "vhds", StorageAccount: "openshiftimages", Container: "images", ImageResourceGroup: "vhds", BuildTimeout: &duration{6 * time.Hour}, NamePattern: defaultBlobPattern, TimestampLayout: "200601021504"}},
+			},
+		},
+		{
+			name: "subscriptions",
+			policy: `
+subscriptions:
+- tenantId: tenant
+- id: sub
+  tenantId: other
+groups:
+- {}
+`,
+			want: &policy{
+				Subscriptions: []subscriptionTarget{{TenantID: "tenant"}, {ID: "sub", TenantID: "other"}},
+				Groups:        []groupRule{{Name: "groups[0]", Tag: "now", Timeout: &duration{72 * time.Hour}, PersistTag: "persist", ExpiresTag: "expires"}},
+			},
+		},
+		{
+			name: "orphans",
+			policy: `
+orphans:
+- {}
+- name: ips
+  kinds: [publicip]
+  timeout: 1h
+  orphanedTag: lost
+`,
+			want: &policy{
+				Orphans: []orphanRule{
+					{Name: "orphans[0]", Kinds: []string{"disk", "snapshot", "nic", "publicip"}, Timeout: &duration{24 * time.Hour}, OrphanedTag: "orphaned-at"},
+					{Name: "ips", Kinds: []string{"publicip"}, Timeout: &duration{time.Hour}, OrphanedTag: "lost"},
+				},
+			},
+		},
+		{
+			name: "unknown orphan kind",
+			policy: `
+orphans:
+- kinds: [vm]
+`,
+			wantErr: `unknown kind "vm"`,
+		},
+		{
+			name: "ttls",
+			policy: `
+ttls:
+- {}
+- name: custom
+  createdAtTag: born
+  ttlTag: lifetime
+  expiresAtTag: dies
+`,
+			want: &policy{
+				TTLs: []ttlRule{
+					{Name: "ttls[0]", CreatedAtTag: "created-at", TTLTag: "ttl", ExpiresAtTag: "expires-at"},
+					{Name: "custom", CreatedAtTag: "born", TTLTag: "lifetime", ExpiresAtTag: "dies"},
+				},
+			},
+		},
+		{
+			name: "ttl tags must differ",
+			policy: `
+ttls:
+- ttlTag: expires-at
+`,
+			wantErr: "createdAtTag, ttlTag and expiresAtTag must differ",
+		},
+		{
+			name: "quarantine",
+			policy: `
+groups:
+- {}
+quarantine: {}
+`,
+			want: &policy{
+				Groups:     []groupRule{{Name: "groups[0]", Tag: "now", Timeout: &duration{72 * time.Hour}, PersistTag: "persist", ExpiresTag: "expires"}},
+				Quarantine: &quarantineConfig{Period: &duration{72 * time.Hour}, Tag: "purge-pending", QuarantinedTag: "purge-quarantined", Container: "quarantine"},
+			},
+		},
+		{
+			name: "quarantine container purged by a blob rule",
+			policy: `
+blobs:
+- container: Quarantine
+quarantine:
+  period: 24h
+`,
+			wantErr: `quarantine: container "quarantine" is purged by rule "blobs[0]"`,
+		},
+		{
+			name: "quarantine tags must differ",
+			policy: `
+groups:
+- {}
+quarantine:
+  quarantinedTag: purge-pending
+`,
+			wantErr: "quarantine: tag and quarantinedTag must differ",
+		},
+		{
+			name:    "empty",
+			policy:  `{}`,
+			wantErr: "policy contains no rules",
+		},
+		{
+			name: "unknown field",
+			policy: `
+images:
+- keep: 3
+`,
+			wantErr: `unknown field "keep"`,
+		},
+		{
+			name: "bad duration",
+			policy: `
+groups:
+- timeout: 3d
+`,
+			wantErr: "unknown unit",
+		},
+		{
+			name: "negative keepImages",
+			policy: `
+images:
+- keepImages: -1
+`,
+			wantErr: "keepImages must not be negative",
+		},
+		{
+			name: "naming scheme",
+			policy: `
+images:
+- namePattern: ^(?P<family>rhel-[0-9.]+)-(?P<timestamp>[0-9]{8})$
+  timestampLayout: "20060102"
+  deleteUnmatched: true
+`,
+			want: &policy{
+				Images: []imageRule{{Name: "images[0]", ResourceGroup: "images", KeepImages: to.IntPtr(5), BuildTimeout: &duration{6 * time.Hour}, NamePattern: `^(?P<family>rhel-[0-9.]+)-(?P<timestamp>[0-9]{8})$`, TimestampLayout: "20060102", DeleteUnmatched: true}},
+			},
+		},
+		{
+			name: "retention",
+			policy: `
+images:
+- keepImages: 3
+  keepYoungerThan: 72h
+  keepWeekly: 4
+  oldVersions:
+    keepWeekly: 1
+`,
+			want: &policy{
+				Images: []imageRule{{Name: "images[0]", ResourceGroup: "images", KeepImages: to.IntPtr(3), KeepYoungerThan: duration{72 * time.Hour}, KeepWeekly: 4, BuildTimeout: &duration{6 * time.Hour}, NamePattern: defaultImagePattern, TimestampLayout: "200601021504", CurrentVersions: to.IntPtr(1), OldVersions: &retention{KeepImages: to.IntPtr(1), KeepWeekly: 1}}},
+			},
+		},
+		{
+			name: "explicit zeros",
+			policy: `
+images:
+- keepImages: 0
+  buildTimeout: 0s
+  currentVersions: 0
+  oldVersions:
+    keepImages: 0
+groups:
+- timeout: 0s
+orphans:
+- timeout: 0s
+quarantine:
+  period: 0s
+`,
+			want: &policy{
+				Images:     []imageRule{{Name: "images[0]", ResourceGroup: "images", KeepImages: to.IntPtr(0), BuildTimeout: &duration{}, NamePattern: defaultImagePattern, TimestampLayout: "200601021504", CurrentVersions: to.IntPtr(0), OldVersions: &retention{KeepImages: to.IntPtr(0)}}},
+				Groups:     []groupRule{{Name: "groups[0]", Tag: "now", Timeout: &duration{}, PersistTag: "persist", ExpiresTag: "expires"}},
+				Orphans:    []orphanRule{{Name: "orphans[0]", Kinds: []string{"disk", "snapshot", "nic", "publicip"}, Timeout: &duration{}, OrphanedTag: "orphaned-at"}},
+				Quarantine: &quarantineConfig{Period: &duration{}, Tag: "purge-pending", QuarantinedTag: "purge-quarantined", Container: "quarantine"},
+			},
+		},
+		{
+			name: "negative old version keepWeekly",
+			policy: `
+images:
+- oldVersions:
+    keepWeekly: -1
+`,
+			wantErr: "oldVersions.keepWeekly must not be negative",
+		},
+		{
+			name: "currentVersions without oldVersions",
+			policy: `
+images:
+- currentVersions: 2
+`,
+			wantErr: "currentVersions requires oldVersions",
+		},
+		{
+			name: "name pattern without timestamp",
+			policy: `
+images:
+- namePattern: ^(?P<family>.*)-[0-9]{12}$
+`,
+			wantErr: "pattern has no timestamp group",
+		},
+		{
+			name: "bad name pattern",
+			policy: `
+blobs:
+- namePattern: (?P<timestamp>[0-9]{12}\.vhd$
+`,
+			wantErr: "missing closing )",
+		},
+		{
+			name: "duplicate names",
+			policy: `
+groups:
+- name: ci
+- name: ci
+  tag: created
+`,
+			wantErr: `duplicate groups rule name "ci"`,
+		},
+		{
+			name: "duplicate subscriptions",
+			policy: `
+subscriptions:
+- id: SUB
+- id: sub
+groups:
+- {}
+`,
+			wantErr: `duplicate subscription "sub"`,
+		},
+	} {
+		p, err := parsePolicy([]byte(tt.policy))
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, p, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// daemon purges on a schedule until it is stopped.  If elector is set, only
+// the elected leader among several replicas purges.
+type daemon struct {
+	schedule *schedule
+	elector  *elector
+	metrics  *metrics
+	out      io.Writer
+
+	// purge runs a single purge; it should return promptly once its context
+	// is done.
+	purge func(context.Context) error
+
+	mu      sync.Mutex
+	running bool
+}
+
+// run runs the daemon until ctx is done.  A purge in progress when ctx is done
+// is cancelled, and run returns once it has stopped.
+func (d *daemon) run(ctx context.Context) {
+	d.mu.Lock()
+	d.running = true
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		d.running = false
+		d.mu.Unlock()
+	}()
+
+	if d.elector == nil {
+		d.loop(ctx)
+		return
+	}
+
+	d.elector.run(ctx, d.loop)
+}
+
+// loop purges at each scheduled time until ctx is done.
+func (d *daemon) loop(ctx context.Context) {
+	for {
+		next := d.schedule.next(time.Now())
+		fmt.Fprintf(d.out, "next purge at %s\n", next.Format(time.RFC3339))
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			return
+		}
+
+		d.purgeOnce(ctx)
+	}
+}
+
+func (d *daemon) purgeOnce(ctx context.Context) {
+	d.metrics.startRun()
+	start := time.Now()
+
+	err := d.purge(ctx)
+	d.metrics.endRun(start, err == nil)
+
+	if err != nil {
+		fmt.Fprintf(d.out, "purge failed: %v\n", err)
+	}
+}
+
+// handler returns an http.Handler serving /healthz and, if the daemon has
+// metrics, /metrics.
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		running := d.running
+		d.mu.Unlock()
+
+		if !running {
+			http.Error(w, "not running", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	if d.metrics != nil {
+		mux.Handle("/metrics", d.metrics.handler())
+	}
+
+	return mux
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDaemon(t *testing.T) {
+	var mu sync.Mutex
+	var purges int
+
+	d := &daemon{
+		schedule: &schedule{every: 5 * time.Millisecond},
+		metrics:  newMetrics(),
+		out:      &syncBuffer{},
+		purge: func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			purges++
+			return nil
+		},
+	}
+
+	srv := httptest.NewServer(d.handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.run(ctx)
+	}()
+
+	waitFor(t, "three purges", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return purges >= 3
+	})
+
+	for _, path := range []string{"/healthz", "/metrics"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d while running", path, resp.StatusCode)
+		}
+	}
+
+	cancel()
+	<-done
+
+	resp, err := http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/healthz: got status %d after stopping", resp.StatusCode)
+	}
+
+	if v, _ := metricValue(t, d.metrics, "azure_purge_last_success_timestamp_seconds", nil); v == 0 {
+		t.Error("last success timestamp not set")
+	}
+}
+
+func TestDaemonStopCancelsPurge(t *testing.T) {
+	started := make(chan struct{})
+	var purgeErr error
+
+	d := &daemon{
+		schedule: &schedule{every: time.Millisecond},
+		out:      &syncBuffer{},
+		purge: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			purgeErr = ctx.Err()
+			return errors.New("interrupted")
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.run(ctx)
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("daemon did not stop")
+	}
+
+	if purgeErr != context.Canceled {
+		t.Errorf("purge saw %v, want %v", purgeErr, context.Canceled)
+	}
+}
+
+func TestDaemonLeaderElection(t *testing.T) {
+	leases := &fakeLeaseClient{}
+	leases.steal("other")
+
+	purged := make(chan struct{}, 10)
+	d := &daemon{
+		schedule: &schedule{every: time.Millisecond},
+		elector:  testElector(leases, "me", &syncBuffer{}),
+		out:      &syncBuffer{},
+		purge: func(ctx context.Context) error {
+			purged <- struct{}{}
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.run(ctx)
+	}()
+
+	select {
+	case <-purged:
+		t.Fatal("purged without holding the lease")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	leases.steal("")
+
+	select {
+	case <-purged:
+	case <-time.After(time.Second):
+		t.Fatal("did not purge after acquiring the lease")
+	}
+
+	cancel()
+	<-done
+}
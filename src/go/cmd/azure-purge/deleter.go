@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	azstorage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+)
+
+const (
+	defaultWorkers   = 10
+	defaultOpTimeout = 30 * time.Minute
+	defaultRetries   = 3
+)
+
+// retryDelay is the wait before the first retry of a deletion.  Tests shorten
+// it.
+var retryDelay = 10 * time.Second
+
+// errImageSurvived is the reason a blob is not deleted when an image it backs
+// could not be deleted or quarantined.
+var errImageSurvived = errors.New("an image it backs was not deleted")
+
+// result is the outcome of an action which was executed.  An action
+// which was not attempted has no attempts, and err says why.
+type result struct {
+	action
+	attempts int
+	err      error
+}
+
+// kindOrder is the order in which resources of each kind are deleted.
+var kindOrder = map[string]int{
+	kindImage:    0,
+	kindBlob:     1,
+	kindDisk:     2,
+	kindSnapshot: 3,
+	kindNIC:      4,
+	kindPublicIP: 5,
+	kindResource: 6,
+	kindGroup:    7,
+}
+
+// execute carries out the given delete, quarantine, restore, mark and unmark
+// actions: images are deleted first, then blobs, then orphaned resources, then
+// expired resources, then resource groups.  Every action is attempted unless
+// ctx is done first or, for a blob, an image it backs survived, and its
+// outcome recorded in p.results; an error is returned if any deletion failed or
+// was not attempted.
+func (p *purger) execute(ctx context.Context, actions []action) error {
+	phases := make([][]action, len(kindOrder))
+	var n int
+	for _, a := range actions {
+		switch a.Action {
+		case actionDelete, actionQuarantine, actionRestore, actionMark, actionUnmark:
+		default:
+			continue
+		}
+		phases[kindOrder[a.Kind]] = append(phases[kindOrder[a.Kind]], a)
+		n++
+	}
+
+	for _, phase := range phases {
+		ready, skipped := p.ready(phase)
+		for _, r := range skipped {
+			p.record(ctx, r)
+		}
+		p.deleteAll(ctx, ready)
+	}
+
+	var attempted, failed, skipped int
+	for _, r := range p.results {
+		switch {
+		case r.attempts == 0:
+			skipped++
+		case r.err != nil:
+			attempted++
+			failed++
+		default:
+			attempted++
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("interrupted after %d of %d deletions: %v", attempted, n, err)
+	}
+
+	switch {
+	case skipped > 0:
+		return fmt.Errorf("%d of %d deletions failed, %d not attempted", failed, n, skipped)
+	case failed > 0:
+		return fmt.Errorf("%d of %d deletions failed", failed, n)
+	}
+
+	return nil
+}
+
+// ready returns those of actions which may be carried out now that the
+// previous phases are done, and the results of those which may not.  A blob is
+// not deleted or quarantined unless every image it backs has been, as the
+// image would be left broken: it is not attempted instead.
+func (p *purger) ready(actions []action) ([]action, []result) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	done := map[string]struct{}{}
+	for _, r := range p.results {
+		if r.attempts > 0 && r.err == nil {
+			done[r.key()] = struct{}{}
+		}
+	}
+
+	var ready []action
+	var skipped []result
+	for _, a := range actions {
+		var survived bool
+		for _, key := range a.Images {
+			if _, found := done[key]; !found {
+				survived = true
+			}
+		}
+		if survived {
+			skipped = append(skipped, result{action: a, err: errImageSurvived})
+			continue
+		}
+		ready = append(ready, a)
+	}
+
+	return ready, skipped
+}
+
+// record records r in p.results and the audit log.
+func (p *purger) record(ctx context.Context, r result) {
+	p.mu.Lock()
+	p.results = append(p.results, r)
+	p.mu.Unlock()
+
+	p.auditResult(ctx, r)
+}
+
+// deleteAll deletes the given resources on a pool of p.workers workers and
+// returns once every deletion has succeeded or failed.  Each deletion is
+// recorded in the audit log as started before it is attempted, and is not
+// attempted if that fails.  No new deletions are started once ctx is done or
+// checkLease fails, and those in progress stop waiting for their operations to
+// complete.
+func (p *purger) deleteAll(ctx context.Context, actions []action) {
+	workers := p.workers
+	if workers < 1 {
+		workers = defaultWorkers
+	}
+
+	ch := make(chan *action)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(actions); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range ch {
+				if err := checkLease(ctx); err != nil {
+					p.record(ctx, result{action: *a, err: err})
+					continue
+				}
+				if err := p.auditStart(ctx, a); err != nil {
+					p.record(ctx, result{action: *a, err: err})
+					continue
+				}
+
+				attempts, err := p.deleteWithRetry(ctx, a)
+				if a.Action == actionDelete {
+					p.metrics.result(p.subscription, a.Kind, a.Rule, err)
+				}
+
+				p.record(ctx, result{action: *a, attempts: attempts, err: err})
+			}
+		}()
+	}
+
+send:
+	for i := range actions {
+		select {
+		case ch <- &actions[i]:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(ch)
+
+	wg.Wait()
+}
+
+// deleteWithRetry deletes the resource of a, retrying if the deletion is
+// throttled or conflicts with another operation.  It returns the number of
+// attempts made and the last error.
+func (p *purger) deleteWithRetry(ctx context.Context, a *action) (attempts int, err error) {
+	delay := p.retryDelay
+	for attempts = 1; ; attempts++ {
+		err = p.delete(ctx, a)
+		if err == nil || attempts > p.retries || !isRetryable(err) {
+			return attempts, err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return attempts, err
+		}
+		delay *= 2
+	}
+}
+
+// delete makes a single attempt to delete, quarantine, restore, mark or unmark
+// the resource of a, within p.opTimeout.
+func (p *purger) delete(ctx context.Context, a *action) error {
+	if p.opTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opTimeout)
+		defer cancel()
+	}
+
+	switch a.Action {
+	case actionQuarantine:
+		return p.quarantineResource(ctx, a)
+	case actionRestore:
+		return p.restoreResource(ctx, a)
+	case actionMark, actionUnmark:
+		return p.markOrphan(ctx, a)
+	}
+
+	switch a.Kind {
+	case kindImage:
+		return p.images.Delete(ctx, a.ResourceGroup, a.Name)
+
+	case kindBlob:
+		bc, err := p.getBlobsClient(ctx, a.ResourceGroup, a.StorageAccount)
+		if err != nil {
+			return err
+		}
+		return bc.DeleteBlob(ctx, a.Container, a.Name)
+
+	case kindGroup:
+		return p.groups.Delete(ctx, a.Name)
+
+	case kindDisk:
+		return p.disks.Delete(ctx, a.ResourceGroup, a.Name)
+
+	case kindSnapshot:
+		return p.snapshots.Delete(ctx, a.ResourceGroup, a.Name)
+
+	case kindNIC:
+		return p.interfaces.Delete(ctx, a.ResourceGroup, a.Name)
+
+	case kindPublicIP:
+		return p.publicIPs.Delete(ctx, a.ResourceGroup, a.Name)
+
+	case kindResource:
+		apiVersion, err := p.apiVersion(ctx, a.ResourceType)
+		if err != nil {
+			return err
+		}
+		return p.resources.DeleteByID(ctx, a.ID, apiVersion)
+	}
+
+	return fmt.Errorf("unknown resource kind %q", a.Kind)
+}
+
+// getBlobsClient returns a BlobsClient for the given storage account, reusing
+// clients between deletions.
+func (p *purger) getBlobsClient(ctx context.Context, resourceGroup, storageAccount string) (azureclient.BlobsClient, error) {
+	key := resourceGroup + "/" + storageAccount
+
+	p.mu.Lock()
+	bc := p.blobsClients[key]
+	p.mu.Unlock()
+	if bc != nil {
+		return bc, nil
+	}
+
+	bc, err := p.storage.GetBlobsClient(ctx, resourceGroup, storageAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.blobsClients == nil {
+		p.blobsClients = map[string]azureclient.BlobsClient{}
+	}
+	p.blobsClients[key] = bc
+
+	return bc, nil
+}
+
+// isRetryable returns true if err indicates that the request was throttled or
+// conflicted with another operation in progress.
+func isRetryable(err error) bool {
+	switch statusCode(err) {
+	case http.StatusTooManyRequests, http.StatusConflict:
+		return true
+	}
+	return false
+}
+
+// statusCode returns the HTTP status code of an error returned by the Azure
+// SDK, or zero if there is none.
+func statusCode(err error) int {
+	switch err := err.(type) {
+	case autorest.DetailedError:
+		if code, ok := err.StatusCode.(int); ok && code != 0 {
+			return code
+		}
+		return statusCode(err.Original)
+	case *autorest.DetailedError:
+		return statusCode(*err)
+	case azure.RequestError:
+		return statusCode(err.DetailedError)
+	case *azure.RequestError:
+		return statusCode(err.DetailedError)
+	case azstorage.AzureStorageServiceError:
+		return err.StatusCode
+	case *azstorage.AzureStorageServiceError:
+		return err.StatusCode
+	}
+	return 0
+}
+
+// sortedResults returns the results of p in deletion order.
+func (p *purger) sortedResults() []result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	results := append([]result(nil), p.results...)
+	sort.Slice(results, func(i, j int) bool {
+		if kindOrder[results[i].Kind] != kindOrder[results[j].Kind] {
+			return kindOrder[results[i].Kind] < kindOrder[results[j].Kind]
+		}
+		return results[i].key() < results[j].key()
+	})
+
+	return results
+}
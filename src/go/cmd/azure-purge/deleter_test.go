@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	azstorage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+func TestStatusCode(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{
+			name: "plain error",
+			err:  errors.New("boom"),
+		},
+		{
+			name: "detailed error",
+			err:  autorest.DetailedError{StatusCode: http.StatusTooManyRequests},
+			want: http.StatusTooManyRequests,
+		},
+		{
+			name: "detailed error wrapping a request error",
+			err:  autorest.NewErrorWithError(&azure.RequestError{DetailedError: autorest.DetailedError{StatusCode: http.StatusConflict}}, "Future", "WaitForCompletion", nil, "failed"),
+			want: http.StatusConflict,
+		},
+		{
+			name: "storage error",
+			err:  azstorage.AzureStorageServiceError{StatusCode: http.StatusTooManyRequests},
+			want: http.StatusTooManyRequests,
+		},
+	} {
+		if got := statusCode(tt.err); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExecute(t *testing.T) {
+	conflict := autorest.DetailedError{StatusCode: http.StatusConflict}
+	throttled := autorest.DetailedError{StatusCode: http.StatusTooManyRequests}
+
+	for _, tt := range []struct {
+		name     string
+		failures map[string][]error
+		delay    time.Duration
+		want     []string
+		wantErr  string
+		wantOut  []string
+	}{
+		{
+			name:    "all deletions succeed",
+			wantOut: []string{"deleted a after 1 attempts", "deleted b after 1 attempts", "deleted c after 1 attempts"},
+			want:    []string{},
+		},
+		{
+			name:     "throttling and conflicts are retried",
+			failures: map[string][]error{"a": {conflict, throttled}, "b": {throttled}},
+			wantOut:  []string{"deleted a after 3 attempts", "deleted b after 2 attempts", "deleted c after 1 attempts"},
+			want:     []string{},
+		},
+		{
+			name:     "retries are limited",
+			failures: map[string][]error{"a": {conflict, conflict, conflict, conflict}},
+			wantOut:  []string{"failed a after 4 attempts", "deleted b after 1 attempts", "deleted c after 1 attempts"},
+			want:     []string{"a"},
+			wantErr:  "1 of 3 deletions failed",
+		},
+		{
+			name:     "other errors are not retried and do not stop other deletions",
+			failures: map[string][]error{"b": {errors.New("boom"), errors.New("boom")}},
+			wantOut:  []string{"deleted a after 1 attempts", "failed b after 1 attempts", "deleted c after 1 attempts"},
+			want:     []string{"b"},
+			wantErr:  "1 of 3 deletions failed",
+		},
+		{
+			name:    "deletions time out",
+			delay:   time.Second,
+			wantOut: []string{"failed a after 1 attempts", "failed b after 1 attempts", "failed c after 1 attempts"},
+			want:    []string{"a", "b", "c"},
+			wantErr: "3 of 3 deletions failed",
+		},
+	} {
+		p, _, _, gc := testPurger(nil, nil, []resources.Group{group("a"), group("b"), group("c")})
+		p.retries = 3
+		p.opTimeout = 50 * time.Millisecond
+		gc.Failures = tt.failures
+		gc.Delay = tt.delay
+
+		var actions []action
+		for _, name := range []string{"a", "b", "c"} {
+			actions = append(actions, action{Action: actionDelete, Kind: kindGroup, Name: name})
+		}
+
+		err := p.execute(context.Background(), actions)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+
+		var out []string
+		for _, r := range p.sortedResults() {
+			if r.err != nil {
+				out = append(out, fmt.Sprintf("failed %s after %d attempts", r.Name, r.attempts))
+			} else {
+				out = append(out, fmt.Sprintf("deleted %s after %d attempts", r.Name, r.attempts))
+			}
+		}
+		if !reflect.DeepEqual(out, tt.wantOut) {
+			t.Errorf("%s: got results %v, want %v", tt.name, out, tt.wantOut)
+		}
+
+		if got := gc.Names(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got groups %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExecuteStopsBeforeLeaseExpires(t *testing.T) {
+	p, _, _, gc := testPurger(nil, nil, []resources.Group{group("a"), group("b")})
+	p.workers = 1
+
+	e := newElector(&fakeLeaseClient{}, "a", &syncBuffer{})
+	e.acquired(time.Now())
+	ctx := context.WithValue(context.Background(), leaseKey{}, e)
+
+	// the lease is not renewed while a is deleted, and is then too close to
+	// expiring for b to be started.
+	gc.OnDelete = func(name string) {
+		e.acquired(time.Now().Add(-e.duration))
+	}
+
+	actions := []action{{Action: actionDelete, Kind: kindGroup, Name: "a"}, {Action: actionDelete, Kind: kindGroup, Name: "b"}}
+	if err := p.execute(ctx, actions); err == nil {
+		t.Error("unexpected success")
+	}
+
+	if got := gc.Names(); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("got groups %v, want [b]", got)
+	}
+	for _, r := range p.sortedResults() {
+		if r.Name == "b" && (r.attempts != 0 || r.err != errLeaseExpiring) {
+			t.Errorf("b: got %d attempts, error %v", r.attempts, r.err)
+		}
+	}
+}
+
+func TestExecuteWorkers(t *testing.T) {
+	var groups []resources.Group
+	var actions []action
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("group%02d", i)
+		groups = append(groups, group(name))
+		actions = append(actions, action{Action: actionDelete, Kind: kindGroup, Name: name})
+	}
+
+	p, _, _, gc := testPurger(nil, nil, groups)
+	p.workers = 3
+	gc.Delay = 10 * time.Millisecond
+
+	if err := p.execute(context.Background(), actions); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := gc.Names(); len(got) != 0 {
+		t.Errorf("got groups %v", got)
+	}
+	if gc.MaxInFlight != 3 {
+		t.Errorf("got %d concurrent deletions, want 3", gc.MaxInFlight)
+	}
+}
+
+func TestExecuteSummary(t *testing.T) {
+	p, _, _, gc := testPurger(nil, nil, []resources.Group{group("a"), group("b")})
+	gc.Failures = map[string][]error{"b": {errors.New("boom")}}
+
+	err := p.execute(context.Background(), []action{
+		{Action: actionDelete, Kind: kindGroup, Name: "b"},
+		{Action: actionDelete, Kind: kindGroup, Name: "a"},
+		{Action: actionKeep, Kind: kindGroup, Name: "c"},
+	})
+
+	out := &strings.Builder{}
+	printSummary(out, "sub", p, err)
+
+	want := `subscription sub: selected 0 images, 0 blobs, 0 groups; failed: 1 of 2 deletions failed
+  deleted group a
+  failed to delete group b after 1 attempts: boom
+`
+	if out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+}
+
+func TestExecuteKeepsBlobsOfSurvivingImages(t *testing.T) {
+	failed, deleted := "centos7-3.10-"+ts(72*time.Hour), "centos7-3.10-"+ts(48*time.Hour)
+	images := []compute.Image{image(failed), image(deleted)}
+
+	p, ic, bc, _ := testPurger(images, []string{failed + ".vhd", deleted + ".vhd"}, nil)
+	ic.Failures = map[string][]error{failed: {errors.New("boom")}}
+	pol := &policy{Images: []imageRule{{}}, Blobs: []blobRule{{}}}
+	pol.setDefaults()
+
+	err := p.run(context.Background(), pol)
+	if err == nil || err.Error() != "1 of 4 deletions failed, 1 not attempted" {
+		t.Errorf("got error %v", err)
+	}
+
+	if got, want := ic.Names("images"), []string{failed}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got images %v, want %v", got, want)
+	}
+	if got, want := bc.Names("images"), []string{failed + ".vhd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got blobs %v, want %v", got, want)
+	}
+
+	out := &strings.Builder{}
+	printSummary(out, "sub", p, err)
+	want := `subscription sub: selected 2 images, 2 blobs, 0 groups; failed: 1 of 4 deletions failed, 1 not attempted
+  failed to delete image ` + failed + ` after 1 attempts: boom
+  deleted image ` + deleted + `
+  did not delete blob ` + failed + `.vhd: an image it backs was not deleted
+  deleted blob ` + deleted + `.vhd
+`
+	if out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+}
+
+func TestExecuteCancelled(t *testing.T) {
+	p, _, _, gc := testPurger(nil, nil, []resources.Group{group("a"), group("b"), group("c")})
+	p.workers = 1
+	gc.Delay = time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	err := p.execute(ctx, []action{
+		{Action: actionDelete, Kind: kindGroup, Name: "a"},
+		{Action: actionDelete, Kind: kindGroup, Name: "b"},
+		{Action: actionDelete, Kind: kindGroup, Name: "c"},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "interrupted after 1 of 3 deletions") {
+		t.Errorf("got error %v", err)
+	}
+
+	if got, want := gc.Names(), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2015-01-01/locks"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2016-06-01/subscriptions"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/azuretest"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+)
+
+const testSubscriptionID = "00000000-0000-0000-0000-000000000000"
+
+// setupE2E starts a fake Azure endpoint and points the azure-purge environment
+// at it.  The returned function restores the environment and stops the server.
+func setupE2E(t *testing.T) (*azuretest.Server, func()) {
+	s := azuretest.NewServer()
+	s.PageSize = 2
+	s.OperationPolls = 2
+
+	dir, err := ioutil.TempDir("", "azure-purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(s.Environment())
+	if err != nil {
+		t.Fatal(err)
+	}
+	envFile := filepath.Join(dir, "environment.json")
+	if err = ioutil.WriteFile(envFile, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"AZURE_ENVIRONMENT":          "AZURESTACKCLOUD",
+		"AZURE_ENVIRONMENT_FILEPATH": envFile,
+		"AZURE_SUBSCRIPTION_ID":      testSubscriptionID,
+		"AZURE_TENANT_ID":            "tenant",
+		"AZURE_CLIENT_ID":            "client",
+		"AZURE_CLIENT_SECRET":        "secret",
+	}
+	oldEnv := map[string]string{}
+	for k, v := range env {
+		oldEnv[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+
+	oldHTTPClient := azureclient.HTTPClient
+	azureclient.HTTPClient = s.Client()
+
+	oldRetryDelay := retryDelay
+	retryDelay = time.Millisecond
+
+	return s, func() {
+		retryDelay = oldRetryDelay
+		azureclient.HTTPClient = oldHTTPClient
+		for k, v := range oldEnv {
+			os.Setenv(k, v)
+		}
+		os.RemoveAll(dir)
+		s.Close()
+	}
+}
+
+func TestE2E(t *testing.T) {
+	s, cleanup := setupE2E(t)
+	defer cleanup()
+
+	now := time.Now()
+	ts := func(d time.Duration) string {
+		return now.Add(-d).UTC().Format("200601021504")
+	}
+
+	s.AddGroup(testSubscriptionID, group("images"))
+	s.AddGroup(testSubscriptionID, group("new-cluster", "now", strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)))
+	s.AddGroup(testSubscriptionID, group("old-cluster", "now", strconv.FormatInt(now.Add(-96*time.Hour).Unix(), 10)))
+	s.AddGroup(testSubscriptionID, group("locked-cluster", "now", strconv.FormatInt(now.Add(-96*time.Hour).Unix(), 10)))
+	s.AddLock(testSubscriptionID, "locked-cluster", "dontdelete", locks.CanNotDelete)
+
+	var wantImages, wantBlobs []string
+	// the recent, not yet validated image counts towards the 5 images kept
+	for i := 1; i <= 7; i++ {
+		name := "centos7-3.10-" + ts(time.Duration(i)*24*time.Hour)
+		s.AddImage(testSubscriptionID, "images", image(name, "valid", "true"))
+		if i <= 4 {
+			wantImages = append(wantImages, name)
+			wantBlobs = append(wantBlobs, name+".vhd")
+		}
+	}
+	for _, name := range []string{"centos7-3.10-" + ts(12*time.Hour), "centos7-3.10-" + ts(time.Hour)} {
+		s.AddImage(testSubscriptionID, "images", image(name))
+	}
+	wantImages = append(wantImages, "centos7-3.10-"+ts(time.Hour))
+	wantBlobs = append(wantBlobs, "centos7-3.10-"+ts(time.Hour)+".vhd", "centos7-3.10-"+ts(30*time.Minute)+".vhd")
+
+	// blobs are kept if referenced by an image's disks, whatever their names
+	rhel := vhdImage("rhel7-3.10-"+ts(24*time.Hour), blobURI("openshiftimages", "images", "rhel7-osdisk.vhd"), blobURI("openshiftimages", "images", "rhel7-datadisk.vhd"))
+	rhel.Tags["valid"] = to.StringPtr("true")
+	s.AddImage(testSubscriptionID, "images", rhel)
+	wantImages = append(wantImages, *rhel.Name)
+	wantBlobs = append(wantBlobs, "rhel7-datadisk.vhd", "rhel7-osdisk.vhd")
+
+	// images and blobs in use by VMs and disks are kept, whatever their age
+	inUse := "centos7-3.10-" + ts(7*24*time.Hour)
+	s.AddVirtualMachine(testSubscriptionID, "new-cluster", vm("master", "/subscriptions/"+testSubscriptionID+"/resourceGroups/images/providers/Microsoft.Compute/images/"+inUse, ""))
+	s.AddDisk(testSubscriptionID, "new-cluster", disk("imported", "", blobURI("openshiftimages", "images", "centos7-3.10-"+ts(192*time.Hour)+".vhd")))
+	wantImages = append(wantImages, inUse)
+	wantBlobs = append(wantBlobs, inUse+".vhd", "centos7-3.10-"+ts(192*time.Hour)+".vhd")
+
+	s.AddStorageAccount(testSubscriptionID, "images", "openshiftimages")
+	s.AddBlob("openshiftimages", "images", "rhel7-osdisk.vhd")
+	s.AddBlob("openshiftimages", "images", "rhel7-datadisk.vhd")
+	s.AddBlob("openshiftimages", "images", "rhel7-3.10-"+ts(24*time.Hour)+".vhd")
+	for _, d := range []time.Duration{30 * time.Minute, time.Hour, 12 * time.Hour, 24 * time.Hour, 48 * time.Hour, 72 * time.Hour, 96 * time.Hour, 120 * time.Hour, 144 * time.Hour, 168 * time.Hour, 192 * time.Hour} {
+		s.AddBlob("openshiftimages", "images", "centos7-3.10-"+ts(d)+".vhd")
+	}
+
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := s.Groups(testSubscriptionID), []string{"images", "locked-cluster", "new-cluster"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, want %v", got, want)
+	}
+
+	sort.Strings(wantImages)
+	sort.Strings(wantBlobs)
+	if got := s.Images(testSubscriptionID, "images"); !reflect.DeepEqual(got, wantImages) {
+		t.Errorf("got images %v, want %v", got, wantImages)
+	}
+	if got := s.Blobs("openshiftimages", "images"); !reflect.DeepEqual(got, wantBlobs) {
+		t.Errorf("got blobs %v, want %v", got, wantBlobs)
+	}
+}
+
+func TestE2EMultipleSubscriptions(t *testing.T) {
+	s, cleanup := setupE2E(t)
+	defer cleanup()
+
+	old := strconv.FormatInt(time.Now().Add(-96*time.Hour).Unix(), 10)
+
+	// sub4 is configured against the wrong tenant, and so fails
+	s.AddSubscription("sub1", "tenant", subscriptions.Enabled)
+	s.AddSubscription("sub2", "tenant", subscriptions.Disabled)
+	s.AddSubscription("sub3", "other", subscriptions.Enabled)
+	s.AddSubscription("sub4", "other", subscriptions.Enabled)
+	for _, sub := range []string{"sub1", "sub2", "sub3", "sub4"} {
+		s.AddGroup(sub, group("old-cluster", "now", old))
+	}
+
+	dir, err := ioutil.TempDir("", "azure-purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policyPath := filepath.Join(dir, "policy.yaml")
+	err = ioutil.WriteFile(policyPath, []byte(`
+subscriptions:
+- tenantId: tenant
+- id: sub3
+  tenantId: other
+- id: sub4
+groups:
+- {}
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPolicyFile := *policyFile
+	*policyFile = policyPath
+	defer func() { *policyFile = oldPolicyFile }()
+
+	err = run()
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 subscriptions failed") {
+		t.Errorf("got error %v, want 1 of 3 subscriptions failed", err)
+	}
+
+	for _, tt := range []struct {
+		sub  string
+		want []string
+	}{
+		{sub: "sub1", want: []string{}},
+		{sub: "sub2", want: []string{"old-cluster"}},
+		{sub: "sub3", want: []string{}},
+		{sub: "sub4", want: []string{"old-cluster"}},
+	} {
+		if got := s.Groups(tt.sub); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got groups %v, want %v", tt.sub, got, tt.want)
+		}
+	}
+}
+
+func TestE2EPlanApply(t *testing.T) {
+	s, cleanup := setupE2E(t)
+	defer cleanup()
+
+	now := time.Now()
+	s.AddGroup(testSubscriptionID, group("images"))
+	s.AddGroup(testSubscriptionID, group("new-cluster", "now", strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)))
+	s.AddGroup(testSubscriptionID, group("old-cluster", "now", strconv.FormatInt(now.Add(-96*time.Hour).Unix(), 10)))
+	s.AddImage(testSubscriptionID, "images", image("centos7-3.10-201801010000"))
+	s.AddStorageAccount(testSubscriptionID, "images", "openshiftimages")
+	s.AddBlob("openshiftimages", "images", "centos7-3.10-201801010000.vhd")
+
+	dir, err := ioutil.TempDir("", "azure-purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	planPath := filepath.Join(dir, "plan.yaml")
+	if err = runPlan([]string{"-o", planPath, "-format", "yaml"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// planning must not delete anything
+	if got, want := s.Groups(testSubscriptionID), []string{"images", "new-cluster", "old-cluster"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, want %v", got, want)
+	}
+
+	if err = runApply([]string{planPath}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := s.Groups(testSubscriptionID), []string{"images", "new-cluster"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, want %v", got, want)
+	}
+	if got, want := s.Images(testSubscriptionID, "images"), []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got images %v, want %v", got, want)
+	}
+	if got, want := s.Blobs("openshiftimages", "images"), []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got blobs %v, want %v", got, want)
+	}
+
+	// the plan's resources no longer exist, so applying it again is refused
+	if err = runApply([]string{planPath}); err == nil || !strings.Contains(err.Error(), "drifted") {
+		t.Errorf("got error %v, want drift", err)
+	}
+}
+
+func TestE2EDeleteFailures(t *testing.T) {
+	s, cleanup := setupE2E(t)
+	defer cleanup()
+
+	s.AddGroup(testSubscriptionID, group("images"))
+	s.AddStorageAccount(testSubscriptionID, "images", "openshiftimages")
+	s.AddBlob("openshiftimages", "images", "centos7-3.10-201801010000.vhd")
+
+	old := strconv.FormatInt(time.Now().Add(-96*time.Hour).Unix(), 10)
+	for _, name := range []string{"busy-cluster", "stuck-cluster", "old-cluster"} {
+		s.AddGroup(testSubscriptionID, group(name, "now", old))
+	}
+
+	// busy-cluster conflicts twice and is then deleted; stuck-cluster
+	// conflicts more often than it is retried.  Neither stops the other
+	// deletions.
+	s.FailRequests(http.MethodDelete, "/images/centos7-3.10-201801010000.vhd", http.StatusTooManyRequests, 1)
+	s.FailRequests(http.MethodDelete, "/resourceGroups/busy-cluster", http.StatusConflict, 2)
+	s.FailRequests(http.MethodDelete, "/resourceGroups/stuck-cluster", http.StatusConflict, 10)
+
+	err := run()
+	if err == nil || !strings.Contains(err.Error(), "1 of 1 subscriptions failed") {
+		t.Errorf("got error %v, want 1 of 1 subscriptions failed", err)
+	}
+
+	if got, want := s.Groups(testSubscriptionID), []string{"images", "stuck-cluster"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, want %v", got, want)
+	}
+	if got, want := s.Blobs("openshiftimages", "images"), []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got blobs %v, want %v", got, want)
+	}
+}
+
+func TestE2ELeaderLease(t *testing.T) {
+	s, cleanup := setupE2E(t)
+	defer cleanup()
+
+	s.AddGroup(testSubscriptionID, group("images"))
+	s.AddStorageAccount(testSubscriptionID, "images", "openshiftimages")
+
+	env, err := azureutil.Environment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	a, err := newDaemonElector(ctx, env, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newDaemonElector(ctx, env, "images/openshiftimages")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the lease blob is created on first use
+	if err = a.leases.AcquireLease(ctx, a.duration, a.id); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Blobs("openshiftimages", defaultLeaseContainer), []string{defaultLeaseBlob}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got blobs %v, want %v", got, want)
+	}
+
+	if err = b.leases.AcquireLease(ctx, b.duration, b.id); statusCode(err) != http.StatusConflict {
+		t.Errorf("got error %v acquiring a held lease, want conflict", err)
+	}
+	if err = a.leases.RenewLease(ctx, a.id); err != nil {
+		t.Error(err)
+	}
+	if err = b.leases.RenewLease(ctx, b.id); err == nil {
+		t.Error("unexpected success renewing another client's lease")
+	}
+
+	if err = a.leases.ReleaseLease(ctx, a.id); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.leases.AcquireLease(ctx, b.duration, b.id); err != nil {
+		t.Errorf("got error %v acquiring a released lease", err)
+	}
+
+	s.BreakLease("openshiftimages", defaultLeaseContainer, defaultLeaseBlob)
+	if err = a.leases.AcquireLease(ctx, a.duration, a.id); err != nil {
+		t.Errorf("got error %v acquiring a broken lease", err)
+	}
+}
+
+func TestE2EOrphans(t *testing.T) {
+	s, cleanup := setupE2E(t)
+	defer cleanup()
+
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	vmID := "/subscriptions/" + testSubscriptionID + "/resourceGroups/cluster/providers/Microsoft.Compute/virtualMachines/master"
+
+	s.AddGroup(testSubscriptionID, group("cluster"))
+	s.AddDisk(testSubscriptionID, "cluster", orphanDisk("cluster", "attached", old, vmID))
+	s.AddDisk(testSubscriptionID, "cluster", orphanDisk("cluster", "unattached", old, "", "orphaned-at", old.Format(time.RFC3339)))
+	s.AddDisk(testSubscriptionID, "cluster", orphanDisk("cluster", "detached", old, ""))
+	s.AddSnapshot(testSubscriptionID, "cluster", snapshot("cluster", "stale", old, "/subscriptions/"+testSubscriptionID+"/resourceGroups/cluster/providers/Microsoft.Compute/disks/gone", "orphaned-at", old.Format(time.RFC3339)))
+	s.AddNetworkInterface(testSubscriptionID, "cluster", nic("cluster", "attached", vmID, "orphaned-at", old.Format(time.RFC3339)))
+	s.AddNetworkInterface(testSubscriptionID, "cluster", nic("cluster", "unattached", "", "orphaned-at", strconv.FormatInt(old.Unix(), 10)))
+	s.AddPublicIPAddress(testSubscriptionID, "cluster", publicIP("cluster", "unassociated", "", "orphaned-at", strconv.FormatInt(old.Unix(), 10)))
+
+	dir, err := ioutil.TempDir("", "azure-purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policyPath := filepath.Join(dir, "policy.yaml")
+	if err = ioutil.WriteFile(policyPath, []byte("orphans:\n- {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPolicyFile := *policyFile
+	*policyFile = policyPath
+	defer func() { *policyFile = oldPolicyFile }()
+
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		resourceType string
+		want         []string
+	}{
+		{resourceType: "Microsoft.Compute/disks", want: []string{"attached", "detached"}},
+		{resourceType: "Microsoft.Compute/snapshots", want: []string{}},
+		{resourceType: "Microsoft.Network/networkInterfaces", want: []string{"attached"}},
+		{resourceType: "Microsoft.Network/publicIPAddresses", want: []string{}},
+	} {
+		if got := s.Resources(testSubscriptionID, tt.resourceType); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.resourceType, got, tt.want)
+		}
+	}
+
+	// the newly detached disk is marked, and the reattached interface
+	// unmarked.
+	if tags := s.ResourceTags(testSubscriptionID, "cluster", "Microsoft.Compute/disks", "detached"); tags["orphaned-at"] == nil {
+		t.Errorf("detached disk: got tags %v", tags)
+	}
+	if tags := s.ResourceTags(testSubscriptionID, "cluster", "Microsoft.Network/networkInterfaces", "attached"); tags["orphaned-at"] != nil {
+		t.Errorf("attached interface: got tags %v", tags)
+	}
+}
+
+func TestE2ETTLs(t *testing.T) {
+	s, cleanup := setupE2E(t)
+	defer cleanup()
+
+	past, future := time.Now().Add(-time.Hour).Format(time.RFC3339), time.Now().Add(time.Hour).Format(time.RFC3339)
+	created := strconv.FormatInt(time.Now().Add(-48*time.Hour).Unix(), 10)
+
+	s.AddGroup(testSubscriptionID, group("expired", "expires-at", past))
+	s.AddResource(testSubscriptionID, "expired", genericResource("expired", "Microsoft.Network/loadBalancers", "lb"))
+	s.AddGroup(testSubscriptionID, group("cluster"))
+	s.AddPublicIPAddress(testSubscriptionID, "cluster", publicIP("cluster", "ip", "", "expires-at", past))
+	s.AddResource(testSubscriptionID, "cluster", genericResource("cluster", "Microsoft.Network/loadBalancers", "lb", "created-at", created, "ttl", "24h"))
+	s.AddResource(testSubscriptionID, "cluster", genericResource("cluster", "Microsoft.Network/loadBalancers", "current", "expires-at", future))
+	s.AddGroup(testSubscriptionID, group("locked"))
+	s.AddLock(testSubscriptionID, "locked", "dontdelete", locks.CanNotDelete)
+	s.AddResource(testSubscriptionID, "locked", genericResource("locked", "Microsoft.Network/loadBalancers", "lb", "expires-at", past))
+
+	dir, err := ioutil.TempDir("", "azure-purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policyPath := filepath.Join(dir, "policy.yaml")
+	if err = ioutil.WriteFile(policyPath, []byte("ttls:\n- {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPolicyFile := *policyFile
+	*policyFile = policyPath
+	defer func() { *policyFile = oldPolicyFile }()
+
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := s.Groups(testSubscriptionID), []string{"cluster", "locked"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, want %v", got, want)
+	}
+	for _, tt := range []struct {
+		resourceType string
+		want         []string
+	}{
+		{resourceType: "Microsoft.Network/loadBalancers", want: []string{"current", "lb"}},
+		{resourceType: "Microsoft.Network/publicIPAddresses", want: []string{}},
+	} {
+		if got := s.Resources(testSubscriptionID, tt.resourceType); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.resourceType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-04-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2015-01-01/locks"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	azstorage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// fakeLocksClient is an in-memory locksClient, keyed by resource group.
+type fakeLocksClient struct {
+	locks map[string][]locks.ManagementLockObject
+}
+
+var _ locksClient = &fakeLocksClient{}
+
+func (c *fakeLocksClient) ListAtResourceGroupLevel(ctx context.Context, resourceGroup string) ([]locks.ManagementLockObject, error) {
+	return c.locks[resourceGroup], nil
+}
+
+// fakeLeaseClient is an in-memory leaseClient.  Leases do not expire; steal
+// simulates another client acquiring the lease after it has.
+type fakeLeaseClient struct {
+	mu     sync.Mutex
+	holder string
+}
+
+var _ leaseClient = &fakeLeaseClient{}
+
+var errLeaseConflict = azstorage.AzureStorageServiceError{StatusCode: http.StatusConflict, Code: "LeaseAlreadyPresent"}
+
+func (c *fakeLeaseClient) AcquireLease(ctx context.Context, d time.Duration, leaseID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.holder != "" && c.holder != leaseID {
+		return errLeaseConflict
+	}
+	c.holder = leaseID
+	return nil
+}
+
+func (c *fakeLeaseClient) RenewLease(ctx context.Context, leaseID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.holder != leaseID {
+		return errLeaseConflict
+	}
+	return nil
+}
+
+func (c *fakeLeaseClient) ReleaseLease(ctx context.Context, leaseID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.holder != leaseID {
+		return errLeaseConflict
+	}
+	c.holder = ""
+	return nil
+}
+
+func (c *fakeLeaseClient) steal(leaseID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.holder = leaseID
+}
+
+func (c *fakeLeaseClient) getHolder() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.holder
+}
+
+// fakeVMsClient is an in-memory vmsClient.  If err is set, List fails with it.
+type fakeVMsClient struct {
+	vms []compute.VirtualMachine
+	err error
+}
+
+var _ vmsClient = &fakeVMsClient{}
+
+func (c *fakeVMsClient) List(ctx context.Context) ([]compute.VirtualMachine, error) {
+	return c.vms, c.err
+}
+
+// fakeDisksClient is an in-memory disksClient.
+type fakeDisksClient struct {
+	mu    sync.Mutex
+	disks []compute.Disk
+}
+
+var _ disksClient = &fakeDisksClient{}
+
+func (c *fakeDisksClient) List(ctx context.Context) ([]compute.Disk, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]compute.Disk(nil), c.disks...), nil
+}
+
+func (c *fakeDisksClient) Delete(ctx context.Context, resourceGroup, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, disk := range c.disks {
+		if strings.EqualFold(*disk.ID, resourceID(resourceGroup, "Microsoft.Compute/disks", name)) {
+			c.disks = append(c.disks[:i], c.disks[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("disk %s/%s not found", resourceGroup, name)
+}
+
+// fakeSnapshotsClient is an in-memory snapshotsClient.
+type fakeSnapshotsClient struct {
+	mu        sync.Mutex
+	snapshots []compute.Snapshot
+}
+
+var _ snapshotsClient = &fakeSnapshotsClient{}
+
+func (c *fakeSnapshotsClient) List(ctx context.Context) ([]compute.Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]compute.Snapshot(nil), c.snapshots...), nil
+}
+
+func (c *fakeSnapshotsClient) Delete(ctx context.Context, resourceGroup, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, snapshot := range c.snapshots {
+		if strings.EqualFold(*snapshot.ID, resourceID(resourceGroup, "Microsoft.Compute/snapshots", name)) {
+			c.snapshots = append(c.snapshots[:i], c.snapshots[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("snapshot %s/%s not found", resourceGroup, name)
+}
+
+// fakeResourcesClient is an in-memory resourcesClient.  The API version used
+// to delete each resource is recorded in deleted, and the tags given to each
+// resource in tagged, keyed by resource ID.
+type fakeResourcesClient struct {
+	mu        sync.Mutex
+	resources []resources.GenericResource
+	deleted   map[string]string
+	tagged    map[string]map[string]*string
+}
+
+var _ resourcesClient = &fakeResourcesClient{}
+
+func (c *fakeResourcesClient) List(ctx context.Context) ([]resources.GenericResource, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]resources.GenericResource(nil), c.resources...), nil
+}
+
+func (c *fakeResourcesClient) UpdateTagsByID(ctx context.Context, id, apiVersion string, tags map[string]*string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.resources {
+		if strings.EqualFold(*c.resources[i].ID, id) {
+			c.resources[i].Tags = tags
+		}
+	}
+	if c.tagged == nil {
+		c.tagged = map[string]map[string]*string{}
+	}
+	c.tagged[id] = tags
+
+	return nil
+}
+
+func (c *fakeResourcesClient) DeleteByID(ctx context.Context, id, apiVersion string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, r := range c.resources {
+		if strings.EqualFold(*r.ID, id) {
+			c.resources = append(c.resources[:i], c.resources[i+1:]...)
+			if c.deleted == nil {
+				c.deleted = map[string]string{}
+			}
+			c.deleted[id] = apiVersion
+			return nil
+		}
+	}
+
+	return fmt.Errorf("resource %s not found", id)
+}
+
+// fakeProvidersClient is an in-memory providersClient, keyed by lower-case
+// namespace.  It counts the calls to Get.
+type fakeProvidersClient struct {
+	mu        sync.Mutex
+	providers map[string]resources.Provider
+	calls     int
+}
+
+var _ providersClient = &fakeProvidersClient{}
+
+func (c *fakeProvidersClient) Get(ctx context.Context, namespace string) (resources.Provider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls++
+	provider, found := c.providers[strings.ToLower(namespace)]
+	if !found {
+		return resources.Provider{}, fmt.Errorf("provider %s not found", namespace)
+	}
+	return provider, nil
+}
+
+// fakeAuditClient is an in-memory auditClient.  If err is set, Insert fails
+// with it.
+type fakeAuditClient struct {
+	mu      sync.Mutex
+	records []auditRecord
+	err     error
+}
+
+var _ auditClient = &fakeAuditClient{}
+
+func (c *fakeAuditClient) Insert(ctx context.Context, records []auditRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	c.records = append(c.records, records...)
+	return nil
+}
+
+func (c *fakeAuditClient) Query(ctx context.Context, q auditQuery) ([]auditRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var records []auditRecord
+	for _, rec := range c.records {
+		if !q.From.IsZero() && rec.Time.Before(q.From) ||
+			!q.To.IsZero() && !rec.Time.Before(q.To) ||
+			q.Name != "" && rec.Name != q.Name {
+			continue
+		}
+		records = append(records, rec)
+	}
+	sortAuditRecords(records)
+
+	return records, nil
+}
+
+// provider returns a resource provider whose resource types each support the
+// given API versions.
+func provider(namespace string, resourceTypes []string, apiVersions ...string) resources.Provider {
+	var types []resources.ProviderResourceType
+	for _, rt := range resourceTypes {
+		types = append(types, resources.ProviderResourceType{ResourceType: to.StringPtr(rt), APIVersions: &apiVersions})
+	}
+	return resources.Provider{Namespace: to.StringPtr(namespace), ResourceTypes: &types}
+}
+
+// genericResource returns a resource of the given type with the given tags,
+// passed as key/value pairs.
+func genericResource(resourceGroup, resourceType, name string, tags ...string) resources.GenericResource {
+	r := resources.GenericResource{
+		ID:   to.StringPtr(resourceID(resourceGroup, resourceType, name)),
+		Name: to.StringPtr(name),
+		Type: to.StringPtr(resourceType),
+		Tags: map[string]*string{},
+	}
+	for i := 0; i < len(tags); i += 2 {
+		r.Tags[tags[i]] = to.StringPtr(tags[i+1])
+	}
+	return r
+}
+
+// image returns an image with the given name and tags, passed as key/value
+// pairs.  As when built from a VHD, its OS disk is the blob NAME.vhd in the
+// default container.
+func image(name string, tags ...string) compute.Image {
+	image := compute.Image{
+		ID:   to.StringPtr(imageID(name)),
+		Name: to.StringPtr(name),
+		Tags: map[string]*string{},
+		ImageProperties: &compute.ImageProperties{
+			StorageProfile: &compute.ImageStorageProfile{
+				OsDisk: &compute.ImageOSDisk{BlobURI: to.StringPtr(blobURI(defaultStorageAccount, defaultContainer, name+".vhd"))},
+			},
+		},
+	}
+	for i := 0; i < len(tags); i += 2 {
+		image.Tags[tags[i]] = to.StringPtr(tags[i+1])
+	}
+	return image
+}
+
+// imageKey returns the key of the action deleting the image name.
+func imageKey(name string) string {
+	return (&action{Kind: kindImage, ResourceGroup: "images", Name: name}).key()
+}
+
+// vhdImage returns an image whose OS and data disks are the blobs with the
+// given URIs.
+func vhdImage(name, osDisk string, dataDisks ...string) compute.Image {
+	image := image(name)
+	image.StorageProfile.OsDisk.BlobURI = to.StringPtr(osDisk)
+
+	var disks []compute.ImageDataDisk
+	for i, uri := range dataDisks {
+		disks = append(disks, compute.ImageDataDisk{Lun: to.Int32Ptr(int32(i)), BlobURI: to.StringPtr(uri)})
+	}
+	image.StorageProfile.DataDisks = &disks
+
+	return image
+}
+
+// blobURI returns the URI of a blob in the public cloud.
+func blobURI(storageAccount, container, name string) string {
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", storageAccount, container, name)
+}
+
+// resourceID returns the ID of a resource of the given type in subscription
+// "sub".
+func resourceID(resourceGroup, resourceType, name string) string {
+	return fmt.Sprintf("/subscriptions/sub/resourceGroups/%s/providers/%s/%s", resourceGroup, resourceType, name)
+}
+
+// imageID returns the resource ID of an image in the images resource group.
+func imageID(name string) string {
+	return resourceID("images", "Microsoft.Compute/images", name)
+}
+
+// vm returns a virtual machine created from the image with the given ID, if
+// any, whose OS and data disks are the blobs with the given URIs.
+func vm(name, imageID string, osDisk string, dataDisks ...string) compute.VirtualMachine {
+	sp := &compute.StorageProfile{}
+	if imageID != "" {
+		sp.ImageReference = &compute.ImageReference{ID: to.StringPtr(imageID)}
+	}
+	if osDisk != "" {
+		sp.OsDisk = &compute.OSDisk{Vhd: &compute.VirtualHardDisk{URI: to.StringPtr(osDisk)}}
+	}
+	var disks []compute.DataDisk
+	for i, uri := range dataDisks {
+		disks = append(disks, compute.DataDisk{Lun: to.Int32Ptr(int32(i)), Vhd: &compute.VirtualHardDisk{URI: to.StringPtr(uri)}})
+	}
+	sp.DataDisks = &disks
+
+	return compute.VirtualMachine{
+		ID:                       to.StringPtr("/subscriptions/sub/resourceGroups/vms/providers/Microsoft.Compute/virtualMachines/" + name),
+		Name:                     to.StringPtr(name),
+		VirtualMachineProperties: &compute.VirtualMachineProperties{StorageProfile: sp},
+	}
+}
+
+// scaleSet returns a scale set created from the image with the given ID, if
+// any, which keeps its OS disks in the containers with the given URIs.
+func scaleSet(name, imageID string, vhdContainers ...string) compute.VirtualMachineScaleSet {
+	sp := &compute.VirtualMachineScaleSetStorageProfile{}
+	if imageID != "" {
+		sp.ImageReference = &compute.ImageReference{ID: to.StringPtr(imageID)}
+	}
+	if len(vhdContainers) > 0 {
+		sp.OsDisk = &compute.VirtualMachineScaleSetOSDisk{VhdContainers: &vhdContainers}
+	}
+
+	return compute.VirtualMachineScaleSet{
+		ID:   to.StringPtr("/subscriptions/sub/resourceGroups/vms/providers/Microsoft.Compute/virtualMachineScaleSets/" + name),
+		Name: to.StringPtr(name),
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+			VirtualMachineProfile: &compute.VirtualMachineScaleSetVMProfile{StorageProfile: sp},
+		},
+	}
+}
+
+// disk returns a managed disk created from the image with the given ID or
+// imported from the blob with the given URI.
+func disk(name, imageID, sourceURI string) compute.Disk {
+	cd := &compute.CreationData{}
+	if imageID != "" {
+		cd.CreateOption = compute.FromImage
+		cd.ImageReference = &compute.ImageDiskReference{ID: to.StringPtr(imageID)}
+	}
+	if sourceURI != "" {
+		cd.CreateOption = compute.Import
+		cd.SourceURI = to.StringPtr(sourceURI)
+	}
+
+	return compute.Disk{
+		ID:             to.StringPtr(resourceID("vms", "Microsoft.Compute/disks", name)),
+		Name:           to.StringPtr(name),
+		DiskProperties: &compute.DiskProperties{CreationData: cd},
+	}
+}
+
+// orphanDisk returns a managed disk created at the given time and attached to
+// the virtual machine managedBy, if set, with the given tags, passed as
+// key/value pairs.
+func orphanDisk(resourceGroup, name string, created time.Time, managedBy string, tags ...string) compute.Disk {
+	d := compute.Disk{
+		ID:             to.StringPtr(resourceID(resourceGroup, "Microsoft.Compute/disks", name)),
+		Name:           to.StringPtr(name),
+		Tags:           map[string]*string{},
+		DiskProperties: &compute.DiskProperties{TimeCreated: &date.Time{Time: created}, CreationData: &compute.CreationData{CreateOption: compute.Empty}},
+	}
+	if managedBy != "" {
+		d.ManagedBy = to.StringPtr(managedBy)
+	}
+	for i := 0; i < len(tags); i += 2 {
+		d.Tags[tags[i]] = to.StringPtr(tags[i+1])
+	}
+	return d
+}
+
+// snapshot returns a snapshot created at the given time and copied from the
+// disk with the given ID, if set, with the given tags, passed as key/value
+// pairs.
+func snapshot(resourceGroup, name string, created time.Time, source string, tags ...string) compute.Snapshot {
+	s := compute.Snapshot{
+		ID:             to.StringPtr(resourceID(resourceGroup, "Microsoft.Compute/snapshots", name)),
+		Name:           to.StringPtr(name),
+		Tags:           map[string]*string{},
+		DiskProperties: &compute.DiskProperties{TimeCreated: &date.Time{Time: created}, CreationData: &compute.CreationData{CreateOption: compute.Import}},
+	}
+	if source != "" {
+		s.CreationData = &compute.CreationData{CreateOption: compute.Copy, SourceResourceID: to.StringPtr(source)}
+	}
+	for i := 0; i < len(tags); i += 2 {
+		s.Tags[tags[i]] = to.StringPtr(tags[i+1])
+	}
+	return s
+}
+
+// nic returns a network interface attached to the virtual machine with the
+// given ID, if set, with the given tags, passed as key/value pairs.
+func nic(resourceGroup, name, vm string, tags ...string) network.Interface {
+	n := network.Interface{
+		ID:                        to.StringPtr(resourceID(resourceGroup, "Microsoft.Network/networkInterfaces", name)),
+		Name:                      to.StringPtr(name),
+		Tags:                      map[string]*string{},
+		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{},
+	}
+	if vm != "" {
+		n.VirtualMachine = &network.SubResource{ID: to.StringPtr(vm)}
+	}
+	for i := 0; i < len(tags); i += 2 {
+		n.Tags[tags[i]] = to.StringPtr(tags[i+1])
+	}
+	return n
+}
+
+// publicIP returns a public IP address associated with the IP configuration
+// with the given ID, if set, with the given tags, passed as key/value pairs.
+func publicIP(resourceGroup, name, ipConfiguration string, tags ...string) network.PublicIPAddress {
+	ip := network.PublicIPAddress{
+		ID:                              to.StringPtr(resourceID(resourceGroup, "Microsoft.Network/publicIPAddresses", name)),
+		Name:                            to.StringPtr(name),
+		Tags:                            map[string]*string{},
+		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{},
+	}
+	if ipConfiguration != "" {
+		ip.IPConfiguration = &network.IPConfiguration{ID: to.StringPtr(ipConfiguration)}
+	}
+	for i := 0; i < len(tags); i += 2 {
+		ip.Tags[tags[i]] = to.StringPtr(tags[i+1])
+	}
+	return ip
+}
+
+// group returns a resource group with the given name and tags, passed as
+// key/value pairs.
+func group(name string, tags ...string) resources.Group {
+	group := resources.Group{Name: to.StringPtr(name), Tags: map[string]*string{}}
+	for i := 0; i < len(tags); i += 2 {
+		group.Tags[tags[i]] = to.StringPtr(tags[i+1])
+	}
+	return group
+}
+
+// lock returns a management lock with the given name and level.
+func lock(name string, level locks.LockLevel) locks.ManagementLockObject {
+	return locks.ManagementLockObject{
+		Name:                     to.StringPtr(name),
+		ManagementLockProperties: &locks.ManagementLockProperties{Level: level},
+	}
+}
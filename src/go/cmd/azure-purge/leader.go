@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLeaseContainer = "azure-purge"
+	defaultLeaseBlob      = "leader"
+
+	// leaseDuration is the lifetime of the leader's lease, which must be
+	// between 15s and 60s.  The lease is renewed every third of its
+	// duration.
+	leaseDuration = 30 * time.Second
+)
+
+// elector elects a single leader among the replicas sharing a blob lease.  The
+// leader holds the lease, renewing it periodically; the other replicas retry
+// until the lease is released or expires.
+type elector struct {
+	leases leaseClient
+
+	// id is the lease ID used by this replica, which must be a GUID.
+	id string
+
+	// duration is the lifetime of the lease, and interval the period at
+	// which it is renewed by the leader and retried by the other replicas.
+	duration time.Duration
+	interval time.Duration
+
+	out io.Writer
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+// leaseKey is the context key of the elector whose leader a context belongs
+// to.
+type leaseKey struct{}
+
+// errLeaseExpiring is returned by checkLease when the leader may not start
+// another deletion.
+var errLeaseExpiring = errors.New("leader lease is about to expire")
+
+// checkLease returns errLeaseExpiring if ctx belongs to a leader whose lease
+// has less than a renewal interval left, as a deletion started then might
+// still be running once another replica has taken over.
+func checkLease(ctx context.Context) error {
+	e, ok := ctx.Value(leaseKey{}).(*elector)
+	if !ok {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if time.Until(e.expires) < e.interval {
+		return errLeaseExpiring
+	}
+	return nil
+}
+
+// acquired records that the lease was acquired or renewed by a request sent at
+// start.
+func (e *elector) acquired(start time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.expires = start.Add(e.duration)
+}
+
+func newElector(leases leaseClient, id string, out io.Writer) *elector {
+	return &elector{
+		leases:   leases,
+		id:       id,
+		duration: leaseDuration,
+		interval: leaseDuration / 3,
+		out:      out,
+	}
+}
+
+// run calls lead each time this replica becomes the leader, until ctx is done.
+// The context passed to lead is cancelled when ctx is done or leadership is
+// lost, and the lease is only released once lead has returned, so that at most
+// one replica is ever leading.
+func (e *elector) run(ctx context.Context, lead func(context.Context)) {
+	for {
+		start := time.Now()
+		err := e.leases.AcquireLease(ctx, e.duration, e.id)
+		switch {
+		case err == nil:
+			e.acquired(start)
+			fmt.Fprintln(e.out, "became leader")
+			e.lead(ctx, lead)
+		case statusCode(err) != http.StatusConflict && ctx.Err() == nil:
+			fmt.Fprintf(e.out, "acquiring lease: %v\n", err)
+		}
+
+		select {
+		case <-time.After(e.interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// lead runs lead while renewing the lease.  lead's context lets checkLease
+// stop deletions before the lease can expire.
+func (e *elector) lead(ctx context.Context, lead func(context.Context)) {
+	leaderCtx, cancel := context.WithCancel(context.WithValue(ctx, leaseKey{}, e))
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lead(leaderCtx)
+	}()
+
+	t := time.NewTicker(e.interval)
+	defer t.Stop()
+
+renew:
+	for {
+		select {
+		case <-t.C:
+			start := time.Now()
+			if err := e.leases.RenewLease(ctx, e.id); err != nil {
+				// the lease may already have been taken by another
+				// replica: stop leading immediately, and do not
+				// release it.
+				fmt.Fprintf(e.out, "lost leadership: %v\n", err)
+				cancel()
+				<-done
+				return
+			}
+			e.acquired(start)
+
+		case <-done:
+			break renew
+
+		case <-ctx.Done():
+			cancel()
+			<-done
+			break renew
+		}
+	}
+
+	// ctx may be done, but the lease is still released so that another
+	// replica need not wait for it to expire.
+	releaseCtx, releaseCancel := context.WithTimeout(context.Background(), e.interval)
+	defer releaseCancel()
+
+	if err := e.leases.ReleaseLease(releaseCtx, e.id); err != nil {
+		fmt.Fprintf(e.out, "releasing lease: %v\n", err)
+		return
+	}
+	fmt.Fprintln(e.out, "released leadership")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer which is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func testElector(leases leaseClient, id string, out *syncBuffer) *elector {
+	e := newElector(leases, id, out)
+	e.interval = 5 * time.Millisecond
+	return e
+}
+
+// waitFor polls f until it returns true, failing the test after a second.
+func waitFor(t *testing.T, what string, f func() bool) {
+	for end := time.Now().Add(time.Second); time.Now().Before(end); time.Sleep(time.Millisecond) {
+		if f() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestElectorSingleLeader(t *testing.T) {
+	leases := &fakeLeaseClient{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var mu sync.Mutex
+	var leading, maxLeading, elected int
+	lead := func(ctx context.Context) {
+		mu.Lock()
+		leading++
+		elected++
+		if leading > maxLeading {
+			maxLeading = leading
+		}
+		mu.Unlock()
+
+		<-ctx.Done()
+
+		mu.Lock()
+		leading--
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range []string{"a", "b", "c"} {
+		e := testElector(leases, id, &syncBuffer{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.run(ctx, lead)
+		}()
+	}
+
+	waitFor(t, "a leader", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return elected > 0
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	wg.Wait()
+
+	if maxLeading != 1 || elected != 1 {
+		t.Errorf("got %d concurrent leaders and %d elections, want 1", maxLeading, elected)
+	}
+	if leading != 0 {
+		t.Errorf("%d leaders still running", leading)
+	}
+	if h := leases.getHolder(); h != "" {
+		t.Errorf("lease still held by %s", h)
+	}
+}
+
+func TestCheckLease(t *testing.T) {
+	if err := checkLease(context.Background()); err != nil {
+		t.Errorf("got %v without an elector", err)
+	}
+
+	e := newElector(&fakeLeaseClient{}, "a", &syncBuffer{})
+	ctx := context.WithValue(context.Background(), leaseKey{}, e)
+
+	for _, tt := range []struct {
+		name     string
+		acquired time.Duration
+		wantErr  error
+	}{
+		{name: "just renewed"},
+		{name: "renewal due", acquired: e.interval},
+		{name: "renewal missed", acquired: e.duration - e.interval + time.Second, wantErr: errLeaseExpiring},
+		{name: "expired", acquired: e.duration, wantErr: errLeaseExpiring},
+	} {
+		e.acquired(time.Now().Add(-tt.acquired))
+		if err := checkLease(ctx); err != tt.wantErr {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestElectorLostLease(t *testing.T) {
+	leases := &fakeLeaseClient{}
+	out := &syncBuffer{}
+	e := testElector(leases, "a", out)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.run(ctx, func(ctx context.Context) {
+			close(started)
+			<-ctx.Done()
+			close(stopped)
+		})
+	}()
+
+	<-started
+	leases.steal("b")
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("leader did not stop after losing its lease")
+	}
+
+	cancel()
+	<-done
+
+	if h := leases.getHolder(); h != "b" {
+		t.Errorf("lease held by %q, want b", h)
+	}
+	if !strings.Contains(out.String(), "lost leadership") {
+		t.Errorf("got output %q", out.String())
+	}
+}
@@ -2,317 +2,550 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
-	"regexp"
-	"sort"
-	"strconv"
+	"strings"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
-	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
-	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2017-10-01/storage"
-	azstorage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+	uuid "github.com/satori/go.uuid"
 )
 
-const (
-	resourceGroup  = "images"
-	storageAccount = "openshiftimages"
-	container      = "images"
-	keepImages     = 5
-	buildTimeout   = 6 * time.Hour
-	groupTimeout   = 3 * 24 * time.Hour
+var (
+	dryRun     = flag.Bool("n", false, "dry-run")
+	policyFile = flag.String("policy", "", "path to YAML or JSON retention policy (default: built-in policy)")
+	workers    = flag.Int("workers", defaultWorkers, "maximum number of concurrent deletions")
+	opTimeout  = flag.Duration("timeout", defaultOpTimeout, "time allowed for each deletion attempt")
+	retries    = flag.Int("retries", defaultRetries, "number of times a throttled or conflicting deletion is retried")
+
+	pushgateway = flag.String("pushgateway", "", "push metrics to the Pushgateway at this URL at the end of the run")
+	pushJob     = flag.String("push-job", "azure-purge", "job name under which metrics are pushed")
+
+	auditAccount = flag.String("audit-account", "", "RESOURCEGROUP/ACCOUNT of the storage account holding the audit log (default: no audit log)")
+	auditTable   = flag.String("audit-table", defaultAuditTable, "name of the audit log table")
+	operator     = flag.String("operator", "", "identity recorded in the audit log (default: AZURE_CLIENT_ID, or the local user)")
 )
 
-var dryRun = flag.Bool("n", false, "dry-run")
+// getAuthorizer returns an authorizer for tenantID.  The default tenant,
+// AZURE_TENANT_ID, is authorized as configured by the usual SDK environment
+// variables; other tenants are authorized using the client credentials of the
+// same (multi-tenant) service principal.
+func getAuthorizer(env azure.Environment, tenantID string) (autorest.Authorizer, error) {
+	if tenantID == os.Getenv("AZURE_TENANT_ID") {
+		return auth.NewAuthorizerFromEnvironment()
+	}
+
+	config := auth.NewClientCredentialsConfig(os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET"), tenantID)
+	config.AADEndpoint = env.ActiveDirectoryEndpoint
+	config.Resource = env.ResourceManagerEndpoint
+	return config.Authorizer()
+}
+
+func newPurger(env azure.Environment, m *metrics, al *auditLog, sub subscription) (*purger, error) {
+	authorizer, err := getAuthorizer(env, sub.tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &purger{
+		images:  azureclient.NewImagesClient(env, sub.id, authorizer),
+		groups:  azureclient.NewGroupsClient(env, sub.id, authorizer),
+		locks:   newLocksClient(env, sub.id, authorizer),
+		storage: azureclient.NewStorageClient(env, sub.id, authorizer),
 
-type byName []compute.Image
+		vms:       newVMsClient(env, sub.id, authorizer),
+		scaleSets: azureclient.NewScaleSetsClient(env, sub.id, authorizer),
+		disks:     newDisksClient(env, sub.id, authorizer),
 
-func (b byName) Len() int           { return len(b) }
-func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
-func (b byName) Less(i, j int) bool { return *b[i].Name < *b[j].Name }
+		snapshots:  newSnapshotsClient(env, sub.id, authorizer),
+		interfaces: azureclient.NewInterfacesClient(env, sub.id, authorizer),
+		publicIPs:  azureclient.NewPublicIPAddressesClient(env, sub.id, authorizer),
 
-var clients = struct {
-	accounts storage.AccountsClient
-	groups   resources.GroupsClient
-	images   compute.ImagesClient
-	storage  azstorage.Client
-}{}
+		resources: newResourcesClient(env, sub.id, authorizer),
+		providers: newProvidersClient(env, sub.id, authorizer),
 
-var now = time.Now()
+		dryRun: *dryRun,
+		now:    time.Now(),
+		out:    os.Stdout,
 
-func getClients() error {
-	subscriptionID := os.Getenv("AZURE_SUBSCRIPTION_ID")
+		workers:    *workers,
+		opTimeout:  *opTimeout,
+		retries:    *retries,
+		retryDelay: retryDelay,
 
-	authorizer, err := auth.NewAuthorizerFromEnvironment()
+		metrics:      m,
+		subscription: sub.id,
+
+		auditLog: al,
+	}, nil
+}
+
+// getSubscriptions loads the policy and resolves the subscriptions it applies
+// to.  Tenants which cannot be listed are reported on stderr and returned as
+// errors.
+func getSubscriptions(ctx context.Context, env azure.Environment) (*policy, []subscription, []error, error) {
+	pol, err := loadPolicy(*policyFile)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
-	clients.accounts = storage.NewAccountsClient(subscriptionID)
-	clients.accounts.Authorizer = authorizer
-	clients.groups = resources.NewGroupsClient(subscriptionID)
-	clients.groups.Authorizer = authorizer
-	clients.images = compute.NewImagesClient(subscriptionID)
-	clients.images.Authorizer = authorizer
+	subs, errs := resolveSubscriptions(ctx, &azureSubscriptionsClient{env: env}, pol.Subscriptions, os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_SUBSCRIPTION_ID"))
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
 
-	keys, err := clients.accounts.ListKeys(context.Background(), resourceGroup, storageAccount)
-	if err != nil {
-		return err
+	return pol, subs, errs, nil
+}
+
+// pushMetrics pushes m to the Pushgateway, if one is configured.  Failure to
+// push is reported but does not fail the run.
+func pushMetrics(m *metrics) {
+	if *pushgateway == "" {
+		return
 	}
 
-	clients.storage, err = azstorage.NewClient(storageAccount, *(*keys.Keys)[0].Value, azstorage.DefaultBaseURL, azstorage.DefaultAPIVersion, true)
-	if err != nil {
-		return err
+	if err := m.push(*pushgateway, *pushJob); err != nil {
+		fmt.Fprintf(os.Stderr, "pushing metrics: %v\n", err)
 	}
+}
 
-	return nil
+// parseAccount parses a storage account of the form RESOURCEGROUP/ACCOUNT.
+func parseAccount(s string) (resourceGroup, storageAccount string, err error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid storage account %q: expected RESOURCEGROUP/ACCOUNT", s)
+	}
+	return parts[0], parts[1], nil
 }
 
-func listGroups() ([]resources.Group, error) {
-	results, err := clients.groups.List(context.Background(), "", nil)
+// getAuditClient returns a client for the audit log table in the storage
+// account given by -audit-account, in the default subscription.
+func getAuditClient(ctx context.Context, env azure.Environment) (auditClient, error) {
+	resourceGroup, storageAccount, err := parseAccount(*auditAccount)
 	if err != nil {
 		return nil, err
 	}
 
-	var groups []resources.Group
-	for ; results.NotDone(); results.Next() {
-		groups = append(groups, results.Values()...)
+	authorizer, err := getAuthorizer(env, os.Getenv("AZURE_TENANT_ID"))
+	if err != nil {
+		return nil, err
 	}
 
-	return groups, nil
+	return newAuditClient(ctx, env, os.Getenv("AZURE_SUBSCRIPTION_ID"), authorizer, resourceGroup, storageAccount, *auditTable)
 }
 
-func listImages() ([]compute.Image, error) {
-	results, err := clients.images.ListByResourceGroup(context.Background(), resourceGroup)
+// getAuditLog returns the audit log of a new run, or nil if no audit log is
+// configured.
+func getAuditLog(ctx context.Context, env azure.Environment) (*auditLog, error) {
+	if *auditAccount == "" {
+		return nil, nil
+	}
+
+	ac, err := getAuditClient(ctx, env)
 	if err != nil {
 		return nil, err
 	}
 
-	var images []compute.Image
-	for ; results.NotDone(); results.Next() {
-		images = append(images, results.Values()...)
+	op := *operator
+	if op == "" {
+		op = getOperator()
 	}
 
-	return images, nil
+	return newAuditLog(ac, op)
 }
 
-func deleteGroups(groups []resources.Group) error {
-	var futures []resources.GroupsDeleteFuture
-	for _, group := range groups {
-		fmt.Printf("delete group %s\n", *group.Name)
-		if *dryRun {
-			continue
-		}
+// purge loads the policy and applies it to every subscription, recording
+// metrics in m.
+func purge(ctx context.Context, env azure.Environment, m *metrics) error {
+	pol, subs, errs, err := getSubscriptions(ctx, env)
+	if err != nil {
+		return err
+	}
 
-		future, err := clients.groups.Delete(context.Background(), *group.Name)
-		if err != nil {
-			return err
-		}
-		futures = append(futures, future)
+	al, err := getAuditLog(ctx, env)
+	if err != nil {
+		return err
 	}
 
-	for _, future := range futures {
-		err := future.WaitForCompletion(context.Background(), clients.groups.Client)
-		if err != nil {
-			return err
-		}
+	failed := purgeSubscriptions(ctx, pol, subs, func(sub subscription) (*purger, error) {
+		return newPurger(env, m, al, sub)
+	}, os.Stdout)
+
+	if failed > 0 || len(errs) > 0 {
+		return fmt.Errorf("%d of %d subscriptions failed, %d tenants could not be listed", failed, len(subs), len(errs))
 	}
 
 	return nil
 }
 
-func deleteImages(images []compute.Image) error {
-	var futures []compute.ImagesDeleteFuture
-	for _, image := range images {
-		fmt.Printf("delete image %s\n", *image.Name)
-		if *dryRun {
-			continue
-		}
+func run() error {
+	env, err := azureutil.Environment()
+	if err != nil {
+		return err
+	}
 
-		future, err := clients.images.Delete(context.Background(), resourceGroup, *image.Name)
-		if err != nil {
-			return err
-		}
-		futures = append(futures, future)
+	m := newMetrics()
+	m.startRun()
+	start := time.Now()
+
+	err = purge(azureutil.SignalContext(), env, m)
+
+	m.endRun(start, err == nil)
+	pushMetrics(m)
+
+	return err
+}
+
+// runPlan writes the plan for the policy without deleting anything.
+func runPlan(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	output := fs.String("o", "", "write the plan to this file (default: stdout)")
+	format := fs.String("format", "json", "plan format: json or yaml")
+	fs.Parse(args)
+
+	ctx := context.Background()
+
+	env, err := azureutil.Environment()
+	if err != nil {
+		return err
 	}
 
-	for _, future := range futures {
-		err := future.WaitForCompletion(context.Background(), clients.images.Client)
+	pol, subs, errs, err := getSubscriptions(ctx, env)
+	if err != nil {
+		return err
+	}
+
+	pl, planErrs := makePlan(ctx, pol, subs, time.Now().UTC(), func(sub subscription) (*purger, error) {
+		return newPurger(env, nil, nil, sub)
+	})
+	for _, err := range planErrs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
 		if err != nil {
 			return err
 		}
+		defer f.Close()
+		w = f
+	}
+
+	if err = writePlan(w, pl, *format); err != nil {
+		return err
+	}
+
+	if len(planErrs) > 0 || len(errs) > 0 {
+		return fmt.Errorf("%d of %d subscriptions could not be planned, %d tenants could not be listed", len(planErrs), len(subs), len(errs))
 	}
 
 	return nil
 }
 
-// purgeInvalidImages removes images from the "images" resourcegroup that are
-// not tagged "valid: true" and which are older than `buildTimeout`.
-func purgeInvalidImages() error {
-	imageRx := regexp.MustCompile(`^.*-([0-9]{12})$`)
+// runApply executes a plan previously written by runPlan.
+func runApply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: azure-purge apply PLANFILE")
+	}
 
-	images, err := listImages()
+	pl, err := readPlan(fs.Arg(0))
 	if err != nil {
 		return err
 	}
 
-	var toDelete []compute.Image
-	for _, image := range images {
-		m := imageRx.FindStringSubmatch(*image.Name)
-		if m == nil {
-			toDelete = append(toDelete, image)
-			continue
-		}
+	env, err := azureutil.Environment()
+	if err != nil {
+		return err
+	}
 
-		t, err := time.Parse("200601021504", m[1])
-		if err == nil && now.Sub(t) < buildTimeout {
-			continue
-		}
+	ctx := azureutil.SignalContext()
 
-		v := image.Tags["valid"]
-		if v == nil || *v != "true" {
-			toDelete = append(toDelete, image)
-		}
+	al, err := getAuditLog(ctx, env)
+	if err != nil {
+		return err
 	}
 
-	return deleteImages(toDelete)
-}
+	m := newMetrics()
+	m.startRun()
+	start := time.Now()
 
-// purgeOldImages removes images from the "images" resourcegroup, leaving only
-// the `keepImages` most recent images of each kind.
-func purgeOldImages() error {
-	imageRx := regexp.MustCompile(`^(.*)-[0-9]{12}$`)
+	failed, err := applyPlan(ctx, pl, func(sub subscription) (*purger, error) {
+		return newPurger(env, m, al, sub)
+	}, os.Stdout)
+
+	m.endRun(start, err == nil && failed == 0)
+	pushMetrics(m)
 
-	images, err := listImages()
 	if err != nil {
 		return err
 	}
 
-	sort.Sort(sort.Reverse(byName(images)))
-
-	var toDelete []compute.Image
-	var lastPrefix *string
-	var i int
-	for _, image := range images {
-		m := imageRx.FindStringSubmatch(*image.Name)
-		switch {
-		case m == nil:
-			toDelete = append(toDelete, image)
-		case lastPrefix == nil || m[1] != *lastPrefix:
-			lastPrefix = &m[1]
-			i = 1
-		default:
-			i++
-			if i > keepImages {
-				toDelete = append(toDelete, image)
-			}
-		}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d subscriptions failed", failed, len(pl.Subscriptions))
 	}
 
-	return deleteImages(toDelete)
+	return nil
 }
 
-// purgeBlobs removes all blobs from `storageAccount`/`container` which do not
-// have a matching image in `resourceGroup` and which are older than
-// `buildTimeout`.
-func purgeBlobs() error {
-	blobRx := regexp.MustCompile(`-([0-9]{12})\.vhd$`)
+// runDaemon purges on a schedule until SIGTERM or SIGINT is received, serving
+// /healthz and /metrics.  Unless disabled, replicas elect a leader by taking a
+// lease on a blob, so that only one purges at a time.
+func runDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	spec := fs.String("schedule", "@hourly", "cron-style purge schedule, e.g. \"0 */6 * * *\" or \"@every 6h\" (UTC)")
+	listen := fs.String("listen", ":8080", "address on which to serve /healthz and /metrics")
+	leaderElection := fs.Bool("leader-election", true, "elect a single leader among replicas")
+	leaseAccount := fs.String("lease-account", "", "RESOURCEGROUP/ACCOUNT of the storage account holding the leader lease (default: that of the policy's first blob rule)")
+	fs.Parse(args)
+
+	sched, err := parseSchedule(*spec)
+	if err != nil {
+		return err
+	}
 
-	images, err := listImages()
+	env, err := azureutil.Environment()
 	if err != nil {
 		return err
 	}
-	allowedBlobs := make(map[string]struct{}, len(images))
-	for _, image := range images {
-		allowedBlobs[*image.Name+".vhd"] = struct{}{}
+
+	ctx := azureutil.SignalContext()
+	m := newMetrics()
+
+	d := &daemon{
+		schedule: sched,
+		metrics:  m,
+		out:      os.Stdout,
+		purge: func(ctx context.Context) error {
+			return purge(ctx, env, m)
+		},
 	}
 
-	bs := clients.storage.GetBlobService()
-	ctr := bs.GetContainerReference(container)
+	if *leaderElection {
+		if d.elector, err = newDaemonElector(ctx, env, *leaseAccount); err != nil {
+			return err
+		}
+	}
 
-	blobs, err := ctr.ListBlobs(azstorage.ListBlobsParameters{})
+	l, err := net.Listen("tcp", *listen)
 	if err != nil {
 		return err
 	}
+	srv := &http.Server{Handler: d.handler()}
+	go srv.Serve(l)
+
+	d.run(ctx)
 
-	for _, blob := range blobs.Blobs {
-		if _, allowed := allowedBlobs[blob.Name]; allowed {
-			continue
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return srv.Shutdown(shutdownCtx)
+}
+
+// newDaemonElector returns an elector using a lease on a blob in the given
+// storage account, in the default subscription.  If leaseAccount is empty, the
+// storage account of the policy's first blob rule is used.
+func newDaemonElector(ctx context.Context, env azure.Environment, leaseAccount string) (*elector, error) {
+	var resourceGroup, storageAccount string
+	if leaseAccount != "" {
+		var err error
+		if resourceGroup, storageAccount, err = parseAccount(leaseAccount); err != nil {
+			return nil, err
 		}
-		if m := blobRx.FindStringSubmatch(blob.Name); m != nil {
-			t, err := time.Parse("200601021504", m[1])
-			if err == nil && now.Sub(t) < buildTimeout {
-				continue
-			}
+	} else {
+		pol, err := loadPolicy(*policyFile)
+		if err != nil {
+			return nil, err
 		}
-		fmt.Printf("delete blob %s\n", blob.Name)
-		if *dryRun {
-			continue
+		if len(pol.Blobs) == 0 {
+			return nil, errors.New("policy has no blob rules: set -lease-account or -leader-election=false")
 		}
+		resourceGroup, storageAccount = pol.Blobs[0].ResourceGroup, pol.Blobs[0].StorageAccount
+	}
 
-		if err = blob.Delete(nil); err != nil {
-			return err
-		}
+	authorizer, err := getAuthorizer(env, os.Getenv("AZURE_TENANT_ID"))
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
-}
+	leases, err := newLeaseClient(ctx, env, os.Getenv("AZURE_SUBSCRIPTION_ID"), authorizer, resourceGroup, storageAccount, defaultLeaseContainer, defaultLeaseBlob)
+	if err != nil {
+		return nil, err
+	}
 
-// purgeGroups removes all resource groups tagged with the "now" tag, where the
-// tag time is older than `groupTimeout`.
-func purgeGroups() error {
-	groups, err := listGroups()
+	id, err := uuid.NewV4()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return newElector(leases, id.String(), os.Stdout), nil
+}
+
+// runAudit runs an audit subcommand.  "query" prints the audit records
+// selected by its flags as JSON.
+func runAudit(args []string) error {
+	if len(args) == 0 || args[0] != "query" {
+		return errors.New("usage: azure-purge audit query [flags]")
 	}
 
-	var toDelete []resources.Group
-	for _, group := range groups {
-		timestamp := group.Tags["now"]
-		if timestamp == nil {
-			continue
+	fs := flag.NewFlagSet("audit query", flag.ExitOnError)
+	since := fs.Duration("since", 0, "only print records written in this period before now, e.g. 24h")
+	from := fs.String("from", "", "only print records written at or after this RFC3339 time")
+	to := fs.String("to", "", "only print records written before this RFC3339 time")
+	name := fs.String("name", "", "only print records about resources with this name")
+	fs.Parse(args[1:])
+	if fs.NArg() != 0 {
+		return errors.New("usage: azure-purge audit query [flags]")
+	}
+	if *auditAccount == "" {
+		return errors.New("-audit-account must be set")
+	}
+
+	q := auditQuery{Name: *name}
+	var err error
+	if *from != "" {
+		if q.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			return err
+		}
+	}
+	if *to != "" {
+		if q.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			return err
 		}
-		t, err := strconv.ParseInt(*timestamp, 10, 64)
-		if err == nil && now.Sub(time.Unix(t, 0)) < groupTimeout {
-			continue
+	}
+	if *since > 0 {
+		if *from != "" {
+			return errors.New("-since and -from are mutually exclusive")
 		}
-		toDelete = append(toDelete, group)
+		q.From = time.Now().Add(-*since)
 	}
 
-	return deleteGroups(toDelete)
-}
+	ctx := context.Background()
 
-func run() error {
-	if err := getClients(); err != nil {
+	env, err := azureutil.Environment()
+	if err != nil {
 		return err
 	}
 
-	if err := purgeInvalidImages(); err != nil {
+	ac, err := getAuditClient(ctx, env)
+	if err != nil {
 		return err
 	}
 
-	if err := purgeOldImages(); err != nil {
+	records, err := ac.Query(ctx, q)
+	if err != nil {
 		return err
 	}
 
-	if err := purgeBlobs(); err != nil {
+	return printAuditRecords(os.Stdout, records)
+}
+
+// runRestore undoes the quarantine of the resources named in args, or of every
+// quarantined resource if there are none, in each subscription of the policy.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Parse(args)
+
+	ctx := azureutil.SignalContext()
+
+	env, err := azureutil.Environment()
+	if err != nil {
 		return err
 	}
 
-	if err := purgeGroups(); err != nil {
+	pol, subs, errs, err := getSubscriptions(ctx, env)
+	if err != nil {
 		return err
 	}
+	if pol.Quarantine == nil {
+		return errors.New("policy has no quarantine")
+	}
+
+	al, err := getAuditLog(ctx, env)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, sub := range subs {
+		p, err := newPurger(env, nil, al, sub)
+		if err == nil {
+			err = p.restore(ctx, pol, fs.Args())
+		}
+
+		if err != nil {
+			failed++
+		}
+		printSummary(os.Stdout, sub.id, p, err)
+	}
+
+	if failed > 0 || len(errs) > 0 {
+		return fmt.Errorf("%d of %d subscriptions failed, %d tenants could not be listed", failed, len(subs), len(errs))
+	}
 
 	return nil
 }
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `usage: %s [flags] [command]
+
+Without a command, the resources selected by the policy are deleted.
+
+Commands:
+  plan [-o FILE] [-format json|yaml]
+	write the resources selected by the policy, and why, as a plan
+  apply PLANFILE
+	delete exactly the resources in a saved plan, refusing if the live state
+	has drifted since the plan was written
+  daemon [-schedule SPEC] [-listen ADDR] [-leader-election=false] [-lease-account RG/ACCOUNT]
+	purge on a schedule until terminated, serving /healthz and /metrics
+  audit query [-since DURATION] [-from TIME] [-to TIME] [-name NAME]
+	print the audit log records in a time range or about a resource, as JSON
+  restore [NAME...]
+	undo the quarantine of the named resources, or of every quarantined
+	resource, if the policy has a quarantine
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	if err := run(); err != nil {
-		panic(err)
+	var err error
+	switch flag.Arg(0) {
+	case "":
+		err = run()
+	case "plan":
+		err = runPlan(flag.Args()[1:])
+	case "apply":
+		err = runApply(flag.Args()[1:])
+	case "daemon":
+		err = runDaemon(flag.Args()[1:])
+	case "audit":
+		err = runAudit(flag.Args()[1:])
+	case "restore":
+		err = runRestore(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
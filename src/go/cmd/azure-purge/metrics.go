@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metrics holds the Prometheus metrics of azure-purge.  Counters accumulate
+// over the lifetime of the process; the oldest surviving resource ages are
+// reset at the start of each run.  A nil *metrics discards all observations.
+type metrics struct {
+	registry *prometheus.Registry
+
+	scanned  *prometheus.CounterVec
+	selected *prometheus.CounterVec
+	deleted  *prometheus.CounterVec
+	failed   *prometheus.CounterVec
+	oldest   *prometheus.GaugeVec
+
+	runDuration prometheus.Gauge
+	lastRun     prometheus.Gauge
+	lastSuccess prometheus.Gauge
+
+	mu      sync.Mutex
+	oldestS map[[3]string]float64
+}
+
+var resourceLabels = []string{"subscription", "kind", "rule"}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		scanned: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "azure_purge_resources_scanned_total",
+			Help: "Number of resources examined by a rule.",
+		}, resourceLabels),
+		selected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "azure_purge_resources_selected_total",
+			Help: "Number of resources selected for deletion by a rule.",
+		}, resourceLabels),
+		deleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "azure_purge_resources_deleted_total",
+			Help: "Number of resources deleted.",
+		}, resourceLabels),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "azure_purge_resources_failed_total",
+			Help: "Number of resources which could not be deleted.",
+		}, resourceLabels),
+		oldest: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "azure_purge_oldest_surviving_resource_age_seconds",
+			Help: "Age of the oldest resource kept by a rule in the last run.",
+		}, resourceLabels),
+		runDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "azure_purge_run_duration_seconds",
+			Help: "Duration of the last run.",
+		}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "azure_purge_last_run_timestamp_seconds",
+			Help: "Time the last run finished.",
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "azure_purge_last_success_timestamp_seconds",
+			Help: "Time the last run without errors finished.",
+		}),
+		oldestS: map[[3]string]float64{},
+	}
+
+	m.registry.MustRegister(m.scanned, m.selected, m.deleted, m.failed, m.oldest, m.runDuration, m.lastRun, m.lastSuccess)
+
+	return m
+}
+
+// startRun resets the per-run metrics.
+func (m *metrics) startRun() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.oldest.Reset()
+	m.oldestS = map[[3]string]float64{}
+}
+
+// endRun records the duration and outcome of a run which started at start.
+func (m *metrics) endRun(start time.Time, success bool) {
+	if m == nil {
+		return
+	}
+
+	now := time.Now()
+	m.runDuration.Set(now.Sub(start).Seconds())
+	m.lastRun.Set(float64(now.Unix()))
+	if success {
+		m.lastSuccess.Set(float64(now.Unix()))
+	}
+}
+
+func (m *metrics) scan(subscriptionID, kind, rule string, n int) {
+	if m == nil {
+		return
+	}
+	m.scanned.WithLabelValues(subscriptionID, kind, rule).Add(float64(n))
+}
+
+func (m *metrics) selectResource(subscriptionID, kind, rule string) {
+	if m == nil {
+		return
+	}
+	m.selected.WithLabelValues(subscriptionID, kind, rule).Inc()
+}
+
+func (m *metrics) result(subscriptionID, kind, rule string, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.failed.WithLabelValues(subscriptionID, kind, rule).Inc()
+	} else {
+		m.deleted.WithLabelValues(subscriptionID, kind, rule).Inc()
+	}
+}
+
+// survive records that a resource of the given age was kept by a rule.
+func (m *metrics) survive(subscriptionID, kind, rule string, age time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := [3]string{subscriptionID, kind, rule}
+	if v, found := m.oldestS[key]; !found || age.Seconds() > v {
+		m.oldestS[key] = age.Seconds()
+		m.oldest.WithLabelValues(subscriptionID, kind, rule).Set(age.Seconds())
+	}
+}
+
+// handler returns an http.Handler serving the metrics.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// push replaces the metrics of job on the Pushgateway at url.
+func (m *metrics) push(url, job string) error {
+	return push.FromGatherer(job, nil, url, m.registry)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricValue returns the value of the named counter or gauge with the given
+// labels, and whether it was found.
+func metricValue(t *testing.T, m *metrics, name string, labels prometheus.Labels) (float64, bool) {
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range families {
+		if mf.GetName() != name {
+			continue
+		}
+	metric:
+		for _, metric := range mf.Metric {
+			if len(metric.Label) != len(labels) {
+				continue
+			}
+			for _, lp := range metric.Label {
+				if v, found := labels[lp.GetName()]; !found || v != lp.GetValue() {
+					continue metric
+				}
+			}
+			if metric.Counter != nil {
+				return metric.Counter.GetValue(), true
+			}
+			return metric.Gauge.GetValue(), true
+		}
+	}
+
+	return 0, false
+}
+
+func TestMetrics(t *testing.T) {
+	images := []compute.Image{
+		image("foo"),
+		image("centos7-3.10-"+ts(48*time.Hour), "valid", "true"),
+		image("centos7-3.10-"+ts(72*time.Hour), "valid", "true"),
+	}
+	blobs := []string{"bar.vhd", "centos7-3.10-" + ts(48*time.Hour) + ".vhd", "centos7-3.10-" + ts(time.Hour) + ".vhd"}
+	groups := []resources.Group{group("new", "now", unix(time.Hour)), group("old", "now", unix(73*time.Hour)), group("older", "now", unix(96*time.Hour)), group("untagged")}
+
+	p, _, _, gc := testPurger(images, blobs, groups)
+	gc.Failures = map[string][]error{"older": {errors.New("boom")}}
+	p.metrics = newMetrics()
+	p.subscription = "sub"
+
+	pol := defaultPolicy()
+	pol.Images[0].KeepImages = to.IntPtr(1)
+	pol.Images[0].DeleteUnmatched = true
+	pol.Blobs[0].DeleteUnmatched = true
+
+	p.metrics.startRun()
+	p.run(context.Background(), pol)
+	p.metrics.endRun(time.Now(), false)
+
+	for _, tt := range []struct {
+		name   string
+		metric string
+		labels prometheus.Labels
+		want   float64
+	}{
+		{name: "images scanned", metric: "azure_purge_resources_scanned_total", labels: prometheus.Labels{"subscription": "sub", "kind": kindImage, "rule": "default"}, want: 3},
+		{name: "blobs scanned", metric: "azure_purge_resources_scanned_total", labels: prometheus.Labels{"subscription": "sub", "kind": kindBlob, "rule": "default"}, want: 3},
+		{name: "groups scanned", metric: "azure_purge_resources_scanned_total", labels: prometheus.Labels{"subscription": "sub", "kind": kindGroup, "rule": "default"}, want: 4},
+		{name: "images selected", metric: "azure_purge_resources_selected_total", labels: prometheus.Labels{"subscription": "sub", "kind": kindImage, "rule": "default"}, want: 2},
+		{name: "blobs selected", metric: "azure_purge_resources_selected_total", labels: prometheus.Labels{"subscription": "sub", "kind": kindBlob, "rule": "default"}, want: 1},
+		{name: "groups selected", metric: "azure_purge_resources_selected_total", labels: prometheus.Labels{"subscription": "sub", "kind": kindGroup, "rule": "default"}, want: 2},
+		{name: "images deleted", metric: "azure_purge_resources_deleted_total", labels: prometheus.Labels{"subscription": "sub", "kind": kindImage, "rule": "default"}, want: 2},
+		{name: "groups deleted", metric: "azure_purge_resources_deleted_total", labels: prometheus.Labels{"subscription": "sub", "kind": kindGroup, "rule": "default"}, want: 1},
+		{name: "groups failed", metric: "azure_purge_resources_failed_total", labels: prometheus.Labels{"subscription": "sub", "kind": kindGroup, "rule": "default"}, want: 1},
+		{name: "oldest image", metric: "azure_purge_oldest_surviving_resource_age_seconds", labels: prometheus.Labels{"subscription": "sub", "kind": kindImage, "rule": "default"}, want: (48 * time.Hour).Seconds()},
+		{name: "oldest blob", metric: "azure_purge_oldest_surviving_resource_age_seconds", labels: prometheus.Labels{"subscription": "sub", "kind": kindBlob, "rule": "default"}, want: (48 * time.Hour).Seconds()},
+		{name: "oldest group", metric: "azure_purge_oldest_surviving_resource_age_seconds", labels: prometheus.Labels{"subscription": "sub", "kind": kindGroup, "rule": "default"}, want: time.Hour.Seconds()},
+	} {
+		got, found := metricValue(t, p.metrics, tt.metric, tt.labels)
+		if !found {
+			t.Errorf("%s: metric %s%v not found", tt.name, tt.metric, tt.labels)
+		} else if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if v, found := metricValue(t, p.metrics, "azure_purge_last_run_timestamp_seconds", nil); !found || v == 0 {
+		t.Errorf("last run timestamp not set")
+	}
+	if v, _ := metricValue(t, p.metrics, "azure_purge_last_success_timestamp_seconds", nil); v != 0 {
+		t.Errorf("last success timestamp set after failed run")
+	}
+
+	p.metrics.startRun()
+	if _, found := metricValue(t, p.metrics, "azure_purge_oldest_surviving_resource_age_seconds", prometheus.Labels{"subscription": "sub", "kind": kindGroup, "rule": "default"}); found {
+		t.Errorf("oldest surviving resource age not reset")
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	p, _, _, _ := testPurger([]compute.Image{image("foo")}, nil, nil)
+	if err := p.run(context.Background(), defaultPolicy()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetricsPush(t *testing.T) {
+	var method, path, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	m := newMetrics()
+	m.scan("sub", kindImage, "default", 3)
+
+	if err := m.push(srv.URL, "azure-purge"); err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodPut || path != "/metrics/job/azure-purge" {
+		t.Errorf("got %s %s", method, path)
+	}
+	if !strings.Contains(body, "azure_purge_resources_scanned_total") {
+		t.Errorf("pushed metrics do not contain azure_purge_resources_scanned_total")
+	}
+}
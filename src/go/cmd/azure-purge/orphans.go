@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// orphan is a resource without an owner, found by an orphan rule, or one
+// which has been adopted: it has an owner again, but is still tagged as
+// orphaned.
+type orphan struct {
+	kind    string
+	id      string
+	tags    map[string]*string
+	adopted bool
+
+	// reason describes why the resource has no owner.
+	reason string
+}
+
+// listOrphans returns the resources of the given kinds which have no owner,
+// and those which have been adopted since they were tagged as orphaned.  Each
+// kind listed is counted as scanned by rule.
+func (p *purger) listOrphans(ctx context.Context, rule orphanRule) ([]orphan, error) {
+	want := map[string]bool{}
+	for _, kind := range rule.Kinds {
+		want[kind] = true
+	}
+
+	var orphans []orphan
+
+	// add adds a resource which is orphaned for the given reason or, if
+	// there is none, which has an owner: those only matter if they are still
+	// tagged as orphaned.
+	add := func(kind string, id *string, tags map[string]*string, reason string) {
+		switch {
+		case reason != "":
+			orphans = append(orphans, orphan{kind: kind, id: to.String(id), tags: tags, reason: reason})
+		case tags[rule.OrphanedTag] != nil:
+			orphans = append(orphans, orphan{kind: kind, id: to.String(id), tags: tags, adopted: true})
+		}
+	}
+
+	if want[kindDisk] || want[kindSnapshot] {
+		disks, err := p.disks.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		snapshots, err := p.snapshots.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sources, err := p.sources(ctx, disks, snapshots)
+		if err != nil {
+			return nil, err
+		}
+
+		if want[kindDisk] {
+			p.metrics.scan(p.subscription, kindDisk, rule.Name, len(disks))
+			for _, disk := range disks {
+				var reason string
+				if disk.ManagedBy == nil && !sources[strings.ToLower(to.String(disk.ID))] {
+					reason = "not attached to a virtual machine"
+				}
+				add(kindDisk, disk.ID, disk.Tags, reason)
+			}
+		}
+
+		if want[kindSnapshot] {
+			p.metrics.scan(p.subscription, kindSnapshot, rule.Name, len(snapshots))
+
+			exists := map[string]bool{}
+			for _, disk := range disks {
+				exists[strings.ToLower(to.String(disk.ID))] = true
+			}
+			for _, snapshot := range snapshots {
+				var reason string
+				if snapshot.DiskProperties != nil && snapshot.CreationData != nil && !sources[strings.ToLower(to.String(snapshot.ID))] {
+					source := to.String(snapshot.CreationData.SourceResourceID)
+					if p.isLocalDisk(source) && !exists[strings.ToLower(source)] {
+						reason = "source disk no longer exists"
+					}
+				}
+				add(kindSnapshot, snapshot.ID, snapshot.Tags, reason)
+			}
+		}
+	}
+
+	if want[kindNIC] {
+		interfaces, err := p.interfaces.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		p.metrics.scan(p.subscription, kindNIC, rule.Name, len(interfaces))
+
+		for _, nic := range interfaces {
+			var reason string
+			if nic.InterfacePropertiesFormat == nil || nic.VirtualMachine == nil {
+				reason = "not attached to a virtual machine"
+			}
+			add(kindNIC, nic.ID, nic.Tags, reason)
+		}
+	}
+
+	if want[kindPublicIP] {
+		addresses, err := p.publicIPs.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		p.metrics.scan(p.subscription, kindPublicIP, rule.Name, len(addresses))
+
+		for _, ip := range addresses {
+			var reason string
+			if ip.PublicIPAddressPropertiesFormat == nil || ip.IPConfiguration == nil {
+				reason = "not associated with an IP configuration"
+			}
+			add(kindPublicIP, ip.ID, ip.Tags, reason)
+		}
+	}
+
+	return orphans, nil
+}
+
+// sources returns the lower-case IDs of the disks and snapshots which are the
+// source of another disk, snapshot or image in the subscription.
+func (p *purger) sources(ctx context.Context, disks []compute.Disk, snapshots []compute.Snapshot) (map[string]bool, error) {
+	images, err := p.images.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := map[string]bool{}
+	add := func(id *string) {
+		if id != nil {
+			sources[strings.ToLower(*id)] = true
+		}
+	}
+
+	for _, disk := range disks {
+		if disk.DiskProperties != nil && disk.CreationData != nil {
+			add(disk.CreationData.SourceResourceID)
+		}
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.DiskProperties != nil && snapshot.CreationData != nil {
+			add(snapshot.CreationData.SourceResourceID)
+		}
+	}
+	for _, image := range images {
+		if image.ImageProperties == nil || image.StorageProfile == nil {
+			continue
+		}
+		if d := image.StorageProfile.OsDisk; d != nil {
+			if d.Snapshot != nil {
+				add(d.Snapshot.ID)
+			}
+			if d.ManagedDisk != nil {
+				add(d.ManagedDisk.ID)
+			}
+		}
+		if image.StorageProfile.DataDisks != nil {
+			for _, d := range *image.StorageProfile.DataDisks {
+				if d.Snapshot != nil {
+					add(d.Snapshot.ID)
+				}
+				if d.ManagedDisk != nil {
+					add(d.ManagedDisk.ID)
+				}
+			}
+		}
+	}
+
+	return sources, nil
+}
+
+// isLocalDisk returns true if id is the ID of a managed disk in p's
+// subscription, whose existence can therefore be checked.
+func (p *purger) isLocalDisk(id string) bool {
+	r, err := azure.ParseResourceID(id)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(r.Provider, "Microsoft.Compute") && strings.EqualFold(r.ResourceType, "disks") &&
+		(p.subscription == "" || strings.EqualFold(r.SubscriptionID, p.subscription))
+}
+
+// planOrphans selects the resources of `rule.Kinds` which have had no owner for
+// longer than `rule.Timeout`.  A new orphan is marked with `rule.OrphanedTag`
+// instead, its age being measured from then, and the tag is removed from
+// resources which have been adopted.  Orphans whose tag cannot be parsed, or
+// which are in a locked resource group, are reported as kept.
+func (p *purger) planOrphans(ctx context.Context, rule orphanRule) ([]action, error) {
+	orphans, err := p.listOrphans(ctx, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := map[string]string{}
+
+	var actions []action
+	for _, o := range orphans {
+		r, err := azure.ParseResourceID(o.id)
+		if err != nil {
+			return nil, err
+		}
+
+		v := o.tags[rule.OrphanedTag]
+		a := action{
+			Action:        actionDelete,
+			Kind:          o.kind,
+			ResourceGroup: r.ResourceGroup,
+			Name:          r.ResourceName,
+			Rule:          rule.Name,
+			Reason:        o.reason,
+			Evidence:      evidence{Tag: rule.OrphanedTag, TagValue: v},
+		}
+		if _, found := p.planned[a.key()]; found {
+			continue
+		}
+		p.recordTags(&a, o.tags)
+
+		var t *time.Time
+		if v != nil {
+			if ts, err := parseTagTime(*v); err == nil {
+				t = &ts
+			}
+		}
+		a.Evidence.Timestamp = t
+
+		lock, found := locked[strings.ToLower(r.ResourceGroup)]
+		if !found {
+			if lock, err = p.deleteLock(ctx, r.ResourceGroup); err != nil {
+				return nil, err
+			}
+			locked[strings.ToLower(r.ResourceGroup)] = lock
+		}
+
+		switch {
+		case lock != "" && o.adopted:
+			continue
+
+		case lock != "":
+			if t != nil {
+				p.survive(o.kind, rule.Name, *t)
+			}
+			a.Action = actionKeep
+			a.Reason = "management lock"
+			a.Evidence.Lock = lock
+
+		case o.adopted:
+			a.Action = actionUnmark
+			a.Reason = "no longer orphaned"
+
+		case v == nil:
+			a.Action = actionMark
+
+		case t == nil:
+			a.Action = actionKeep
+			a.Reason = fmt.Sprintf("%s, but %s tag is not a time", o.reason, rule.OrphanedTag)
+
+		case p.now.Sub(*t) < rule.Timeout.Duration:
+			p.survive(o.kind, rule.Name, *t)
+			continue
+		}
+
+		actions = append(actions, a)
+	}
+
+	return actions, nil
+}
+
+// markOrphan tags the resource of a with the tag of its evidence, holding the
+// time at which it was found orphaned, or for an unmark action, removes the
+// tag.  As with quarantine, the time is that of the marking, not of the plan.
+func (p *purger) markOrphan(ctx context.Context, a *action) error {
+	tags := p.resourceTags(a)
+	if a.Action == actionMark {
+		tags[a.Evidence.Tag] = to.StringPtr(time.Now().UTC().Format(time.RFC3339))
+	} else {
+		delete(tags, a.Evidence.Tag)
+	}
+
+	return p.updateTags(ctx, a, tags)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-04-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2015-01-01/locks"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient/fake"
+)
+
+func TestPurgeOrphans(t *testing.T) {
+	old, recent := testNow.Add(-48*time.Hour), testNow.Add(-time.Hour)
+	longAgo, lately := old.Format(time.RFC3339), recent.Format(time.RFC3339)
+	vmID := resourceID("cluster", "Microsoft.Compute/virtualMachines", "master")
+
+	imageSource := image("rhel7")
+	imageSource.StorageProfile.OsDisk.ManagedDisk = &compute.SubResource{ID: to.StringPtr(resourceID("cluster", "Microsoft.Compute/disks", "imagesource"))}
+
+	p, _, _, _ := testPurger([]compute.Image{imageSource}, nil, nil)
+	p.subscription = "sub"
+	disks := &fakeDisksClient{disks: []compute.Disk{
+		orphanDisk("cluster", "attached", old, vmID),
+		orphanDisk("cluster", "old", old, "", "orphaned-at", longAgo),
+		orphanDisk("cluster", "new", recent, "", "orphaned-at", lately),
+		orphanDisk("cluster", "detached", testNow.Add(-365*24*time.Hour), ""),
+		orphanDisk("cluster", "source", old, ""),
+		orphanDisk("cluster", "imagesource", old, ""),
+		orphanDisk("cluster", "adopted", old, vmID, "orphaned-at", longAgo),
+	}}
+	snapshots := &fakeSnapshotsClient{snapshots: []compute.Snapshot{
+		snapshot("cluster", "copy", old, resourceID("cluster", "Microsoft.Compute/disks", "source")),
+		snapshot("cluster", "stale", old, resourceID("cluster", "Microsoft.Compute/disks", "gone"), "orphaned-at", longAgo),
+		snapshot("cluster", "foreign", old, "/subscriptions/other/resourceGroups/cluster/providers/Microsoft.Compute/disks/gone"),
+		snapshot("cluster", "imported", old, ""),
+	}}
+	interfaces := &fake.InterfacesClient{Interfaces: map[string][]network.Interface{"cluster": {
+		nic("cluster", "attached", vmID),
+		nic("cluster", "tagged", "", "orphaned-at", unix(48*time.Hour)),
+		nic("cluster", "untagged", ""),
+		nic("cluster", "bad", "", "orphaned-at", "yesterday"),
+	}}}
+	publicIPs := &fake.PublicIPAddressesClient{Addresses: map[string][]network.PublicIPAddress{"cluster": {
+		publicIP("cluster", "associated", vmID+"/ipconfig"),
+		publicIP("cluster", "orphan", "", "orphaned-at", longAgo),
+	}}}
+	rc := &fakeResourcesClient{}
+	p.disks, p.snapshots, p.interfaces, p.publicIPs, p.resources = disks, snapshots, interfaces, publicIPs, rc
+	p.providers = &fakeProvidersClient{providers: map[string]resources.Provider{
+		"microsoft.compute": provider("Microsoft.Compute", []string{"disks"}, "2018-04-01"),
+		"microsoft.network": provider("Microsoft.Network", []string{"networkInterfaces", "publicIPAddresses"}, "2018-04-01"),
+	}}
+
+	pol := &policy{Orphans: []orphanRule{{}}}
+	pol.setDefaults()
+
+	if err := p.run(context.Background(), pol); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotDisks, gotSnapshots, gotNICs, gotIPs []string
+	for _, d := range disks.disks {
+		gotDisks = append(gotDisks, *d.Name)
+	}
+	for _, s := range snapshots.snapshots {
+		gotSnapshots = append(gotSnapshots, *s.Name)
+	}
+	for _, n := range interfaces.Interfaces["cluster"] {
+		gotNICs = append(gotNICs, *n.Name)
+	}
+	for _, ip := range publicIPs.Addresses["cluster"] {
+		gotIPs = append(gotIPs, *ip.Name)
+	}
+
+	for _, tt := range []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{name: "disks", got: gotDisks, want: []string{"attached", "new", "detached", "source", "imagesource", "adopted"}},
+		{name: "snapshots", got: gotSnapshots, want: []string{"copy", "foreign", "imported"}},
+		{name: "nics", got: gotNICs, want: []string{"attached", "untagged", "bad"}},
+		{name: "public IPs", got: gotIPs, want: []string{"associated"}},
+	} {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	want := `delete disk old
+mark disk detached: not attached to a virtual machine
+unmark disk adopted: no longer orphaned
+delete snapshot stale
+delete nic tagged
+mark nic untagged: not attached to a virtual machine
+keep nic bad: not attached to a virtual machine, but orphaned-at tag is not a time
+delete publicip orphan
+`
+	if got := p.out.(*bytes.Buffer).String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+
+	// the disk detached after a year in use is only marked, and the
+	// adopted disk is unmarked.
+	if len(rc.tagged) != 3 {
+		t.Errorf("got %d tagged resources, want 3", len(rc.tagged))
+	}
+	for _, name := range []string{"detached", "untagged"} {
+		resourceType := "Microsoft.Compute/disks"
+		if name == "untagged" {
+			resourceType = "Microsoft.Network/networkInterfaces"
+		}
+		tags := rc.tagged[resourceID("cluster", resourceType, name)]
+		if _, err := time.Parse(time.RFC3339, to.String(tags["orphaned-at"])); err != nil {
+			t.Errorf("%s: got tags %v", name, tags)
+		}
+	}
+	if tags, found := rc.tagged[resourceID("cluster", "Microsoft.Compute/disks", "adopted")]; !found || tags["orphaned-at"] != nil {
+		t.Errorf("adopted: got tags %v", tags)
+	}
+
+	for _, kind := range []string{kindDisk, kindSnapshot, kindNIC, kindPublicIP} {
+		if got := p.selected[kind+"s"]; got != 1 {
+			t.Errorf("got %d %ss selected, want 1", got, kind)
+		}
+	}
+}
+
+func TestPurgeOrphansKindsAndLocks(t *testing.T) {
+	old := testNow.Add(-48 * time.Hour)
+
+	p, _, _, _ := testPurger(nil, nil, nil)
+	p.locks = &fakeLocksClient{locks: map[string][]locks.ManagementLockObject{"locked": {lock("dontdelete", locks.CanNotDelete)}}}
+	p.disks = &fakeDisksClient{disks: []compute.Disk{orphanDisk("locked", "disk", old, "", "orphaned-at", unix(48*time.Hour)), orphanDisk("cluster", "disk", old, "", "orphaned-at", unix(48*time.Hour))}}
+	p.publicIPs = &fake.PublicIPAddressesClient{Addresses: map[string][]network.PublicIPAddress{"cluster": {publicIP("cluster", "ip", "", "orphaned-at", unix(48*time.Hour))}}}
+	p.dryRun = true
+
+	// the second rule does not select the disk already selected by the first
+	pol := &policy{Orphans: []orphanRule{{Kinds: []string{kindDisk}}, {}}}
+	pol.setDefaults()
+
+	actions, err := p.plan(context.Background(), pol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for i := range actions {
+		got = append(got, actions[i].Rule+": "+actions[i].String()+" "+actions[i].ResourceGroup)
+	}
+	want := []string{
+		"orphans[0]: keep disk disk: management lock locked",
+		"orphans[0]: delete disk disk cluster",
+		"orphans[1]: keep disk disk: management lock locked",
+		"orphans[1]: delete publicip ip cluster",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got actions %v, want %v", got, want)
+	}
+	if actions[0].Evidence.Lock != "dontdelete (CanNotDelete)" {
+		t.Errorf("got lock evidence %q", actions[0].Evidence.Lock)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// plan is the saved result of evaluating a policy: the actions selected in
+// each subscription at a given time.  A plan can be reviewed and later
+// applied exactly as written.
+type plan struct {
+	Generated     time.Time          `json:"generated"`
+	Policy        *policy            `json:"policy"`
+	Subscriptions []planSubscription `json:"subscriptions"`
+}
+
+// planSubscription holds the actions selected in one subscription.
+type planSubscription struct {
+	ID       string   `json:"id"`
+	TenantID string   `json:"tenantId,omitempty"`
+	Actions  []action `json:"actions"`
+}
+
+// makePlan evaluates pol against each subscription as at now.  Subscriptions
+// which cannot be evaluated are left out of the plan and returned as errors.
+func makePlan(ctx context.Context, pol *policy, subs []subscription, now time.Time, newPurger func(subscription) (*purger, error)) (*plan, []error) {
+	pl := &plan{Generated: now, Policy: pol, Subscriptions: []planSubscription{}}
+
+	purgers, perrs := preparePurgers(ctx, pol, subs, newPurger)
+
+	var errs []error
+	for i, sub := range subs {
+		p, err := purgers[i], perrs[i]
+		if err != nil {
+			errs = append(errs, fmt.Errorf("subscription %s: %v", sub.id, err))
+			continue
+		}
+		p.now = now
+
+		actions, err := p.plan(ctx, pol)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("subscription %s: %v", sub.id, err))
+			continue
+		}
+		if actions == nil {
+			actions = []action{}
+		}
+
+		pl.Subscriptions = append(pl.Subscriptions, planSubscription{ID: sub.id, TenantID: sub.tenantID, Actions: actions})
+	}
+
+	return pl, errs
+}
+
+// writePlan writes pl to w in the given format, "json" or "yaml".
+func writePlan(w io.Writer, pl *plan, format string) error {
+	b, err := json.MarshalIndent(pl, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		b = append(b, '\n')
+	case "yaml":
+		if b, err = yaml.JSONToYAML(b); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown plan format %q", format)
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// readPlan reads a YAML or JSON plan written by writePlan.
+func readPlan(path string) (*plan, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pl, err := parsePlan(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return pl, nil
+}
+
+func parsePlan(b []byte) (*plan, error) {
+	b, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+
+	var pl plan
+	if err = d.Decode(&pl); err != nil {
+		return nil, err
+	}
+
+	if pl.Policy == nil {
+		return nil, errors.New("plan contains no policy")
+	}
+	// plans are written with their defaults filled in, but may be edited.
+	pl.Policy.setDefaults()
+	if err = pl.Policy.validate(); err != nil {
+		return nil, err
+	}
+
+	return &pl, nil
+}
+
+// diffActions compares the planned actions of a subscription with those
+// selected from its live state, and describes each difference.  The actions on
+// a resource are compared together, as an image may be both deleted and
+// missing blobs.
+func diffActions(planned, live []action) []string {
+	marshal := func(actions []action) map[string]string {
+		m := map[string][]string{}
+		for i := range actions {
+			b, _ := json.Marshal(actions[i])
+			m[actions[i].key()] = append(m[actions[i].key()], string(b))
+		}
+
+		joined := make(map[string]string, len(m))
+		for k, v := range m {
+			sort.Strings(v)
+			joined[k] = strings.Join(v, "\n")
+		}
+		return joined
+	}
+	p, l := marshal(planned), marshal(live)
+
+	var diffs []string
+	reported := map[string]bool{}
+	for i := range planned {
+		a := &planned[i]
+		if reported[a.key()] {
+			continue
+		}
+		reported[a.key()] = true
+
+		switch v, found := l[a.key()]; {
+		case !found:
+			diffs = append(diffs, fmt.Sprintf("%s %s is no longer selected", a.Kind, a.displayName()))
+		case v != p[a.key()]:
+			diffs = append(diffs, fmt.Sprintf("%s %s has changed", a.Kind, a.displayName()))
+		}
+	}
+	for i := range live {
+		a := &live[i]
+		if _, found := p[a.key()]; !found && !reported[a.key()] {
+			reported[a.key()] = true
+			diffs = append(diffs, fmt.Sprintf("%s %s is newly selected", a.Kind, a.displayName()))
+		}
+	}
+	sort.Strings(diffs)
+
+	return diffs
+}
+
+// applyPlan executes the actions of pl.  Before anything is deleted, the plan's
+// policy is re-evaluated against the live state of every subscription as at
+// the time the plan was generated; if the result differs from the plan in any
+// way, the plan is refused.  The number of subscriptions which failed is
+// returned.
+func applyPlan(ctx context.Context, pl *plan, newPurger func(subscription) (*purger, error), out io.Writer) (failed int, err error) {
+	subs := make([]subscription, len(pl.Subscriptions))
+	for i, ps := range pl.Subscriptions {
+		subs[i] = subscription{id: ps.ID, tenantID: ps.TenantID}
+	}
+	purgers, errs := preparePurgers(ctx, pl.Policy, subs, newPurger)
+
+	var drift []string
+	for i, ps := range pl.Subscriptions {
+		p, err := purgers[i], errs[i]
+		if err != nil {
+			return 0, fmt.Errorf("subscription %s: %v", ps.ID, err)
+		}
+		p.now = pl.Generated
+
+		live, err := p.plan(ctx, pl.Policy)
+		if err != nil {
+			return 0, fmt.Errorf("subscription %s: %v", ps.ID, err)
+		}
+
+		for _, d := range diffActions(ps.Actions, live) {
+			drift = append(drift, fmt.Sprintf("subscription %s: %s", ps.ID, d))
+		}
+	}
+
+	if len(drift) > 0 {
+		for _, d := range drift {
+			fmt.Fprintln(out, d)
+		}
+		return 0, fmt.Errorf("live state has drifted from the plan (%d differences); refusing to apply", len(drift))
+	}
+
+	for i, ps := range pl.Subscriptions {
+		p := purgers[i]
+		p.report(ps.Actions)
+
+		var errs errorList
+		if !p.dryRun {
+			if err := p.execute(ctx, ps.Actions); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := p.audit(ctx, ps.Actions); err != nil {
+			errs = append(errs, err)
+		}
+
+		var err error
+		if len(errs) > 0 {
+			err = errs
+			failed++
+		}
+		printSummary(out, ps.ID, p, err)
+	}
+
+	return failed, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient/fake"
+)
+
+func timePtr(d time.Duration) *time.Time {
+	t := testNow.Add(-d).Truncate(time.Minute)
+	return &t
+}
+
+func TestPlan(t *testing.T) {
+	images := []compute.Image{
+		image("foo", "valid", "true"),
+		image("centos7-3.10-"+ts(7*time.Hour), "valid", "false"),
+		image("centos7-3.10-"+ts(48*time.Hour), "valid", "true"),
+		image("centos7-3.10-"+ts(72*time.Hour), "valid", "true"),
+	}
+	blobs := []string{"bar.vhd", "centos7-3.10-" + ts(7*time.Hour) + ".vhd", "centos7-3.10-" + ts(72*time.Hour) + ".vhd"}
+	groups := []resources.Group{group("bad", "now", "yesterday"), group("old", "now", unix(73*time.Hour))}
+
+	p, _, _, _ := testPurger(images, blobs, groups)
+	pol := defaultPolicy()
+	pol.Images[0].KeepImages = to.IntPtr(1)
+
+	actions, err := p.plan(context.Background(), pol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldGroup := testNow.Add(-73 * time.Hour)
+	want := []action{
+		{Action: "keep", Kind: kindImage, ResourceGroup: "images", Name: "foo", Rule: "default", Reason: "name does not match naming scheme"},
+		{Action: "delete", Kind: kindImage, ResourceGroup: "images", Name: "centos7-3.10-" + ts(7*time.Hour), Rule: "default", Reason: "not valid after build timeout", Evidence: evidence{Tag: "valid", TagValue: to.StringPtr("false"), Timestamp: timePtr(7 * time.Hour)}},
+		{Action: "delete", Kind: kindImage, ResourceGroup: "images", Name: "centos7-3.10-" + ts(72*time.Hour), Rule: "default", Reason: "older than the newest 1 images", Evidence: evidence{Prefix: "centos7-3.10", Rank: 2, Timestamp: timePtr(72 * time.Hour)}},
+		{Action: "keep", Kind: kindBlob, ResourceGroup: "images", StorageAccount: "openshiftimages", Container: "images", Name: "bar.vhd", Rule: "default", Reason: "name does not match naming scheme"},
+		{Action: "delete", Kind: kindBlob, ResourceGroup: "images", StorageAccount: "openshiftimages", Container: "images", Name: "centos7-3.10-" + ts(72*time.Hour) + ".vhd", Rule: "default", Reason: "not referenced by any image", Evidence: evidence{Timestamp: timePtr(72 * time.Hour)}, Images: []string{imageKey("centos7-3.10-" + ts(72*time.Hour))}},
+		{Action: "delete", Kind: kindBlob, ResourceGroup: "images", StorageAccount: "openshiftimages", Container: "images", Name: "centos7-3.10-" + ts(7*time.Hour) + ".vhd", Rule: "default", Reason: "not referenced by any image", Evidence: evidence{Timestamp: timePtr(7 * time.Hour)}, Images: []string{imageKey("centos7-3.10-" + ts(7*time.Hour))}},
+		{Action: "missing", Kind: kindImage, ResourceGroup: "images", StorageAccount: "openshiftimages", Container: "images", Name: "foo", Rule: "default", Reason: "referenced blob not found", Evidence: evidence{Blobs: []string{blobURI("openshiftimages", "images", "foo.vhd")}}},
+		{Action: "missing", Kind: kindImage, ResourceGroup: "images", StorageAccount: "openshiftimages", Container: "images", Name: "centos7-3.10-" + ts(48*time.Hour), Rule: "default", Reason: "referenced blob not found", Evidence: evidence{Blobs: []string{blobURI("openshiftimages", "images", "centos7-3.10-"+ts(48*time.Hour)+".vhd")}}},
+		{Action: "delete", Kind: kindGroup, Name: "bad", Rule: "default", Reason: "tag is not a timestamp", Evidence: evidence{Tag: "now", TagValue: to.StringPtr("yesterday")}},
+		{Action: "delete", Kind: kindGroup, Name: "old", Rule: "default", Reason: "timeout expired", Evidence: evidence{Tag: "now", TagValue: to.StringPtr(unix(73 * time.Hour)), Timestamp: &oldGroup}},
+	}
+
+	if !reflect.DeepEqual(actions, want) {
+		for i := range actions {
+			t.Logf("got %#v", actions[i])
+		}
+		t.Errorf("got %d actions, want %d", len(actions), len(want))
+	}
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	images := []compute.Image{image("centos7-3.10-"+ts(7*time.Hour), "valid", "false")}
+	groups := []resources.Group{group("old", "now", unix(73*time.Hour))}
+
+	pl, errs := makePlan(context.Background(), defaultPolicy(), []subscription{{id: "sub", tenantID: "tenant"}}, testNow, func(sub subscription) (*purger, error) {
+		p, _, _, _ := testPurger(images, nil, groups)
+		return p, nil
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	for _, format := range []string{"json", "yaml"} {
+		buf := &bytes.Buffer{}
+		if err := writePlan(buf, pl, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		got, err := parsePlan(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !reflect.DeepEqual(got, pl) {
+			t.Errorf("%s: got %#v, want %#v", format, got, pl)
+		}
+	}
+
+	if err := writePlan(&bytes.Buffer{}, pl, "xml"); err == nil {
+		t.Error("unexpected success writing xml")
+	}
+}
+
+func TestDiffActions(t *testing.T) {
+	del := action{Action: actionDelete, Kind: kindImage, ResourceGroup: "images", Name: "foo", Rule: "default", Reason: "expired"}
+	missing := func(uri string) action {
+		return action{Action: actionMissing, Kind: kindImage, ResourceGroup: "images", Name: "foo", Rule: "default", Reason: "referenced blob not found", Evidence: evidence{Blobs: []string{uri}}}
+	}
+	other := action{Action: actionDelete, Kind: kindGroup, Name: "old", Rule: "default", Reason: "expired"}
+
+	for _, tt := range []struct {
+		name    string
+		planned []action
+		live    []action
+		want    []string
+	}{
+		{
+			name:    "unchanged",
+			planned: []action{missing("a"), del},
+			live:    []action{del, missing("a")},
+		},
+		{
+			name:    "missing blobs changed",
+			planned: []action{missing("a"), del},
+			live:    []action{missing("b"), del},
+			want:    []string{"image foo has changed"},
+		},
+		{
+			name:    "image no longer missing blobs",
+			planned: []action{missing("a"), del, other},
+			live:    []action{del, other},
+			want:    []string{"image foo has changed"},
+		},
+		{
+			name:    "newly selected",
+			planned: []action{other},
+			live:    []action{missing("a"), del, other},
+			want:    []string{"image foo is newly selected"},
+		},
+	} {
+		if got := diffActions(tt.planned, tt.live); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyPlan(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		drift     func(ic *fake.ImagesClient, gc *fake.GroupsClient)
+		wantErr   string
+		wantOut   string
+		wantGroup []string
+	}{
+		{
+			name:      "no drift",
+			drift:     func(ic *fake.ImagesClient, gc *fake.GroupsClient) {},
+			wantOut:   "subscription sub: selected 1 images, 0 blobs, 1 groups\n  deleted image foo\n  deleted group old\n",
+			wantGroup: []string{"new"},
+		},
+		{
+			name: "planned resource removed",
+			drift: func(ic *fake.ImagesClient, gc *fake.GroupsClient) {
+				gc.Delete(context.Background(), "old")
+			},
+			wantErr:   "1 differences",
+			wantOut:   "subscription sub: group old is no longer selected\n",
+			wantGroup: []string{"new"},
+		},
+		{
+			name: "evidence changed",
+			drift: func(ic *fake.ImagesClient, gc *fake.GroupsClient) {
+				gc.Groups[1].Tags["now"] = to.StringPtr(unix(96 * time.Hour))
+			},
+			wantErr:   "1 differences",
+			wantOut:   "subscription sub: group old has changed\n",
+			wantGroup: []string{"new", "old"},
+		},
+		{
+			name: "resource newly selected",
+			drift: func(ic *fake.ImagesClient, gc *fake.GroupsClient) {
+				ic.Images["images"] = append(ic.Images["images"], image("bar"))
+				gc.Groups = append(gc.Groups, group("older", "now", unix(96*time.Hour)))
+			},
+			wantErr:   "2 differences",
+			wantOut:   "subscription sub: group older is newly selected\nsubscription sub: image bar is newly selected\n",
+			wantGroup: []string{"new", "old", "older"},
+		},
+	} {
+		p, ic, _, gc := testPurger([]compute.Image{image("foo")}, nil, []resources.Group{group("new", "now", unix(time.Hour)), group("old", "now", unix(73*time.Hour))})
+		pol := &policy{Images: defaultPolicy().Images, Groups: defaultPolicy().Groups}
+		pol.Images[0].DeleteUnmatched = true
+		newPurger := func(sub subscription) (*purger, error) {
+			return p, nil
+		}
+
+		pl, errs := makePlan(context.Background(), pol, []subscription{{id: "sub"}}, testNow, newPurger)
+		if len(errs) > 0 {
+			t.Fatal(errs)
+		}
+
+		tt.drift(ic, gc)
+
+		out := &bytes.Buffer{}
+		failed, err := applyPlan(context.Background(), pl, newPurger, out)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+		} else if err != nil || failed != 0 {
+			t.Errorf("%s: unexpected error %v (%d failed)", tt.name, err, failed)
+		}
+
+		if out.String() != tt.wantOut {
+			t.Errorf("%s: got output %q, want %q", tt.name, out.String(), tt.wantOut)
+		}
+		if got := gc.Names(); !reflect.DeepEqual(got, tt.wantGroup) {
+			t.Errorf("%s: got groups %v, want %v", tt.name, got, tt.wantGroup)
+		}
+	}
+}
@@ -0,0 +1,881 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2015-01-01/locks"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	azstorage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+	"github.com/openshift/azure-misc/src/go/pkg/vmimage"
+)
+
+// errorList is an error made up of several errors.
+type errorList []error
+
+func (errs errorList) Error() string {
+	s := make([]string, 0, len(errs))
+	for _, err := range errs {
+		s = append(s, err.Error())
+	}
+	return strings.Join(s, "; ")
+}
+
+// action is a resource selected for deletion by a rule, together with the
+// evidence for its selection.
+type action struct {
+	Action         string   `json:"action"`
+	Kind           string   `json:"kind"`
+	ResourceGroup  string   `json:"resourceGroup"`
+	StorageAccount string   `json:"storageAccount,omitempty"`
+	Container      string   `json:"container,omitempty"`
+	ResourceType   string   `json:"resourceType,omitempty"`
+	ID             string   `json:"id,omitempty"`
+	Name           string   `json:"name"`
+	Rule           string   `json:"rule"`
+	Reason         string   `json:"reason"`
+	Evidence       evidence `json:"evidence"`
+
+	// Images holds the keys of the actions deleting the images which a blob
+	// backs, which must succeed before the blob is deleted.
+	Images []string `json:"images,omitempty"`
+}
+
+// evidence records the observations which led a rule to select a resource.
+type evidence struct {
+	Tag       string     `json:"tag,omitempty"`
+	TagValue  *string    `json:"tagValue,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Prefix    string     `json:"prefix,omitempty"`
+	Version   string     `json:"version,omitempty"`
+	Rank      int        `json:"rank,omitempty"`
+	Lock      string     `json:"lock,omitempty"`
+	Blobs     []string   `json:"blobs,omitempty"`
+	Referrers []string   `json:"referrers,omitempty"`
+}
+
+const (
+	actionDelete = "delete"
+	actionKeep   = "keep"
+
+	// actionMissing reports an image which references blobs that do not exist.
+	actionMissing = "missing"
+
+	// actionQuarantine quarantines a resource selected for deletion by a
+	// policy with a quarantine, and actionRestore undoes it.
+	actionQuarantine = "quarantine"
+	actionRestore    = "restore"
+
+	// actionMark tags a resource found orphaned with the time, and
+	// actionUnmark removes the tag once it has an owner again.
+	actionMark   = "mark"
+	actionUnmark = "unmark"
+)
+
+const (
+	kindImage    = "image"
+	kindBlob     = "blob"
+	kindGroup    = "group"
+	kindDisk     = "disk"
+	kindSnapshot = "snapshot"
+	kindNIC      = "nic"
+	kindPublicIP = "publicip"
+
+	// kindResource is a resource of any type, deleted by its ID.
+	kindResource = "resource"
+)
+
+// key uniquely identifies the resource of an action within a subscription.
+func (a *action) key() string {
+	return strings.ToLower(strings.Join([]string{a.Kind, a.ResourceGroup, a.StorageAccount, a.Container, a.ResourceType, a.Name}, "/"))
+}
+
+// displayName returns the name of the resource of a, prefixed by its resource
+// type if it has one.
+func (a *action) displayName() string {
+	if a.ResourceType != "" {
+		return a.ResourceType + "/" + a.Name
+	}
+	return a.Name
+}
+
+func (a *action) String() string {
+	if a.Action == actionMissing {
+		return fmt.Sprintf("%s %s %s: %s: %s", a.Action, a.Kind, a.displayName(), a.Reason, strings.Join(a.Evidence.Blobs, ", "))
+	}
+	if len(a.Evidence.Referrers) > 0 {
+		return fmt.Sprintf("%s %s %s: %s: %s", a.Action, a.Kind, a.displayName(), a.Reason, strings.Join(a.Evidence.Referrers, ", "))
+	}
+	if a.Action != actionDelete {
+		return fmt.Sprintf("%s %s %s: %s", a.Action, a.Kind, a.displayName(), a.Reason)
+	}
+	return fmt.Sprintf("%s %s %s", a.Action, a.Kind, a.displayName())
+}
+
+// purger plans and executes the actions of retention rules in a single
+// subscription.
+type purger struct {
+	images  azureclient.ImagesClient
+	groups  azureclient.GroupsClient
+	locks   locksClient
+	storage azureclient.StorageClient
+
+	vms       vmsClient
+	scaleSets azureclient.ScaleSetsClient
+	disks     disksClient
+
+	snapshots  snapshotsClient
+	interfaces azureclient.InterfacesClient
+	publicIPs  azureclient.PublicIPAddressesClient
+
+	resources resourcesClient
+	providers providersClient
+
+	// refs, if set, holds the images and blobs in use, which are never
+	// selected.
+	refs *references
+
+	// blobPageSize limits the number of blobs returned by each list request, or
+	// is zero for the service default of 5000.
+	blobPageSize uint
+
+	// workers bounds the number of concurrent deletions, each attempt of which
+	// is allowed opTimeout and retried up to retries times, backing off
+	// exponentially from retryDelay.
+	workers    int
+	opTimeout  time.Duration
+	retries    int
+	retryDelay time.Duration
+
+	dryRun bool
+	now    time.Time
+	out    io.Writer
+
+	// metrics, if set, records what was scanned, selected and deleted, under
+	// the label subscription.
+	metrics      *metrics
+	subscription string
+
+	// auditLog, if set, records each action executed with the tags of its
+	// resource held in tags, and auditErr the first error writing to it.
+	auditLog *auditLog
+	tags     map[string]map[string]string
+	auditErr error
+
+	// quarantine, if set, is the quarantine of the policy being applied.
+	quarantine *quarantineConfig
+
+	mu           sync.Mutex
+	selected     map[string]int
+	results      []result
+	blobsClients map[string]azureclient.BlobsClient
+
+	// apiVersions caches the API versions of the resource types of each
+	// resource provider, keyed by lower-case namespace and then by lower-case
+	// resource type.
+	apiVersions map[string]map[string][]string
+
+	// planned holds the keys of the resources selected for deletion so far by
+	// plan, so that later rules treat them as already deleted.
+	planned map[string]struct{}
+}
+
+// count records that n resources of the given kind were selected for
+// deletion.
+func (p *purger) count(kind string, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.selected == nil {
+		p.selected = map[string]int{}
+	}
+	p.selected[kind] += n
+}
+
+// survive records the age of a resource, created at t, which rule keeps.
+func (p *purger) survive(kind, rule string, t time.Time) {
+	p.metrics.survive(p.subscription, kind, rule, p.now.Sub(t))
+}
+
+// report prints the given actions and counts the resources to be deleted or
+// quarantined.
+func (p *purger) report(actions []action) {
+	for i := range actions {
+		fmt.Fprintln(p.out, actions[i].String())
+		if actions[i].Action == actionDelete || actions[i].Action == actionQuarantine {
+			p.count(actions[i].Kind+"s", 1)
+			p.metrics.selectResource(p.subscription, actions[i].Kind, actions[i].Rule)
+		}
+	}
+}
+
+// listImages lists the images in resourceGroup, separating those already
+// selected for deletion from those remaining.
+func (p *purger) listImages(ctx context.Context, resourceGroup string) (remaining, selected []compute.Image, err error) {
+	images, err := p.images.ListByResourceGroup(ctx, resourceGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, image := range images {
+		a := action{Kind: kindImage, ResourceGroup: resourceGroup, Name: *image.Name}
+		if _, found := p.planned[a.key()]; found {
+			selected = append(selected, image)
+		} else {
+			remaining = append(remaining, image)
+		}
+	}
+
+	return remaining, selected, nil
+}
+
+// planImages selects the invalid images and then the old images of
+// `rule.ResourceGroup`.
+func (p *purger) planImages(ctx context.Context, rule imageRule) ([]action, error) {
+	scheme, err := rule.scheme()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.refs.err(); err != nil {
+		return nil, err
+	}
+
+	images, _, err := p.listImages(ctx, rule.ResourceGroup)
+	if err != nil {
+		return nil, err
+	}
+	p.metrics.scan(p.subscription, kindImage, rule.Name, len(images))
+
+	invalid := p.selectInvalidImages(rule, scheme, images)
+
+	selected := make(map[string]struct{}, len(invalid))
+	for _, a := range invalid {
+		selected[a.Name] = struct{}{}
+	}
+	var remaining []compute.Image
+	for _, image := range images {
+		if _, found := selected[*image.Name]; !found {
+			remaining = append(remaining, image)
+		}
+	}
+
+	old := p.selectOldImages(rule, scheme, remaining)
+	for _, a := range old {
+		selected[a.Name] = struct{}{}
+	}
+
+	// images in use are kept, whatever their selection.
+	ids := make(map[string]string, len(images))
+	tags := make(map[string]map[string]*string, len(images))
+	for _, image := range images {
+		ids[*image.Name] = to.String(image.ID)
+		tags[*image.Name] = image.Tags
+	}
+	actions := append(invalid, old...)
+	for i := range actions {
+		a := &actions[i]
+		p.recordTags(a, tags[a.Name])
+		if referrers := p.refs.imageReferrers(ids[a.Name]); len(referrers) > 0 {
+			a.Action = actionKeep
+			a.Reason = "in use"
+			a.Evidence.Referrers = referrers
+			delete(selected, a.Name)
+		}
+	}
+
+	for _, image := range images {
+		if _, found := selected[*image.Name]; found {
+			continue
+		}
+		if n, err := scheme.Parse(*image.Name); err == nil {
+			p.survive(kindImage, rule.Name, n.Built)
+		}
+	}
+
+	return actions, nil
+}
+
+// selectInvalidImages selects the images which are not tagged "valid: true" and
+// are older than `rule.BuildTimeout`, and those whose names do not match the
+// naming scheme.
+func (p *purger) selectInvalidImages(rule imageRule, scheme *vmimage.Scheme, images []compute.Image) []action {
+	var actions []action
+	for _, image := range images {
+		a := action{
+			Action:        actionDelete,
+			Kind:          kindImage,
+			ResourceGroup: rule.ResourceGroup,
+			Name:          *image.Name,
+			Rule:          rule.Name,
+		}
+
+		n, err := scheme.Parse(*image.Name)
+		if err != nil {
+			a.Reason = "name does not match naming scheme"
+			if !rule.DeleteUnmatched {
+				a.Action = actionKeep
+			}
+			actions = append(actions, a)
+			continue
+		}
+
+		if p.now.Sub(n.Built) < rule.BuildTimeout.Duration {
+			continue
+		}
+
+		v := image.Tags["valid"]
+		if v == nil || *v != "true" {
+			a.Reason = "not valid after build timeout"
+			a.Evidence = evidence{Tag: "valid", TagValue: v, Timestamp: &n.Built}
+			actions = append(actions, a)
+		}
+	}
+
+	return actions
+}
+
+// selectOldImages selects the images which are not kept by the retention of
+// their family and version, other than the newest valid image of each family.
+func (p *purger) selectOldImages(rule imageRule, scheme *vmimage.Scheme, images []compute.Image) []action {
+	type parsedImage struct {
+		name  string
+		valid bool
+		vmimage.Name
+	}
+
+	var parsed []parsedImage
+	versions := map[string]map[string]struct{}{}
+	for _, image := range images {
+		n, err := scheme.Parse(*image.Name)
+		if err != nil {
+			continue
+		}
+		parsed = append(parsed, parsedImage{name: *image.Name, valid: to.String(image.Tags["valid"]) == "true", Name: n})
+
+		if versions[n.Family] == nil {
+			versions[n.Family] = map[string]struct{}{}
+		}
+		versions[n.Family][n.Version] = struct{}{}
+	}
+
+	// old holds the versions of each family which have the old retention.
+	old := map[string]map[string]bool{}
+	if rule.OldVersions != nil {
+		for family := range versions {
+			vs := make([]string, 0, len(versions[family]))
+			for v := range versions[family] {
+				vs = append(vs, v)
+			}
+			sort.Slice(vs, func(i, j int) bool { return vmimage.CompareVersions(vs[i], vs[j]) > 0 })
+
+			old[family] = map[string]bool{}
+			for i := *rule.CurrentVersions; i < len(vs); i++ {
+				old[family][vs[i]] = true
+			}
+		}
+	}
+
+	// newest version first within each family, and newest first within each
+	// version; families, equal versions and images built at the same time are
+	// in reverse name order.
+	sort.Slice(parsed, func(i, j int) bool {
+		switch {
+		case parsed[i].Family != parsed[j].Family:
+			return parsed[i].Family > parsed[j].Family
+		case parsed[i].Version != parsed[j].Version:
+			if c := vmimage.CompareVersions(parsed[i].Version, parsed[j].Version); c != 0 {
+				return c > 0
+			}
+			return parsed[i].Version > parsed[j].Version
+		case !parsed[i].Built.Equal(parsed[j].Built):
+			return parsed[i].Built.After(parsed[j].Built)
+		default:
+			return parsed[i].name > parsed[j].name
+		}
+	})
+
+	var actions []action
+	var last *parsedImage
+	var i int
+	var keptValid bool
+	var keptWeeks map[int]bool
+	for j := range parsed {
+		image := &parsed[j]
+		if last == nil || image.Family != last.Family {
+			keptValid = false
+		}
+		if last == nil || image.Family != last.Family || image.Version != last.Version {
+			i = 0
+			keptWeeks = map[int]bool{}
+		}
+		last = image
+		i++
+
+		ret := rule.retention()
+		if old[image.Family][image.Version] {
+			ret = *rule.OldVersions
+		}
+
+		keep := i <= *ret.KeepImages || p.now.Sub(image.Built) < ret.KeepYoungerThan.Duration
+		if image.valid && !keptValid {
+			keptValid = true
+			keep = true
+		}
+		if week := int(p.now.Sub(image.Built) / (7 * 24 * time.Hour)); week < ret.KeepWeekly && !keptWeeks[week] {
+			keptWeeks[week] = true
+			keep = true
+		}
+		if keep {
+			continue
+		}
+
+		built := image.Built
+		actions = append(actions, action{
+			Action:        actionDelete,
+			Kind:          kindImage,
+			ResourceGroup: rule.ResourceGroup,
+			Name:          image.name,
+			Rule:          rule.Name,
+			Reason:        fmt.Sprintf("older than the newest %d images", *ret.KeepImages),
+			Evidence:      evidence{Prefix: image.Family, Version: image.Version, Rank: i, Timestamp: &built},
+		})
+	}
+
+	return actions
+}
+
+// blobRef identifies a blob within a subscription.
+type blobRef struct {
+	storageAccount string
+	container      string
+	name           string
+}
+
+// parseBlobURI parses a blob URI of the form
+// https://ACCOUNT.blob.SUFFIX/CONTAINER/NAME, lower-casing the account and
+// container.
+func parseBlobURI(uri string) (blobRef, error) {
+	account, container, name, err := azureutil.ParseBlobURI(uri)
+	if err != nil {
+		return blobRef{}, err
+	}
+
+	return blobRef{storageAccount: strings.ToLower(account), container: strings.ToLower(container), name: name}, nil
+}
+
+// parseContainerURI parses a container URI of the form
+// https://ACCOUNT.blob.SUFFIX/CONTAINER, returning a blobRef with no name.
+func parseContainerURI(uri string) (blobRef, error) {
+	account, container, err := azureutil.ParseContainerURI(uri)
+	if err != nil {
+		return blobRef{}, err
+	}
+
+	return blobRef{storageAccount: strings.ToLower(account), container: strings.ToLower(container)}, nil
+}
+
+// imageBlobURIs returns the URIs of the blobs backing the OS and data disks of
+// image.
+func imageBlobURIs(image compute.Image) []string {
+	var uris []string
+
+	if image.ImageProperties == nil || image.StorageProfile == nil {
+		return nil
+	}
+
+	if d := image.StorageProfile.OsDisk; d != nil && d.BlobURI != nil {
+		uris = append(uris, *d.BlobURI)
+	}
+	if image.StorageProfile.DataDisks != nil {
+		for _, d := range *image.StorageProfile.DataDisks {
+			if d.BlobURI != nil {
+				uris = append(uris, *d.BlobURI)
+			}
+		}
+	}
+
+	return uris
+}
+
+// planBlobs selects the blobs in `rule.StorageAccount`/`rule.Container` which
+// are older than `rule.BuildTimeout` and neither referenced by an image in
+// `rule.ImageResourceGroup` nor in use, and reports the images whose blobs are
+// missing.
+func (p *purger) planBlobs(ctx context.Context, rule blobRule) ([]action, error) {
+	scheme, err := rule.scheme()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.refs.err(); err != nil {
+		return nil, err
+	}
+
+	images, selected, err := p.listImages(ctx, rule.ImageResourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	// refs returns the names of the blobs in the container referenced by
+	// image, and their URIs.
+	refs := func(image compute.Image) (names, uris []string) {
+		for _, uri := range imageBlobURIs(image) {
+			ref, err := parseBlobURI(uri)
+			if err == nil && ref.storageAccount == strings.ToLower(rule.StorageAccount) && ref.container == strings.ToLower(rule.Container) {
+				names = append(names, ref.name)
+				uris = append(uris, uri)
+			}
+		}
+		return
+	}
+
+	// referenced holds the names of the blobs in the container referenced
+	// by any image, and whether each was found.
+	referenced := map[string]bool{}
+	for _, image := range images {
+		names, _ := refs(image)
+		for _, name := range names {
+			referenced[name] = false
+		}
+	}
+
+	// owners holds the keys of the actions deleting the images which each
+	// blob in the container backs.
+	owners := map[string][]string{}
+	for _, image := range selected {
+		ia := action{Kind: kindImage, ResourceGroup: rule.ImageResourceGroup, Name: *image.Name}
+		names, _ := refs(image)
+		for _, name := range names {
+			owners[name] = append(owners[name], ia.key())
+		}
+	}
+
+	bc, err := p.storage.GetBlobsClient(ctx, rule.ResourceGroup, rule.StorageAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	// blobs are considered a page at a time, so that arbitrarily large
+	// containers do not have to be held in memory.
+	var actions []action
+	params := azstorage.ListBlobsParameters{MaxResults: p.blobPageSize}
+	for {
+		blobs, err := bc.ListBlobs(ctx, rule.Container, params)
+		if err != nil {
+			return nil, err
+		}
+
+		p.metrics.scan(p.subscription, kindBlob, rule.Name, len(blobs.Blobs))
+
+		for _, blob := range blobs.Blobs {
+			var t *time.Time
+			if n, err := scheme.Parse(blob.Name); err == nil {
+				t = &n.Built
+			}
+
+			_, isReferenced := referenced[blob.Name]
+			if isReferenced {
+				referenced[blob.Name] = true
+			}
+
+			if isReferenced || t != nil && p.now.Sub(*t) < rule.BuildTimeout.Duration {
+				if t != nil {
+					p.survive(kindBlob, rule.Name, *t)
+				}
+				continue
+			}
+
+			a := action{
+				Action:         actionDelete,
+				Kind:           kindBlob,
+				ResourceGroup:  rule.ResourceGroup,
+				StorageAccount: rule.StorageAccount,
+				Container:      rule.Container,
+				Name:           blob.Name,
+				Rule:           rule.Name,
+				Reason:         "not referenced by any image",
+				Evidence:       evidence{Timestamp: t},
+				Images:         owners[blob.Name],
+			}
+			if t == nil && !rule.DeleteUnmatched {
+				a.Action = actionKeep
+				a.Reason = "name does not match naming scheme"
+			}
+
+			ref := blobRef{storageAccount: strings.ToLower(rule.StorageAccount), container: strings.ToLower(rule.Container), name: blob.Name}
+			if referrers := p.refs.blobReferrers(ref); len(referrers) > 0 {
+				a.Action = actionKeep
+				a.Reason = "in use"
+				a.Evidence.Referrers = referrers
+				if t != nil {
+					p.survive(kindBlob, rule.Name, *t)
+				}
+			}
+
+			actions = append(actions, a)
+		}
+
+		if blobs.NextMarker == "" {
+			break
+		}
+		params.Marker = blobs.NextMarker
+	}
+
+	for _, image := range images {
+		var missing []string
+		names, uris := refs(image)
+		for i, name := range names {
+			if !referenced[name] {
+				missing = append(missing, uris[i])
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		a := action{
+			Action:         actionMissing,
+			Kind:           kindImage,
+			ResourceGroup:  rule.ImageResourceGroup,
+			StorageAccount: rule.StorageAccount,
+			Container:      rule.Container,
+			Name:           *image.Name,
+			Rule:           rule.Name,
+			Reason:         "referenced blob not found",
+			Evidence:       evidence{Blobs: missing},
+		}
+		p.recordTags(&a, image.Tags)
+		actions = append(actions, a)
+	}
+
+	return actions, nil
+}
+
+// planGroups selects the resource groups whose `rule.Tag` time is older than
+// `rule.Timeout`, and reports the tagged groups which are kept.
+func (p *purger) planGroups(ctx context.Context, rule groupRule) ([]action, error) {
+	groups, err := p.groups.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.metrics.scan(p.subscription, kindGroup, rule.Name, len(groups))
+
+	var actions []action
+	for _, group := range groups {
+		timestamp := group.Tags[rule.Tag]
+		if timestamp == nil {
+			continue
+		}
+
+		a := action{
+			Action:   actionDelete,
+			Kind:     kindGroup,
+			Name:     *group.Name,
+			Rule:     rule.Name,
+			Reason:   "tag is not a timestamp",
+			Evidence: evidence{Tag: rule.Tag, TagValue: timestamp},
+		}
+
+		var created *time.Time
+		t, err := strconv.ParseInt(*timestamp, 10, 64)
+		if err == nil {
+			ts := time.Unix(t, 0).UTC()
+			created = &ts
+			a.Reason = "timeout expired"
+			a.Evidence.Timestamp = &ts
+			if p.now.Sub(ts) < rule.Timeout.Duration {
+				a.Action = actionKeep
+				a.Reason = "timeout not expired"
+			}
+		}
+
+		if a.Action == actionDelete {
+			reason, ev, err := p.groupProtection(ctx, rule, group)
+			if err != nil {
+				return nil, err
+			}
+			if reason != "" {
+				a.Action = actionKeep
+				a.Reason = reason
+				a.Evidence = ev
+			}
+		}
+
+		if a.Action == actionKeep && created != nil {
+			p.survive(kindGroup, rule.Name, *created)
+		}
+
+		p.recordTags(&a, group.Tags)
+		actions = append(actions, a)
+	}
+
+	return actions, nil
+}
+
+// groupProtection returns the reason, if any, that group is protected by its
+// persist or expires tags or by a management lock, and the evidence for it.
+func (p *purger) groupProtection(ctx context.Context, rule groupRule, group resources.Group) (string, evidence, error) {
+	if rule.PersistTag != "" {
+		if v := group.Tags[rule.PersistTag]; v != nil && strings.EqualFold(*v, "true") {
+			return "persist tag is set", evidence{Tag: rule.PersistTag, TagValue: v}, nil
+		}
+	}
+
+	if rule.ExpiresTag != "" {
+		if v := group.Tags[rule.ExpiresTag]; v != nil {
+			t, err := time.Parse(time.RFC3339, *v)
+			if err != nil {
+				return "expires tag is not an RFC3339 time", evidence{Tag: rule.ExpiresTag, TagValue: v}, nil
+			}
+			if t.After(p.now) {
+				t = t.UTC()
+				return "expires tag is in the future", evidence{Tag: rule.ExpiresTag, TagValue: v, Timestamp: &t}, nil
+			}
+		}
+	}
+
+	lock, err := p.deleteLock(ctx, *group.Name)
+	if err != nil {
+		return "", evidence{}, err
+	}
+	if lock != "" {
+		return "management lock", evidence{Lock: lock}, nil
+	}
+
+	return "", evidence{}, nil
+}
+
+// deleteLock describes the first CanNotDelete or ReadOnly management lock on
+// resourceGroup, or returns "" if there is none.
+func (p *purger) deleteLock(ctx context.Context, resourceGroup string) (string, error) {
+	l, err := p.locks.ListAtResourceGroupLevel(ctx, resourceGroup)
+	if err != nil {
+		return "", err
+	}
+	for _, lock := range l {
+		if lock.ManagementLockProperties == nil {
+			continue
+		}
+		switch lock.Level {
+		case locks.CanNotDelete, locks.ReadOnly:
+			return fmt.Sprintf("%s (%s)", to.String(lock.Name), lock.Level), nil
+		}
+	}
+
+	return "", nil
+}
+
+// plan evaluates every rule in the policy and then its quarantine, returning
+// the actions and an errorList of the failures.
+func (p *purger) plan(ctx context.Context, pol *policy) ([]action, error) {
+	var actions []action
+	var errs errorList
+	p.planned = map[string]struct{}{}
+	p.quarantine = pol.Quarantine
+
+	add := func(a []action) {
+		for i := range a {
+			if a[i].Action == actionDelete {
+				p.planned[a[i].key()] = struct{}{}
+			}
+		}
+		actions = append(actions, a...)
+	}
+
+	for _, rule := range pol.Images {
+		a, err := p.planImages(ctx, rule)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("images rule %q: %v", rule.Name, err))
+			continue
+		}
+		add(a)
+	}
+
+	for _, rule := range pol.Blobs {
+		a, err := p.planBlobs(ctx, rule)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("blobs rule %q: %v", rule.Name, err))
+			continue
+		}
+		add(a)
+	}
+
+	for _, rule := range pol.Groups {
+		a, err := p.planGroups(ctx, rule)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("groups rule %q: %v", rule.Name, err))
+			continue
+		}
+		add(a)
+	}
+
+	for _, rule := range pol.Orphans {
+		a, err := p.planOrphans(ctx, rule)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("orphans rule %q: %v", rule.Name, err))
+			continue
+		}
+		add(a)
+	}
+
+	for _, rule := range pol.TTLs {
+		a, err := p.planTTLs(ctx, rule)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ttls rule %q: %v", rule.Name, err))
+			continue
+		}
+		add(a)
+	}
+
+	if p.quarantine != nil {
+		p.applyQuarantine(actions)
+
+		a, err := p.planQuarantinedBlobs(ctx, pol)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("quarantine: %v", err))
+		}
+		add(a)
+	}
+
+	if len(errs) > 0 {
+		return actions, errs
+	}
+	return actions, nil
+}
+
+// run plans and then executes every rule in the policy, skipping the actions of
+// failing rules and returning their failures as an errorList.
+func (p *purger) run(ctx context.Context, pol *policy) error {
+	var errs errorList
+
+	actions, err := p.plan(ctx, pol)
+	if err != nil {
+		errs = append(errs, err.(errorList)...)
+	}
+
+	p.report(actions)
+	if !p.dryRun {
+		if err := p.execute(ctx, actions); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := p.audit(ctx, actions); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2015-01-01/locks"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient/fake"
+)
+
+var testNow = time.Date(2018, 6, 14, 12, 0, 0, 0, time.UTC)
+
+// ts returns the image name timestamp of a build d ago.
+func ts(d time.Duration) string {
+	return testNow.Add(-d).Format("200601021504")
+}
+
+// unix returns the "now" tag value of a group created d ago.
+func unix(d time.Duration) string {
+	return strconv.FormatInt(testNow.Add(-d).Unix(), 10)
+}
+
+func testPurger(images []compute.Image, blobs []string, groups []resources.Group) (*purger, *fake.ImagesClient, *fake.BlobsClient, *fake.GroupsClient) {
+	ic := &fake.ImagesClient{Images: map[string][]compute.Image{"images": images}}
+	sc := &fake.StorageClient{}
+	bc := sc.AddAccount("images", "openshiftimages", "eastus")
+	bc.AddBlobs("images", blobs...)
+	gc := &fake.GroupsClient{Groups: groups}
+
+	return &purger{
+		images:  ic,
+		groups:  gc,
+		locks:   &fakeLocksClient{},
+		storage: sc,
+
+		vms:       &fakeVMsClient{},
+		scaleSets: &fake.ScaleSetsClient{},
+		disks:     &fakeDisksClient{},
+
+		snapshots:  &fakeSnapshotsClient{},
+		interfaces: &fake.InterfacesClient{},
+		publicIPs:  &fake.PublicIPAddressesClient{},
+
+		resources: &fakeResourcesClient{},
+		providers: &fakeProvidersClient{},
+
+		now: testNow,
+		out: &bytes.Buffer{},
+	}, ic, bc, gc
+}
+
+func TestPurgeImages(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		images []compute.Image
+		rule   imageRule
+		want   []string
+	}{
+		{
+			name: "unmatched names are kept",
+			images: []compute.Image{
+				image("foo"),
+				image("centos7-3.10-latest", "valid", "true"),
+				image("centos7-3.10-"+ts(7*time.Hour), "valid", "true"),
+			},
+			want: []string{"centos7-3.10-" + ts(7*time.Hour), "centos7-3.10-latest", "foo"},
+		},
+		{
+			name: "unmatched names are removed if the rule says so",
+			images: []compute.Image{
+				image("foo", "valid", "true"),
+				image("centos7-3.10-latest", "valid", "true"),
+				image("centos7-3.10-"+ts(7*time.Hour), "valid", "true"),
+			},
+			rule: imageRule{DeleteUnmatched: true},
+			want: []string{"centos7-3.10-" + ts(7*time.Hour)},
+		},
+		{
+			name: "custom naming scheme",
+			images: []compute.Image{
+				image("rhel-3.10-"+testNow.Add(-72*time.Hour).Format("2006-01-02T15:04"), "valid", "true"),
+				image("rhel-3.10-"+testNow.Add(-48*time.Hour).Format("2006-01-02T15:04"), "valid", "true"),
+				image("rhel-3.10-" + testNow.Add(-7*time.Hour).Format("2006-01-02T15:04")),
+				image("centos7-3.10-" + ts(7*time.Hour)),
+			},
+			rule: imageRule{KeepImages: to.IntPtr(1), NamePattern: `^(?P<family>rhel-[0-9.]+)-(?P<timestamp>.*)$`, TimestampLayout: "2006-01-02T15:04"},
+			want: []string{"centos7-3.10-" + ts(7*time.Hour), "rhel-3.10-" + testNow.Add(-48*time.Hour).Format("2006-01-02T15:04")},
+		},
+		{
+			name: "invalid images are removed after the build timeout",
+			images: []compute.Image{
+				image("centos7-3.10-" + ts(7*time.Hour)),
+				image("centos7-3.10-"+ts(8*time.Hour), "valid", "false"),
+				image("centos7-3.10-"+ts(9*time.Hour), "valid", "true"),
+			},
+			want: []string{"centos7-3.10-" + ts(9*time.Hour)},
+		},
+		{
+			name: "images within the build timeout are kept",
+			images: []compute.Image{
+				image("centos7-3.10-" + ts(time.Hour)),
+				image("centos7-3.10-"+ts(2*time.Hour), "valid", "false"),
+			},
+			want: []string{"centos7-3.10-" + ts(2*time.Hour), "centos7-3.10-" + ts(time.Hour)},
+		},
+		{
+			name: "custom build timeout",
+			images: []compute.Image{
+				image("centos7-3.10-" + ts(time.Hour)),
+				image("centos7-3.10-" + ts(3*time.Hour)),
+			},
+			rule: imageRule{BuildTimeout: &duration{2 * time.Hour}},
+			want: []string{"centos7-3.10-" + ts(time.Hour)},
+		},
+		{
+			name: "only the most recent images of each kind are kept",
+			images: []compute.Image{
+				image("centos7-3.9-"+ts(24*time.Hour), "valid", "true"),
+				image("centos7-3.9-"+ts(48*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(24*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(48*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(72*time.Hour), "valid", "true"),
+			},
+			rule: imageRule{KeepImages: to.IntPtr(2)},
+			want: []string{
+				"centos7-3.10-" + ts(48*time.Hour),
+				"centos7-3.10-" + ts(24*time.Hour),
+				"centos7-3.9-" + ts(48*time.Hour),
+				"centos7-3.9-" + ts(24*time.Hour),
+			},
+		},
+		{
+			name: "recent invalid images count towards the images kept",
+			images: []compute.Image{
+				image("centos7-3.10-" + ts(time.Hour)),
+				image("centos7-3.10-"+ts(24*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(48*time.Hour), "valid", "true"),
+			},
+			rule: imageRule{KeepImages: to.IntPtr(2)},
+			want: []string{"centos7-3.10-" + ts(24*time.Hour), "centos7-3.10-" + ts(time.Hour)},
+		},
+		{
+			name: "the newest valid image is always kept",
+			images: []compute.Image{
+				image("centos7-3.10-" + ts(time.Hour)),
+				image("centos7-3.10-"+ts(24*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(48*time.Hour), "valid", "true"),
+			},
+			rule: imageRule{KeepImages: to.IntPtr(1)},
+			want: []string{"centos7-3.10-" + ts(24*time.Hour), "centos7-3.10-" + ts(time.Hour)},
+		},
+		{
+			name: "only the newest valid image of a family is always kept",
+			images: []compute.Image{
+				image("centos7-3.9-" + ts(time.Hour)),
+				image("centos7-3.9-"+ts(48*time.Hour), "valid", "true"),
+				image("centos7-3.10-" + ts(time.Hour)),
+				image("centos7-3.10-"+ts(24*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(72*time.Hour), "valid", "true"),
+			},
+			rule: imageRule{
+				KeepImages:  to.IntPtr(1),
+				NamePattern: `^(?P<family>centos7)-(?P<version>[0-9.]+)-(?P<timestamp>[0-9]{12})$`,
+			},
+			want: []string{"centos7-3.10-" + ts(24*time.Hour), "centos7-3.10-" + ts(time.Hour), "centos7-3.9-" + ts(time.Hour)},
+		},
+		{
+			name: "the newest valid image may be of an older version",
+			images: []compute.Image{
+				image("centos7-3.9-" + ts(time.Hour)),
+				image("centos7-3.9-"+ts(48*time.Hour), "valid", "true"),
+				image("centos7-3.10-" + ts(time.Hour)),
+			},
+			rule: imageRule{
+				KeepImages:  to.IntPtr(1),
+				NamePattern: `^(?P<family>centos7)-(?P<version>[0-9.]+)-(?P<timestamp>[0-9]{12})$`,
+			},
+			want: []string{"centos7-3.10-" + ts(time.Hour), "centos7-3.9-" + ts(48*time.Hour), "centos7-3.9-" + ts(time.Hour)},
+		},
+		{
+			name: "no images need be kept by count",
+			images: []compute.Image{
+				image("centos7-3.10-"+ts(24*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(48*time.Hour), "valid", "true"),
+			},
+			rule: imageRule{KeepImages: to.IntPtr(0)},
+			want: []string{"centos7-3.10-" + ts(24*time.Hour)},
+		},
+		{
+			name: "recent images are kept",
+			images: []compute.Image{
+				image("centos7-3.10-"+ts(24*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(48*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(72*time.Hour), "valid", "true"),
+			},
+			rule: imageRule{KeepImages: to.IntPtr(1), KeepYoungerThan: duration{60 * time.Hour}},
+			want: []string{"centos7-3.10-" + ts(48*time.Hour), "centos7-3.10-" + ts(24*time.Hour)},
+		},
+		{
+			name: "one image per week is kept",
+			images: []compute.Image{
+				image("centos7-3.10-"+ts(24*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(48*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(8*24*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(9*24*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(15*24*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(22*24*time.Hour), "valid", "true"),
+			},
+			rule: imageRule{KeepImages: to.IntPtr(1), KeepWeekly: 3},
+			want: []string{
+				"centos7-3.10-" + ts(15*24*time.Hour),
+				"centos7-3.10-" + ts(8*24*time.Hour),
+				"centos7-3.10-" + ts(24*time.Hour),
+			},
+		},
+		{
+			name: "old versions have their own retention",
+			images: []compute.Image{
+				image("centos7-3.9-"+ts(24*time.Hour), "valid", "true"),
+				image("centos7-3.9-"+ts(48*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(24*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(48*time.Hour), "valid", "true"),
+				image("centos7-3.10-"+ts(72*time.Hour), "valid", "true"),
+			},
+			rule: imageRule{
+				KeepImages:  to.IntPtr(2),
+				NamePattern: `^(?P<family>centos7)-(?P<version>[0-9.]+)-(?P<timestamp>[0-9]{12})$`,
+				OldVersions: &retention{KeepImages: to.IntPtr(1)},
+			},
+			want: []string{
+				"centos7-3.10-" + ts(48*time.Hour),
+				"centos7-3.10-" + ts(24*time.Hour),
+				"centos7-3.9-" + ts(24*time.Hour),
+			},
+		},
+	} {
+		p, ic, _, _ := testPurger(tt.images, nil, nil)
+		pol := &policy{Images: []imageRule{tt.rule}}
+		pol.setDefaults()
+
+		if err := p.run(context.Background(), pol); err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		}
+
+		if got := ic.Names("images"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got images %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPurgeBlobs(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		images []compute.Image
+		blobs  []string
+		rule   blobRule
+		want   []string
+	}{
+		{
+			name:   "blobs with a matching image are kept",
+			images: []compute.Image{image("centos7-3.10-" + ts(48*time.Hour))},
+			blobs:  []string{"centos7-3.10-" + ts(48*time.Hour) + ".vhd"},
+			want:   []string{"centos7-3.10-" + ts(48*time.Hour) + ".vhd"},
+		},
+		{
+			name:  "orphaned blobs are removed after the build timeout",
+			blobs: []string{"centos7-3.10-" + ts(7*time.Hour) + ".vhd", "centos7-3.10-" + ts(time.Hour) + ".vhd"},
+			want:  []string{"centos7-3.10-" + ts(time.Hour) + ".vhd"},
+		},
+		{
+			name:  "custom build timeout",
+			blobs: []string{"centos7-3.10-" + ts(3*time.Hour) + ".vhd", "centos7-3.10-" + ts(time.Hour) + ".vhd"},
+			rule:  blobRule{BuildTimeout: &duration{2 * time.Hour}},
+			want:  []string{"centos7-3.10-" + ts(time.Hour) + ".vhd"},
+		},
+		{
+			name:   "blobs referenced by image disks are kept, whatever their names",
+			images: []compute.Image{vhdImage("centos7-3.10-"+ts(48*time.Hour), blobURI("openshiftimages", "images", "osdisk.vhd"), blobURI("OpenShiftImages", "images", "datadisk.vhd"))},
+			blobs:  []string{"centos7-3.10-" + ts(48*time.Hour) + ".vhd", "datadisk.vhd", "osdisk.vhd"},
+			want:   []string{"datadisk.vhd", "osdisk.vhd"},
+		},
+		{
+			name:   "blobs referenced in other storage accounts or containers are not kept",
+			images: []compute.Image{vhdImage("foo", blobURI("otheraccount", "images", "foo.vhd"), blobURI("openshiftimages", "vhds", "bar.vhd"))},
+			blobs:  []string{"bar.vhd", "foo.vhd"},
+			rule:   blobRule{DeleteUnmatched: true},
+			want:   []string{},
+		},
+		{
+			name:  "orphaned blobs with unmatched names are kept",
+			blobs: []string{"foo.vhd", "foo.txt"},
+			want:  []string{"foo.txt", "foo.vhd"},
+		},
+		{
+			name:  "orphaned blobs with unmatched names are removed if the rule says so",
+			blobs: []string{"foo.vhd", "foo.txt"},
+			rule:  blobRule{DeleteUnmatched: true},
+			want:  []string{},
+		},
+		{
+			name:  "custom naming scheme",
+			blobs: []string{"rhel-" + testNow.Add(-72*time.Hour).Format("20060102") + ".vhd", "rhel-" + testNow.Format("20060102") + ".vhd"},
+			rule:  blobRule{BuildTimeout: &duration{36 * time.Hour}, NamePattern: `^rhel-(?P<timestamp>[0-9]{8})\.vhd$`, TimestampLayout: "20060102"},
+			want:  []string{"rhel-" + testNow.Format("20060102") + ".vhd"},
+		},
+	} {
+		p, _, bc, _ := testPurger(tt.images, tt.blobs, nil)
+		pol := &policy{Blobs: []blobRule{tt.rule}}
+		pol.setDefaults()
+
+		if err := p.run(context.Background(), pol); err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		}
+
+		if got := bc.Names("images"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got blobs %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseBlobURI(t *testing.T) {
+	for _, tt := range []struct {
+		uri     string
+		want    blobRef
+		wantErr bool
+	}{
+		{uri: "https://OpenShiftImages.blob.core.windows.net/Images/foo.vhd", want: blobRef{storageAccount: "openshiftimages", container: "images", name: "foo.vhd"}},
+		{uri: "https://account.blob.core.chinacloudapi.cn/images/dir/foo%20bar.vhd", want: blobRef{storageAccount: "account", container: "images", name: "dir/foo bar.vhd"}},
+		{uri: "https://account.file.core.windows.net/images/foo.vhd", wantErr: true},
+		{uri: "https://account.blob.core.windows.net/images", wantErr: true},
+		{uri: "https://account.blob.core.windows.net/images/", wantErr: true},
+		{uri: "%", wantErr: true},
+	} {
+		got, err := parseBlobURI(tt.uri)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: unexpected success", tt.uri)
+			}
+		} else if err != nil || got != tt.want {
+			t.Errorf("%s: got %#v, %v, want %#v", tt.uri, got, err, tt.want)
+		}
+	}
+}
+
+func TestMissingBlobsAreReported(t *testing.T) {
+	images := []compute.Image{
+		image("present"),
+		vhdImage("missing", blobURI("openshiftimages", "images", "osdisk.vhd"), blobURI("openshiftimages", "images", "datadisk.vhd"), blobURI("otheraccount", "images", "elsewhere.vhd")),
+	}
+
+	p, _, _, _ := testPurger(images, []string{"datadisk.vhd", "present.vhd"}, nil)
+	pol := &policy{Blobs: []blobRule{{}}}
+	pol.setDefaults()
+
+	actions, err := p.plan(context.Background(), pol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []action{{
+		Action:         actionMissing,
+		Kind:           kindImage,
+		ResourceGroup:  "images",
+		StorageAccount: "openshiftimages",
+		Container:      "images",
+		Name:           "missing",
+		Rule:           "blobs[0]",
+		Reason:         "referenced blob not found",
+		Evidence:       evidence{Blobs: []string{blobURI("openshiftimages", "images", "osdisk.vhd")}},
+	}}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("got actions %#v, want %#v", actions, want)
+	}
+
+	p.report(actions)
+	if got, want := p.out.(*bytes.Buffer).String(), "missing image missing: referenced blob not found: "+blobURI("openshiftimages", "images", "osdisk.vhd")+"\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestBlobsAreLinkedToTheirImages(t *testing.T) {
+	name := "centos7-3.10-" + ts(48*time.Hour)
+	images := []compute.Image{
+		vhdImage(name, blobURI("openshiftimages", "images", name+".vhd"), blobURI("openshiftimages", "images", "shared.vhd")),
+		vhdImage("other", blobURI("openshiftimages", "images", "shared.vhd")),
+	}
+
+	p, _, _, _ := testPurger(images, []string{name + ".vhd", "shared.vhd", "unreferenced.vhd"}, nil)
+	pol := &policy{Images: []imageRule{{DeleteUnmatched: true}}, Blobs: []blobRule{{DeleteUnmatched: true}}}
+	pol.setDefaults()
+
+	actions, err := p.plan(context.Background(), pol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string][]string{}
+	for _, a := range actions {
+		if a.Kind == kindBlob {
+			got[a.Name] = a.Images
+		}
+	}
+	want := map[string][]string{
+		name + ".vhd":      {imageKey(name)},
+		"shared.vhd":       {imageKey(name), imageKey("other")},
+		"unreferenced.vhd": nil,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got images %#v, want %#v", got, want)
+	}
+}
+
+func TestPurgeBlobsPaged(t *testing.T) {
+	var images []compute.Image
+	var blobs, want []string
+	for i := 0; i < 25; i++ {
+		name := "centos7-3.10-" + ts(time.Duration(i+1)*time.Hour)
+		if i%2 == 0 {
+			images = append(images, image(name))
+		}
+		if i%2 == 0 || i < 5 {
+			want = append(want, name+".vhd")
+		}
+		blobs = append(blobs, name+".vhd")
+	}
+	sort.Strings(blobs)
+	sort.Strings(want)
+
+	for _, pageSize := range []uint{0, 1, 4, 25, 26} {
+		p, _, bc, _ := testPurger(images, append([]string(nil), blobs...), nil)
+		p.blobPageSize = pageSize
+
+		if err := p.run(context.Background(), &policy{Blobs: []blobRule{defaultPolicy().Blobs[0]}}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := bc.Names("images"); !reflect.DeepEqual(got, want) {
+			t.Errorf("page size %d: got blobs %v, want %v", pageSize, got, want)
+		}
+
+		wantCalls := 1
+		if pageSize > 0 {
+			wantCalls = (len(blobs) + int(pageSize) - 1) / int(pageSize)
+		}
+		if bc.ListCalls != wantCalls {
+			t.Errorf("page size %d: got %d list calls, want %d", pageSize, bc.ListCalls, wantCalls)
+		}
+	}
+}
+
+func TestPurgeGroups(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		groups []resources.Group
+		locks  map[string][]locks.ManagementLockObject
+		rule   groupRule
+		want   []string
+	}{
+		{
+			name:   "untagged groups are kept",
+			groups: []resources.Group{group("images"), group("other", "owner", "me")},
+			want:   []string{"images", "other"},
+		},
+		{
+			name: "groups are removed after the group timeout",
+			groups: []resources.Group{
+				group("new", "now", unix(71*time.Hour)),
+				group("old", "now", unix(73*time.Hour)),
+			},
+			want: []string{"new"},
+		},
+		{
+			name:   "groups with unparseable tags are removed",
+			groups: []resources.Group{group("bad", "now", "yesterday")},
+			want:   []string{},
+		},
+		{
+			name: "custom tag and timeout",
+			groups: []resources.Group{
+				group("new", "created", unix(30*time.Minute)),
+				group("old", "created", unix(2*time.Hour)),
+				group("other", "now", unix(2*time.Hour)),
+			},
+			rule: groupRule{Tag: "created", Timeout: &duration{time.Hour}},
+			want: []string{"new", "other"},
+		},
+		{
+			name: "persisted groups are kept",
+			groups: []resources.Group{
+				group("debug", "now", unix(73*time.Hour), "persist", "True"),
+				group("old", "now", unix(73*time.Hour), "persist", "false"),
+			},
+			want: []string{"debug"},
+		},
+		{
+			name: "groups are kept until they expire",
+			groups: []resources.Group{
+				group("debug", "now", unix(73*time.Hour), "expires", testNow.Add(time.Hour).Format(time.RFC3339)),
+				group("expired", "now", unix(73*time.Hour), "expires", testNow.Add(-time.Hour).Format(time.RFC3339)),
+				group("typo", "now", unix(73*time.Hour), "expires", "tomorrow"),
+			},
+			want: []string{"debug", "typo"},
+		},
+		{
+			name: "custom protection tags",
+			groups: []resources.Group{
+				group("debug", "now", unix(73*time.Hour), "keep", "true"),
+				group("old", "now", unix(73*time.Hour), "persist", "true"),
+			},
+			rule: groupRule{PersistTag: "keep"},
+			want: []string{"debug"},
+		},
+		{
+			name: "locked groups are kept",
+			groups: []resources.Group{
+				group("cannotdelete", "now", unix(73*time.Hour)),
+				group("readonly", "now", unix(73*time.Hour)),
+				group("notspecified", "now", unix(73*time.Hour)),
+			},
+			locks: map[string][]locks.ManagementLockObject{
+				"cannotdelete": {lock("lock", locks.CanNotDelete)},
+				"readonly":     {lock("lock", locks.ReadOnly)},
+				"notspecified": {lock("lock", locks.NotSpecified)},
+			},
+			want: []string{"cannotdelete", "readonly"},
+		},
+	} {
+		p, _, _, gc := testPurger(nil, nil, tt.groups)
+		p.locks = &fakeLocksClient{locks: tt.locks}
+		pol := &policy{Groups: []groupRule{tt.rule}}
+		pol.setDefaults()
+
+		if err := p.run(context.Background(), pol); err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		}
+
+		if got := gc.Names(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got groups %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	images := []compute.Image{image("foo")}
+	blobs := []string{"bar.vhd"}
+	groups := []resources.Group{group("old", "now", "0")}
+
+	p, ic, bc, gc := testPurger(images, blobs, groups)
+	p.dryRun = true
+
+	pol := defaultPolicy()
+	pol.Images[0].DeleteUnmatched = true
+	pol.Blobs[0].DeleteUnmatched = true
+
+	if err := p.run(context.Background(), pol); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ic.Names("images"); len(got) != 1 {
+		t.Errorf("got images %v", got)
+	}
+	if got := bc.Names("images"); len(got) != 1 {
+		t.Errorf("got blobs %v", got)
+	}
+	if got := gc.Names(); len(got) != 1 {
+		t.Errorf("got groups %v", got)
+	}
+
+	// foo is selected by the invalid images pass, so is not selected again by
+	// the old images pass.
+	want := "delete image foo\ndelete blob bar.vhd\ndelete group old\n"
+	if got := p.out.(*bytes.Buffer).String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestKeptGroupsAreReported(t *testing.T) {
+	groups := []resources.Group{
+		group("new", "now", unix(time.Hour)),
+		group("debug", "now", unix(73*time.Hour), "persist", "true"),
+		group("locked", "now", unix(73*time.Hour)),
+		group("old", "now", unix(73*time.Hour)),
+	}
+
+	p, _, _, _ := testPurger(nil, nil, groups)
+	p.locks = &fakeLocksClient{locks: map[string][]locks.ManagementLockObject{"locked": {lock("dontdelete", locks.CanNotDelete)}}}
+	p.dryRun = true
+
+	if err := p.run(context.Background(), &policy{Groups: defaultPolicy().Groups}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `keep group new: timeout not expired
+keep group debug: persist tag is set
+keep group locked: management lock
+delete group old
+`
+	if got := p.out.(*bytes.Buffer).String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+	if got := p.selected["groups"]; got != 1 {
+		t.Errorf("got %d groups selected, want 1", got)
+	}
+}
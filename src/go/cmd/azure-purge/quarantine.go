@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	azstorage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// quarantineMetadata is the metadata of a quarantined blob which holds the
+// time it was quarantined.
+const quarantineMetadata = "purgepending"
+
+// applyQuarantine rewrites the delete actions of a policy with a quarantine to
+// quarantine, keep or delete each resource according to its quarantine.
+func (p *purger) applyQuarantine(actions []action) {
+	q := p.quarantine
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// images holds the rewritten actions of the images, by key.
+	images := map[string]*action{}
+
+	for i := range actions {
+		a := &actions[i]
+		if a.Kind == kindImage {
+			images[a.key()] = a
+		}
+		if a.Action != actionDelete || len(a.Images) > 0 {
+			continue
+		}
+
+		if a.Kind == kindBlob {
+			a.Action = actionQuarantine
+			continue
+		}
+
+		v, found := p.tags[a.key()][q.Tag]
+		if !found {
+			if v, found := p.tags[a.key()][q.QuarantinedTag]; found {
+				a.Action = actionKeep
+				a.Reason = "quarantine tag removed"
+				a.Evidence = evidence{Tag: q.QuarantinedTag, TagValue: &v}
+			} else {
+				a.Action = actionQuarantine
+			}
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			a.Action = actionKeep
+			a.Reason = "quarantine tag is not an RFC3339 time"
+			a.Evidence = evidence{Tag: q.Tag, TagValue: &v}
+			continue
+		}
+
+		t = t.UTC()
+		if p.now.Sub(t) < q.Period.Duration {
+			a.Action = actionKeep
+			a.Reason = "quarantine not expired"
+			a.Evidence = evidence{Tag: q.Tag, TagValue: &v, Timestamp: &t}
+			continue
+		}
+
+		a.Reason += "; quarantine expired"
+	}
+
+	for i := range actions {
+		a := &actions[i]
+		if a.Action != actionDelete || len(a.Images) == 0 {
+			continue
+		}
+
+		for _, key := range a.Images {
+			if image := images[key]; image == nil || image.Action != actionDelete {
+				a.Action = actionKeep
+				a.Reason = "quarantined with the images it backs"
+				break
+			}
+		}
+		if a.Action == actionDelete {
+			a.Reason += "; quarantine of the images it backs expired"
+		}
+	}
+}
+
+// storageAccountRef identifies a storage account within a subscription, and
+// the resource groups of the images whose VHDs it holds.
+type storageAccountRef struct {
+	resourceGroup       string
+	storageAccount      string
+	imageResourceGroups []string
+}
+
+// quarantineAccounts returns the storage accounts of the blob rules of pol,
+// each of which holds a quarantine container.
+func quarantineAccounts(pol *policy) []storageAccountRef {
+	var accounts []storageAccountRef
+	index := map[string]int{}
+	for _, rule := range pol.Blobs {
+		key := strings.ToLower(rule.ResourceGroup + "/" + rule.StorageAccount)
+		i, found := index[key]
+		if !found {
+			i = len(accounts)
+			index[key] = i
+			accounts = append(accounts, storageAccountRef{resourceGroup: rule.ResourceGroup, storageAccount: rule.StorageAccount})
+		}
+		accounts[i].imageResourceGroups = append(accounts[i].imageResourceGroups, rule.ImageResourceGroup)
+	}
+	return accounts
+}
+
+// imageBlobs returns the blobs in account backing the images in its image
+// resource groups which are not selected for deletion, and the names of those
+// images.
+func (p *purger) imageBlobs(ctx context.Context, account storageAccountRef) (map[blobRef][]string, error) {
+	blobs := map[blobRef][]string{}
+	seen := map[string]struct{}{}
+	for _, resourceGroup := range account.imageResourceGroups {
+		if _, found := seen[strings.ToLower(resourceGroup)]; found {
+			continue
+		}
+		seen[strings.ToLower(resourceGroup)] = struct{}{}
+
+		images, _, err := p.listImages(ctx, resourceGroup)
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range images {
+			for _, uri := range imageBlobURIs(image) {
+				ref, err := parseBlobURI(uri)
+				if err == nil && ref.storageAccount == strings.ToLower(account.storageAccount) {
+					blobs[ref] = append(blobs[ref], *image.Name)
+				}
+			}
+		}
+	}
+	return blobs, nil
+}
+
+// listQuarantinedBlobs calls fn with each blob in the quarantine container of
+// the given storage account, if it exists.
+func (p *purger) listQuarantinedBlobs(ctx context.Context, resourceGroup, storageAccount string, fn func(azstorage.Blob)) error {
+	bc, err := p.getBlobsClient(ctx, resourceGroup, storageAccount)
+	if err != nil {
+		return err
+	}
+
+	params := azstorage.ListBlobsParameters{
+		MaxResults: p.blobPageSize,
+		Include:    &azstorage.IncludeBlobDataset{Metadata: true},
+	}
+	for {
+		blobs, err := bc.ListBlobs(ctx, p.quarantine.Container, params)
+		if err != nil {
+			if statusCode(err) == http.StatusNotFound {
+				return nil
+			}
+			return err
+		}
+
+		for _, blob := range blobs.Blobs {
+			fn(blob)
+		}
+
+		if blobs.NextMarker == "" {
+			return nil
+		}
+		params.Marker = blobs.NextMarker
+	}
+}
+
+// planQuarantinedBlobs selects the quarantined blobs of the blob rules of pol
+// whose quarantine has expired and which are neither persisted nor in use.
+func (p *purger) planQuarantinedBlobs(ctx context.Context, pol *policy) ([]action, error) {
+	q := p.quarantine
+
+	if err := p.refs.err(); err != nil {
+		return nil, err
+	}
+
+	var actions []action
+	for _, account := range quarantineAccounts(pol) {
+		resourceGroup, storageAccount := account.resourceGroup, account.storageAccount
+
+		imageBlobs, err := p.imageBlobs(ctx, account)
+		if err != nil {
+			return nil, fmt.Errorf("storage account %s: %v", storageAccount, err)
+		}
+
+		err = p.listQuarantinedBlobs(ctx, resourceGroup, storageAccount, func(blob azstorage.Blob) {
+			a := action{
+				Action:         actionDelete,
+				Kind:           kindBlob,
+				ResourceGroup:  resourceGroup,
+				StorageAccount: storageAccount,
+				Container:      q.Container,
+				Name:           blob.Name,
+				Rule:           "quarantine",
+				Reason:         "quarantine expired",
+			}
+
+			v, found := blob.Metadata[quarantineMetadata]
+			t, err := time.Parse(time.RFC3339, v)
+			switch {
+			case !found || err != nil:
+				a.Action = actionKeep
+				a.Reason = "quarantine time is not an RFC3339 time"
+				a.Evidence = evidence{TagValue: &v}
+			case p.now.Sub(t) < q.Period.Duration:
+				t = t.UTC()
+				a.Action = actionKeep
+				a.Reason = "quarantine not expired"
+				a.Evidence = evidence{Timestamp: &t}
+			default:
+				t = t.UTC()
+				a.Evidence = evidence{Timestamp: &t}
+			}
+
+			// the blob is referenced in quarantine, or where it came from
+			refs := []blobRef{{storageAccount: strings.ToLower(storageAccount), container: strings.ToLower(q.Container), name: blob.Name}}
+			if s := strings.SplitN(blob.Name, "/", 2); len(s) == 2 {
+				refs = append(refs, blobRef{storageAccount: strings.ToLower(storageAccount), container: strings.ToLower(s[0]), name: s[1]})
+			}
+
+			var images, referrers []string
+			for _, ref := range refs {
+				images = append(images, imageBlobs[ref]...)
+				referrers = append(referrers, p.refs.blobReferrers(ref)...)
+			}
+
+			persist := blob.Metadata[defaultPersistTag]
+			switch {
+			case a.Action != actionDelete:
+			case strings.EqualFold(persist, "true"):
+				a.Action = actionKeep
+				a.Reason = "persist tag is set"
+				a.Evidence.Tag = defaultPersistTag
+				a.Evidence.TagValue = &persist
+			case len(images) > 0:
+				a.Action = actionKeep
+				a.Reason = "referenced by image " + strings.Join(images, ", ")
+			case len(referrers) > 0:
+				a.Action = actionKeep
+				a.Reason = "in use"
+				a.Evidence.Referrers = referrers
+			}
+
+			actions = append(actions, a)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("storage account %s: %v", storageAccount, err)
+		}
+	}
+
+	return actions, nil
+}
+
+// quarantineResource quarantines the resource of a from now, moving a blob to
+// the quarantine container of its storage account and tagging any other
+// resource.
+func (p *purger) quarantineResource(ctx context.Context, a *action) error {
+	q := p.quarantine
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	if a.Kind == kindBlob {
+		bc, err := p.getBlobsClient(ctx, a.ResourceGroup, a.StorageAccount)
+		if err != nil {
+			return err
+		}
+		return bc.MoveBlob(ctx, a.Container, a.Name, q.Container, a.Container+"/"+a.Name, map[string]string{quarantineMetadata: now})
+	}
+
+	tags := p.resourceTags(a)
+	tags[q.Tag] = &now
+	tags[q.QuarantinedTag] = &now
+	return p.updateTags(ctx, a, tags)
+}
+
+// restoreResource undoes the quarantine of the resource of a, moving a blob
+// back to its original container and untagging any other resource.
+func (p *purger) restoreResource(ctx context.Context, a *action) error {
+	q := p.quarantine
+
+	if a.Kind == kindBlob {
+		s := strings.SplitN(a.Name, "/", 2)
+		if len(s) != 2 {
+			return fmt.Errorf("quarantined blob %q has no container", a.Name)
+		}
+
+		bc, err := p.getBlobsClient(ctx, a.ResourceGroup, a.StorageAccount)
+		if err != nil {
+			return err
+		}
+		return bc.MoveBlob(ctx, a.Container, a.Name, s[0], s[1], nil)
+	}
+
+	tags := p.resourceTags(a)
+	delete(tags, q.Tag)
+	delete(tags, q.QuarantinedTag)
+	return p.updateTags(ctx, a, tags)
+}
+
+// resourceTags returns a copy of the tags of the resource of a recorded when
+// it was selected.
+func (p *purger) resourceTags(a *action) map[string]*string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tags := map[string]*string{}
+	for k, v := range p.tags[a.key()] {
+		tags[k] = to.StringPtr(v)
+	}
+	return tags
+}
+
+// updateTags replaces the tags of the resource of a, which must not be a blob.
+func (p *purger) updateTags(ctx context.Context, a *action, tags map[string]*string) error {
+	if a.Kind == kindGroup {
+		return p.groups.UpdateTags(ctx, a.Name, tags)
+	}
+
+	resourceType := a.ResourceType
+	if resourceType == "" {
+		resourceType = resourceProviders[a.Kind]
+	}
+	apiVersion, err := p.apiVersion(ctx, resourceType)
+	if err != nil {
+		return err
+	}
+
+	return p.resources.UpdateTagsByID(ctx, a.resourceID(p.subscription), apiVersion, tags)
+}
+
+// planRestore selects the quarantined resource groups, resources and blobs of
+// pol, or only those named in names if it is not empty.
+func (p *purger) planRestore(ctx context.Context, pol *policy, names []string) ([]action, error) {
+	q := p.quarantine
+
+	selected := func(name string) bool {
+		if len(names) == 0 {
+			return true
+		}
+		for _, n := range names {
+			if n == name || strings.HasSuffix(name, "/"+n) {
+				return true
+			}
+		}
+		return false
+	}
+
+	quarantined := func(tags map[string]*string) (evidence, bool) {
+		for _, tag := range []string{q.Tag, q.QuarantinedTag} {
+			if v := tags[tag]; v != nil {
+				return evidence{Tag: tag, TagValue: v}, true
+			}
+		}
+		return evidence{}, false
+	}
+
+	var actions []action
+	add := func(a action, tags map[string]*string) {
+		if !selected(a.Name) {
+			return
+		}
+		p.recordTags(&a, tags)
+		actions = append(actions, a)
+	}
+
+	groups, err := p.groups.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if ev, found := quarantined(group.Tags); found {
+			add(action{
+				Action:   actionRestore,
+				Kind:     kindGroup,
+				Name:     *group.Name,
+				Rule:     "quarantine",
+				Reason:   "quarantined",
+				Evidence: ev,
+			}, group.Tags)
+		}
+	}
+
+	l, err := p.resources.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range l {
+		ev, found := quarantined(res.Tags)
+		if !found {
+			continue
+		}
+
+		r, err := azure.ParseResourceID(to.String(res.ID))
+		if err != nil {
+			return nil, err
+		}
+		add(action{
+			Action:        actionRestore,
+			Kind:          kindResource,
+			ResourceGroup: r.ResourceGroup,
+			ResourceType:  to.String(res.Type),
+			ID:            to.String(res.ID),
+			Name:          to.String(res.Name),
+			Rule:          "quarantine",
+			Reason:        "quarantined",
+			Evidence:      ev,
+		}, res.Tags)
+	}
+
+	for _, account := range quarantineAccounts(pol) {
+		resourceGroup, storageAccount := account.resourceGroup, account.storageAccount
+		err := p.listQuarantinedBlobs(ctx, resourceGroup, storageAccount, func(blob azstorage.Blob) {
+			a := action{
+				Action:         actionRestore,
+				Kind:           kindBlob,
+				ResourceGroup:  resourceGroup,
+				StorageAccount: storageAccount,
+				Container:      q.Container,
+				Name:           blob.Name,
+				Rule:           "quarantine",
+				Reason:         "quarantined",
+			}
+			if t, err := time.Parse(time.RFC3339, blob.Metadata[quarantineMetadata]); err == nil {
+				t = t.UTC()
+				a.Evidence.Timestamp = &t
+			}
+			add(a, nil)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("storage account %s: %v", storageAccount, err)
+		}
+	}
+
+	return actions, nil
+}
+
+// restore undoes the quarantine of the resources of pol selected by
+// planRestore, returning failures as an errorList.
+func (p *purger) restore(ctx context.Context, pol *policy, names []string) error {
+	p.quarantine = pol.Quarantine
+
+	actions, err := p.planRestore(ctx, pol, names)
+	if err != nil {
+		return errorList{err}
+	}
+
+	var errs errorList
+	p.report(actions)
+	if !p.dryRun {
+		if err := p.execute(ctx, actions); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := p.audit(ctx, actions); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func testQuarantinePolicy() *policy {
+	pol := defaultPolicy()
+	pol.Quarantine = &quarantineConfig{}
+	pol.setDefaults()
+	return pol
+}
+
+func TestQuarantine(t *testing.T) {
+	pending, expired := testNow.Add(-time.Hour).Format(time.RFC3339), testNow.Add(-73*time.Hour).Format(time.RFC3339)
+
+	images := []compute.Image{
+		image("centos7-3.10-" + ts(7*time.Hour)),
+		image("centos7-3.10-"+ts(8*time.Hour), "purge-pending", pending),
+		image("centos7-3.10-"+ts(9*time.Hour), "purge-pending", expired),
+		image("centos7-3.10-"+ts(10*time.Hour), "purge-pending", "soon"),
+	}
+	groups := []resources.Group{
+		group("old", "now", unix(73*time.Hour)),
+		group("pending", "now", unix(73*time.Hour), "purge-pending", pending),
+	}
+	p, ic, bc, gc := testPurger(images, []string{"rhel7-3.10-" + ts(7*time.Hour) + ".vhd"}, groups)
+	p.subscription = "sub"
+	p.providers = &fakeProvidersClient{providers: map[string]resources.Provider{
+		"microsoft.compute": provider("Microsoft.Compute", []string{"images"}, "2018-04-01"),
+	}}
+	rc := p.resources.(*fakeResourcesClient)
+
+	bc.AddBlobs("quarantine", "images/expired.vhd", "images/pending.vhd")
+	bc.Metadata = map[string]map[string]string{
+		"quarantine/images/expired.vhd": {quarantineMetadata: expired},
+		"quarantine/images/pending.vhd": {quarantineMetadata: pending},
+	}
+
+	if err := p.run(context.Background(), testQuarantinePolicy()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"centos7-3.10-" + ts(7*time.Hour), "centos7-3.10-" + ts(8*time.Hour), "centos7-3.10-" + ts(10*time.Hour)}
+	sort.Strings(want)
+	if got := ic.Names("images"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got images %v, want %v", got, want)
+	}
+	if len(rc.tagged) != 1 {
+		t.Errorf("got tagged resources %v, want 1", rc.tagged)
+	}
+	if _, err := time.Parse(time.RFC3339, to.String(rc.tagged[imageID("centos7-3.10-"+ts(7*time.Hour))]["purge-pending"])); err != nil {
+		t.Errorf("image not quarantined: %v", err)
+	}
+
+	if got, want := gc.Names(), []string{"old", "pending"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, want %v", got, want)
+	}
+	tags := gc.Groups[0].Tags
+	if _, err := time.Parse(time.RFC3339, to.String(tags["purge-pending"])); err != nil || to.String(tags["now"]) != unix(73*time.Hour) {
+		t.Errorf("group not quarantined: got tags %v", tags)
+	}
+	if to.String(tags["purge-quarantined"]) != to.String(tags["purge-pending"]) {
+		t.Errorf("group quarantine not recorded: got tags %v", tags)
+	}
+	if to.String(gc.Groups[1].Tags["purge-pending"]) != pending {
+		t.Errorf("pending group retagged: got tags %v", gc.Groups[1].Tags)
+	}
+
+	if got := bc.Names("images"); len(got) != 0 {
+		t.Errorf("got blobs %v, want none", got)
+	}
+	if got, want := bc.Names("quarantine"), []string{"images/pending.vhd", "images/rhel7-3.10-" + ts(7*time.Hour) + ".vhd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got quarantined blobs %v, want %v", got, want)
+	}
+	if _, err := time.Parse(time.RFC3339, bc.Metadata["quarantine/images/rhel7-3.10-"+ts(7*time.Hour)+".vhd"][quarantineMetadata]); err != nil {
+		t.Errorf("blob not quarantined: %v", err)
+	}
+}
+
+func TestQuarantineTagRemoved(t *testing.T) {
+	p, _, _, gc := testPurger(nil, nil, []resources.Group{group("old", "now", unix(73*time.Hour))})
+	pol := testQuarantinePolicy()
+
+	plan := func() []string {
+		actions, err := p.plan(context.Background(), pol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for i := range actions {
+			got = append(got, actions[i].String())
+		}
+		return got
+	}
+
+	if err := p.run(context.Background(), pol); err != nil {
+		t.Fatal(err)
+	}
+
+	delete(gc.Groups[0].Tags, "purge-pending")
+	if got, want := plan(), []string{"keep group old: quarantine tag removed"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got actions %q, want %q", got, want)
+	}
+	if got, want := gc.Names(), []string{"old"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, want %v", got, want)
+	}
+
+	if err := p.restore(context.Background(), pol, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tags := gc.Groups[0].Tags; tags["purge-quarantined"] != nil {
+		t.Errorf("group quarantine not undone: got tags %v", tags)
+	}
+	if got, want := plan(), []string{"quarantine group old: timeout expired"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got actions %q, want %q", got, want)
+	}
+}
+
+func TestQuarantineKeepsBlobsWithTheirImages(t *testing.T) {
+	expired := testNow.Add(-73 * time.Hour).Format(time.RFC3339)
+
+	for _, tt := range []struct {
+		name       string
+		tags       []string
+		wantImages []string
+		wantBlobs  []string
+	}{
+		{
+			name:       "image quarantined",
+			wantImages: []string{"centos7-3.10-" + ts(7*time.Hour)},
+			wantBlobs:  []string{"centos7-3.10-" + ts(7*time.Hour) + ".vhd"},
+		},
+		{
+			name:       "image quarantine expired",
+			tags:       []string{"purge-pending", expired},
+			wantImages: []string{},
+			wantBlobs:  []string{},
+		},
+	} {
+		name := "centos7-3.10-" + ts(7*time.Hour)
+		img := vhdImage(name, blobURI("openshiftimages", "images", name+".vhd"))
+		for i := 0; i < len(tt.tags); i += 2 {
+			img.Tags[tt.tags[i]] = to.StringPtr(tt.tags[i+1])
+		}
+
+		p, ic, bc, _ := testPurger([]compute.Image{img}, []string{name + ".vhd"}, nil)
+		p.subscription = "sub"
+		p.providers = &fakeProvidersClient{providers: map[string]resources.Provider{
+			"microsoft.compute": provider("Microsoft.Compute", []string{"images"}, "2018-04-01"),
+		}}
+
+		if err := p.run(context.Background(), testQuarantinePolicy()); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if got := ic.Names("images"); !reflect.DeepEqual(got, tt.wantImages) {
+			t.Errorf("%s: got images %v, want %v", tt.name, got, tt.wantImages)
+		}
+		// the VHD of a quarantined image stays where the image can use it
+		if got := bc.Names("images"); !reflect.DeepEqual(got, tt.wantBlobs) {
+			t.Errorf("%s: got blobs %v, want %v", tt.name, got, tt.wantBlobs)
+		}
+		if got := bc.Names("quarantine"); len(got) != 0 {
+			t.Errorf("%s: got quarantined blobs %v, want none", tt.name, got)
+		}
+	}
+}
+
+func TestPlanQuarantinedBlobs(t *testing.T) {
+	expired := testNow.Add(-73 * time.Hour).Format(time.RFC3339)
+	vmID := resourceID("cluster", "Microsoft.Compute/virtualMachines", "vm")
+
+	images := []compute.Image{vhdImage("imported", blobURI("openshiftimages", "quarantine", "images/imaged.vhd"))}
+	p, _, bc, _ := testPurger(images, nil, nil)
+	p.quarantine = testQuarantinePolicy().Quarantine
+	p.refs = newReferences()
+	p.refs.addBlob(blobURI("openshiftimages", "images", "used.vhd"), vmID)
+
+	bc.AddBlobs("quarantine", "images/gone.vhd", "images/imaged.vhd", "images/persist.vhd", "images/used.vhd")
+	bc.Metadata = map[string]map[string]string{
+		"quarantine/images/gone.vhd":    {quarantineMetadata: expired},
+		"quarantine/images/imaged.vhd":  {quarantineMetadata: expired},
+		"quarantine/images/persist.vhd": {quarantineMetadata: expired, "persist": "true"},
+		"quarantine/images/used.vhd":    {quarantineMetadata: expired},
+	}
+
+	actions, err := p.planQuarantinedBlobs(context.Background(), testQuarantinePolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for i := range actions {
+		got = append(got, actions[i].String())
+	}
+	want := []string{
+		"delete blob images/gone.vhd",
+		"keep blob images/imaged.vhd: referenced by image imported",
+		"keep blob images/persist.vhd: persist tag is set",
+		"keep blob images/used.vhd: in use: " + vmID,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got actions %q, want %q", got, want)
+	}
+}
+
+func TestQuarantineActions(t *testing.T) {
+	p, _, _, _ := testPurger(nil, nil, nil)
+	p.quarantine = testQuarantinePolicy().Quarantine
+
+	actions := []action{
+		{Action: actionDelete, Kind: kindGroup, Name: "new", Reason: "timeout expired"},
+		{Action: actionDelete, Kind: kindGroup, Name: "pending", Reason: "timeout expired"},
+		{Action: actionDelete, Kind: kindGroup, Name: "expired", Reason: "timeout expired"},
+		{Action: actionDelete, Kind: kindGroup, Name: "invalid", Reason: "timeout expired"},
+		{Action: actionDelete, Kind: kindGroup, Name: "untagged", Reason: "timeout expired"},
+		{Action: actionDelete, Kind: kindBlob, Name: "foo.vhd", Reason: "not referenced by any image"},
+		{Action: actionKeep, Kind: kindGroup, Name: "kept", Reason: "timeout not expired"},
+		{Action: actionDelete, Kind: kindBlob, Name: "new.vhd", Reason: "not referenced by any image", Images: []string{imageKey("new")}},
+		{Action: actionDelete, Kind: kindBlob, Name: "expired.vhd", Reason: "not referenced by any image", Images: []string{imageKey("expired")}},
+		{Action: actionDelete, Kind: kindImage, ResourceGroup: "images", Name: "new", Reason: "old"},
+		{Action: actionDelete, Kind: kindImage, ResourceGroup: "images", Name: "expired", Reason: "old"},
+	}
+	for i, v := range []string{"", testNow.Add(-time.Hour).Format(time.RFC3339), testNow.Add(-72 * time.Hour).Format(time.RFC3339), "tomorrow", "", "", "", "", "", "", testNow.Add(-72 * time.Hour).Format(time.RFC3339)} {
+		if v != "" {
+			p.recordTags(&actions[i], map[string]*string{"purge-pending": to.StringPtr(v), "purge-quarantined": to.StringPtr(v)})
+		}
+	}
+	p.recordTags(&actions[4], map[string]*string{"purge-quarantined": to.StringPtr(testNow.Add(-time.Hour).Format(time.RFC3339))})
+
+	p.applyQuarantine(actions)
+
+	var got [][2]string
+	for _, a := range actions {
+		got = append(got, [2]string{a.Action, a.Reason})
+	}
+	want := [][2]string{
+		{actionQuarantine, "timeout expired"},
+		{actionKeep, "quarantine not expired"},
+		{actionDelete, "timeout expired; quarantine expired"},
+		{actionKeep, "quarantine tag is not an RFC3339 time"},
+		{actionKeep, "quarantine tag removed"},
+		{actionQuarantine, "not referenced by any image"},
+		{actionKeep, "timeout not expired"},
+		{actionKeep, "quarantined with the images it backs"},
+		{actionDelete, "not referenced by any image; quarantine of the images it backs expired"},
+		{actionQuarantine, "old"},
+		{actionDelete, "old; quarantine expired"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got actions %v, want %v", got, want)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	pending := testNow.Add(-time.Hour).Format(time.RFC3339)
+
+	for _, tt := range []struct {
+		name           string
+		names          []string
+		dryRun         bool
+		wantGroups     []string
+		wantResources  []string
+		wantBlobs      []string
+		wantQuarantine []string
+	}{
+		{
+			name:           "everything",
+			wantGroups:     []string{"cluster", "other"},
+			wantResources:  []string{"disk"},
+			wantBlobs:      []string{"a.vhd", "b.vhd"},
+			wantQuarantine: []string{},
+		},
+		{
+			name:           "by name",
+			names:          []string{"other", "a.vhd"},
+			wantGroups:     []string{"other"},
+			wantBlobs:      []string{"a.vhd"},
+			wantQuarantine: []string{"images/b.vhd"},
+		},
+		{
+			name:           "dry run",
+			dryRun:         true,
+			wantBlobs:      []string{},
+			wantQuarantine: []string{"images/a.vhd", "images/b.vhd"},
+		},
+	} {
+		groups := []resources.Group{
+			group("cluster", "now", unix(73*time.Hour), "purge-pending", pending),
+			group("other", "purge-pending", pending),
+			group("untagged", "now", unix(time.Hour)),
+		}
+		p, _, bc, gc := testPurger(nil, nil, groups)
+		p.subscription = "sub"
+		p.dryRun = tt.dryRun
+		p.providers = &fakeProvidersClient{providers: map[string]resources.Provider{
+			"microsoft.compute": provider("Microsoft.Compute", []string{"disks"}, "2018-04-01"),
+		}}
+		rc := &fakeResourcesClient{resources: []resources.GenericResource{
+			genericResource("cluster", "Microsoft.Compute/disks", "disk", "purge-pending", pending, "owner", "ci"),
+			genericResource("cluster", "Microsoft.Compute/disks", "other-disk"),
+		}}
+		p.resources = rc
+
+		bc.AddBlobs("quarantine", "images/a.vhd", "images/b.vhd")
+		bc.Metadata = map[string]map[string]string{
+			"quarantine/images/a.vhd": {quarantineMetadata: pending},
+			"quarantine/images/b.vhd": {quarantineMetadata: pending},
+		}
+
+		if err := p.restore(context.Background(), testQuarantinePolicy(), tt.names); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		var restoredGroups []string
+		for _, g := range gc.Groups {
+			if g.Tags["purge-pending"] == nil && *g.Name != "untagged" {
+				restoredGroups = append(restoredGroups, *g.Name)
+			}
+		}
+		if !reflect.DeepEqual(restoredGroups, tt.wantGroups) {
+			t.Errorf("%s: got restored groups %v, want %v", tt.name, restoredGroups, tt.wantGroups)
+		}
+		if to.String(gc.Groups[0].Tags["now"]) != unix(73*time.Hour) {
+			t.Errorf("%s: lost tags of group cluster: %v", tt.name, gc.Groups[0].Tags)
+		}
+
+		var restoredResources []string
+		for _, r := range rc.resources {
+			if r.Tags["purge-pending"] == nil && *r.Name != "other-disk" {
+				restoredResources = append(restoredResources, *r.Name)
+				if to.String(r.Tags["owner"]) != "ci" {
+					t.Errorf("%s: lost tags of resource %s: %v", tt.name, *r.Name, r.Tags)
+				}
+			}
+		}
+		if !reflect.DeepEqual(restoredResources, tt.wantResources) {
+			t.Errorf("%s: got restored resources %v, want %v", tt.name, restoredResources, tt.wantResources)
+		}
+
+		if got := bc.Names("images"); !reflect.DeepEqual(got, tt.wantBlobs) {
+			t.Errorf("%s: got blobs %v, want %v", tt.name, got, tt.wantBlobs)
+		}
+		if got := bc.Names("quarantine"); !reflect.DeepEqual(got, tt.wantQuarantine) {
+			t.Errorf("%s: got quarantined blobs %v, want %v", tt.name, got, tt.wantQuarantine)
+		}
+	}
+}
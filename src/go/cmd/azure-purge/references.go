@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// references records the images and blobs used by the virtual machines, scale
+// sets and managed disks of every subscription of a run, and the IDs of their
+// users.
+type references struct {
+	mu sync.Mutex
+
+	// images is keyed by lower-case image resource ID, and containers by
+	// blobRef with an empty name.
+	images     map[string]map[string]struct{}
+	blobs      map[blobRef]map[string]struct{}
+	containers map[blobRef]map[string]struct{}
+
+	// errs holds the errors of the subscriptions whose references could not
+	// be collected.
+	errs errorList
+}
+
+func newReferences() *references {
+	return &references{
+		images:     map[string]map[string]struct{}{},
+		blobs:      map[blobRef]map[string]struct{}{},
+		containers: map[blobRef]map[string]struct{}{},
+	}
+}
+
+func addReferrer(m map[string]struct{}, referrer string) map[string]struct{} {
+	if m == nil {
+		m = map[string]struct{}{}
+	}
+	m[referrer] = struct{}{}
+	return m
+}
+
+func (r *references) addImage(id, referrer string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id = strings.ToLower(id)
+	r.images[id] = addReferrer(r.images[id], referrer)
+}
+
+// addBlob records that referrer uses the blob at uri, if it is a blob URI.
+func (r *references) addBlob(uri, referrer string) {
+	ref, err := parseBlobURI(uri)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.blobs[ref] = addReferrer(r.blobs[ref], referrer)
+}
+
+// addContainer records that referrer keeps blobs in the container at uri.
+func (r *references) addContainer(uri, referrer string) {
+	ref, err := parseContainerURI(uri)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.containers[ref] = addReferrer(r.containers[ref], referrer)
+}
+
+func (r *references) addError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.errs = append(r.errs, err)
+}
+
+// err returns an error if the references of any subscription could not be
+// collected.
+func (r *references) err() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.errs) > 0 {
+		return fmt.Errorf("cannot tell which resources are in use: %v", r.errs)
+	}
+	return nil
+}
+
+// imageReferrers returns the sorted IDs of the resources using the image with
+// the given ID.
+func (r *references) imageReferrers(id string) []string {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return sortedReferrers(r.images[strings.ToLower(id)])
+}
+
+// blobReferrers returns the sorted IDs of the resources using the given blob,
+// or its container.
+func (r *references) blobReferrers(ref blobRef) []string {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	referrers := sortedReferrers(r.blobs[ref])
+	ref.name = ""
+	return append(referrers, sortedReferrers(r.containers[ref])...)
+}
+
+// accountReferrers returns the sorted IDs of the resources using any blob or
+// container in the given storage account.
+func (r *references) accountReferrers(storageAccount string) []string {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	storageAccount = strings.ToLower(storageAccount)
+	m := map[string]struct{}{}
+	for _, refs := range []map[blobRef]map[string]struct{}{r.blobs, r.containers} {
+		for ref, referrers := range refs {
+			if ref.storageAccount != storageAccount {
+				continue
+			}
+			for referrer := range referrers {
+				m[referrer] = struct{}{}
+			}
+		}
+	}
+
+	return sortedReferrers(m)
+}
+
+func sortedReferrers(m map[string]struct{}) []string {
+	if len(m) == 0 {
+		return nil
+	}
+
+	referrers := make([]string, 0, len(m))
+	for referrer := range m {
+		referrers = append(referrers, referrer)
+	}
+	sort.Strings(referrers)
+
+	return referrers
+}
+
+// collectReferences records the images and blobs used by the virtual
+// machines, scale sets and managed disks of p's subscription in r.
+func (p *purger) collectReferences(ctx context.Context, r *references) error {
+	vms, err := p.vms.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if vm.VirtualMachineProperties == nil || vm.StorageProfile == nil {
+			continue
+		}
+		id := to.String(vm.ID)
+		sp := vm.StorageProfile
+
+		if sp.ImageReference != nil && sp.ImageReference.ID != nil {
+			r.addImage(*sp.ImageReference.ID, id)
+		}
+		if sp.OsDisk != nil {
+			addVHDs(r, id, sp.OsDisk.Vhd, sp.OsDisk.Image)
+		}
+		if sp.DataDisks != nil {
+			for _, d := range *sp.DataDisks {
+				addVHDs(r, id, d.Vhd, d.Image)
+			}
+		}
+	}
+
+	scaleSets, err := p.scaleSets.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ss := range scaleSets {
+		if ss.VirtualMachineScaleSetProperties == nil || ss.VirtualMachineProfile == nil || ss.VirtualMachineProfile.StorageProfile == nil {
+			continue
+		}
+		id := to.String(ss.ID)
+		sp := ss.VirtualMachineProfile.StorageProfile
+
+		if sp.ImageReference != nil && sp.ImageReference.ID != nil {
+			r.addImage(*sp.ImageReference.ID, id)
+		}
+		if sp.OsDisk != nil {
+			addVHDs(r, id, sp.OsDisk.Image)
+			if sp.OsDisk.VhdContainers != nil {
+				for _, uri := range *sp.OsDisk.VhdContainers {
+					r.addContainer(uri, id)
+				}
+			}
+		}
+	}
+
+	disks, err := p.disks.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, disk := range disks {
+		if disk.DiskProperties == nil || disk.CreationData == nil {
+			continue
+		}
+		id := to.String(disk.ID)
+		cd := disk.CreationData
+
+		if cd.ImageReference != nil && cd.ImageReference.ID != nil {
+			r.addImage(*cd.ImageReference.ID, id)
+		}
+		if cd.SourceURI != nil {
+			r.addBlob(*cd.SourceURI, id)
+		}
+	}
+
+	return nil
+}
+
+func addVHDs(r *references, referrer string, vhds ...*compute.VirtualHardDisk) {
+	for _, vhd := range vhds {
+		if vhd != nil && vhd.URI != nil {
+			r.addBlob(*vhd.URI, referrer)
+		}
+	}
+}
+
+// preparePurgers creates a purger for each subscription, sharing the references
+// of every subscription between them if pol has image, blob or ttl rules.
+func preparePurgers(ctx context.Context, pol *policy, subs []subscription, newPurger func(subscription) (*purger, error)) ([]*purger, []error) {
+	purgers := make([]*purger, len(subs))
+	errs := make([]error, len(subs))
+	for i, sub := range subs {
+		purgers[i], errs[i] = newPurger(sub)
+	}
+
+	if len(pol.Images) == 0 && len(pol.Blobs) == 0 && len(pol.TTLs) == 0 {
+		return purgers, errs
+	}
+
+	refs := newReferences()
+	for i, sub := range subs {
+		if errs[i] != nil {
+			refs.addError(fmt.Errorf("subscription %s: %v", sub.id, errs[i]))
+			continue
+		}
+		if err := purgers[i].collectReferences(ctx, refs); err != nil {
+			refs.addError(fmt.Errorf("subscription %s: %v", sub.id, err))
+		}
+	}
+	for _, p := range purgers {
+		if p != nil {
+			p.refs = refs
+		}
+	}
+
+	return purgers, errs
+}
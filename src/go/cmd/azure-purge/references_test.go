@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient/fake"
+)
+
+const (
+	vmID       = "/subscriptions/sub/resourceGroups/vms/providers/Microsoft.Compute/virtualMachines/"
+	scaleSetID = "/subscriptions/sub/resourceGroups/vms/providers/Microsoft.Compute/virtualMachineScaleSets/"
+	diskID     = "/subscriptions/sub/resourceGroups/vms/providers/Microsoft.Compute/disks/"
+)
+
+func TestReferences(t *testing.T) {
+	p, _, _, _ := testPurger(nil, nil, nil)
+	p.vms = &fakeVMsClient{vms: []compute.VirtualMachine{
+		vm("vm1", strings.ToUpper(imageID("foo")), blobURI("OpenShiftImages", "Images", "os.vhd"), blobURI("openshiftimages", "images", "data.vhd")),
+		vm("vm2", imageID("foo"), ""),
+		vm("platform", "", ""),
+	}}
+	p.scaleSets = &fake.ScaleSetsClient{ScaleSets: map[string][]compute.VirtualMachineScaleSet{
+		"vms": {scaleSet("ss1", imageID("bar"), "https://openshiftimages.blob.core.windows.net/vhds")},
+	}}
+	p.disks = &fakeDisksClient{disks: []compute.Disk{
+		disk("disk1", imageID("baz"), ""),
+		disk("disk2", "", blobURI("openshiftimages", "images", "imported.vhd")),
+	}}
+
+	refs := newReferences()
+	if err := p.collectReferences(context.Background(), refs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{name: "image used by VMs", got: refs.imageReferrers(imageID("foo")), want: []string{vmID + "vm1", vmID + "vm2"}},
+		{name: "image used by scale set", got: refs.imageReferrers(imageID("bar")), want: []string{scaleSetID + "ss1"}},
+		{name: "image used by disk", got: refs.imageReferrers(imageID("baz")), want: []string{diskID + "disk1"}},
+		{name: "unused image", got: refs.imageReferrers(imageID("qux")), want: nil},
+		{name: "OS disk blob", got: refs.blobReferrers(blobRef{"openshiftimages", "images", "os.vhd"}), want: []string{vmID + "vm1"}},
+		{name: "data disk blob", got: refs.blobReferrers(blobRef{"openshiftimages", "images", "data.vhd"}), want: []string{vmID + "vm1"}},
+		{name: "imported blob", got: refs.blobReferrers(blobRef{"openshiftimages", "images", "imported.vhd"}), want: []string{diskID + "disk2"}},
+		{name: "scale set container", got: refs.blobReferrers(blobRef{"openshiftimages", "vhds", "anything.vhd"}), want: []string{scaleSetID + "ss1"}},
+		{name: "unused blob", got: refs.blobReferrers(blobRef{"openshiftimages", "images", "os.VHD"}), want: nil},
+	} {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: got referrers %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	if err := refs.err(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestResourcesInUseAreKept(t *testing.T) {
+	images := []compute.Image{
+		image("foo"),
+		image("centos7-3.10-"+ts(24*time.Hour), "valid", "true"),
+		image("centos7-3.10-"+ts(48*time.Hour), "valid", "true"),
+		image("centos7-3.10-"+ts(72*time.Hour), "valid", "true"),
+		image("centos7-3.10-"+ts(96*time.Hour), "valid", "true"),
+	}
+	blobs := []string{"foo.vhd", "imported.vhd", "orphan.vhd", "vmdisk.vhd"}
+	for _, image := range images[1:] {
+		blobs = append(blobs, *image.Name+".vhd")
+	}
+	sort.Strings(blobs)
+
+	p, ic, bc, _ := testPurger(images, blobs, nil)
+	p.vms = &fakeVMsClient{vms: []compute.VirtualMachine{vm("vm1", imageID("foo"), blobURI("openshiftimages", "images", "vmdisk.vhd"))}}
+	p.scaleSets = &fake.ScaleSetsClient{ScaleSets: map[string][]compute.VirtualMachineScaleSet{"vms": {scaleSet("ss1", imageID("centos7-3.10-"+ts(72*time.Hour)))}}}
+	p.disks = &fakeDisksClient{disks: []compute.Disk{disk("disk1", "", blobURI("openshiftimages", "images", "imported.vhd"))}}
+
+	pol := &policy{Images: []imageRule{{}}, Blobs: []blobRule{{}}}
+	pol.setDefaults()
+	pol.Images[0].KeepImages = to.IntPtr(1)
+	pol.Blobs[0].DeleteUnmatched = true
+
+	purgers, errs := preparePurgers(context.Background(), pol, []subscription{{id: "sub"}}, func(subscription) (*purger, error) { return p, nil })
+	if errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	if err := purgers[0].run(context.Background(), pol); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := ic.Names("images"), []string{"centos7-3.10-" + ts(72*time.Hour), "centos7-3.10-" + ts(24*time.Hour), "foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got images %v, want %v", got, want)
+	}
+	if got, want := bc.Names("images"), []string{"centos7-3.10-" + ts(72*time.Hour) + ".vhd", "centos7-3.10-" + ts(24*time.Hour) + ".vhd", "foo.vhd", "imported.vhd", "vmdisk.vhd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got blobs %v, want %v", got, want)
+	}
+
+	out := p.out.(*bytes.Buffer).String()
+	for _, line := range []string{
+		"keep image foo: in use: " + vmID + "vm1\n",
+		"keep image centos7-3.10-" + ts(72*time.Hour) + ": in use: " + scaleSetID + "ss1\n",
+		"keep blob imported.vhd: in use: " + diskID + "disk1\n",
+		"keep blob vmdisk.vhd: in use: " + vmID + "vm1\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("output %q does not contain %q", out, line)
+		}
+	}
+}
+
+func TestPreparePurgers(t *testing.T) {
+	pol := defaultPolicy()
+	old := "centos7-3.10-" + ts(96*time.Hour)
+
+	newPurger := func(failing string) func(subscription) (*purger, error) {
+		return func(sub subscription) (*purger, error) {
+			switch sub.id {
+			case failing:
+				return nil, errors.New("unauthorized")
+			case "sub1":
+				p, _, _, _ := testPurger([]compute.Image{image(old)}, nil, []resources.Group{group("old", "now", unix(96*time.Hour))})
+				return p, nil
+			default:
+				p, _, _, _ := testPurger(nil, nil, nil)
+				p.vms = &fakeVMsClient{vms: []compute.VirtualMachine{vm("vm1", imageID(old), "")}}
+				return p, nil
+			}
+		}
+	}
+
+	// an image in use in another subscription is kept
+	purgers, errs := preparePurgers(context.Background(), pol, []subscription{{id: "sub1"}, {id: "sub2"}}, newPurger(""))
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatal(errs)
+	}
+	actions, err := purgers[0].plan(context.Background(), pol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) < 1 || actions[0].Action != actionKeep || actions[0].Name != old || !reflect.DeepEqual(actions[0].Evidence.Referrers, []string{vmID + "vm1"}) {
+		t.Errorf("got actions %v, want image %s kept", actions, old)
+	}
+
+	// if any subscription's references cannot be collected, image and blob
+	// rules fail but group rules are still applied
+	purgers, errs = preparePurgers(context.Background(), pol, []subscription{{id: "sub1"}, {id: "sub2"}}, newPurger("sub2"))
+	if errs[0] != nil || errs[1] == nil {
+		t.Fatal(errs)
+	}
+	actions, err = purgers[0].plan(context.Background(), pol)
+	if err == nil || !strings.Contains(err.Error(), "cannot tell which resources are in use: subscription sub2: unauthorized") {
+		t.Errorf("got error %v", err)
+	}
+	if len(actions) != 1 || actions[0].Kind != kindGroup || actions[0].Action != actionDelete {
+		t.Errorf("got actions %v, want group old deleted", actions)
+	}
+
+	// references are not collected when there are no image or blob rules
+	purgers, _ = preparePurgers(context.Background(), &policy{Groups: pol.Groups}, []subscription{{id: "sub1"}}, newPurger(""))
+	if purgers[0].refs != nil {
+		t.Errorf("references collected for a groups-only policy")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule is a cron-style schedule.  It is either a fixed interval, or the set
+// of allowed minutes, hours, days of the month, months and days of the week.
+type schedule struct {
+	every time.Duration
+
+	minute, hour, dom, month, dow uint64
+
+	// domStar and dowStar are set if the day of month or day of week field
+	// was "*".  As in cron, if both fields are restricted a day matches if
+	// either does.
+	domStar, dowStar bool
+}
+
+var scheduleDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseSchedule parses a schedule in one of the forms:
+//
+//	MINUTE HOUR DAY-OF-MONTH MONTH DAY-OF-WEEK   (e.g. "*/30 8-18 * * 1-5")
+//	@hourly, @daily, @weekly, @monthly or @yearly
+//	@every DURATION                              (e.g. "@every 6h")
+//
+// Each field of the five-field form is "*" or a comma-separated list of values
+// or ranges, optionally with a step ("/N").  Sunday is day 0 (or 7) of the
+// week.  Schedules are evaluated in UTC.
+func parseSchedule(spec string) (*schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", spec, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("schedule %q: interval must be positive", spec)
+		}
+		return &schedule{every: d}, nil
+	}
+
+	if s, found := scheduleDescriptors[spec]; found {
+		spec = s
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: expected 5 fields, found %d", spec, len(fields))
+	}
+
+	s := &schedule{
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+
+	for _, f := range []struct {
+		name     string
+		field    string
+		min, max int
+		bits     *uint64
+	}{
+		{"minute", fields[0], 0, 59, &s.minute},
+		{"hour", fields[1], 0, 23, &s.hour},
+		{"day of month", fields[2], 1, 31, &s.dom},
+		{"month", fields[3], 1, 12, &s.month},
+		{"day of week", fields[4], 0, 7, &s.dow},
+	} {
+		bits, err := parseScheduleField(f.field, f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %s: %v", spec, f.name, err)
+		}
+		*f.bits = bits
+	}
+
+	// day 7 is also Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	if s.next(time.Unix(0, 0)).IsZero() {
+		return nil, fmt.Errorf("schedule %q never matches", spec)
+	}
+
+	return s, nil
+}
+
+// parseScheduleField returns the set of values allowed by field as a bitmask.
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.IndexByte(part, '/'); i != -1 {
+			var err error
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step != 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// next returns the first time after t allowed by the schedule.
+func (s *schedule) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+
+	// a schedule which can match at all matches within eight years, which
+	// covers a leap day falling on any given day of the week.
+	for end := t.AddDate(8, 0, 0); t.Before(end); {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	// the schedule never matches, e.g. "0 0 30 2 *"
+	return time.Time{}
+}
+
+func (s *schedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
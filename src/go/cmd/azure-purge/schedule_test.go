@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	// Thursday
+	from := time.Date(2018, 6, 14, 12, 34, 56, 0, time.UTC)
+
+	for _, tt := range []struct {
+		spec    string
+		want    time.Time
+		wantErr bool
+	}{
+		{spec: "* * * * *", want: time.Date(2018, 6, 14, 12, 35, 0, 0, time.UTC)},
+		{spec: "@hourly", want: time.Date(2018, 6, 14, 13, 0, 0, 0, time.UTC)},
+		{spec: "@daily", want: time.Date(2018, 6, 15, 0, 0, 0, 0, time.UTC)},
+		{spec: "@weekly", want: time.Date(2018, 6, 17, 0, 0, 0, 0, time.UTC)},
+		{spec: "@monthly", want: time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{spec: "@yearly", want: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{spec: "@every 90m", want: from.Add(90 * time.Minute)},
+		{spec: "*/15 * * * *", want: time.Date(2018, 6, 14, 12, 45, 0, 0, time.UTC)},
+		{spec: "0 */6 * * *", want: time.Date(2018, 6, 14, 18, 0, 0, 0, time.UTC)},
+		{spec: "30 8-18/2 * * *", want: time.Date(2018, 6, 14, 14, 30, 0, 0, time.UTC)},
+		{spec: "0 9 * * 1-5", want: time.Date(2018, 6, 15, 9, 0, 0, 0, time.UTC)},
+		{spec: "0 9 * * 6,7", want: time.Date(2018, 6, 16, 9, 0, 0, 0, time.UTC)},
+		{spec: "0 0 13 * 5", want: time.Date(2018, 6, 15, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 29 2 *", want: time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 30 2 *", wantErr: true},
+		{spec: "* * * *", wantErr: true},
+		{spec: "60 * * * *", wantErr: true},
+		{spec: "5-1 * * * *", wantErr: true},
+		{spec: "*/0 * * * *", wantErr: true},
+		{spec: "@every -1h", wantErr: true},
+		{spec: "@fortnightly", wantErr: true},
+	} {
+		s, err := parseSchedule(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: unexpected success", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+
+		if got := s.next(from); !got.Equal(tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// subscription is a subscription to be purged, and the tenant to authorize
+// against.
+type subscription struct {
+	id       string
+	tenantID string
+}
+
+// resolveSubscriptions expands targets into the list of subscriptions to be
+// purged, discovering the subscriptions of any target without an ID.  If there
+// are no targets, the default subscription is returned.  Tenants which cannot
+// be listed are returned as errors, rather than aborting the run.
+func resolveSubscriptions(ctx context.Context, sc subscriptionsClient, targets []subscriptionTarget, defaultTenantID, defaultSubscriptionID string) ([]subscription, []error) {
+	if len(targets) == 0 {
+		return []subscription{{id: defaultSubscriptionID, tenantID: defaultTenantID}}, nil
+	}
+
+	var subs []subscription
+	var errs []error
+	seen := map[string]struct{}{}
+	add := func(id, tenantID string) {
+		if _, found := seen[strings.ToLower(id)]; found {
+			return
+		}
+		seen[strings.ToLower(id)] = struct{}{}
+		subs = append(subs, subscription{id: id, tenantID: tenantID})
+	}
+
+	for _, target := range targets {
+		tenantID := target.TenantID
+		if tenantID == "" {
+			tenantID = defaultTenantID
+		}
+
+		if target.ID != "" {
+			add(target.ID, tenantID)
+			continue
+		}
+
+		ids, err := sc.List(ctx, tenantID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %v", tenantID, err))
+			continue
+		}
+		for _, id := range ids {
+			add(id, tenantID)
+		}
+	}
+
+	return subs, errs
+}
+
+// purgeSubscriptions applies pol to each subscription in turn and writes a
+// summary line for each to out.  A failing subscription does not prevent the
+// remaining subscriptions from being purged.  The number of subscriptions which
+// failed is returned.
+func purgeSubscriptions(ctx context.Context, pol *policy, subs []subscription, newPurger func(subscription) (*purger, error), out io.Writer) (failed int) {
+	purgers, errs := preparePurgers(ctx, pol, subs, newPurger)
+
+	for i, sub := range subs {
+		p, err := purgers[i], errs[i]
+		if err == nil {
+			err = p.run(ctx, pol)
+		}
+
+		if err != nil {
+			failed++
+		}
+		printSummary(out, sub.id, p, err)
+	}
+
+	return failed
+}
+
+// printSummary writes a summary line for a subscription to out, followed by
+// the outcome of each action executed.  p may be nil if the subscription failed before
+// any resources were selected.
+func printSummary(out io.Writer, subscriptionID string, p *purger, err error) {
+	var selected map[string]int
+	var results []result
+	if p != nil {
+		selected = p.selected
+		results = p.sortedResults()
+	}
+	summary := fmt.Sprintf("selected %d images, %d blobs, %d groups", selected["images"], selected["blobs"], selected["groups"])
+	// orphaned and expired resources are only listed if there are any, since
+	// most policies have no orphan or ttl rules.
+	for _, kind := range []string{kindDisk, kindSnapshot, kindNIC, kindPublicIP, kindResource} {
+		if n := selected[kind+"s"]; n > 0 {
+			summary += fmt.Sprintf(", %d %ss", n, kind)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(out, "subscription %s: %s; failed: %v\n", subscriptionID, summary, err)
+	} else {
+		fmt.Fprintf(out, "subscription %s: %s\n", subscriptionID, summary)
+	}
+
+	for _, r := range results {
+		if r.attempts == 0 {
+			fmt.Fprintf(out, "  did not %s %s %s: %v\n", r.Action, r.Kind, r.displayName(), r.err)
+			continue
+		}
+		if r.err != nil {
+			fmt.Fprintf(out, "  failed to %s %s %s after %d attempts: %v\n", r.Action, r.Kind, r.displayName(), r.attempts, r.err)
+			continue
+		}
+		switch r.Action {
+		case actionQuarantine:
+			fmt.Fprintf(out, "  quarantined %s %s\n", r.Kind, r.displayName())
+		case actionRestore:
+			fmt.Fprintf(out, "  restored %s %s\n", r.Kind, r.displayName())
+		case actionMark:
+			fmt.Fprintf(out, "  marked %s %s orphaned\n", r.Kind, r.displayName())
+		case actionUnmark:
+			fmt.Fprintf(out, "  unmarked %s %s\n", r.Kind, r.displayName())
+		default:
+			fmt.Fprintf(out, "  deleted %s %s\n", r.Kind, r.displayName())
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient/fake"
+)
+
+type fakeSubscriptionsClient struct {
+	tenants map[string][]string
+}
+
+var _ subscriptionsClient = &fakeSubscriptionsClient{}
+
+func (c *fakeSubscriptionsClient) List(ctx context.Context, tenantID string) ([]string, error) {
+	ids, found := c.tenants[tenantID]
+	if !found {
+		return nil, errors.New("unauthorized")
+	}
+	return ids, nil
+}
+
+func TestResolveSubscriptions(t *testing.T) {
+	sc := &fakeSubscriptionsClient{tenants: map[string][]string{
+		"tenant": {"sub1", "sub2"},
+		"other":  {"sub3"},
+	}}
+
+	for _, tt := range []struct {
+		name     string
+		targets  []subscriptionTarget
+		want     []subscription
+		wantErrs []string
+	}{
+		{
+			name: "no targets uses the default subscription",
+			want: []subscription{{id: "default", tenantID: "tenant"}},
+		},
+		{
+			name:    "explicit subscriptions",
+			targets: []subscriptionTarget{{ID: "sub1"}, {ID: "sub3", TenantID: "other"}},
+			want:    []subscription{{id: "sub1", tenantID: "tenant"}, {id: "sub3", tenantID: "other"}},
+		},
+		{
+			name:    "subscriptions are discovered per tenant",
+			targets: []subscriptionTarget{{}, {TenantID: "other"}},
+			want:    []subscription{{id: "sub1", tenantID: "tenant"}, {id: "sub2", tenantID: "tenant"}, {id: "sub3", tenantID: "other"}},
+		},
+		{
+			name:    "duplicates are removed",
+			targets: []subscriptionTarget{{ID: "SUB2"}, {TenantID: "tenant"}},
+			want:    []subscription{{id: "SUB2", tenantID: "tenant"}, {id: "sub1", tenantID: "tenant"}},
+		},
+		{
+			name:     "unlistable tenants are reported",
+			targets:  []subscriptionTarget{{TenantID: "missing"}, {TenantID: "other"}},
+			want:     []subscription{{id: "sub3", tenantID: "other"}},
+			wantErrs: []string{"tenant missing: unauthorized"},
+		},
+	} {
+		subs, errs := resolveSubscriptions(context.Background(), sc, tt.targets, "tenant", "default")
+		if !reflect.DeepEqual(subs, tt.want) {
+			t.Errorf("%s: got subscriptions %v, want %v", tt.name, subs, tt.want)
+		}
+		var gotErrs []string
+		for _, err := range errs {
+			gotErrs = append(gotErrs, err.Error())
+		}
+		if !reflect.DeepEqual(gotErrs, tt.wantErrs) {
+			t.Errorf("%s: got errors %v, want %v", tt.name, gotErrs, tt.wantErrs)
+		}
+	}
+}
+
+func TestPurgeSubscriptions(t *testing.T) {
+	pol := &policy{Groups: []groupRule{{Name: "default", Tag: "now", Timeout: &duration{defaultGroupTimeout}}}}
+	subs := []subscription{{id: "sub1"}, {id: "sub2"}, {id: "sub3"}}
+
+	gcs := map[string]*fake.GroupsClient{}
+	newPurger := func(sub subscription) (*purger, error) {
+		if sub.id == "sub2" {
+			return nil, errors.New("unauthorized")
+		}
+		p, _, _, gc := testPurger([]compute.Image{}, nil, []resources.Group{group("old", "now", unix(96*time.Hour)), group("new")})
+		gcs[sub.id] = gc
+		return p, nil
+	}
+
+	out := &bytes.Buffer{}
+	if failed := purgeSubscriptions(context.Background(), pol, subs, newPurger, out); failed != 1 {
+		t.Errorf("got %d failed subscriptions, want 1", failed)
+	}
+
+	for _, id := range []string{"sub1", "sub3"} {
+		if got, want := gcs[id].Names(), []string{"new"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got groups %v, want %v", id, got, want)
+		}
+	}
+
+	want := `subscription sub1: selected 0 images, 0 blobs, 1 groups
+  deleted group old
+subscription sub2: selected 0 images, 0 blobs, 0 groups; failed: unauthorized
+subscription sub3: selected 0 images, 0 blobs, 1 groups
+  deleted group old
+`
+	if out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// resourceKinds maps the lower-case resource types which other rules select to
+// their kinds.
+var resourceKinds = map[string]string{
+	"microsoft.compute/images":            kindImage,
+	"microsoft.compute/disks":             kindDisk,
+	"microsoft.compute/snapshots":         kindSnapshot,
+	"microsoft.network/networkinterfaces": kindNIC,
+	"microsoft.network/publicipaddresses": kindPublicIP,
+}
+
+// parseTagTime parses a time in RFC3339 format or in Unix seconds.
+func parseTagTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not an RFC3339 time or Unix timestamp", s)
+	}
+
+	return time.Unix(i, 0).UTC(), nil
+}
+
+// parseTTL parses a duration in Go format (e.g. "72h") or in seconds.
+func parseTTL(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a duration", s)
+	}
+
+	return time.Duration(i) * time.Second, nil
+}
+
+// expiry returns when, if ever, a resource or group with the given tags expires
+// according to rule, why, and the evidence for it.
+func (rule ttlRule) expiry(tags map[string]*string) (*time.Time, string, evidence, error) {
+	if v := tags[rule.ExpiresAtTag]; v != nil {
+		ev := evidence{Tag: rule.ExpiresAtTag, TagValue: v}
+		t, err := parseTagTime(*v)
+		if err != nil {
+			return nil, "", ev, fmt.Errorf("%s tag is not a time", rule.ExpiresAtTag)
+		}
+		ev.Timestamp = &t
+		return &t, fmt.Sprintf("%s time has passed", rule.ExpiresAtTag), ev, nil
+	}
+
+	created, ttl := tags[rule.CreatedAtTag], tags[rule.TTLTag]
+	if created == nil || ttl == nil {
+		return nil, "", evidence{}, nil
+	}
+
+	ev := evidence{Tag: rule.CreatedAtTag, TagValue: created}
+	t, err := parseTagTime(*created)
+	if err != nil {
+		return nil, "", ev, fmt.Errorf("%s tag is not a time", rule.CreatedAtTag)
+	}
+	ev.Timestamp = &t
+
+	d, err := parseTTL(*ttl)
+	if err != nil {
+		return nil, "", evidence{Tag: rule.TTLTag, TagValue: ttl}, fmt.Errorf("%s tag is not a duration", rule.TTLTag)
+	}
+
+	expires := t.Add(d)
+	return &expires, fmt.Sprintf("%s of %s has elapsed", rule.TTLTag, d), ev, nil
+}
+
+// referrers returns the sorted IDs of the resources outside its resource group
+// which use res: an image, or a storage account holding VHDs.
+func (p *purger) referrers(res resources.GenericResource) []string {
+	var referrers []string
+	switch strings.ToLower(to.String(res.Type)) {
+	case "microsoft.compute/images":
+		referrers = p.refs.imageReferrers(to.String(res.ID))
+	case "microsoft.storage/storageaccounts":
+		referrers = p.refs.accountReferrers(to.String(res.Name))
+	}
+
+	r, err := azure.ParseResourceID(to.String(res.ID))
+	if err != nil {
+		return referrers
+	}
+	group := strings.ToLower(fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/", r.SubscriptionID, r.ResourceGroup))
+
+	// users in the same group are deleted with it
+	var outside []string
+	for _, referrer := range referrers {
+		if !strings.HasPrefix(strings.ToLower(referrer), group) {
+			outside = append(outside, referrer)
+		}
+	}
+	return outside
+}
+
+// planTTLs selects the resource groups, and then the resources of any type,
+// which have expired according to the tags of rule and are neither managed, in
+// use nor locked.
+func (p *purger) planTTLs(ctx context.Context, rule ttlRule) ([]action, error) {
+	if err := p.refs.err(); err != nil {
+		return nil, err
+	}
+
+	locked := map[string]string{}
+	deleteLock := func(resourceGroup string) (string, error) {
+		lock, found := locked[strings.ToLower(resourceGroup)]
+		if !found {
+			var err error
+			if lock, err = p.deleteLock(ctx, resourceGroup); err != nil {
+				return "", err
+			}
+			locked[strings.ToLower(resourceGroup)] = lock
+		}
+		return lock, nil
+	}
+
+	// only resources with a creation time have an age to record
+	survive := func(kind string, ev evidence) {
+		if ev.Tag == rule.CreatedAtTag && ev.Timestamp != nil {
+			p.survive(kind, rule.Name, *ev.Timestamp)
+		}
+	}
+
+	l, err := p.resources.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// a group is in use if any of its resources is
+	groupReferrers := map[string]map[string]struct{}{}
+	for _, res := range l {
+		for _, referrer := range p.referrers(res) {
+			r, err := azure.ParseResourceID(to.String(res.ID))
+			if err != nil {
+				return nil, err
+			}
+			group := strings.ToLower(r.ResourceGroup)
+			groupReferrers[group] = addReferrer(groupReferrers[group], referrer)
+		}
+	}
+
+	groups, err := p.groups.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.metrics.scan(p.subscription, kindGroup, rule.Name, len(groups))
+
+	var actions []action
+	for _, group := range groups {
+		expires, reason, ev, err := rule.expiry(group.Tags)
+		if expires == nil && err == nil {
+			continue
+		}
+
+		a := action{Action: actionDelete, Kind: kindGroup, Name: *group.Name, Rule: rule.Name, Reason: reason, Evidence: ev}
+		if _, found := p.planned[a.key()]; found {
+			continue
+		}
+		p.recordTags(&a, group.Tags)
+
+		if err != nil {
+			a.Action = actionKeep
+			a.Reason = err.Error()
+			actions = append(actions, a)
+			continue
+		}
+
+		if expires.After(p.now) {
+			survive(kindGroup, ev)
+			continue
+		}
+
+		if referrers := sortedReferrers(groupReferrers[strings.ToLower(*group.Name)]); len(referrers) > 0 {
+			survive(kindGroup, ev)
+			a.Action = actionKeep
+			a.Reason = "in use"
+			a.Evidence.Referrers = referrers
+			actions = append(actions, a)
+			continue
+		}
+
+		lock, err := deleteLock(*group.Name)
+		if err != nil {
+			return nil, err
+		}
+		if lock != "" {
+			survive(kindGroup, ev)
+			a.Action = actionKeep
+			a.Reason = "management lock"
+			a.Evidence = evidence{Lock: lock}
+		}
+
+		actions = append(actions, a)
+		if a.Action == actionDelete {
+			p.planned[a.key()] = struct{}{}
+		}
+	}
+
+	p.metrics.scan(p.subscription, kindResource, rule.Name, len(l))
+
+	for _, res := range l {
+		r, err := azure.ParseResourceID(to.String(res.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		expires, reason, ev, err := rule.expiry(res.Tags)
+		if expires == nil && err == nil {
+			continue
+		}
+
+		// resources in a group which is to be deleted go with it
+		g := action{Kind: kindGroup, Name: r.ResourceGroup}
+		if _, found := p.planned[g.key()]; found {
+			continue
+		}
+
+		// as do those already selected by another rule
+		if kind, found := resourceKinds[strings.ToLower(to.String(res.Type))]; found {
+			k := action{Kind: kind, ResourceGroup: r.ResourceGroup, Name: to.String(res.Name)}
+			if _, found := p.planned[k.key()]; found {
+				continue
+			}
+		}
+
+		a := action{
+			Action:        actionDelete,
+			Kind:          kindResource,
+			ResourceGroup: r.ResourceGroup,
+			ResourceType:  to.String(res.Type),
+			ID:            to.String(res.ID),
+			Name:          to.String(res.Name),
+			Rule:          rule.Name,
+			Reason:        reason,
+			Evidence:      ev,
+		}
+		if _, found := p.planned[a.key()]; found {
+			continue
+		}
+		p.recordTags(&a, res.Tags)
+
+		if err != nil {
+			a.Action = actionKeep
+			a.Reason = err.Error()
+			actions = append(actions, a)
+			continue
+		}
+
+		if expires.After(p.now) {
+			survive(kindResource, ev)
+			continue
+		}
+
+		if res.ManagedBy != nil {
+			survive(kindResource, ev)
+			a.Action = actionKeep
+			a.Reason = "managed by another resource"
+			a.Evidence.Referrers = []string{*res.ManagedBy}
+			actions = append(actions, a)
+			continue
+		}
+
+		if referrers := p.referrers(res); len(referrers) > 0 {
+			survive(kindResource, ev)
+			a.Action = actionKeep
+			a.Reason = "in use"
+			a.Evidence.Referrers = referrers
+			actions = append(actions, a)
+			continue
+		}
+
+		lock, err := deleteLock(r.ResourceGroup)
+		if err != nil {
+			return nil, err
+		}
+		if lock != "" {
+			survive(kindResource, ev)
+			a.Action = actionKeep
+			a.Reason = "management lock"
+			a.Evidence = evidence{Lock: lock}
+		}
+
+		actions = append(actions, a)
+	}
+
+	return actions, nil
+}
+
+// apiVersion returns the newest stable, or failing that preview, API version of
+// the given resource type, such as "Microsoft.Network/publicIPAddresses".
+func (p *purger) apiVersion(ctx context.Context, resourceType string) (string, error) {
+	i := strings.Index(resourceType, "/")
+	if i == -1 {
+		return "", fmt.Errorf("invalid resource type %q", resourceType)
+	}
+	namespace := strings.ToLower(resourceType[:i])
+
+	p.mu.Lock()
+	types, found := p.apiVersions[namespace]
+	p.mu.Unlock()
+
+	if !found {
+		provider, err := p.providers.Get(ctx, namespace)
+		if err != nil {
+			return "", err
+		}
+
+		types = map[string][]string{}
+		if provider.ResourceTypes != nil {
+			for _, rt := range *provider.ResourceTypes {
+				if rt.ResourceType != nil && rt.APIVersions != nil {
+					types[strings.ToLower(*rt.ResourceType)] = *rt.APIVersions
+				}
+			}
+		}
+
+		p.mu.Lock()
+		if p.apiVersions == nil {
+			p.apiVersions = map[string]map[string][]string{}
+		}
+		p.apiVersions[namespace] = types
+		p.mu.Unlock()
+	}
+
+	// API versions are dates, optionally followed by a suffix such as
+	// "-preview", so the newest sorts last.
+	versions := append([]string(nil), types[strings.ToLower(resourceType[i+1:])]...)
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no API versions found for resource type %q", resourceType)
+	}
+	sort.Strings(versions)
+
+	for j := len(versions) - 1; j >= 0; j-- {
+		if !strings.Contains(versions[j], "-preview") && !strings.Contains(versions[j], "-beta") && !strings.Contains(versions[j], "-alpha") {
+			return versions[j], nil
+		}
+	}
+	return versions[len(versions)-1], nil
+}
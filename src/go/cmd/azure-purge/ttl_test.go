@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2015-01-01/locks"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func TestExpiry(t *testing.T) {
+	rule := ttlRule{CreatedAtTag: "created-at", TTLTag: "ttl", ExpiresAtTag: "expires-at"}
+	at := func(s string) *time.Time {
+		t, _ := time.Parse(time.RFC3339, s)
+		return &t
+	}
+
+	for _, tt := range []struct {
+		name    string
+		tags    []string
+		want    *time.Time
+		wantErr string
+	}{
+		{name: "no tags"},
+		{name: "created-at without ttl", tags: []string{"created-at", "2018-06-14T00:00:00Z"}},
+		{name: "expires-at RFC3339", tags: []string{"expires-at", "2018-06-14T02:00:00+02:00"}, want: at("2018-06-14T00:00:00Z")},
+		{name: "expires-at Unix", tags: []string{"expires-at", "1528934400"}, want: at("2018-06-14T00:00:00Z")},
+		{name: "expires-at wins", tags: []string{"expires-at", "1528934400", "created-at", "1528934400", "ttl", "1h"}, want: at("2018-06-14T00:00:00Z")},
+		{name: "ttl duration", tags: []string{"created-at", "2018-06-14T00:00:00Z", "ttl", "72h"}, want: at("2018-06-17T00:00:00Z")},
+		{name: "ttl seconds", tags: []string{"created-at", "1528934400", "ttl", "3600"}, want: at("2018-06-14T01:00:00Z")},
+		{name: "bad expires-at", tags: []string{"expires-at", "tomorrow"}, wantErr: "expires-at tag is not a time"},
+		{name: "bad created-at", tags: []string{"created-at", "today", "ttl", "1h"}, wantErr: "created-at tag is not a time"},
+		{name: "bad ttl", tags: []string{"created-at", "1528934400", "ttl", "forever"}, wantErr: "ttl tag is not a duration"},
+	} {
+		tags := group("", tt.tags...).Tags
+		got, _, _, err := rule.expiry(tags)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case (got == nil) != (tt.want == nil) || got != nil && !got.Equal(*tt.want):
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPurgeTTLs(t *testing.T) {
+	past, future := testNow.Add(-time.Hour).Format(time.RFC3339), testNow.Add(time.Hour).Format(time.RFC3339)
+
+	groups := []resources.Group{
+		group("expired", "expires-at", past),
+		group("current", "expires-at", future),
+		group("locked", "created-at", unix(48*time.Hour), "ttl", "24h"),
+		group("untagged"),
+	}
+	p, _, _, gc := testPurger(nil, nil, groups)
+	p.locks = &fakeLocksClient{locks: map[string][]locks.ManagementLockObject{"locked": {lock("dontdelete", locks.CanNotDelete)}}}
+
+	managed := genericResource("cluster", "Microsoft.Compute/disks", "osdisk", "expires-at", past)
+	managed.ManagedBy = to.StringPtr(resourceID("cluster", "Microsoft.Compute/virtualMachines", "master"))
+	rc := &fakeResourcesClient{resources: []resources.GenericResource{
+		genericResource("expired", "Microsoft.Network/publicIPAddresses", "ip", "expires-at", past),
+		genericResource("locked", "Microsoft.Network/publicIPAddresses", "ip", "expires-at", past),
+		genericResource("cluster", "Microsoft.Network/publicIPAddresses", "ip", "created-at", unix(48*time.Hour), "ttl", "86400"),
+		genericResource("cluster", "Microsoft.Network/loadBalancers", "lb", "expires-at", future),
+		genericResource("cluster", "Microsoft.KeyVault/vaults", "vault", "expires-at", "soon"),
+		genericResource("cluster", "Microsoft.Network/virtualNetworks", "vnet"),
+		managed,
+	}}
+	p.resources = rc
+	p.providers = &fakeProvidersClient{providers: map[string]resources.Provider{
+		"microsoft.network": provider("Microsoft.Network", []string{"publicIPAddresses", "loadBalancers"}, "2018-08-01", "2018-10-01-preview", "2017-09-01"),
+	}}
+
+	pol := &policy{TTLs: []ttlRule{{}}}
+	pol.setDefaults()
+
+	if err := p.run(context.Background(), pol); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `delete group expired
+keep group locked: management lock
+keep resource Microsoft.Network/publicIPAddresses/ip: management lock
+delete resource Microsoft.Network/publicIPAddresses/ip
+keep resource Microsoft.KeyVault/vaults/vault: expires-at tag is not a time
+keep resource Microsoft.Compute/disks/osdisk: managed by another resource: ` + *managed.ManagedBy + `
+`
+	if got := p.out.(*bytes.Buffer).String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+
+	if got, want := gc.Names(), []string{"current", "locked", "untagged"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, want %v", got, want)
+	}
+
+	// the IP address in the expired group is deleted with it
+	wantDeleted := map[string]string{resourceID("cluster", "Microsoft.Network/publicIPAddresses", "ip"): "2018-08-01"}
+	if !reflect.DeepEqual(rc.deleted, wantDeleted) {
+		t.Errorf("got deleted %v, want %v", rc.deleted, wantDeleted)
+	}
+}
+
+func TestPurgeTTLsKeepsResourcesInUse(t *testing.T) {
+	past := testNow.Add(-time.Hour).Format(time.RFC3339)
+	vm := func(resourceGroup string) string {
+		return resourceID(resourceGroup, "Microsoft.Compute/virtualMachines", "vm")
+	}
+
+	p, _, _, gc := testPurger(nil, nil, []resources.Group{
+		group("images", "expires-at", past),
+		group("self", "expires-at", past),
+		group("shared"),
+	})
+	p.resources = &fakeResourcesClient{resources: []resources.GenericResource{
+		genericResource("images", "Microsoft.Compute/images", "image"),
+		genericResource("self", "Microsoft.Compute/images", "image"),
+		genericResource("shared", "Microsoft.Compute/images", "image", "expires-at", past),
+		genericResource("shared", "Microsoft.Storage/storageAccounts", "vhds", "expires-at", past),
+		genericResource("shared", "Microsoft.Storage/storageAccounts", "unused", "expires-at", past),
+	}}
+	p.refs = newReferences()
+	p.refs.addImage(resourceID("images", "Microsoft.Compute/images", "image"), vm("cluster"))
+	p.refs.addImage(resourceID("self", "Microsoft.Compute/images", "image"), vm("self"))
+	p.refs.addImage(resourceID("shared", "Microsoft.Compute/images", "image"), vm("cluster"))
+	p.refs.addBlob(blobURI("vhds", "vhds", "os.vhd"), vm("cluster"))
+	p.dryRun = true
+
+	pol := &policy{TTLs: []ttlRule{{}}}
+	pol.setDefaults()
+
+	actions, err := p.plan(context.Background(), pol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for i := range actions {
+		got = append(got, actions[i].String())
+	}
+	// a group used only by its own resources is deleted with them
+	want := []string{
+		"keep group images: in use: " + vm("cluster"),
+		"delete group self",
+		"keep resource Microsoft.Compute/images/image: in use: " + vm("cluster"),
+		"keep resource Microsoft.Storage/storageAccounts/vhds: in use: " + vm("cluster"),
+		"delete resource Microsoft.Storage/storageAccounts/unused",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got actions %q, want %q", got, want)
+	}
+	if got, want := gc.Names(), []string{"images", "self", "shared"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %v, want %v", got, want)
+	}
+}
+
+func TestPurgeTTLsSkipsPlannedResources(t *testing.T) {
+	old := testNow.Add(-48 * time.Hour)
+
+	p, _, _, _ := testPurger(nil, nil, []resources.Group{group("cluster", "now", unix(96*time.Hour)), group("other")})
+	p.disks = &fakeDisksClient{disks: []compute.Disk{orphanDisk("other", "disk", old, "", "orphaned-at", unix(48*time.Hour))}}
+	p.resources = &fakeResourcesClient{resources: []resources.GenericResource{
+		genericResource("cluster", "Microsoft.Network/publicIPAddresses", "ip", "expires-at", "0"),
+		genericResource("other", "Microsoft.Compute/disks", "disk", "expires-at", "0"),
+		genericResource("other", "Microsoft.Compute/disks", "other", "expires-at", "0"),
+	}}
+	p.dryRun = true
+
+	pol := &policy{
+		Groups:  []groupRule{{}},
+		Orphans: []orphanRule{{Kinds: []string{kindDisk}}},
+		TTLs:    []ttlRule{{}},
+	}
+	pol.setDefaults()
+
+	actions, err := p.plan(context.Background(), pol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for i := range actions {
+		got = append(got, actions[i].Rule+": "+actions[i].String())
+	}
+	want := []string{
+		"groups[0]: delete group cluster",
+		"orphans[0]: delete disk disk",
+		"ttls[0]: delete resource Microsoft.Compute/disks/other",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got actions %v, want %v", got, want)
+	}
+}
+
+func TestAPIVersion(t *testing.T) {
+	pc := &fakeProvidersClient{providers: map[string]resources.Provider{
+		"microsoft.network": provider("Microsoft.Network", []string{"publicIPAddresses"}, "2018-08-01", "2018-10-01-preview", "2017-09-01"),
+		"microsoft.contoso": provider("Microsoft.Contoso", []string{"widgets"}, "2018-01-01-preview", "2018-03-01-preview"),
+	}}
+	p, _, _, _ := testPurger(nil, nil, nil)
+	p.providers = pc
+
+	for _, tt := range []struct {
+		resourceType string
+		want         string
+		wantErr      string
+	}{
+		{resourceType: "Microsoft.Network/publicIPAddresses", want: "2018-08-01"},
+		{resourceType: "microsoft.network/PUBLICIPADDRESSES", want: "2018-08-01"},
+		{resourceType: "Microsoft.Contoso/widgets", want: "2018-03-01-preview"},
+		{resourceType: "Microsoft.Network/loadBalancers", wantErr: "no API versions found"},
+		{resourceType: "Microsoft.Unknown/things", wantErr: "provider microsoft.unknown not found"},
+		{resourceType: "nonsense", wantErr: "invalid resource type"},
+	} {
+		got, err := p.apiVersion(context.Background(), tt.resourceType)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.resourceType, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.resourceType, got, err, tt.want)
+		}
+	}
+
+	// each provider is looked up once; failed lookups are not cached
+	if pc.calls != 3 {
+		t.Errorf("got %d provider lookups, want 3", pc.calls)
+	}
+}
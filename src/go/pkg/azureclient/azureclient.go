@@ -0,0 +1,362 @@
+// Package azureclient wraps the Azure SDK clients shared by the commands which
+// manage Azure resources behind narrow interfaces, so that the commands can be
+// tested against the in-memory fakes of package fake.
+package azureclient
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-04-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+)
+
+// HTTPClient sends every request to Azure.  Tests replace it to redirect
+// requests to a fake endpoint.
+var HTTPClient = http.DefaultClient
+
+// ImagesClient lists, gets, creates and deletes images.  List returns the
+// images of the whole subscription.  CreateOrUpdate and Delete return once the
+// image has been created, updated or removed.
+type ImagesClient interface {
+	List(ctx context.Context) ([]compute.Image, error)
+	ListByResourceGroup(ctx context.Context, resourceGroup string) ([]compute.Image, error)
+	Get(ctx context.Context, resourceGroup, name string) (compute.Image, error)
+	CreateOrUpdate(ctx context.Context, resourceGroup, name string, image compute.Image) error
+	Delete(ctx context.Context, resourceGroup, name string) error
+}
+
+// GroupsClient lists, gets, creates, tags and deletes resource groups.  Get
+// returns nil if the group does not exist.  CreateOrUpdate and UpdateTags
+// replace the tags of an existing group.  Delete returns once the group has
+// been removed.
+type GroupsClient interface {
+	List(ctx context.Context) ([]resources.Group, error)
+	Get(ctx context.Context, name string) (*resources.Group, error)
+	CreateOrUpdate(ctx context.Context, name string, group resources.Group) error
+	UpdateTags(ctx context.Context, name string, tags map[string]*string) error
+	Delete(ctx context.Context, name string) error
+}
+
+// ScaleSetsClient lists the virtual machine scale sets of a subscription or of
+// a resource group.
+type ScaleSetsClient interface {
+	List(ctx context.Context) ([]compute.VirtualMachineScaleSet, error)
+	ListByResourceGroup(ctx context.Context, resourceGroup string) ([]compute.VirtualMachineScaleSet, error)
+}
+
+// InterfacesClient lists and deletes network interfaces.  List and
+// ListByResourceGroup do not return the interfaces of scale set instances,
+// which ListByScaleSet does.  Delete returns once the interface has been
+// removed.
+type InterfacesClient interface {
+	List(ctx context.Context) ([]network.Interface, error)
+	ListByResourceGroup(ctx context.Context, resourceGroup string) ([]network.Interface, error)
+	ListByScaleSet(ctx context.Context, resourceGroup, scaleSet string) ([]network.Interface, error)
+	Delete(ctx context.Context, resourceGroup, name string) error
+}
+
+// PublicIPAddressesClient lists and deletes public IP addresses.  Delete
+// returns once the address has been removed.
+type PublicIPAddressesClient interface {
+	List(ctx context.Context) ([]network.PublicIPAddress, error)
+	ListByResourceGroup(ctx context.Context, resourceGroup string) ([]network.PublicIPAddress, error)
+	Delete(ctx context.Context, resourceGroup, name string) error
+}
+
+type imagesClient struct {
+	client compute.ImagesClient
+}
+
+var _ ImagesClient = &imagesClient{}
+
+// NewImagesClient returns an ImagesClient for a subscription.
+func NewImagesClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) ImagesClient {
+	c := &imagesClient{client: compute.NewImagesClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = HTTPClient
+	SkipRegistration(&c.client.Client)
+	return c
+}
+
+func (c *imagesClient) List(ctx context.Context) ([]compute.Image, error) {
+	results, err := c.client.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []compute.Image
+	for ; results.NotDone(); results.Next() {
+		images = append(images, results.Values()...)
+	}
+
+	return images, nil
+}
+
+func (c *imagesClient) ListByResourceGroup(ctx context.Context, resourceGroup string) ([]compute.Image, error) {
+	results, err := c.client.ListByResourceGroup(ctx, resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []compute.Image
+	for ; results.NotDone(); results.Next() {
+		images = append(images, results.Values()...)
+	}
+
+	return images, nil
+}
+
+func (c *imagesClient) Get(ctx context.Context, resourceGroup, name string) (compute.Image, error) {
+	return c.client.Get(ctx, resourceGroup, name, "")
+}
+
+func (c *imagesClient) CreateOrUpdate(ctx context.Context, resourceGroup, name string, image compute.Image) error {
+	future, err := c.client.CreateOrUpdate(ctx, resourceGroup, name, image)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, c.client.Client)
+}
+
+func (c *imagesClient) Delete(ctx context.Context, resourceGroup, name string) error {
+	future, err := c.client.Delete(ctx, resourceGroup, name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, c.client.Client)
+}
+
+type groupsClient struct {
+	client resources.GroupsClient
+}
+
+var _ GroupsClient = &groupsClient{}
+
+// NewGroupsClient returns a GroupsClient for a subscription.
+func NewGroupsClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) GroupsClient {
+	c := &groupsClient{client: resources.NewGroupsClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = HTTPClient
+	SkipRegistration(&c.client.Client)
+	return c
+}
+
+func (c *groupsClient) List(ctx context.Context) ([]resources.Group, error) {
+	results, err := c.client.List(ctx, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []resources.Group
+	for ; results.NotDone(); results.Next() {
+		groups = append(groups, results.Values()...)
+	}
+
+	return groups, nil
+}
+
+func (c *groupsClient) Get(ctx context.Context, name string) (*resources.Group, error) {
+	group, err := c.client.Get(ctx, name)
+	if err != nil {
+		if group.Response.Response != nil && group.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+func (c *groupsClient) CreateOrUpdate(ctx context.Context, name string, group resources.Group) error {
+	_, err := c.client.CreateOrUpdate(ctx, name, group)
+	return err
+}
+
+func (c *groupsClient) UpdateTags(ctx context.Context, name string, tags map[string]*string) error {
+	_, err := c.client.Update(ctx, name, resources.GroupPatchable{Tags: tags})
+	return err
+}
+
+func (c *groupsClient) Delete(ctx context.Context, name string) error {
+	future, err := c.client.Delete(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, c.client.Client)
+}
+
+type scaleSetsClient struct {
+	client compute.VirtualMachineScaleSetsClient
+}
+
+var _ ScaleSetsClient = &scaleSetsClient{}
+
+// NewScaleSetsClient returns a ScaleSetsClient for a subscription.
+func NewScaleSetsClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) ScaleSetsClient {
+	c := &scaleSetsClient{client: compute.NewVirtualMachineScaleSetsClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = HTTPClient
+	return c
+}
+
+func (c *scaleSetsClient) List(ctx context.Context) ([]compute.VirtualMachineScaleSet, error) {
+	results, err := c.client.ListAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var scaleSets []compute.VirtualMachineScaleSet
+	for ; results.NotDone(); results.Next() {
+		scaleSets = append(scaleSets, results.Values()...)
+	}
+
+	return scaleSets, nil
+}
+
+func (c *scaleSetsClient) ListByResourceGroup(ctx context.Context, resourceGroup string) ([]compute.VirtualMachineScaleSet, error) {
+	results, err := c.client.List(ctx, resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	var scaleSets []compute.VirtualMachineScaleSet
+	for ; results.NotDone(); results.Next() {
+		scaleSets = append(scaleSets, results.Values()...)
+	}
+
+	return scaleSets, nil
+}
+
+type interfacesClient struct {
+	client network.InterfacesClient
+}
+
+var _ InterfacesClient = &interfacesClient{}
+
+// NewInterfacesClient returns an InterfacesClient for a subscription.
+func NewInterfacesClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) InterfacesClient {
+	c := &interfacesClient{client: network.NewInterfacesClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = HTTPClient
+	SkipRegistration(&c.client.Client)
+	return c
+}
+
+func (c *interfacesClient) List(ctx context.Context) ([]network.Interface, error) {
+	results, err := c.client.ListAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var interfaces []network.Interface
+	for ; results.NotDone(); results.Next() {
+		interfaces = append(interfaces, results.Values()...)
+	}
+
+	return interfaces, nil
+}
+
+func (c *interfacesClient) ListByResourceGroup(ctx context.Context, resourceGroup string) ([]network.Interface, error) {
+	results, err := c.client.List(ctx, resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	var interfaces []network.Interface
+	for ; results.NotDone(); results.Next() {
+		interfaces = append(interfaces, results.Values()...)
+	}
+
+	return interfaces, nil
+}
+
+func (c *interfacesClient) ListByScaleSet(ctx context.Context, resourceGroup, scaleSet string) ([]network.Interface, error) {
+	results, err := c.client.ListVirtualMachineScaleSetNetworkInterfaces(ctx, resourceGroup, scaleSet)
+	if err != nil {
+		return nil, err
+	}
+
+	var interfaces []network.Interface
+	for ; results.NotDone(); results.Next() {
+		interfaces = append(interfaces, results.Values()...)
+	}
+
+	return interfaces, nil
+}
+
+func (c *interfacesClient) Delete(ctx context.Context, resourceGroup, name string) error {
+	future, err := c.client.Delete(ctx, resourceGroup, name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, c.client.Client)
+}
+
+type publicIPAddressesClient struct {
+	client network.PublicIPAddressesClient
+}
+
+var _ PublicIPAddressesClient = &publicIPAddressesClient{}
+
+// NewPublicIPAddressesClient returns a PublicIPAddressesClient for a
+// subscription.
+func NewPublicIPAddressesClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) PublicIPAddressesClient {
+	c := &publicIPAddressesClient{client: network.NewPublicIPAddressesClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)}
+	c.client.Authorizer = authorizer
+	c.client.Sender = HTTPClient
+	SkipRegistration(&c.client.Client)
+	return c
+}
+
+func (c *publicIPAddressesClient) List(ctx context.Context) ([]network.PublicIPAddress, error) {
+	results, err := c.client.ListAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []network.PublicIPAddress
+	for ; results.NotDone(); results.Next() {
+		addresses = append(addresses, results.Values()...)
+	}
+
+	return addresses, nil
+}
+
+func (c *publicIPAddressesClient) ListByResourceGroup(ctx context.Context, resourceGroup string) ([]network.PublicIPAddress, error) {
+	results, err := c.client.List(ctx, resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []network.PublicIPAddress
+	for ; results.NotDone(); results.Next() {
+		addresses = append(addresses, results.Values()...)
+	}
+
+	return addresses, nil
+}
+
+func (c *publicIPAddressesClient) Delete(ctx context.Context, resourceGroup, name string) error {
+	future, err := c.client.Delete(ctx, resourceGroup, name)
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletion(ctx, c.client.Client)
+}
+
+// SkipRegistration makes c return conflicts to the caller, rather than retrying
+// them as possible resource provider registration failures.  It is used by
+// every client which deletes resources.
+func SkipRegistration(c *autorest.Client) {
+	c.SkipResourceProviderRegistration = true
+}
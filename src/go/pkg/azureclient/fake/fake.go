@@ -0,0 +1,369 @@
+// Package fake provides in-memory fakes of the clients of package azureclient,
+// for use in tests.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-04-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+)
+
+// ImagesClient is an in-memory azureclient.ImagesClient, keyed by resource
+// group.  Errors queued in Failures are returned by successive attempts to
+// delete the named image.  Updates counts the calls to CreateOrUpdate, which
+// fails with UpdateErr if it is set.
+type ImagesClient struct {
+	mu        sync.Mutex
+	Images    map[string][]compute.Image
+	Failures  map[string][]error
+	Updates   int
+	UpdateErr error
+}
+
+var _ azureclient.ImagesClient = &ImagesClient{}
+
+// List returns the images of every resource group, in order of resource
+// group.
+func (c *ImagesClient) List(ctx context.Context) ([]compute.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var images []compute.Image
+	for _, resourceGroup := range sortedKeys(c.Images) {
+		images = append(images, c.Images[resourceGroup]...)
+	}
+	return images, nil
+}
+
+func (c *ImagesClient) ListByResourceGroup(ctx context.Context, resourceGroup string) ([]compute.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]compute.Image(nil), c.Images[resourceGroup]...), nil
+}
+
+func (c *ImagesClient) Get(ctx context.Context, resourceGroup, name string) (compute.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, image := range c.Images[resourceGroup] {
+		if *image.Name == name {
+			return image, nil
+		}
+	}
+
+	return compute.Image{}, fmt.Errorf("image %s/%s not found", resourceGroup, name)
+}
+
+func (c *ImagesClient) CreateOrUpdate(ctx context.Context, resourceGroup, name string, image compute.Image) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Updates++
+	if c.UpdateErr != nil {
+		return c.UpdateErr
+	}
+
+	if c.Images == nil {
+		c.Images = map[string][]compute.Image{}
+	}
+	image.Name = to.StringPtr(name)
+	for i := range c.Images[resourceGroup] {
+		if *c.Images[resourceGroup][i].Name == name {
+			c.Images[resourceGroup][i] = image
+			return nil
+		}
+	}
+	c.Images[resourceGroup] = append(c.Images[resourceGroup], image)
+
+	return nil
+}
+
+func (c *ImagesClient) Delete(ctx context.Context, resourceGroup, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if errs := c.Failures[name]; len(errs) > 0 {
+		c.Failures[name] = errs[1:]
+		return errs[0]
+	}
+
+	for i, image := range c.Images[resourceGroup] {
+		if *image.Name == name {
+			c.Images[resourceGroup] = append(c.Images[resourceGroup][:i], c.Images[resourceGroup][i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("image %s/%s not found", resourceGroup, name)
+}
+
+// Names returns the sorted names of the images in resourceGroup.
+func (c *ImagesClient) Names(resourceGroup string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := []string{}
+	for _, image := range c.Images[resourceGroup] {
+		names = append(names, *image.Name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// GroupsClient is an in-memory azureclient.GroupsClient.  Errors queued in
+// Failures are returned by successive attempts to delete the named group, and
+// each deletion takes Delay, unless its context is done first.  OnDelete, if
+// set, is called at the start of each deletion.  MaxInFlight records the
+// largest number of concurrent deletions.
+type GroupsClient struct {
+	mu     sync.Mutex
+	Groups []resources.Group
+
+	OnDelete    func(name string)
+	Failures    map[string][]error
+	Delay       time.Duration
+	inFlight    int
+	MaxInFlight int
+}
+
+var _ azureclient.GroupsClient = &GroupsClient{}
+
+func (c *GroupsClient) List(ctx context.Context) ([]resources.Group, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]resources.Group(nil), c.Groups...), nil
+}
+
+func (c *GroupsClient) Get(ctx context.Context, name string) (*resources.Group, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, group := range c.Groups {
+		if *group.Name == name {
+			return &group, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (c *GroupsClient) CreateOrUpdate(ctx context.Context, name string, group resources.Group) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	group.Name = to.StringPtr(name)
+	for i := range c.Groups {
+		if *c.Groups[i].Name == name {
+			c.Groups[i] = group
+			return nil
+		}
+	}
+	c.Groups = append(c.Groups, group)
+
+	return nil
+}
+
+func (c *GroupsClient) UpdateTags(ctx context.Context, name string, tags map[string]*string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.Groups {
+		if *c.Groups[i].Name == name {
+			c.Groups[i].Tags = tags
+			return nil
+		}
+	}
+
+	return fmt.Errorf("group %s not found", name)
+}
+
+func (c *GroupsClient) Delete(ctx context.Context, name string) error {
+	if c.OnDelete != nil {
+		c.OnDelete(name)
+	}
+
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.MaxInFlight {
+		c.MaxInFlight = c.inFlight
+	}
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.inFlight--
+		c.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(c.Delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if errs := c.Failures[name]; len(errs) > 0 {
+		c.Failures[name] = errs[1:]
+		return errs[0]
+	}
+
+	for i, group := range c.Groups {
+		if *group.Name == name {
+			c.Groups = append(c.Groups[:i], c.Groups[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("group %s not found", name)
+}
+
+// Names returns the sorted names of the groups.
+func (c *GroupsClient) Names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := []string{}
+	for _, group := range c.Groups {
+		names = append(names, *group.Name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// ScaleSetsClient is an in-memory azureclient.ScaleSetsClient, keyed by
+// resource group.
+type ScaleSetsClient struct {
+	ScaleSets map[string][]compute.VirtualMachineScaleSet
+}
+
+var _ azureclient.ScaleSetsClient = &ScaleSetsClient{}
+
+func (c *ScaleSetsClient) List(ctx context.Context) ([]compute.VirtualMachineScaleSet, error) {
+	var scaleSets []compute.VirtualMachineScaleSet
+	for _, resourceGroup := range sortedKeys(c.ScaleSets) {
+		scaleSets = append(scaleSets, c.ScaleSets[resourceGroup]...)
+	}
+	return scaleSets, nil
+}
+
+func (c *ScaleSetsClient) ListByResourceGroup(ctx context.Context, resourceGroup string) ([]compute.VirtualMachineScaleSet, error) {
+	return c.ScaleSets[resourceGroup], nil
+}
+
+// InterfacesClient is an in-memory azureclient.InterfacesClient, keyed by
+// resource group.  The interfaces of scale set instances are held apart in
+// ScaleSetInterfaces, keyed by "resourcegroup/scaleset".
+type InterfacesClient struct {
+	mu                 sync.Mutex
+	Interfaces         map[string][]network.Interface
+	ScaleSetInterfaces map[string][]network.Interface
+}
+
+var _ azureclient.InterfacesClient = &InterfacesClient{}
+
+func (c *InterfacesClient) List(ctx context.Context) ([]network.Interface, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var interfaces []network.Interface
+	for _, resourceGroup := range sortedKeys(c.Interfaces) {
+		interfaces = append(interfaces, c.Interfaces[resourceGroup]...)
+	}
+	return interfaces, nil
+}
+
+func (c *InterfacesClient) ListByResourceGroup(ctx context.Context, resourceGroup string) ([]network.Interface, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]network.Interface(nil), c.Interfaces[resourceGroup]...), nil
+}
+
+func (c *InterfacesClient) ListByScaleSet(ctx context.Context, resourceGroup, scaleSet string) ([]network.Interface, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]network.Interface(nil), c.ScaleSetInterfaces[resourceGroup+"/"+scaleSet]...), nil
+}
+
+func (c *InterfacesClient) Delete(ctx context.Context, resourceGroup, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, nic := range c.Interfaces[resourceGroup] {
+		if strings.EqualFold(*nic.Name, name) {
+			c.Interfaces[resourceGroup] = append(c.Interfaces[resourceGroup][:i], c.Interfaces[resourceGroup][i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("network interface %s/%s not found", resourceGroup, name)
+}
+
+// PublicIPAddressesClient is an in-memory
+// azureclient.PublicIPAddressesClient, keyed by resource group.
+type PublicIPAddressesClient struct {
+	mu        sync.Mutex
+	Addresses map[string][]network.PublicIPAddress
+}
+
+var _ azureclient.PublicIPAddressesClient = &PublicIPAddressesClient{}
+
+func (c *PublicIPAddressesClient) List(ctx context.Context) ([]network.PublicIPAddress, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var addresses []network.PublicIPAddress
+	for _, resourceGroup := range sortedKeys(c.Addresses) {
+		addresses = append(addresses, c.Addresses[resourceGroup]...)
+	}
+	return addresses, nil
+}
+
+func (c *PublicIPAddressesClient) ListByResourceGroup(ctx context.Context, resourceGroup string) ([]network.PublicIPAddress, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]network.PublicIPAddress(nil), c.Addresses[resourceGroup]...), nil
+}
+
+func (c *PublicIPAddressesClient) Delete(ctx context.Context, resourceGroup, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, ip := range c.Addresses[resourceGroup] {
+		if strings.EqualFold(*ip.Name, name) {
+			c.Addresses[resourceGroup] = append(c.Addresses[resourceGroup][:i], c.Addresses[resourceGroup][i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("public IP address %s/%s not found", resourceGroup, name)
+}
+
+// sortedKeys returns the sorted keys of m, which must be a map keyed by
+// string.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,236 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	azstorage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/openshift/azure-misc/src/go/pkg/azureclient"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+)
+
+// StorageClient is an in-memory azureclient.StorageClient, holding storage
+// accounts keyed by name.
+type StorageClient struct {
+	mu       sync.Mutex
+	Accounts map[string]*BlobsClient
+}
+
+var _ azureclient.StorageClient = &StorageClient{}
+
+func (c *StorageClient) GetLocation(ctx context.Context, resourceGroup, storageAccount string) (string, error) {
+	a, err := c.get(resourceGroup, storageAccount)
+	if err != nil {
+		return "", err
+	}
+	return a.Location, nil
+}
+
+func (c *StorageClient) GetBlobsClient(ctx context.Context, resourceGroup, storageAccount string) (azureclient.BlobsClient, error) {
+	return c.get(resourceGroup, storageAccount)
+}
+
+func (c *StorageClient) get(resourceGroup, storageAccount string) (*BlobsClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	a, found := c.Accounts[storageAccount]
+	if !found || !strings.EqualFold(a.ResourceGroup, resourceGroup) {
+		return nil, fmt.Errorf("storage account %s/%s not found", resourceGroup, storageAccount)
+	}
+	return a, nil
+}
+
+// AddAccount adds an empty storage account.
+func (c *StorageClient) AddAccount(resourceGroup, name, location string) *BlobsClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	a := &BlobsClient{storage: c, Name: name, ResourceGroup: resourceGroup, Location: location, Blobs: map[string][]byte{}}
+	if c.Accounts == nil {
+		c.Accounts = map[string]*BlobsClient{}
+	}
+	c.Accounts[name] = a
+	return a
+}
+
+// BlobsClient is an in-memory azureclient.BlobsClient for a storage account
+// added by StorageClient.AddAccount, holding the contents and metadata of
+// blobs keyed by CONTAINER/NAME.  As with the real service, listings are
+// paged, and the marker is the name of the first blob of the next page;
+// ListCalls counts them.  Blobs may only be copied from a SAS URI of a blob in
+// an account of the same StorageClient.
+type BlobsClient struct {
+	storage       *StorageClient
+	Name          string
+	ResourceGroup string
+	Location      string
+
+	mu        sync.Mutex
+	Blobs     map[string][]byte
+	Metadata  map[string]map[string]string
+	ListCalls int
+}
+
+var _ azureclient.BlobsClient = &BlobsClient{}
+
+func (c *BlobsClient) ListBlobs(ctx context.Context, container string, params azstorage.ListBlobsParameters) (azstorage.BlobListResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ListCalls++
+
+	maxResults := params.MaxResults
+	if maxResults == 0 {
+		maxResults = 5000
+	}
+
+	resp := azstorage.BlobListResponse{Marker: params.Marker, MaxResults: int64(maxResults)}
+	for _, name := range c.names(container) {
+		if name < params.Marker {
+			continue
+		}
+		if uint(len(resp.Blobs)) == maxResults {
+			resp.NextMarker = name
+			break
+		}
+		blob := azstorage.Blob{Name: name}
+		if params.Include != nil && params.Include.Metadata {
+			blob.Metadata = c.Metadata[container+"/"+name]
+		}
+		resp.Blobs = append(resp.Blobs, blob)
+	}
+
+	return resp, nil
+}
+
+func (c *BlobsClient) GetURI(container, name string) string {
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", c.Name, container, name)
+}
+
+func (c *BlobsClient) GetSASURI(container, name string, expiry time.Time) (string, error) {
+	return c.GetURI(container, name) + "?se=" + expiry.UTC().Format(time.RFC3339) + "&sig=fake", nil
+}
+
+func (c *BlobsClient) Get(ctx context.Context, container, name string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, found := c.Blobs[container+"/"+name]
+	if !found {
+		return nil, fmt.Errorf("blob %s/%s not found", container, name)
+	}
+	return b, nil
+}
+
+func (c *BlobsClient) Put(ctx context.Context, container, name string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Blobs[container+"/"+name] = b
+	return nil
+}
+
+func (c *BlobsClient) Copy(ctx context.Context, container, name, sourceURI string) error {
+	i := strings.Index(sourceURI, "?")
+	if i == -1 || !strings.Contains(sourceURI[i:], "sig=") {
+		return fmt.Errorf("source %s is not readable", sourceURI)
+	}
+	account, srcContainer, srcName, err := azureutil.ParseBlobURI(sourceURI[:i])
+	if err != nil {
+		return err
+	}
+
+	c.storage.mu.Lock()
+	src := c.storage.Accounts[account]
+	c.storage.mu.Unlock()
+	if src == nil {
+		return fmt.Errorf("storage account %s not found", account)
+	}
+	src.mu.Lock()
+	contents, found := src.Blobs[srcContainer+"/"+srcName]
+	src.mu.Unlock()
+	if !found {
+		return fmt.Errorf("blob %s not found", sourceURI[:i])
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Blobs[container+"/"+name] = contents
+	return nil
+}
+
+func (c *BlobsClient) MoveBlob(ctx context.Context, srcContainer, srcName, dstContainer, dstName string, metadata map[string]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	contents, found := c.Blobs[srcContainer+"/"+srcName]
+	if !found {
+		return fmt.Errorf("blob %s/%s not found", srcContainer, srcName)
+	}
+	delete(c.Blobs, srcContainer+"/"+srcName)
+	delete(c.Metadata, srcContainer+"/"+srcName)
+
+	c.Blobs[dstContainer+"/"+dstName] = contents
+	if c.Metadata == nil {
+		c.Metadata = map[string]map[string]string{}
+	}
+	c.Metadata[dstContainer+"/"+dstName] = metadata
+
+	return nil
+}
+
+func (c *BlobsClient) DeleteBlob(ctx context.Context, container, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, found := c.Blobs[container+"/"+name]; !found {
+		return fmt.Errorf("blob %s/%s not found", container, name)
+	}
+	delete(c.Blobs, container+"/"+name)
+	delete(c.Metadata, container+"/"+name)
+
+	return nil
+}
+
+// AddBlobs adds empty blobs with the given names to container.
+func (c *BlobsClient) AddBlobs(container string, names ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, name := range names {
+		c.Blobs[container+"/"+name] = nil
+	}
+}
+
+// Names returns the sorted names of the blobs in container.
+func (c *BlobsClient) Names(container string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.names(container)
+}
+
+func (c *BlobsClient) names(container string) []string {
+	names := []string{}
+	for key := range c.Blobs {
+		if strings.HasPrefix(key, container+"/") {
+			names = append(names, strings.TrimPrefix(key, container+"/"))
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,231 @@
+package azureclient
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2017-10-01/storage"
+	azstorage "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/openshift/azure-misc/src/go/pkg/azureutil"
+)
+
+// copyPollInterval is the wait between checks on the progress of a blob copy.
+var copyPollInterval = 10 * time.Second
+
+// blockSize is the size of the blocks in which blobs are uploaded.
+const blockSize = 4 << 20
+
+// StorageClient returns the location of a storage account, and a BlobsClient
+// for it.
+type StorageClient interface {
+	GetLocation(ctx context.Context, resourceGroup, storageAccount string) (string, error)
+	GetBlobsClient(ctx context.Context, resourceGroup, storageAccount string) (BlobsClient, error)
+}
+
+// BlobsClient lists, reads, writes, copies, moves and deletes blobs in a
+// storage account.  GetSASURI returns a URI granting read access to a blob
+// until expiry.  Put uploads the blob in blocks, so that it may be larger than
+// a single request allows.  Copy returns once the blob at sourceURI has been
+// copied.  MoveBlob copies a blob to dstContainer/dstName, which is given the
+// metadata metadata, and then deletes the original.  Put, Copy and MoveBlob
+// create the destination container if it does not exist.
+type BlobsClient interface {
+	ListBlobs(ctx context.Context, container string, params azstorage.ListBlobsParameters) (azstorage.BlobListResponse, error)
+	GetURI(container, name string) string
+	GetSASURI(container, name string, expiry time.Time) (string, error)
+	Get(ctx context.Context, container, name string) ([]byte, error)
+	Put(ctx context.Context, container, name string, r io.Reader) error
+	Copy(ctx context.Context, container, name, sourceURI string) error
+	MoveBlob(ctx context.Context, srcContainer, srcName, dstContainer, dstName string, metadata map[string]string) error
+	DeleteBlob(ctx context.Context, container, name string) error
+}
+
+type storageClient struct {
+	accounts storage.AccountsClient
+	env      azure.Environment
+}
+
+var _ StorageClient = &storageClient{}
+
+// NewStorageClient returns a StorageClient for a subscription.
+func NewStorageClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) StorageClient {
+	return &storageClient{accounts: newAccountsClient(env, subscriptionID, authorizer), env: env}
+}
+
+func (c *storageClient) GetLocation(ctx context.Context, resourceGroup, storageAccount string) (string, error) {
+	account, err := c.accounts.GetProperties(ctx, resourceGroup, storageAccount)
+	if err != nil {
+		return "", err
+	}
+
+	return to.String(account.Location), nil
+}
+
+func (c *storageClient) GetBlobsClient(ctx context.Context, resourceGroup, storageAccount string) (BlobsClient, error) {
+	client, err := accountClient(ctx, c.accounts, c.env, resourceGroup, storageAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blobsClient{bs: client.GetBlobService()}, nil
+}
+
+// NewAccountClient returns a client for the blob and table services of a
+// storage account, authorized by the account's first key.
+func NewAccountClient(ctx context.Context, env azure.Environment, subscriptionID string, authorizer autorest.Authorizer, resourceGroup, storageAccount string) (azstorage.Client, error) {
+	return accountClient(ctx, newAccountsClient(env, subscriptionID, authorizer), env, resourceGroup, storageAccount)
+}
+
+func newAccountsClient(env azure.Environment, subscriptionID string, authorizer autorest.Authorizer) storage.AccountsClient {
+	accounts := storage.NewAccountsClientWithBaseURI(azureutil.BaseURI(env), subscriptionID)
+	accounts.Authorizer = authorizer
+	accounts.Sender = HTTPClient
+	return accounts
+}
+
+func accountClient(ctx context.Context, accounts storage.AccountsClient, env azure.Environment, resourceGroup, storageAccount string) (azstorage.Client, error) {
+	keys, err := accounts.ListKeys(ctx, resourceGroup, storageAccount)
+	if err != nil {
+		return azstorage.Client{}, err
+	}
+
+	client, err := azstorage.NewClient(storageAccount, *(*keys.Keys)[0].Value, env.StorageEndpointSuffix, azstorage.DefaultAPIVersion, true)
+	if err != nil {
+		return azstorage.Client{}, err
+	}
+	client.HTTPClient = HTTPClient
+
+	return client, nil
+}
+
+type blobsClient struct {
+	bs azstorage.BlobStorageClient
+}
+
+var _ BlobsClient = &blobsClient{}
+
+func (c *blobsClient) ListBlobs(ctx context.Context, container string, params azstorage.ListBlobsParameters) (azstorage.BlobListResponse, error) {
+	return c.bs.GetContainerReference(container).ListBlobs(params)
+}
+
+func (c *blobsClient) GetURI(container, name string) string {
+	return c.bs.GetContainerReference(container).GetBlobReference(name).GetURL()
+}
+
+func (c *blobsClient) GetSASURI(container, name string, expiry time.Time) (string, error) {
+	return c.bs.GetContainerReference(container).GetBlobReference(name).GetSASURI(azstorage.BlobSASOptions{
+		BlobServiceSASPermissions: azstorage.BlobServiceSASPermissions{Read: true},
+		SASOptions:                azstorage.SASOptions{Expiry: expiry, UseHTTPS: true},
+	})
+}
+
+func (c *blobsClient) Get(ctx context.Context, container, name string) ([]byte, error) {
+	rc, err := c.bs.GetContainerReference(container).GetBlobReference(name).Get(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+func (c *blobsClient) Put(ctx context.Context, container, name string, r io.Reader) error {
+	cr := c.bs.GetContainerReference(container)
+	if _, err := cr.CreateIfNotExists(nil); err != nil {
+		return err
+	}
+
+	b := cr.GetBlobReference(name)
+	buf := make([]byte, blockSize)
+	var blocks []azstorage.Block
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// block IDs must all be of the same length.
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(blocks))))
+			if err := b.PutBlock(id, buf[:n], nil); err != nil {
+				return err
+			}
+			blocks = append(blocks, azstorage.Block{ID: id, Status: azstorage.BlockStatusUncommitted})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.PutBlockList(blocks, nil)
+}
+
+// Copy starts a server-side copy and polls it until it completes.  The SDK's
+// own Blob.Copy polls without pausing, and cannot be cancelled; a copy which is
+// cancelled here is aborted.
+func (c *blobsClient) Copy(ctx context.Context, container, name, sourceURI string) error {
+	cr := c.bs.GetContainerReference(container)
+	if _, err := cr.CreateIfNotExists(nil); err != nil {
+		return err
+	}
+
+	b := cr.GetBlobReference(name)
+	id, err := b.StartCopy(sourceURI, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err = b.GetProperties(nil); err != nil {
+			return err
+		}
+		if b.Properties.CopyID != id {
+			return fmt.Errorf("copy to %s/%s was superseded by another copy", container, name)
+		}
+
+		switch strings.ToLower(b.Properties.CopyStatus) {
+		case "success":
+			return nil
+		case "pending":
+		default:
+			return fmt.Errorf("copy to %s/%s %s: %s", container, name, b.Properties.CopyStatus, b.Properties.CopyStatusDescription)
+		}
+
+		select {
+		case <-time.After(copyPollInterval):
+		case <-ctx.Done():
+			b.AbortCopy(id, nil)
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *blobsClient) MoveBlob(ctx context.Context, srcContainer, srcName, dstContainer, dstName string, metadata map[string]string) error {
+	dst := c.bs.GetContainerReference(dstContainer)
+	if _, err := dst.CreateIfNotExists(nil); err != nil {
+		return err
+	}
+
+	src := c.bs.GetContainerReference(srcContainer).GetBlobReference(srcName)
+	b := dst.GetBlobReference(dstName)
+	b.Metadata = metadata
+	if err := b.Copy(src.GetURL(), nil); err != nil {
+		return err
+	}
+
+	return src.Delete(nil)
+}
+
+func (c *blobsClient) DeleteBlob(ctx context.Context, container, name string) error {
+	return c.bs.GetContainerReference(container).GetBlobReference(name).Delete(nil)
+}
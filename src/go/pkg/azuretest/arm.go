@@ -0,0 +1,628 @@
+package azuretest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-04-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2015-01-01/locks"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-02-01/resources"
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2017-10-01/storage"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+type group struct {
+	resources.Group
+	images map[string]*compute.Image
+	locks  map[string]*locks.ManagementLockObject
+
+	// resources holds the other resources of the group, keyed by lower-case
+	// resource type (e.g. "microsoft.compute/disks") and then by lower-case
+	// name.
+	resources map[string]map[string]interface{}
+}
+
+// AddGroup adds a resource group to the given subscription.
+func (s *Server) AddGroup(subscriptionID string, g resources.Group) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := s.getSubscription(subscriptionID)
+	g.ID = to.StringPtr(fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", sub.id, *g.Name))
+	if g.Location == nil {
+		g.Location = to.StringPtr("eastus")
+	}
+	if g.Properties == nil {
+		g.Properties = &resources.GroupProperties{ProvisioningState: to.StringPtr("Succeeded")}
+	}
+
+	sub.groups[strings.ToLower(*g.Name)] = &group{
+		Group:     g,
+		images:    map[string]*compute.Image{},
+		locks:     map[string]*locks.ManagementLockObject{},
+		resources: map[string]map[string]interface{}{},
+	}
+}
+
+// Groups returns the sorted names of the resource groups in the given
+// subscription.
+func (s *Server) Groups(subscriptionID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := []string{}
+	for _, g := range s.getSubscription(subscriptionID).groups {
+		names = append(names, *g.Name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// AddImage adds an image to the given resource group, which must already
+// exist.
+func (s *Server) AddImage(subscriptionID, resourceGroup string, image compute.Image) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.getGroup(subscriptionID, resourceGroup)
+	image.ID = to.StringPtr(fmt.Sprintf("%s/providers/Microsoft.Compute/images/%s", *g.ID, *image.Name))
+	image.Type = to.StringPtr("Microsoft.Compute/images")
+	if image.Location == nil {
+		image.Location = g.Location
+	}
+
+	g.images[strings.ToLower(*image.Name)] = &image
+}
+
+// resourceTypes are the types of the resources, other than images, which can
+// be added to a resource group and listed across a subscription.
+var resourceTypes = map[string]bool{
+	"microsoft.compute/virtualmachines":         true,
+	"microsoft.compute/virtualmachinescalesets": true,
+	"microsoft.compute/disks":                   true,
+	"microsoft.compute/snapshots":               true,
+	"microsoft.network/networkinterfaces":       true,
+	"microsoft.network/publicipaddresses":       true,
+}
+
+// AddVirtualMachine adds a virtual machine to the given resource group, which
+// must already exist.
+func (s *Server) AddVirtualMachine(subscriptionID, resourceGroup string, vm compute.VirtualMachine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.getGroup(subscriptionID, resourceGroup)
+	vm.ID, vm.Type = g.resourceID("Microsoft.Compute/virtualMachines", *vm.Name)
+	if vm.Location == nil {
+		vm.Location = g.Location
+	}
+
+	g.addResource(*vm.Type, *vm.Name, &vm)
+}
+
+// AddScaleSet adds a virtual machine scale set to the given resource group,
+// which must already exist.
+func (s *Server) AddScaleSet(subscriptionID, resourceGroup string, ss compute.VirtualMachineScaleSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.getGroup(subscriptionID, resourceGroup)
+	ss.ID, ss.Type = g.resourceID("Microsoft.Compute/virtualMachineScaleSets", *ss.Name)
+	if ss.Location == nil {
+		ss.Location = g.Location
+	}
+
+	g.addResource(*ss.Type, *ss.Name, &ss)
+}
+
+// AddDisk adds a managed disk to the given resource group, which must already
+// exist.
+func (s *Server) AddDisk(subscriptionID, resourceGroup string, disk compute.Disk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.getGroup(subscriptionID, resourceGroup)
+	disk.ID, disk.Type = g.resourceID("Microsoft.Compute/disks", *disk.Name)
+	if disk.Location == nil {
+		disk.Location = g.Location
+	}
+
+	g.addResource(*disk.Type, *disk.Name, &disk)
+}
+
+// AddSnapshot adds a snapshot to the given resource group, which must already
+// exist.
+func (s *Server) AddSnapshot(subscriptionID, resourceGroup string, snapshot compute.Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.getGroup(subscriptionID, resourceGroup)
+	snapshot.ID, snapshot.Type = g.resourceID("Microsoft.Compute/snapshots", *snapshot.Name)
+	if snapshot.Location == nil {
+		snapshot.Location = g.Location
+	}
+
+	g.addResource(*snapshot.Type, *snapshot.Name, &snapshot)
+}
+
+// AddNetworkInterface adds a network interface to the given resource group,
+// which must already exist.
+func (s *Server) AddNetworkInterface(subscriptionID, resourceGroup string, nic network.Interface) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.getGroup(subscriptionID, resourceGroup)
+	nic.ID, nic.Type = g.resourceID("Microsoft.Network/networkInterfaces", *nic.Name)
+	if nic.Location == nil {
+		nic.Location = g.Location
+	}
+
+	g.addResource(*nic.Type, *nic.Name, &nic)
+}
+
+// AddPublicIPAddress adds a public IP address to the given resource group,
+// which must already exist.
+func (s *Server) AddPublicIPAddress(subscriptionID, resourceGroup string, ip network.PublicIPAddress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.getGroup(subscriptionID, resourceGroup)
+	ip.ID, ip.Type = g.resourceID("Microsoft.Network/publicIPAddresses", *ip.Name)
+	if ip.Location == nil {
+		ip.Location = g.Location
+	}
+
+	g.addResource(*ip.Type, *ip.Name, &ip)
+}
+
+// AddResource adds a resource of any type to the given resource group, which
+// must already exist.  Its type is taken from r.Type.
+func (s *Server) AddResource(subscriptionID, resourceGroup string, r resources.GenericResource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.getGroup(subscriptionID, resourceGroup)
+	r.ID, r.Type = g.resourceID(*r.Type, *r.Name)
+	if r.Location == nil {
+		r.Location = g.Location
+	}
+
+	g.addResource(*r.Type, *r.Name, &r)
+}
+
+// ResourceTags returns the tags of the named resource of the given type (e.g.
+// "Microsoft.Compute/disks") in the given resource group, which must exist.
+func (s *Server) ResourceTags(subscriptionID, resourceGroup, resourceType, name string) map[string]*string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := s.getGroup(subscriptionID, resourceGroup).resources[strings.ToLower(resourceType)][strings.ToLower(name)]
+	return reflect.ValueOf(v).Elem().FieldByName("Tags").Interface().(map[string]*string)
+}
+
+// apiVersions are the API versions advertised for every resource type, newest
+// first as Resource Manager returns them.  Resources may only be deleted using
+// one of them.
+var apiVersions = []string{"2018-10-01-preview", "2018-08-01", "2018-04-01", "2017-12-01"}
+
+// Resources returns the sorted names of the resources of the given type (e.g.
+// "Microsoft.Compute/disks") in every resource group of the given
+// subscription.
+func (s *Server) Resources(subscriptionID, resourceType string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := []string{}
+	for _, g := range s.getSubscription(subscriptionID).groups {
+		for name := range g.resources[strings.ToLower(resourceType)] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (s *Server) getGroup(subscriptionID, resourceGroup string) *group {
+	g := s.getSubscription(subscriptionID).groups[strings.ToLower(resourceGroup)]
+	if g == nil {
+		panic(fmt.Sprintf("resource group %s not found", resourceGroup))
+	}
+	return g
+}
+
+// resourceID returns the ID of the named resource of the given type in g, and
+// the type.
+func (g *group) resourceID(resourceType, name string) (*string, *string) {
+	return to.StringPtr(fmt.Sprintf("%s/providers/%s/%s", *g.ID, resourceType, name)), to.StringPtr(resourceType)
+}
+
+func (g *group) addResource(resourceType, name string, v interface{}) {
+	resourceType = strings.ToLower(resourceType)
+	if g.resources[resourceType] == nil {
+		g.resources[resourceType] = map[string]interface{}{}
+	}
+	g.resources[resourceType][strings.ToLower(name)] = v
+}
+
+// AddLock adds a management lock to the given resource group, which must
+// already exist.  Groups with a CanNotDelete or ReadOnly lock cannot be
+// deleted.
+func (s *Server) AddLock(subscriptionID, resourceGroup, name string, level locks.LockLevel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.getGroup(subscriptionID, resourceGroup)
+	g.locks[strings.ToLower(name)] = &locks.ManagementLockObject{
+		ID:                       to.StringPtr(fmt.Sprintf("%s/providers/Microsoft.Authorization/locks/%s", *g.ID, name)),
+		Type:                     to.StringPtr("Microsoft.Authorization/locks"),
+		Name:                     to.StringPtr(name),
+		ManagementLockProperties: &locks.ManagementLockProperties{Level: level},
+	}
+}
+
+// Images returns the sorted names of the images in the given resource group.
+func (s *Server) Images(subscriptionID, resourceGroup string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := []string{}
+	if g := s.getSubscription(subscriptionID).groups[strings.ToLower(resourceGroup)]; g != nil {
+		for _, image := range g.images {
+			names = append(names, *image.Name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// serveARM serves requests under /subscriptions/<subscriptionID>/.
+func (s *Server) serveARM(w http.ResponseWriter, r *http.Request, subscriptionID string, path []string) {
+	sub := s.getSubscription(subscriptionID)
+	if sub.tenantID != "" && sub.tenantID != tenantID(r) {
+		writeError(w, http.StatusUnauthorized, "InvalidAuthenticationTokenTenant", "The access token is from the wrong issuer. It must match the tenant associated with subscription '%s'.", sub.id)
+		return
+	}
+
+	lower := make([]string, len(path))
+	for i := range path {
+		lower[i] = strings.ToLower(path[i])
+	}
+
+	if len(lower) == 1 && lower[0] == "resources" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "%s not allowed", r.Method)
+			return
+		}
+		s.listResources(w, r, sub, "")
+		return
+	}
+
+	if len(lower) == 2 && lower[0] == "providers" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "%s not allowed", r.Method)
+			return
+		}
+		s.getProvider(w, r, sub, path[1])
+		return
+	}
+
+	if len(lower) == 3 && lower[0] == "providers" {
+		resourceType := lower[1] + "/" + lower[2]
+		if resourceType == "microsoft.compute/images" || resourceTypes[resourceType] {
+			if r.Method != http.MethodGet {
+				writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "%s not allowed", r.Method)
+				return
+			}
+			s.listResources(w, r, sub, resourceType)
+			return
+		}
+	}
+
+	if len(lower) == 0 || lower[0] != "resourcegroups" {
+		writeError(w, http.StatusNotFound, "NotFound", "%s %s not found", r.Method, r.URL.Path)
+		return
+	}
+
+	if len(lower) == 1 {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "%s not allowed", r.Method)
+			return
+		}
+		s.listGroups(w, r, sub)
+		return
+	}
+
+	g := sub.groups[lower[1]]
+	if g == nil {
+		writeError(w, http.StatusNotFound, "ResourceGroupNotFound", "Resource group '%s' could not be found.", path[1])
+		return
+	}
+
+	switch {
+	case len(lower) == 2:
+		s.serveGroup(w, r, sub, g)
+	case len(lower) == 5 && lower[2] == "providers" && lower[3] == "microsoft.compute" && lower[4] == "images":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "%s not allowed", r.Method)
+			return
+		}
+		s.listImages(w, r, g)
+	case len(lower) == 6 && lower[2] == "providers" && lower[3] == "microsoft.compute" && lower[4] == "images":
+		s.serveImage(w, r, g, path[5])
+	case len(lower) == 6 && lower[2] == "providers" && (resourceTypes[lower[3]+"/"+lower[4]] || g.resources[lower[3]+"/"+lower[4]] != nil):
+		s.serveResource(w, r, g, path[3]+"/"+path[4], path[5])
+	case len(lower) == 5 && lower[2] == "providers" && lower[3] == "microsoft.authorization" && lower[4] == "locks":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "%s not allowed", r.Method)
+			return
+		}
+		s.listLocks(w, r, g)
+	case len(lower) == 7 && lower[2] == "providers" && lower[3] == "microsoft.storage" && lower[4] == "storageaccounts" && lower[6] == "listkeys":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "%s not allowed", r.Method)
+			return
+		}
+		s.listKeys(w, r, sub, g, path[5])
+	default:
+		writeError(w, http.StatusNotFound, "NotFound", "%s %s not found", r.Method, r.URL.Path)
+	}
+}
+
+func (s *Server) listGroups(w http.ResponseWriter, r *http.Request, sub *subscription) {
+	var keys []string
+	for k := range sub.groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, sub.groups[k].Group)
+	}
+
+	s.writeList(w, r, values)
+}
+
+// listResources lists the resources of the given lower-case type in every
+// resource group of sub, or the resources of every type if resourceType is
+// empty.
+func (s *Server) listResources(w http.ResponseWriter, r *http.Request, sub *subscription, resourceType string) {
+	var groups []string
+	for k := range sub.groups {
+		groups = append(groups, k)
+	}
+	sort.Strings(groups)
+
+	values := []interface{}{}
+	for _, k := range groups {
+		items := sub.groups[k].resources[resourceType]
+		switch resourceType {
+		case "microsoft.compute/images":
+			items = map[string]interface{}{}
+			for name, image := range sub.groups[k].images {
+				items[name] = image
+			}
+		case "":
+			items = map[string]interface{}{}
+			for name, image := range sub.groups[k].images {
+				items["microsoft.compute/images/"+name] = image
+			}
+			for t, l := range sub.groups[k].resources {
+				for name, v := range l {
+					items[t+"/"+name] = v
+				}
+			}
+		}
+
+		var names []string
+		for name := range items {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			values = append(values, items[name])
+		}
+	}
+
+	s.writeList(w, r, values)
+}
+
+// serveResource serves a resource of a type in resourceTypes.  PATCH replaces
+// its tags.
+func (s *Server) serveResource(w http.ResponseWriter, r *http.Request, g *group, resourceType, name string) {
+	items := g.resources[strings.ToLower(resourceType)]
+	v := items[strings.ToLower(name)]
+	if v == nil {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", "The Resource '%s/%s' under resource group '%s' was not found.", resourceType, name, *g.Name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, v)
+
+	case http.MethodDelete:
+		if !checkAPIVersion(w, r, resourceType) {
+			return
+		}
+		s.startOperation(w, func() {
+			delete(items, strings.ToLower(name))
+		})
+
+	case http.MethodPatch:
+		if !checkAPIVersion(w, r, resourceType) {
+			return
+		}
+		var patch struct {
+			Tags map[string]*string `json:"tags"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequestContent", "%v", err)
+			return
+		}
+		reflect.ValueOf(v).Elem().FieldByName("Tags").Set(reflect.ValueOf(patch.Tags))
+		writeJSON(w, http.StatusOK, v)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "%s not allowed", r.Method)
+	}
+}
+
+// checkAPIVersion fails the request unless it uses one of apiVersions.
+func checkAPIVersion(w http.ResponseWriter, r *http.Request, resourceType string) bool {
+	v := r.URL.Query().Get("api-version")
+	for _, apiVersion := range apiVersions {
+		if v == apiVersion {
+			return true
+		}
+	}
+
+	writeError(w, http.StatusBadRequest, "NoRegisteredProviderFound", "No registered resource provider found for API version '%s' and resource type '%s'. The supported api-versions are '%s'.", v, resourceType, strings.Join(apiVersions, ", "))
+	return false
+}
+
+// getProvider returns the resource provider with the given namespace, whose
+// resource types are those served in its namespace and those of the
+// resources of sub.
+func (s *Server) getProvider(w http.ResponseWriter, r *http.Request, sub *subscription, namespace string) {
+	prefix := strings.ToLower(namespace) + "/"
+
+	types := map[string]bool{}
+	for t := range resourceTypes {
+		types[t] = true
+	}
+	types["microsoft.compute/images"] = true
+	for _, g := range sub.groups {
+		for t := range g.resources {
+			types[t] = true
+		}
+	}
+
+	var rts []resources.ProviderResourceType
+	for t := range types {
+		if strings.HasPrefix(t, prefix) {
+			rts = append(rts, resources.ProviderResourceType{ResourceType: to.StringPtr(t[len(prefix):]), APIVersions: &apiVersions})
+		}
+	}
+	if len(rts) == 0 {
+		writeError(w, http.StatusNotFound, "InvalidResourceNamespace", "The resource namespace '%s' is invalid.", namespace)
+		return
+	}
+	sort.Slice(rts, func(i, j int) bool { return *rts[i].ResourceType < *rts[j].ResourceType })
+
+	writeJSON(w, http.StatusOK, resources.Provider{
+		ID:                to.StringPtr(fmt.Sprintf("/subscriptions/%s/providers/%s", sub.id, namespace)),
+		Namespace:         to.StringPtr(namespace),
+		RegistrationState: to.StringPtr("Registered"),
+		ResourceTypes:     &rts,
+	})
+}
+
+func (s *Server) serveGroup(w http.ResponseWriter, r *http.Request, sub *subscription, g *group) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, g.Group)
+
+	case http.MethodDelete:
+		for _, lock := range g.locks {
+			if lock.Level == locks.CanNotDelete || lock.Level == locks.ReadOnly {
+				writeError(w, http.StatusConflict, "ScopeLocked", "The scope '%s' cannot perform delete operation because following scope(s) are locked: '%s'.", *g.ID, *lock.ID)
+				return
+			}
+		}
+
+		s.startOperation(w, func() {
+			delete(sub.groups, strings.ToLower(*g.Name))
+			for name, a := range s.accounts {
+				if strings.EqualFold(a.subscriptionID, sub.id) && strings.EqualFold(a.resourceGroup, *g.Name) {
+					delete(s.accounts, name)
+				}
+			}
+		})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "%s not allowed", r.Method)
+	}
+}
+
+func (s *Server) listLocks(w http.ResponseWriter, r *http.Request, g *group) {
+	var keys []string
+	for k := range g.locks {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, g.locks[k])
+	}
+
+	s.writeList(w, r, values)
+}
+
+func (s *Server) listImages(w http.ResponseWriter, r *http.Request, g *group) {
+	var keys []string
+	for k := range g.images {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, g.images[k])
+	}
+
+	s.writeList(w, r, values)
+}
+
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request, g *group, name string) {
+	image := g.images[strings.ToLower(name)]
+	if image == nil {
+		writeError(w, http.StatusNotFound, "NotFound", "The Resource 'Microsoft.Compute/images/%s' under resource group '%s' was not found.", name, *g.Name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, image)
+
+	case http.MethodDelete:
+		if !checkAPIVersion(w, r, "Microsoft.Compute/images") {
+			return
+		}
+		s.startOperation(w, func() {
+			delete(g.images, strings.ToLower(name))
+		})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "%s not allowed", r.Method)
+	}
+}
+
+func (s *Server) listKeys(w http.ResponseWriter, r *http.Request, sub *subscription, g *group, name string) {
+	a := s.accounts[strings.ToLower(name)]
+	if a == nil || !strings.EqualFold(a.subscriptionID, sub.id) || !strings.EqualFold(a.resourceGroup, *g.Name) {
+		writeError(w, http.StatusNotFound, "ResourceNotFound", "The Resource 'Microsoft.Storage/storageAccounts/%s' under resource group '%s' was not found.", name, *g.Name)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, storage.AccountListKeysResult{
+		Keys: &[]storage.AccountKey{
+			{
+				KeyName:     to.StringPtr("key1"),
+				Value:       to.StringPtr(base64.StdEncoding.EncodeToString([]byte(a.name))),
+				Permissions: storage.Full,
+			},
+		},
+	})
+}
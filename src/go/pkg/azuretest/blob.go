@@ -0,0 +1,290 @@
+package azuretest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultMaxResults = 5000
+
+type account struct {
+	subscriptionID string
+	resourceGroup  string
+	name           string
+	containers     map[string]map[string]*blob
+}
+
+type blob struct {
+	name         string
+	lastModified time.Time
+
+	leaseID       string
+	leaseDuration time.Duration
+	leaseExpires  time.Time
+}
+
+// leased returns true if the blob has an unexpired lease.
+func (b *blob) leased() bool {
+	return b.leaseID != "" && time.Now().Before(b.leaseExpires)
+}
+
+// AddStorageAccount adds a storage account to the given resource group.
+func (s *Server) AddStorageAccount(subscriptionID, resourceGroup, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accounts[strings.ToLower(name)] = &account{
+		subscriptionID: subscriptionID,
+		resourceGroup:  resourceGroup,
+		name:           name,
+		containers:     map[string]map[string]*blob{},
+	}
+}
+
+// AddBlob adds a blob to the given container, creating the container if
+// necessary.  The storage account must already exist.
+func (s *Server) AddBlob(storageAccount, container, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.accounts[strings.ToLower(storageAccount)]
+	if a == nil {
+		panic(fmt.Sprintf("storage account %s not found", storageAccount))
+	}
+
+	if a.containers[container] == nil {
+		a.containers[container] = map[string]*blob{}
+	}
+	a.containers[container][name] = &blob{name: name, lastModified: time.Now().UTC()}
+}
+
+// Blobs returns the sorted names of the blobs in the given container.
+func (s *Server) Blobs(storageAccount, container string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := []string{}
+	if a := s.accounts[strings.ToLower(storageAccount)]; a != nil {
+		names = sortedBlobNames(a.containers[container])
+	}
+
+	return names
+}
+
+// BreakLease ends any lease on the given blob immediately, as though it had
+// expired.
+func (s *Server) BreakLease(storageAccount, container, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a := s.accounts[strings.ToLower(storageAccount)]; a != nil {
+		if b := a.containers[container][name]; b != nil {
+			b.leaseID = ""
+		}
+	}
+}
+
+func sortedBlobNames(blobs map[string]*blob) []string {
+	names := []string{}
+	for name := range blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serveBlob serves Blob service requests for the given storage account.
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, storageAccount string) {
+	a := s.accounts[strings.ToLower(storageAccount)]
+	if a == nil {
+		writeXMLError(w, http.StatusNotFound, "ResourceNotFound", "The specified resource does not exist.")
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey "+a.name+":") {
+		writeXMLError(w, http.StatusForbidden, "AuthenticationFailed", "Server failed to authenticate the request.")
+		return
+	}
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	q := r.URL.Query()
+
+	if len(path) == 1 && r.Method == http.MethodPut && q.Get("restype") == "container" {
+		if a.containers[path[0]] != nil {
+			writeXMLError(w, http.StatusConflict, "ContainerAlreadyExists", "The specified container already exists.")
+			return
+		}
+		a.containers[path[0]] = map[string]*blob{}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	blobs := a.containers[path[0]]
+	if blobs == nil {
+		writeXMLError(w, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet && q.Get("restype") == "container" && q.Get("comp") == "list":
+		s.listBlobs(w, r, path[0], blobs)
+
+	case len(path) == 2 && r.Method == http.MethodPut && q.Get("comp") == "lease":
+		s.leaseBlob(w, r, blobs[path[1]])
+
+	case len(path) == 2 && r.Method == http.MethodPut && q.Get("comp") == "":
+		if b := blobs[path[1]]; b != nil && b.leased() && r.Header.Get("x-ms-lease-id") != b.leaseID {
+			writeXMLError(w, http.StatusPreconditionFailed, "LeaseIdMissing", "There is currently a lease on the blob and no lease ID was specified in the request.")
+			return
+		}
+		blobs[path[1]] = &blob{name: path[1], lastModified: time.Now().UTC()}
+		w.WriteHeader(http.StatusCreated)
+
+	case len(path) == 2 && r.Method == http.MethodDelete:
+		b := blobs[path[1]]
+		if b == nil {
+			writeXMLError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+			return
+		}
+		if b.leased() && r.Header.Get("x-ms-lease-id") != b.leaseID {
+			writeXMLError(w, http.StatusPreconditionFailed, "LeaseIdMissing", "There is currently a lease on the blob and no lease ID was specified in the request.")
+			return
+		}
+		delete(blobs, path[1])
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		writeXMLError(w, http.StatusBadRequest, "UnsupportedHttpVerb", "The resource doesn't support the specified HTTP verb.")
+	}
+}
+
+// leaseBlob serves the acquire, renew and release lease actions.
+func (s *Server) leaseBlob(w http.ResponseWriter, r *http.Request, b *blob) {
+	if b == nil {
+		writeXMLError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		return
+	}
+
+	switch r.Header.Get("x-ms-lease-action") {
+	case "acquire":
+		id := r.Header.Get("x-ms-proposed-lease-id")
+		if b.leased() && b.leaseID != id {
+			writeXMLError(w, http.StatusConflict, "LeaseAlreadyPresent", "There is already a lease present.")
+			return
+		}
+
+		d, err := strconv.Atoi(r.Header.Get("x-ms-lease-duration"))
+		if err != nil || (d != -1 && (d < 15 || d > 60)) {
+			writeXMLError(w, http.StatusBadRequest, "InvalidHeaderValue", "The value for one of the HTTP headers is not in the correct format.")
+			return
+		}
+		b.leaseID = id
+		b.leaseDuration = time.Duration(d) * time.Second
+		if d == -1 {
+			b.leaseDuration = 100 * 365 * 24 * time.Hour
+		}
+		b.leaseExpires = time.Now().Add(b.leaseDuration)
+		w.Header().Set("x-ms-lease-id", id)
+		w.WriteHeader(http.StatusCreated)
+
+	case "renew":
+		// an expired lease may be renewed if no other lease has been
+		// acquired since.
+		if b.leaseID == "" || b.leaseID != r.Header.Get("x-ms-lease-id") {
+			writeXMLError(w, http.StatusConflict, "LeaseIdMismatchWithLeaseOperation", "The lease ID specified did not match the lease ID for the blob.")
+			return
+		}
+		b.leaseExpires = time.Now().Add(b.leaseDuration)
+		w.Header().Set("x-ms-lease-id", b.leaseID)
+		w.WriteHeader(http.StatusOK)
+
+	case "release":
+		if b.leaseID == "" || b.leaseID != r.Header.Get("x-ms-lease-id") {
+			writeXMLError(w, http.StatusConflict, "LeaseIdMismatchWithLeaseOperation", "The lease ID specified did not match the lease ID for the blob.")
+			return
+		}
+		b.leaseID = ""
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		writeXMLError(w, http.StatusBadRequest, "InvalidHeaderValue", "The value for one of the HTTP headers is not in the correct format.")
+	}
+}
+
+type blobListResponse struct {
+	XMLName       xml.Name       `xml:"EnumerationResults"`
+	ContainerName string         `xml:"ContainerName,attr"`
+	Prefix        string         `xml:"Prefix"`
+	Marker        string         `xml:"Marker"`
+	MaxResults    int            `xml:"MaxResults"`
+	Blobs         []blobResponse `xml:"Blobs>Blob"`
+	NextMarker    string         `xml:"NextMarker"`
+}
+
+type blobResponse struct {
+	Name         string `xml:"Name"`
+	LastModified string `xml:"Properties>Last-Modified"`
+	BlobType     string `xml:"Properties>BlobType"`
+}
+
+// listBlobs writes a page of the container listing.  The marker is the name
+// of the first blob to return.
+func (s *Server) listBlobs(w http.ResponseWriter, r *http.Request, container string, blobs map[string]*blob) {
+	q := r.URL.Query()
+
+	maxResults := defaultMaxResults
+	if v := q.Get("maxresults"); v != "" {
+		var err error
+		if maxResults, err = strconv.Atoi(v); err != nil || maxResults < 1 || maxResults > defaultMaxResults {
+			writeXMLError(w, http.StatusBadRequest, "OutOfRangeQueryParameterValue", "One of the query parameters specified in the request URI is outside the permissible range.")
+			return
+		}
+	}
+
+	resp := blobListResponse{
+		ContainerName: container,
+		Prefix:        q.Get("prefix"),
+		Marker:        q.Get("marker"),
+		MaxResults:    maxResults,
+	}
+
+	for _, name := range sortedBlobNames(blobs) {
+		if !strings.HasPrefix(name, resp.Prefix) || name < resp.Marker {
+			continue
+		}
+		if len(resp.Blobs) == maxResults {
+			resp.NextMarker = name
+			break
+		}
+		resp.Blobs = append(resp.Blobs, blobResponse{
+			Name:         name,
+			LastModified: blobs[name].lastModified.Format(http.TimeFormat),
+			BlobType:     "PageBlob",
+		})
+	}
+
+	writeXML(w, http.StatusOK, resp)
+}
+
+func writeXML(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeXMLError(w http.ResponseWriter, statusCode int, code, message string) {
+	writeXML(w, statusCode, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{
+		Code:    code,
+		Message: message,
+	})
+}
@@ -0,0 +1,317 @@
+// Package azuretest provides an in-process fake of the subset of the Azure
+// Resource Manager, Active Directory and Blob service APIs used by the tools in
+// this repository, so that they can be exercised end-to-end without a real
+// subscription.
+package azuretest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2016-06-01/subscriptions"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// Server is a fake Azure endpoint.  ARM and AAD requests are served at
+// Server.URL; Blob service requests are recognised by their
+// <account>.blob.<suffix> Host header.  Use Client() to route requests for any
+// host to the server.
+type Server struct {
+	*httptest.Server
+
+	// PageSize limits the number of items returned per page of ARM list
+	// operations; zero means unlimited.
+	PageSize int
+
+	// OperationPolls is the number of times an asynchronous operation is
+	// reported InProgress before it completes.
+	OperationPolls int
+
+	mu            sync.Mutex
+	subscriptions map[string]*subscription
+	accounts      map[string]*account
+	operations    map[string]*operation
+	nextOperation int
+	failures      []*failure
+}
+
+type failure struct {
+	method     string
+	pathSuffix string
+	statusCode int
+	n          int
+}
+
+type subscription struct {
+	id       string
+	tenantID string
+	state    subscriptions.State
+	groups   map[string]*group
+}
+
+type operation struct {
+	polls    int
+	complete func()
+}
+
+// NewServer starts and returns a new, empty Server.  The caller should call
+// Close when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		OperationPolls: 1,
+		subscriptions:  map[string]*subscription{},
+		accounts:       map[string]*account{},
+		operations:     map[string]*operation{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Environment returns an Azure environment whose endpoints point at the
+// server.
+func (s *Server) Environment() azure.Environment {
+	return azure.Environment{
+		Name:                    "AzureStackCloud",
+		ResourceManagerEndpoint: s.URL + "/",
+		ActiveDirectoryEndpoint: s.URL + "/",
+		StorageEndpointSuffix:   "core.windows.net",
+		TokenAudience:           s.URL + "/",
+	}
+}
+
+// FailRequests makes the next n requests with the given method, whose path
+// ends with pathSuffix (case-insensitively), fail with statusCode.
+func (s *Server) FailRequests(method, pathSuffix string, statusCode, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = append(s.failures, &failure{method: method, pathSuffix: strings.ToLower(pathSuffix), statusCode: statusCode, n: n})
+}
+
+// injectFailure fails r if it matches a failure registered by FailRequests.
+func (s *Server) injectFailure(w http.ResponseWriter, r *http.Request) bool {
+	for _, f := range s.failures {
+		if f.n == 0 || r.Method != f.method || !strings.HasSuffix(strings.ToLower(r.URL.Path), f.pathSuffix) {
+			continue
+		}
+		f.n--
+
+		code := strings.Replace(http.StatusText(f.statusCode), " ", "", -1)
+		w.Header().Set("Retry-After", "0")
+		if strings.Contains(r.Host, ".blob.") {
+			writeXMLError(w, f.statusCode, code, "Injected failure.")
+		} else {
+			writeError(w, f.statusCode, code, "Injected failure.")
+		}
+		return true
+	}
+
+	return false
+}
+
+// Client returns an http.Client which sends every request to the server,
+// whatever its destination host.
+func (s *Server) Client() *http.Client {
+	return &http.Client{Transport: &transport{s: s}}
+}
+
+type transport struct {
+	s *Server
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse(t.s.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(http.Request)
+	*r = *req
+	r.URL = new(url.URL)
+	*r.URL = *req.URL
+	r.URL.Scheme = u.Scheme
+	r.URL.Host = u.Host
+	r.Host = req.URL.Host
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.injectFailure(w, r) {
+		return
+	}
+
+	if i := strings.Index(r.Host, ".blob."); i != -1 {
+		s.serveBlob(w, r, r.Host[:i])
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 3 && path[1] == "oauth2" && path[2] == "token" && r.Method == http.MethodPost:
+		s.serveToken(w, r, path[0])
+	case len(path) == 2 && path[0] == "operations" && r.Method == http.MethodGet:
+		s.serveOperation(w, r, path[1])
+	case len(path) == 1 && strings.EqualFold(path[0], "subscriptions") && r.Method == http.MethodGet:
+		s.listSubscriptions(w, r)
+	case len(path) >= 2 && strings.EqualFold(path[0], "subscriptions"):
+		s.serveARM(w, r, path[1], path[2:])
+	default:
+		writeError(w, http.StatusNotFound, "NotFound", "%s %s not found", r.Method, r.URL.Path)
+	}
+}
+
+// serveToken issues an AAD token to any client.  The access token is simply
+// the tenant ID, so that ARM requests can be checked against the tenant of
+// their subscription.
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request, tenantID string) {
+	expires := time.Now().Add(time.Hour)
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": tenantID,
+		"expires_in":   "3600",
+		"expires_on":   strconv.FormatInt(expires.Unix(), 10),
+		"not_before":   strconv.FormatInt(time.Now().Unix(), 10),
+		"resource":     r.FormValue("resource"),
+		"token_type":   "Bearer",
+	})
+}
+
+// startOperation accepts an asynchronous request, calling complete once the
+// operation has been polled s.OperationPolls times.
+func (s *Server) startOperation(w http.ResponseWriter, complete func()) {
+	s.nextOperation++
+	id := strconv.Itoa(s.nextOperation)
+	s.operations[id] = &operation{polls: s.OperationPolls, complete: complete}
+
+	w.Header().Set("Azure-AsyncOperation", s.URL+"/operations/"+id)
+	w.Header().Set("Retry-After", "0")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) serveOperation(w http.ResponseWriter, r *http.Request, id string) {
+	op, found := s.operations[id]
+	if !found {
+		writeError(w, http.StatusNotFound, "NotFound", "operation %s not found", id)
+		return
+	}
+
+	w.Header().Set("Retry-After", "0")
+
+	if op.polls > 0 {
+		op.polls--
+		writeJSON(w, http.StatusOK, map[string]string{"status": "InProgress"})
+		return
+	}
+
+	if op.complete != nil {
+		op.complete()
+		op.complete = nil
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "Succeeded"})
+}
+
+// AddSubscription adds a subscription belonging to the given tenant.
+// Subscriptions which are not added explicitly are created on first use, and
+// accept tokens from any tenant.
+func (s *Server) AddSubscription(subscriptionID, tenantID string, state subscriptions.State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := s.getSubscription(subscriptionID)
+	sub.tenantID = tenantID
+	sub.state = state
+}
+
+func (s *Server) getSubscription(subscriptionID string) *subscription {
+	key := strings.ToLower(subscriptionID)
+	if _, found := s.subscriptions[key]; !found {
+		s.subscriptions[key] = &subscription{id: subscriptionID, state: subscriptions.Enabled, groups: map[string]*group{}}
+	}
+	return s.subscriptions[key]
+}
+
+// tenantID returns the tenant of the AAD token of the request.
+func tenantID(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// listSubscriptions lists the subscriptions of the tenant of the request.
+func (s *Server) listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	for k, sub := range s.subscriptions {
+		if sub.tenantID == tenantID(r) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		sub := s.subscriptions[k]
+		values = append(values, subscriptions.Subscription{
+			ID:             to.StringPtr("/subscriptions/" + sub.id),
+			SubscriptionID: to.StringPtr(sub.id),
+			DisplayName:    to.StringPtr(sub.id),
+			State:          sub.state,
+		})
+	}
+
+	s.writeList(w, r, values)
+}
+
+// writeList writes a page of an ARM list response, starting at the offset
+// given by the $skiptoken query parameter.
+func (s *Server) writeList(w http.ResponseWriter, r *http.Request, values []interface{}) {
+	skip, _ := strconv.Atoi(r.URL.Query().Get("$skiptoken"))
+	if skip > len(values) {
+		skip = len(values)
+	}
+	values = values[skip:]
+
+	resp := struct {
+		Value    []interface{} `json:"value"`
+		NextLink string        `json:"nextLink,omitempty"`
+	}{
+		Value: values,
+	}
+
+	if s.PageSize > 0 && len(values) > s.PageSize {
+		resp.Value = values[:s.PageSize]
+
+		u := *r.URL
+		q := u.Query()
+		q.Set("$skiptoken", strconv.Itoa(skip+s.PageSize))
+		u.RawQuery = q.Encode()
+		resp.NextLink = s.URL + u.RequestURI()
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code, format string, a ...interface{}) {
+	writeJSON(w, statusCode, map[string]interface{}{
+		"error": map[string]string{
+			"code":    code,
+			"message": fmt.Sprintf(format, a...),
+		},
+	})
+}
@@ -0,0 +1,99 @@
+// Package azureutil holds the helpers shared by the commands which manage
+// Azure resources: choosing the Azure environment, stopping on a signal, and
+// parsing blob URIs.
+package azureutil
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// Environment returns the Azure environment named by AZURE_ENVIRONMENT,
+// defaulting to the public cloud.  As with the SDK authorizers, custom
+// endpoints may be given in the file named by AZURE_ENVIRONMENT_FILEPATH by
+// setting AZURE_ENVIRONMENT=AZURESTACKCLOUD.
+func Environment() (azure.Environment, error) {
+	name := os.Getenv("AZURE_ENVIRONMENT")
+	if name == "" {
+		return azure.PublicCloud, nil
+	}
+
+	return azure.EnvironmentFromName(name)
+}
+
+// BaseURI returns the Resource Manager endpoint of env, in the form expected by
+// the SDK clients.
+func BaseURI(env azure.Environment) string {
+	return strings.TrimSuffix(env.ResourceManagerEndpoint, "/")
+}
+
+// SignalContext returns a context which is cancelled on SIGTERM or SIGINT, so
+// that work in progress stops cleanly.  The signal is reported on stderr.
+func SignalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-ch
+		fmt.Fprintf(os.Stderr, "received %s, stopping\n", sig)
+		cancel()
+	}()
+
+	return ctx
+}
+
+// ParseBlobURI parses a blob URI of the form
+// https://ACCOUNT.blob.SUFFIX/CONTAINER/NAME.  The name may contain slashes.
+func ParseBlobURI(uri string) (account, container, name string, err error) {
+	account, path, err := parseStorageURI(uri)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	p := strings.SplitN(path, "/", 2)
+	if len(p) != 2 || p[0] == "" || p[1] == "" {
+		return "", "", "", fmt.Errorf("invalid blob URI %q", uri)
+	}
+
+	return account, p[0], p[1], nil
+}
+
+// ParseContainerURI parses a container URI of the form
+// https://ACCOUNT.blob.SUFFIX/CONTAINER, with or without a trailing slash.
+func ParseContainerURI(uri string) (account, container string, err error) {
+	account, path, err := parseStorageURI(uri)
+	if err != nil {
+		return "", "", err
+	}
+
+	path = strings.TrimSuffix(path, "/")
+	if path == "" || strings.Contains(path, "/") {
+		return "", "", fmt.Errorf("invalid container URI %q", uri)
+	}
+
+	return account, path, nil
+}
+
+// parseStorageURI returns the storage account of a blob service URI, and its
+// path without the leading slash.
+func parseStorageURI(uri string) (string, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+
+	host := strings.SplitN(u.Hostname(), ".", 3)
+	if len(host) != 3 || host[0] == "" || !strings.EqualFold(host[1], "blob") {
+		return "", "", fmt.Errorf("invalid blob service URI %q", uri)
+	}
+
+	return host[0], strings.TrimPrefix(u.Path, "/"), nil
+}
@@ -0,0 +1,53 @@
+package azureutil
+
+import (
+	"testing"
+)
+
+func TestParseBlobURI(t *testing.T) {
+	for _, tt := range []struct {
+		uri                          string
+		account, container, blobName string
+		wantErr                      bool
+	}{
+		{uri: "https://OpenShiftImages.blob.core.windows.net/Images/foo.vhd", account: "OpenShiftImages", container: "Images", blobName: "foo.vhd"},
+		{uri: "https://account.blob.core.chinacloudapi.cn/images/dir/foo%20bar.vhd", account: "account", container: "images", blobName: "dir/foo bar.vhd"},
+		{uri: "https://account.file.core.windows.net/images/foo.vhd", wantErr: true},
+		{uri: "https://example.com/images/foo.vhd", wantErr: true},
+		{uri: "https://account.blob.core.windows.net/images", wantErr: true},
+		{uri: "https://account.blob.core.windows.net/images/", wantErr: true},
+		{uri: "%", wantErr: true},
+	} {
+		account, container, name, err := ParseBlobURI(tt.uri)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: unexpected success", tt.uri)
+			}
+		} else if err != nil || account != tt.account || container != tt.container || name != tt.blobName {
+			t.Errorf("%s: got %q, %q, %q, %v, want %q, %q, %q", tt.uri, account, container, name, err, tt.account, tt.container, tt.blobName)
+		}
+	}
+}
+
+func TestParseContainerURI(t *testing.T) {
+	for _, tt := range []struct {
+		uri                string
+		account, container string
+		wantErr            bool
+	}{
+		{uri: "https://account.blob.core.windows.net/vhds", account: "account", container: "vhds"},
+		{uri: "https://account.blob.core.windows.net/vhds/", account: "account", container: "vhds"},
+		{uri: "https://account.blob.core.windows.net/", wantErr: true},
+		{uri: "https://account.blob.core.windows.net/vhds/foo.vhd", wantErr: true},
+		{uri: "https://account.queue.core.windows.net/vhds", wantErr: true},
+	} {
+		account, container, err := ParseContainerURI(tt.uri)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: unexpected success", tt.uri)
+			}
+		} else if err != nil || account != tt.account || container != tt.container {
+			t.Errorf("%s: got %q, %q, %v, want %q, %q", tt.uri, account, container, err, tt.account, tt.container)
+		}
+	}
+}
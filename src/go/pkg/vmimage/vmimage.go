@@ -0,0 +1,255 @@
+// Package vmimage parses the names of OpenShift VM images, which are by default
+// of the form FAMILY-YYYYMMDDHHMM (e.g. centos7-3.10-201806140000), and selects
+// the latest images matching a filter.
+package vmimage
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+// TimestampLayout is the default layout of the build timestamp of an image
+// name, in UTC.
+const TimestampLayout = "200601021504"
+
+// DefaultPattern is the default grammar of image names, FAMILY-YYYYMMDDHHMM.
+const DefaultPattern = `^(?P<family>.*)-(?P<timestamp>[0-9]{12})$`
+
+// DefaultScheme parses names of the form FAMILY-YYYYMMDDHHMM.
+var DefaultScheme = MustScheme(DefaultPattern, TimestampLayout)
+
+// Scheme is an image naming scheme: a regular expression with a named group
+// "timestamp", and optionally "family" and "version", and the layout (as in
+// time.Parse) of the timestamp.  Timestamps without a zone are in UTC.
+type Scheme struct {
+	rx     *regexp.Regexp
+	layout string
+}
+
+// NewScheme returns the naming scheme with the given pattern and timestamp
+// layout.
+func NewScheme(pattern, layout string) (*Scheme, error) {
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var hasTimestamp bool
+	for _, name := range rx.SubexpNames() {
+		switch name {
+		case "timestamp":
+			hasTimestamp = true
+		case "", "family", "version":
+		default:
+			return nil, fmt.Errorf("unknown group %q in pattern: groups must be named family, timestamp or version", name)
+		}
+	}
+	if !hasTimestamp {
+		return nil, errors.New("pattern has no timestamp group")
+	}
+	if layout == "" {
+		return nil, errors.New("timestamp layout is empty")
+	}
+
+	return &Scheme{rx: rx, layout: layout}, nil
+}
+
+// MustScheme is like NewScheme, but panics if the scheme is invalid.
+func MustScheme(pattern, layout string) *Scheme {
+	s, err := NewScheme(pattern, layout)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Name is a parsed image name.  Family and Version are empty if the scheme
+// has no such group.
+type Name struct {
+	Family  string
+	Version string
+	Built   time.Time
+}
+
+// Parse parses an image name according to s.
+func (s *Scheme) Parse(name string) (Name, error) {
+	m := s.rx.FindStringSubmatch(name)
+	if m == nil {
+		return Name{}, fmt.Errorf("image name %q does not match the naming pattern", name)
+	}
+
+	var n Name
+	for i, group := range s.rx.SubexpNames() {
+		switch group {
+		case "family":
+			n.Family = m[i]
+		case "version":
+			n.Version = m[i]
+		case "timestamp":
+			t, err := time.Parse(s.layout, m[i])
+			if err != nil {
+				return Name{}, fmt.Errorf("image name %q has an invalid timestamp", name)
+			}
+			n.Built = t
+		}
+	}
+
+	return n, nil
+}
+
+// ParseName parses an image name of the form FAMILY-YYYYMMDDHHMM.
+func ParseName(name string) (Name, error) {
+	return DefaultScheme.Parse(name)
+}
+
+// CompareVersions compares two dot-separated versions, e.g. "3.9" and "3.10",
+// returning -1, 0 or 1 if a is less than, equal to or greater than b.  Numeric
+// components are compared numerically and others lexically; a version which
+// is a prefix of another is the lesser.
+func CompareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := compareVersionComponents(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+func compareVersionComponents(a, b string) int {
+	an, aerr := strconv.ParseUint(a, 10, 64)
+	bn, berr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aerr == nil && berr == nil && an < bn:
+		return -1
+	case aerr == nil && berr == nil && an > bn:
+		return 1
+	case aerr == nil && berr == nil:
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// Image describes an image whose name could be parsed.
+type Image struct {
+	Name          string            `json:"name"`
+	ID            string            `json:"id"`
+	ResourceGroup string            `json:"resourceGroup"`
+	Location      string            `json:"location"`
+	Family        string            `json:"family"`
+	Version       string            `json:"version,omitempty"`
+	Built         time.Time         `json:"built"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+// Filter selects images.  Empty fields match every image.  Scheme defaults to
+// DefaultScheme.
+type Filter struct {
+	Scheme   *Scheme
+	Family   string
+	Version  string
+	Location string
+
+	// Tags holds tags which an image must have, with the given values.
+	Tags map[string]string
+}
+
+// Match returns true if image has a name matching the scheme and is selected by
+// f.
+// Locations are compared case-insensitively, ignoring spaces, since Azure
+// accepts both "eastus" and "East US".
+func (f Filter) Match(image compute.Image) bool {
+	n, err := f.scheme().Parse(to.String(image.Name))
+	if err != nil {
+		return false
+	}
+
+	if f.Family != "" && n.Family != f.Family {
+		return false
+	}
+	if f.Version != "" && n.Version != f.Version {
+		return false
+	}
+	if f.Location != "" && normalizeLocation(to.String(image.Location)) != normalizeLocation(f.Location) {
+		return false
+	}
+	for k, v := range f.Tags {
+		if t := image.Tags[k]; t == nil || *t != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f Filter) scheme() *Scheme {
+	if f.Scheme == nil {
+		return DefaultScheme
+	}
+	return f.Scheme
+}
+
+func normalizeLocation(location string) string {
+	return strings.ToLower(strings.Replace(location, " ", "", -1))
+}
+
+// Latest returns the n most recently built images matching f, newest first.
+// Images built at the same time are ordered by name.  If n is zero or
+// negative, every matching image is returned.
+func Latest(images []compute.Image, f Filter, n int) []Image {
+	var selected []Image
+	for _, image := range images {
+		if !f.Match(image) {
+			continue
+		}
+
+		name, _ := f.scheme().Parse(*image.Name)
+		i := Image{
+			Name:     *image.Name,
+			ID:       to.String(image.ID),
+			Location: to.String(image.Location),
+			Family:   name.Family,
+			Version:  name.Version,
+			Built:    name.Built,
+		}
+		if r, err := azure.ParseResourceID(i.ID); err == nil {
+			i.ResourceGroup = r.ResourceGroup
+		}
+		if len(image.Tags) > 0 {
+			i.Tags = make(map[string]string, len(image.Tags))
+			for k, v := range image.Tags {
+				i.Tags[k] = to.String(v)
+			}
+		}
+		selected = append(selected, i)
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		if !selected[i].Built.Equal(selected[j].Built) {
+			return selected[i].Built.After(selected[j].Built)
+		}
+		return selected[i].Name < selected[j].Name
+	})
+
+	if n > 0 && len(selected) > n {
+		selected = selected[:n]
+	}
+
+	return selected
+}
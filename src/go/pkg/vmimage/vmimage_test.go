@@ -0,0 +1,179 @@
+package vmimage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func TestParseName(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		want    Name
+		wantErr bool
+	}{
+		{name: "centos7-3.10-201806140000", want: Name{Family: "centos7-3.10", Built: time.Date(2018, 6, 14, 0, 0, 0, 0, time.UTC)}},
+		{name: "rhel-7-201801010130", want: Name{Family: "rhel-7", Built: time.Date(2018, 1, 1, 1, 30, 0, 0, time.UTC)}},
+		{name: "centos7-3.10-latest", wantErr: true},
+		{name: "centos7-3.10-20180614000", wantErr: true},
+		{name: "centos7-3.10-201813140000", wantErr: true},
+		{name: "201806140000", wantErr: true},
+	} {
+		got, err := ParseName(tt.name)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: unexpected success", tt.name)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %#v, %v, want %#v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestScheme(t *testing.T) {
+	s, err := NewScheme(`^rhel-(?P<version>[0-9.]+)-(?P<timestamp>[0-9]{8})(-(?P<family>\w+))?$`, "20060102")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		want    Name
+		wantErr bool
+	}{
+		{name: "rhel-3.10-20180614-node", want: Name{Family: "node", Version: "3.10", Built: time.Date(2018, 6, 14, 0, 0, 0, 0, time.UTC)}},
+		{name: "rhel-3.10-20180614", want: Name{Version: "3.10", Built: time.Date(2018, 6, 14, 0, 0, 0, 0, time.UTC)}},
+		{name: "centos7-3.10-201806140000", wantErr: true},
+		{name: "rhel-3.10-20181314", wantErr: true},
+	} {
+		got, err := s.Parse(tt.name)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: unexpected success", tt.name)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %#v, %v, want %#v", tt.name, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		pattern string
+		layout  string
+	}{
+		{pattern: `^(.*)-([0-9]{12})$`, layout: TimestampLayout},
+		{pattern: `^(?P<family>.*)-(?P<build>[0-9]{12})$`, layout: TimestampLayout},
+		{pattern: `^(?P<family>.*)-(?P<timestamp>[0-9]{12}$`, layout: TimestampLayout},
+		{pattern: DefaultPattern},
+	} {
+		if _, err := NewScheme(tt.pattern, tt.layout); err == nil {
+			t.Errorf("%s %q: unexpected success", tt.pattern, tt.layout)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{a: "3.10", b: "3.9", want: 1},
+		{a: "3.9", b: "3.10", want: -1},
+		{a: "3.10", b: "3.10", want: 0},
+		{a: "3.10", b: "3.10.1", want: -1},
+		{a: "4.0", b: "3.11", want: 1},
+		{a: "3.10", b: "3.x", want: -1},
+		{a: "", b: "3.9", want: -1},
+	} {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("%q, %q: got %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// image returns an image in the given location with the given tags, passed
+// as key/value pairs.
+func image(name, location string, tags ...string) compute.Image {
+	image := compute.Image{
+		ID:       to.StringPtr("/subscriptions/sub/resourceGroups/images/providers/Microsoft.Compute/images/" + name),
+		Name:     to.StringPtr(name),
+		Location: to.StringPtr(location),
+		Tags:     map[string]*string{},
+	}
+	for i := 0; i < len(tags); i += 2 {
+		image.Tags[tags[i]] = to.StringPtr(tags[i+1])
+	}
+	return image
+}
+
+func TestLatest(t *testing.T) {
+	images := []compute.Image{
+		image("centos7-3.10-201806130000", "eastus", "valid", "true"),
+		image("centos7-3.10-201806140000", "eastus"),
+		image("centos7-3.10-201806120000", "westus", "valid", "true"),
+		image("centos7-3.10-201806110000", "East US", "valid", "true"),
+		image("centos7-3.9-201806150000", "eastus", "valid", "true"),
+		image("centos7-3.10-latest", "eastus", "valid", "true"),
+	}
+
+	for _, tt := range []struct {
+		name   string
+		filter Filter
+		n      int
+		want   []string
+	}{
+		{
+			name: "all parseable images, newest first",
+			want: []string{"centos7-3.9-201806150000", "centos7-3.10-201806140000", "centos7-3.10-201806130000", "centos7-3.10-201806120000", "centos7-3.10-201806110000"},
+		},
+		{
+			name:   "latest valid image of a family",
+			filter: Filter{Family: "centos7-3.10", Tags: map[string]string{"valid": "true"}},
+			n:      1,
+			want:   []string{"centos7-3.10-201806130000"},
+		},
+		{
+			name:   "latest images in a location",
+			filter: Filter{Family: "centos7-3.10", Location: "eastus", Tags: map[string]string{"valid": "true"}},
+			n:      2,
+			want:   []string{"centos7-3.10-201806130000", "centos7-3.10-201806110000"},
+		},
+		{
+			name:   "no match",
+			filter: Filter{Family: "rhel7"},
+		},
+		{
+			name:   "custom scheme",
+			filter: Filter{Scheme: MustScheme(`^centos7-(?P<version>[0-9.]+)-(?P<timestamp>[0-9]{12})$`, TimestampLayout), Version: "3.9"},
+			want:   []string{"centos7-3.9-201806150000"},
+		},
+	} {
+		var got []string
+		for _, i := range Latest(images, tt.filter, tt.n) {
+			got = append(got, i.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	got := Latest(images, Filter{Family: "centos7-3.10", Location: "westus"}, 1)
+	want := []Image{{
+		Name:          "centos7-3.10-201806120000",
+		ID:            "/subscriptions/sub/resourceGroups/images/providers/Microsoft.Compute/images/centos7-3.10-201806120000",
+		ResourceGroup: "images",
+		Location:      "westus",
+		Family:        "centos7-3.10",
+		Built:         time.Date(2018, 6, 12, 0, 0, 0, 0, time.UTC),
+		Tags:          map[string]string{"valid": "true"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}